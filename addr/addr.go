@@ -0,0 +1,85 @@
+// Package addr parses mail addresses, and normalizes them so that different spellings of the same Gmail mailbox, like
+// "J.Doe+lists@gmail.com" and "jdoe@googlemail.com", compare equal.
+package addr
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/zond/gmail/imap"
+)
+
+// GmailDomains are the domains whose addresses ignore dots and everything after a plus in the local part. The first is
+// the canonical one, that the others are normalized to.
+var GmailDomains = []string{"gmail.com", "googlemail.com"}
+
+// Parse parses an RFC 5322 address, like "Jane Doe <j.doe@gmail.com>".
+func Parse(s string) (*mail.Address, error) {
+	return mail.ParseAddress(s)
+}
+
+// ParseList parses a comma separated list of RFC 5322 addresses, like the value of a To header.
+func ParseList(s string) ([]*mail.Address, error) {
+	return mail.ParseAddressList(s)
+}
+
+// Split returns the local part and the lower cased domain of address, or address and an empty domain if it has no @.
+func Split(address string) (local, domain string) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return address, ""
+	}
+	return address[:at], strings.ToLower(address[at+1:])
+}
+
+// Domain returns the lower cased domain of address.
+func Domain(address string) string {
+	_, domain := Split(address)
+	return domain
+}
+
+// Normalize returns address lower cased, and for GmailDomains without dots and plus suffix in the local part, and with
+// the canonical domain.
+func Normalize(address string) string {
+	local, domain := Split(strings.TrimSpace(address))
+	local = strings.ToLower(local)
+	if domain == "" {
+		return local
+	}
+	for _, gmail := range GmailDomains {
+		if domain == gmail {
+			if plus := strings.Index(local, "+"); plus != -1 {
+				local = local[:plus]
+			}
+			local = strings.Replace(local, ".", "", -1)
+			domain = GmailDomains[0]
+			break
+		}
+	}
+	return local + "@" + domain
+}
+
+// Equal returns whether a and b are the same mailbox after normalization.
+func Equal(a, b string) bool {
+	return Normalize(a) == Normalize(b)
+}
+
+// From returns the parsed From address of msg, or nil if it has none that is valid.
+func From(msg *imap.Mail) *mail.Address {
+	if msg.MIMEBody == nil {
+		return nil
+	}
+	result, err := Parse(msg.GetHeader("From"))
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+// NormalizedFrom returns the normalized From address of msg, or an empty string if it has none that is valid.
+func NormalizedFrom(msg *imap.Mail) string {
+	if from := From(msg); from != nil {
+		return Normalize(from.Address)
+	}
+	return ""
+}
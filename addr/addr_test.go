@@ -0,0 +1,43 @@
+package addr
+
+import (
+	"testing"
+
+	"github.com/zond/gmail/imap"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, test := range []struct {
+		address    string
+		normalized string
+	}{
+		{"j.doe+x@gmail.com", "jdoe@gmail.com"},
+		{"J.Doe@GoogleMail.com", "jdoe@gmail.com"},
+		{" jdoe@gmail.com ", "jdoe@gmail.com"},
+		{"J.Doe+x@Example.com", "j.doe+x@example.com"},
+		{"postmaster", "postmaster"},
+	} {
+		if normalized := Normalize(test.address); normalized != test.normalized {
+			t.Errorf("Wanted %q to normalize to %q, got %q", test.address, test.normalized, normalized)
+		}
+	}
+	if !Equal("j.doe+x@gmail.com", "jdoe@gmail.com") {
+		t.Errorf("Wanted Gmail addresses differing by dots and suffix to be equal")
+	}
+	if Equal("j.doe@example.com", "jdoe@example.com") {
+		t.Errorf("Wanted other addresses differing by dots to differ")
+	}
+	msg, err := imap.Parse(imap.Message{Body: []byte("From: Jane Doe <J.Doe+news@gmail.com>\r\n\r\nbody")})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if from := From(msg); from == nil || from.Name != "Jane Doe" {
+		t.Errorf("Wanted the From address, got %+v", from)
+	}
+	if from := NormalizedFrom(msg); from != "jdoe@gmail.com" {
+		t.Errorf("Wanted the normalized From address, got %q", from)
+	}
+	if from := NormalizedFrom(&imap.Mail{}); from != "" {
+		t.Errorf("Wanted no From address for mail without a body, got %q", from)
+	}
+}
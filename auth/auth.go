@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Credentials struct {
+	User     string
+	Password string
+	// Token is an OAuth2 access token. When set it is used with XOAUTH2 instead of the password.
+	Token string
+	// Expiry is when Token expires. Long lived connections log in again RefreshMargin before, to avoid being dropped.
+	Expiry time.Time
+}
+
+// String hides the secrets, so that credentials can't end up in logs by accident.
+func (self Credentials) String() string {
+	return fmt.Sprintf("{User:%v Password:%v Token:%v Expiry:%v}", self.User, redact(self.Password), redact(self.Token), self.Expiry)
+}
+
+func (self Credentials) GoString() string {
+	return "auth.Credentials" + self.String()
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// Zero overwrites b, to shorten the time a secret copied into it stays in memory. Since strings can't be overwritten,
+// this is best effort.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Provider is asked for credentials every time a connection logs in.
+type Provider interface {
+	Credentials() (Credentials, error)
+}
+
+type Static Credentials
+
+func (self Static) String() string {
+	return Credentials(self).String()
+}
+
+func (self Static) GoString() string {
+	return "auth.Static" + Credentials(self).String()
+}
+
+func (self Static) Credentials() (Credentials, error) {
+	return Credentials(self), nil
+}
+
+// Swappable is a Provider whose underlying Provider can be replaced while it is in use.
+type Swappable struct {
+	lock     sync.RWMutex
+	provider Provider
+}
+
+func NewSwappable(provider Provider) *Swappable {
+	return &Swappable{
+		provider: provider,
+	}
+}
+
+func (self *Swappable) Swap(provider Provider) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.provider = provider
+}
+
+func (self *Swappable) Credentials() (Credentials, error) {
+	self.lock.RLock()
+	provider := self.provider
+	self.lock.RUnlock()
+	return provider.Credentials()
+}
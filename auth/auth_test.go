@@ -0,0 +1,18 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	creds := Static{User: "user@example.com", Password: "secret", Token: "token"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, v := range []interface{}{creds, Credentials(creds)} {
+			if s := fmt.Sprintf(format, v); strings.Contains(s, "secret") || strings.Contains(s, "token") || !strings.Contains(s, "user@example.com") {
+				t.Errorf("%v of %T leaked a secret or lost the user: %v", format, v, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event describes an authentication attempt, for auditing.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Protocol is imap, xmpp or smtp.
+	Protocol  string `json:"protocol"`
+	Server    string `json:"server"`
+	User      string `json:"user"`
+	Mechanism string `json:"mechanism"`
+	Success   bool   `json:"success"`
+	// Reason is why the attempt failed, as reported by the server when possible.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewEvent returns an Event for an attempt that failed with err, or succeeded if err is nil.
+func NewEvent(protocol, server, user, mechanism string, err error) (result Event) {
+	result = Event{
+		Time:      time.Now(),
+		Protocol:  protocol,
+		Server:    server,
+		User:      user,
+		Mechanism: mechanism,
+		Success:   err == nil,
+	}
+	if err != nil {
+		result.Reason = err.Error()
+	}
+	return
+}
+
+// JSONLines returns an event handler writing each event as a line of JSON to w, to ship them to a log collector.
+func JSONLines(w io.Writer) func(e Event) {
+	lock := &sync.Mutex{}
+	enc := json.NewEncoder(w)
+	return func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		enc.Encode(e)
+	}
+}
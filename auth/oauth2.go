@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+// The Google OAuth2 endpoints and scopes needed for IMAP, SMTP and XMPP.
+var (
+	DeviceCodeURL = "https://oauth2.googleapis.com/device/code"
+	TokenURL      = "https://oauth2.googleapis.com/token"
+	Scopes        = []string{"https://mail.google.com/", "https://www.googleapis.com/auth/googletalk"}
+	// ReadOnlyScopes only allow reading mail with the Gmail API, see the rest package. IMAP needs Scopes, even when
+	// used read-only.
+	ReadOnlyScopes = []string{"https://www.googleapis.com/auth/gmail.readonly", "https://www.googleapis.com/auth/googletalk"}
+)
+
+// DefaultPollInterval is how often Authorize polls for the token when the server didn't say, as RFC 8628 section 3.2
+// specifies. The server may ask for slower polling, which adds 5 seconds each time.
+var DefaultPollInterval = 5 * time.Second
+
+// RefreshMargin is how long before it expires an access token is refreshed.
+var RefreshMargin = time.Minute
+
+var HTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// Token is an OAuth2 token.
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// TokenStore persists the token of an OAuth2 provider, so that it survives restarts.
+type TokenStore interface {
+	LoadToken() (Token, error)
+	SaveToken(token Token) error
+}
+
+// TokenFile is a TokenStore keeping the token as JSON in a file only readable by the owner.
+type TokenFile string
+
+func (self TokenFile) LoadToken() (result Token, err error) {
+	b, err := ioutil.ReadFile(string(self))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &result)
+	return
+}
+
+func (self TokenFile) SaveToken(token Token) (err error) {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return
+	}
+	tmp := string(self) + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, string(self))
+}
+
+// OAuth2Config identifies the OAuth2 client registered in the Google Cloud console. Device authorization needs a
+// client of the "TVs and Limited Input devices" type.
+type OAuth2Config struct {
+	ClientID     string
+	ClientSecret string
+	// Scopes are authorized instead of the package Scopes when not empty, like ReadOnlyScopes.
+	Scopes []string
+}
+
+func (self OAuth2Config) scopes() []string {
+	if len(self.Scopes) > 0 {
+		return self.Scopes
+	}
+	return Scopes
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// token is the token of the response, received at now.
+func (self tokenResponse) token(now time.Time) Token {
+	return Token{
+		AccessToken:  self.AccessToken,
+		RefreshToken: self.RefreshToken,
+		Expiry:       now.Add(time.Duration(self.ExpiresIn) * time.Second),
+	}
+}
+
+// postForm posts the form using client, or HTTPClient if client is nil.
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, result interface{}) (status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if client == nil {
+		client = HTTPClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	status = rsp.StatusCode
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, result); err != nil {
+		err = fmt.Errorf("%v returned %v: %s", endpoint, rsp.Status, b)
+	}
+	return
+}
+
+// OAuth2 is a Provider returning Credentials with an access token, refreshed using the refresh token in the store when
+// it is about to expire.
+type OAuth2 struct {
+	user       string
+	config     OAuth2Config
+	store      TokenStore
+	httpClient *http.Client
+	clock      clock.Clock
+	lock       sync.Mutex
+	token      *Token
+}
+
+func NewOAuth2(user string, config OAuth2Config, store TokenStore) *OAuth2 {
+	return &OAuth2{
+		user:   user,
+		config: config,
+		store:  store,
+		clock:  clock.Real,
+	}
+}
+
+// WithHTTPClient makes the provider talk to the token endpoints using client instead of HTTPClient.
+func (self *OAuth2) WithHTTPClient(client *http.Client) *OAuth2 {
+	self.httpClient = client
+	return self
+}
+
+// WithClock makes the provider time token expiry and authorization polls with c, to let tests drive them.
+func (self *OAuth2) WithClock(c clock.Clock) *OAuth2 {
+	self.clock = c
+	return self
+}
+
+func (self *OAuth2) Credentials() (result Credentials, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.token == nil {
+		var token Token
+		if token, err = self.store.LoadToken(); err != nil {
+			return
+		}
+		self.token = &token
+	}
+	if !self.clock.Now().Add(RefreshMargin).Before(self.token.Expiry) {
+		if err = self.refresh(); err != nil {
+			return
+		}
+	}
+	result = Credentials{
+		User:   self.user,
+		Token:  self.token.AccessToken,
+		Expiry: self.token.Expiry,
+	}
+	return
+}
+
+func (self *OAuth2) refresh() (err error) {
+	if self.token.RefreshToken == "" {
+		return fmt.Errorf("no refresh token for %v, authorize again", self.user)
+	}
+	rsp := tokenResponse{}
+	if _, err = postForm(context.Background(), self.httpClient, TokenURL, url.Values{
+		"client_id":     {self.config.ClientID},
+		"client_secret": {self.config.ClientSecret},
+		"refresh_token": {self.token.RefreshToken},
+		"grant_type":    {"refresh_token"},
+	}, &rsp); err != nil {
+		return
+	}
+	if rsp.Error != "" {
+		return fmt.Errorf("refreshing the token for %v: %v %v", self.user, rsp.Error, rsp.Description)
+	}
+	token := rsp.token(self.clock.Now())
+	// Google usually doesn't send a new refresh token.
+	if token.RefreshToken == "" {
+		token.RefreshToken = self.token.RefreshToken
+	}
+	if err = self.store.SaveToken(token); err != nil {
+		return
+	}
+	self.token = &token
+	return
+}
+
+// DeviceCode is what the user needs to authorize the device.
+type DeviceCode struct {
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// Authorize runs the OAuth2 device authorization flow: prompt is called with the code the user has to enter at the
+// verification URL, and once they did, the token is saved to the store.
+func (self *OAuth2) Authorize(ctx context.Context, prompt func(code DeviceCode)) (err error) {
+	device := struct {
+		DeviceCode
+		Code     string `json:"device_code"`
+		Interval int    `json:"interval"`
+		Error    string `json:"error"`
+	}{}
+	status, err := postForm(ctx, self.httpClient, DeviceCodeURL, url.Values{
+		"client_id": {self.config.ClientID},
+		"scope":     {strings.Join(self.config.scopes(), " ")},
+	}, &device)
+	if err != nil {
+		return
+	}
+	if device.Error != "" || status != http.StatusOK {
+		return fmt.Errorf("requesting a device code: %v %v", status, device.Error)
+	}
+	prompt(device.DeviceCode)
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-self.clock.After(interval):
+		}
+		rsp := tokenResponse{}
+		if _, err = postForm(ctx, self.httpClient, TokenURL, url.Values{
+			"client_id":     {self.config.ClientID},
+			"client_secret": {self.config.ClientSecret},
+			"device_code":   {device.Code},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &rsp); err != nil {
+			return
+		}
+		switch rsp.Error {
+		case "":
+			token := rsp.token(self.clock.Now())
+			if err = self.store.SaveToken(token); err != nil {
+				return
+			}
+			self.lock.Lock()
+			self.token = &token
+			self.lock.Unlock()
+			return
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return fmt.Errorf("authorizing %v: %v %v", self.user, rsp.Error, rsp.Description)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+func TestOAuth2(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	polls := make(chan time.Time, 3)
+	refreshes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/device":
+			fmt.Fprint(w, `{"device_code": "device", "user_code": "ABC-DEF", "verification_url": "https://example.com/device", "expires_in": 1800, "interval": 0}`)
+		case r.Form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:device_code":
+			polls <- fake.Now()
+			switch len(polls) {
+			case 1:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "slow_down"}`)
+			case 2:
+				w.WriteHeader(http.StatusPreconditionRequired)
+				fmt.Fprint(w, `{"error": "authorization_pending"}`)
+			default:
+				fmt.Fprint(w, `{"access_token": "first", "refresh_token": "refresh", "expires_in": 30}`)
+			}
+		case r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") == "refresh":
+			refreshes++
+			fmt.Fprint(w, `{"access_token": "second", "expires_in": 3600}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+		}
+	}))
+	defer server.Close()
+	defer func(device, token string) {
+		DeviceCodeURL, TokenURL = device, token
+	}(DeviceCodeURL, TokenURL)
+	DeviceCodeURL, TokenURL = server.URL+"/device", server.URL+"/token"
+
+	store := TokenFile(filepath.Join(t.TempDir(), "token.json"))
+	provider := NewOAuth2("user@example.com", OAuth2Config{ClientID: "id"}, store).WithClock(fake)
+	var prompted DeviceCode
+	start := fake.Now()
+	authorized := make(chan error, 1)
+	go func() {
+		authorized <- provider.Authorize(context.Background(), func(code DeviceCode) {
+			prompted = code
+		})
+	}()
+	// Without an interval from the server, polling starts every 5 seconds, and slows down by 5 seconds when asked.
+	for _, interval := range []time.Duration{5 * time.Second, 10 * time.Second, 10 * time.Second} {
+		fake.BlockUntil(1)
+		fake.Advance(interval)
+	}
+	if err := <-authorized; err != nil {
+		t.Fatalf("%v", err)
+	}
+	if prompted.UserCode != "ABC-DEF" || len(polls) != 3 {
+		t.Errorf("Wanted a prompt and three polls, got %+v and %v", prompted, len(polls))
+	}
+	last := start
+	for _, want := range []time.Duration{5 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if polled := <-polls; polled.Sub(last) != want {
+			t.Errorf("Wanted a poll after %v, got one after %v", want, polled.Sub(last))
+		} else {
+			last = polled
+		}
+	}
+	// The token expires within RefreshMargin, so it is refreshed at once, keeping the refresh token.
+	creds, err := NewOAuth2("user@example.com", OAuth2Config{ClientID: "id"}, store).WithClock(fake).Credentials()
+	if err != nil || creds.Token != "second" || creds.User != "user@example.com" {
+		t.Fatalf("Wanted the refreshed token, got %+v, %v", creds, err)
+	}
+	saved, err := store.LoadToken()
+	if err != nil || saved.RefreshToken != "refresh" || saved.Expiry.Before(time.Now().Add(time.Hour-time.Minute)) {
+		t.Errorf("Wanted the refreshed token saved, got %+v, %v", saved, err)
+	}
+	if _, err := provider.Credentials(); err != nil || refreshes != 2 {
+		t.Errorf("Wanted a second refresh, got %v refreshes, %v", refreshes, err)
+	}
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (self *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	self.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+	defer func(token string) {
+		TokenURL = token
+	}(TokenURL)
+	TokenURL = server.URL
+
+	store := TokenFile(filepath.Join(t.TempDir(), "token.json"))
+	if err := store.SaveToken(Token{RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	transport := &countingTransport{}
+	provider := NewOAuth2("user@example.com", OAuth2Config{ClientID: "id"}, store).WithHTTPClient(&http.Client{Transport: transport})
+	if creds, err := provider.Credentials(); err != nil || creds.Token != "token" || transport.requests != 1 {
+		t.Errorf("Wanted the token refreshed using the client, got %+v, %v and %v requests", creds, err, transport.requests)
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+// ServiceAccount is a Provider for Google Workspace accounts, using a service account with domain-wide delegation to
+// impersonate the user. The delegation has to be granted the Scopes in the Workspace admin console.
+type ServiceAccount struct {
+	user       string
+	key        *serviceAccountKey
+	scopes     []string
+	httpClient *http.Client
+	clock      clock.Clock
+	lock       sync.Mutex
+	token      *Token
+}
+
+// NewServiceAccount returns a ServiceAccount impersonating user, using the JSON key file of the service account as
+// downloaded from the Google Cloud console.
+func NewServiceAccount(keyJSON []byte, user string) (result *ServiceAccount, err error) {
+	key := &serviceAccountKey{}
+	if err = json.Unmarshal(keyJSON, key); err != nil {
+		return
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		err = fmt.Errorf("no private key found for %v", key.ClientEmail)
+		return
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return
+		}
+	}
+	var ok bool
+	if key.key, ok = parsed.(*rsa.PrivateKey); !ok {
+		err = fmt.Errorf("the private key of %v is not an RSA key", key.ClientEmail)
+		return
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = TokenURL
+	}
+	result = &ServiceAccount{
+		user:  user,
+		key:   key,
+		clock: clock.Real,
+	}
+	return
+}
+
+// For returns a ServiceAccount impersonating another user with the same key, to monitor many mailboxes.
+func (self *ServiceAccount) For(user string) *ServiceAccount {
+	return &ServiceAccount{
+		user:       user,
+		key:        self.key,
+		scopes:     self.scopes,
+		httpClient: self.httpClient,
+		clock:      self.clock,
+	}
+}
+
+// WithHTTPClient makes the service account talk to the token endpoint using client instead of HTTPClient.
+func (self *ServiceAccount) WithHTTPClient(client *http.Client) *ServiceAccount {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.httpClient = client
+	return self
+}
+
+// WithClock makes the service account time token expiry with c, to let tests drive it.
+func (self *ServiceAccount) WithClock(c clock.Clock) *ServiceAccount {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.clock = c
+	return self
+}
+
+// WithScopes makes the service account ask for the scopes, like ReadOnlyScopes, instead of the package Scopes.
+func (self *ServiceAccount) WithScopes(scopes ...string) *ServiceAccount {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.scopes = scopes
+	self.token = nil
+	return self
+}
+
+func (self *ServiceAccount) Credentials() (result Credentials, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.token == nil || !self.clock.Now().Add(RefreshMargin).Before(self.token.Expiry) {
+		if err = self.refresh(); err != nil {
+			return
+		}
+	}
+	result = Credentials{
+		User:   self.user,
+		Token:  self.token.AccessToken,
+		Expiry: self.token.Expiry,
+	}
+	return
+}
+
+// assertion is the signed JWT asking for a token for the user.
+func (self *ServiceAccount) assertion() (result string, err error) {
+	now := self.clock.Now()
+	scopes := Scopes
+	if len(self.scopes) > 0 {
+		scopes = self.scopes
+	}
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   self.key.ClientEmail,
+		"sub":   self.user,
+		"scope": strings.Join(scopes, " "),
+		"aud":   self.key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, self.key.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return
+	}
+	result = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return
+}
+
+func (self *ServiceAccount) refresh() (err error) {
+	assertion, err := self.assertion()
+	if err != nil {
+		return
+	}
+	rsp := tokenResponse{}
+	if _, err = postForm(context.Background(), self.httpClient, self.key.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}, &rsp); err != nil {
+		return
+	}
+	if rsp.Error != "" {
+		return fmt.Errorf("getting a token for %v as %v: %v %v", self.user, self.key.ClientEmail, rsp.Error, rsp.Description)
+	}
+	token := rsp.token(self.clock.Now())
+	self.token = &token
+	return
+}
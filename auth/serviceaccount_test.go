@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	subjects := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 || r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("Unexpected request %v", r.Form)
+			return
+		}
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+			t.Errorf("Bad signature: %v", err)
+		}
+		claims := map[string]interface{}{}
+		b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(b, &claims); err != nil || claims["iss"] != "robot@example.iam.gserviceaccount.com" {
+			t.Errorf("Unexpected claims %s", b)
+		}
+		subjects = append(subjects, fmt.Sprint(claims["sub"]))
+		fmt.Fprintf(w, `{"access_token": "token-%v", "expires_in": 3600}`, claims["sub"])
+	}))
+	defer server.Close()
+	keyJSON, _ := json.Marshal(map[string]string{
+		"client_email": "robot@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL,
+	})
+	provider, err := NewServiceAccount(keyJSON, "a@example.com")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, p := range []*ServiceAccount{provider, provider, provider.For("b@example.com")} {
+		creds, err := p.Credentials()
+		if err != nil || creds.Token != "token-"+creds.User {
+			t.Errorf("Wanted a token for the user, got %+v, %v", creds, err)
+		}
+	}
+	if want := "[a@example.com b@example.com]"; fmt.Sprint(subjects) != want {
+		t.Errorf("Wanted tokens requested for %v, got %v", want, subjects)
+	}
+}
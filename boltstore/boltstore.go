@@ -0,0 +1,250 @@
+// Package boltstore persists imap.Checkpoint, imap.Unacked and imap.Dedup state, a log of notifications, the mail held
+// back for digests, the queue of an outbox.Outbox, and the mail counted by a quota.Limiter, in a single bbolt database
+// file.
+//
+//	store, err := boltstore.Open("gmail.db")
+//	client := imap.New(user, password).Checkpoint(store).Dedup(store)
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	checkpointBucket   = []byte("checkpoints")
+	unackedBucket      = []byte("unacked")
+	seenBucket         = []byte("seen")
+	notificationBucket = []byte("notifications")
+	outboxBucket       = []byte("outbox")
+	digestBucket       = []byte("digests")
+	quotaBucket        = []byte("quota")
+)
+
+// Store implements imap.Checkpoint, imap.Unacked and imap.Dedup. It is safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path.
+func Open(path string) (result *Store, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	if err = db.Update(func(tx *bolt.Tx) (err error) {
+		for _, bucket := range [][]byte{checkpointBucket, unackedBucket, seenBucket, notificationBucket, outboxBucket, digestBucket, quotaBucket} {
+			if _, err = tx.CreateBucketIfNotExists(bucket); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		db.Close()
+		return
+	}
+	result = &Store{
+		db: db,
+	}
+	return
+}
+
+func (self *Store) Close() error {
+	return self.db.Close()
+}
+
+func (self *Store) LastUID(mailbox string, uidValidity uint32) (result uint32, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(checkpointBucket).Get([]byte(mailbox)); len(v) == 8 && binary.BigEndian.Uint32(v) == uidValidity {
+			result = binary.BigEndian.Uint32(v[4:])
+		}
+		return nil
+	})
+	return
+}
+
+func (self *Store) SetLastUID(mailbox string, uidValidity uint32, uid uint32) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint32(v, uidValidity)
+	binary.BigEndian.PutUint32(v[4:], uid)
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointBucket).Put([]byte(mailbox), v)
+	})
+}
+
+func (self *Store) UnackedUIDs(mailbox string, uidValidity uint32) (result []uint32, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(unackedBucket).Get([]byte(mailbox)); len(v) >= 4 && binary.BigEndian.Uint32(v) == uidValidity {
+			for v = v[4:]; len(v) >= 4; v = v[4:] {
+				result = append(result, binary.BigEndian.Uint32(v))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (self *Store) SetUnackedUIDs(mailbox string, uidValidity uint32, uids []uint32) error {
+	v := make([]byte, 4+4*len(uids))
+	binary.BigEndian.PutUint32(v, uidValidity)
+	for i, uid := range uids {
+		binary.BigEndian.PutUint32(v[4+4*i:], uid)
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(unackedBucket).Put([]byte(mailbox), v)
+	})
+}
+
+func (self *Store) Seen(key string) (result bool, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		result = tx.Bucket(seenBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return
+}
+
+// MarkSeen remembers key along with the current time, used by Prune.
+func (self *Store) MarkSeen(key string) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Unix()))
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(seenBucket).Put([]byte(key), v)
+	})
+}
+
+// Prune forgets the keys marked as seen before the given time, to keep the database from growing forever.
+func (self *Store) Prune(before time.Time) error {
+	return self.db.Update(func(tx *bolt.Tx) (err error) {
+		c := tx.Bucket(seenBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) < before.Unix() {
+				if err = c.Delete(); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+}
+
+// AddNotification records a notification sent for account at the given time, encoded by the caller, for Notifications
+// to return.
+func (self *Store) AddNotification(account string, at time.Time, notification []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) (err error) {
+		bucket, err := tx.Bucket(notificationBucket).CreateBucketIfNotExists([]byte(account))
+		if err != nil {
+			return
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return
+		}
+		// The keys sort by time, and then by the order they were added in.
+		k := make([]byte, 16)
+		binary.BigEndian.PutUint64(k, uint64(at.UnixNano()))
+		binary.BigEndian.PutUint64(k[8:], seq)
+		return bucket.Put(k, notification)
+	})
+}
+
+// Notifications returns the notifications recorded for account at or after since, oldest first.
+func (self *Store) Notifications(account string, since time.Time) (result [][]byte, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(notificationBucket).Bucket([]byte(account))
+		if bucket == nil {
+			return nil
+		}
+		from := make([]byte, 8)
+		binary.BigEndian.PutUint64(from, uint64(since.UnixNano()))
+		c := bucket.Cursor()
+		for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+			result = append(result, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return
+}
+
+// PruneNotifications forgets the notifications recorded before the given time.
+func (self *Store) PruneNotifications(before time.Time) error {
+	to := make([]byte, 8)
+	binary.BigEndian.PutUint64(to, uint64(before.UnixNano()))
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationBucket).ForEach(func(account, _ []byte) (err error) {
+			c := tx.Bucket(notificationBucket).Bucket(account).Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, to) < 0; k, _ = c.First() {
+				if err = c.Delete(); err != nil {
+					return
+				}
+			}
+			return
+		})
+	})
+}
+
+// PutDigest stores the mail held back for the digest with name, encoded by the caller, replacing any stored before. Nil
+// removes it.
+func (self *Store) PutDigest(name string, digest []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		if digest == nil {
+			return tx.Bucket(digestBucket).Delete([]byte(name))
+		}
+		return tx.Bucket(digestBucket).Put([]byte(name), digest)
+	})
+}
+
+// Digest returns the mail stored by PutDigest for name, or nil if there is none.
+func (self *Store) Digest(name string) (result []byte, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(digestBucket).Get([]byte(name)); v != nil {
+			result = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return
+}
+
+// PutQuota stores the mail counted by the quota.Limiter with name, encoded by the caller, replacing any stored before.
+func (self *Store) PutQuota(name string, sent []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(quotaBucket).Put([]byte(name), sent)
+	})
+}
+
+// Quota returns the mail stored by PutQuota for name, or nil if there is none.
+func (self *Store) Quota(name string) (result []byte, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(quotaBucket).Get([]byte(name)); v != nil {
+			result = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return
+}
+
+// PutOutgoing stores the outgoing message with id, encoded by the caller, replacing any stored before.
+func (self *Store) PutOutgoing(id string, msg []byte) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Put([]byte(id), msg)
+	})
+}
+
+// Outgoing returns the outgoing messages, ordered by id.
+func (self *Store) Outgoing() (result [][]byte, err error) {
+	err = self.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+			result = append(result, append([]byte{}, v...))
+			return nil
+		})
+	})
+	return
+}
+
+func (self *Store) RemoveOutgoing(id string) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,168 @@
+package boltstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+	"github.com/zond/gmail/quota"
+)
+
+func TestCheckpointAndDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gmail.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: first\r\n\r\nbody")
+	failing := mailbox.Deliver("From: a@example.com\r\nSubject: fail\r\n\r\nbody")
+	mailbox.Deliver("From: a@example.com\r\nSubject: third\r\n\r\nbody")
+	seen := []uint32{}
+	handler := func(msg *imap.Mail) error {
+		seen = append(seen, msg.UID)
+		if msg.GetHeader("Subject") == "fail" {
+			return fmt.Errorf("failing")
+		}
+		return nil
+	}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(store).Dedup(store)
+	if _, ok := c.HandleNew(handler).(imap.DeliveryError); !ok {
+		t.Fatalf("Wanted a DeliveryError")
+	}
+	// The checkpoint moves past the failed message, which is remembered as unacked.
+	if last, err := store.LastUID("INBOX", mailbox.UIDValidity()); err != nil || last != failing+1 {
+		t.Errorf("Wanted checkpoint %v but got %v, %v", failing+1, last, err)
+	}
+	if unacked, err := store.UnackedUIDs("INBOX", mailbox.UIDValidity()); err != nil || fmt.Sprint(unacked) != fmt.Sprint([]uint32{failing}) {
+		t.Errorf("Wanted %v unacked but got %v, %v", failing, unacked, err)
+	}
+	store.Close()
+	if store, err = Open(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	seen = nil
+	c = imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(store).Dedup(store)
+	if _, ok := c.HandleNew(handler).(imap.DeliveryError); !ok {
+		t.Fatalf("Wanted a DeliveryError")
+	}
+	if fmt.Sprint(seen) != fmt.Sprint([]uint32{failing}) {
+		t.Errorf("Wanted only %v to be retried, got %v", failing, seen)
+	}
+	mailbox.Renumber()
+	seen = nil
+	if _, ok := c.HandleNew(handler).(imap.DeliveryError); !ok {
+		t.Fatalf("Wanted a DeliveryError")
+	}
+	if len(seen) != 1 {
+		t.Errorf("Wanted only the failing message to be retried after renumbering, got %v", seen)
+	}
+	if err := store.Prune(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if found, err := store.Seen(fmt.Sprintf("gmail:%x", imaptest.GmailIDBase+1)); err != nil || found {
+		t.Errorf("Wanted pruned key to be gone, got %v, %v", found, err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "gmail.db"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	start := time.Now()
+	for i, account := range []string{"a@example.com", "b@example.com", "a@example.com", "a@example.com"} {
+		if err := store.AddNotification(account, start.Add(time.Duration(i)*time.Minute), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if found, err := store.Notifications("a@example.com", start); err != nil || fmt.Sprintf("%s", found) != "[0 2 3]" {
+		t.Errorf("Wanted [0 2 3], got %s, %v", found, err)
+	}
+	if found, err := store.Notifications("a@example.com", start.Add(time.Minute)); err != nil || fmt.Sprintf("%s", found) != "[2 3]" {
+		t.Errorf("Wanted [2 3], got %s, %v", found, err)
+	}
+	if err := store.PruneNotifications(start.Add(3 * time.Minute)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if found, err := store.Notifications("a@example.com", start); err != nil || fmt.Sprintf("%s", found) != "[3]" {
+		t.Errorf("Wanted [3] after pruning, got %s, %v", found, err)
+	}
+	if found, err := store.Notifications("b@example.com", start); err != nil || len(found) != 0 {
+		t.Errorf("Wanted nothing after pruning, got %s, %v", found, err)
+	}
+	if found, err := store.Notifications("c@example.com", start); err != nil || len(found) != 0 {
+		t.Errorf("Wanted nothing for an unknown account, got %s, %v", found, err)
+	}
+}
+
+func TestOutgoing(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "gmail.db"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	for _, id := range []string{"b", "a", "c"} {
+		if err := store.PutOutgoing(id, []byte(id+"1")); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := store.PutOutgoing("b", []byte("b2")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := store.RemoveOutgoing("c"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if found, err := store.Outgoing(); err != nil || fmt.Sprintf("%s", found) != "[a1 b2]" {
+		t.Errorf("Wanted [a1 b2], got %s, %v", found, err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "gmail.db"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	if found, err := store.Digest("a@example.com"); err != nil || found != nil {
+		t.Errorf("Wanted nothing, got %s, %v", found, err)
+	}
+	for _, digest := range []string{"1", "2"} {
+		if err := store.PutDigest("a@example.com", []byte(digest)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if found, err := store.Digest("a@example.com"); err != nil || string(found) != "2" {
+		t.Errorf("Wanted 2, got %s, %v", found, err)
+	}
+	if err := store.PutDigest("a@example.com", nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if found, err := store.Digest("a@example.com"); err != nil || found != nil {
+		t.Errorf("Wanted nothing after removing it, got %s, %v", found, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gmail.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := quota.New(quota.Limits{PerDay: 2}).Persist(store, "a@example.com").Reserve(1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	store.Close()
+	if store, err = Open(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	if remaining := quota.New(quota.Limits{PerDay: 2}).Persist(store, "a@example.com").Remaining(); remaining != 1 {
+		t.Errorf("Wanted 1 message remaining after reopening, got %v", remaining)
+	}
+}
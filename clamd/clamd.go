@@ -0,0 +1,135 @@
+// Package clamd scans attachments with the ClamAV daemon, as an imap.AttachmentScanner.
+//
+//	client.MailHandler(imap.Scan(handler, clamd.New("unix", "/var/run/clamav/clamd.ctl"), imap.Quarantine("Quarantine")))
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ChunkSize is how many bytes of an attachment are sent to clamd at a time.
+var ChunkSize = 64 * 1024
+
+// ScanError is returned when clamd fails to scan an attachment, for example because it is larger than its
+// StreamMaxLength. It is an imap.Unscannable error, since clamd will fail the same way if asked again.
+type ScanError struct {
+	Name   string
+	Reason string
+}
+
+func (self ScanError) Error() string {
+	return fmt.Sprintf("clamd: scanning %q failed: %v", self.Name, self.Reason)
+}
+
+func (self ScanError) Unscannable() {}
+
+// Scanner connects to clamd for each scan, using the INSTREAM command.
+type Scanner struct {
+	// Network and Addr are where clamd listens, like "unix" and "/var/run/clamav/clamd.ctl", or "tcp" and
+	// "localhost:3310".
+	Network string
+	Addr    string
+	// Timeout, unless zero, limits how long a scan may take.
+	Timeout time.Duration
+}
+
+func New(network, addr string) *Scanner {
+	return &Scanner{
+		Network: network,
+		Addr:    addr,
+		Timeout: time.Minute,
+	}
+}
+
+// command sends cmd to clamd, calls f to send any data, and returns the reply.
+func (self *Scanner) command(cmd string, f func(w io.Writer) error) (result string, err error) {
+	conn, err := net.DialTimeout(self.Network, self.Addr, self.Timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if self.Timeout != 0 {
+		if err = conn.SetDeadline(time.Now().Add(self.Timeout)); err != nil {
+			return
+		}
+	}
+	// The z prefix makes clamd use NUL terminated commands and replies.
+	if _, err = io.WriteString(conn, "z"+cmd+"\x00"); err != nil {
+		return
+	}
+	if f != nil {
+		w := bufio.NewWriter(conn)
+		if err = f(w); err != nil {
+			return
+		}
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+	if result, err = bufio.NewReader(conn).ReadString(0); err == io.EOF && result != "" {
+		err = nil
+	}
+	result = strings.TrimRight(result, "\x00\r\n")
+	return
+}
+
+// Ping returns an error unless clamd is reachable.
+func (self *Scanner) Ping() (err error) {
+	reply, err := self.command("PING", nil)
+	if err != nil {
+		return
+	}
+	if reply != "PONG" {
+		err = fmt.Errorf("clamd: unexpected reply to PING: %q", reply)
+	}
+	return
+}
+
+// Scan streams r to clamd, and returns the name of the signature it matched, or an empty string if it is clean.
+func (self *Scanner) Scan(name string, r io.Reader) (threat string, err error) {
+	reply, err := self.command("INSTREAM", func(w io.Writer) (err error) {
+		buf := make([]byte, ChunkSize)
+		size := make([]byte, 4)
+		for {
+			n, readErr := io.ReadFull(r, buf)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size, uint32(n))
+				if _, err = w.Write(size); err != nil {
+					return
+				}
+				if _, err = w.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+		_, err = w.Write(make([]byte, 4))
+		return
+	})
+	if err != nil {
+		return
+	}
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR".
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+	case strings.HasSuffix(reply, " FOUND"):
+		threat = strings.TrimSuffix(reply, " FOUND")
+	case strings.HasSuffix(reply, " ERROR"):
+		err = ScanError{Name: name, Reason: strings.TrimSuffix(reply, " ERROR")}
+	default:
+		err = ScanError{Name: name, Reason: fmt.Sprintf("unexpected reply %q", reply)}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+)
+
+// readChunks reads an INSTREAM stream.
+func readChunks(r io.Reader) (result []byte, err error) {
+	buf := &bytes.Buffer{}
+	size := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(r, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			result = buf.Bytes()
+			return
+		}
+		if _, err = io.CopyN(buf, r, int64(n)); err != nil {
+			return
+		}
+	}
+}
+
+// serve accepts connections on l, replying like clamd with the EICAR test signature.
+func serve(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			cmd, err := r.ReadString(0)
+			if err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+			switch cmd {
+			case "zPING\x00":
+				io.WriteString(conn, "PONG\x00")
+			case "zINSTREAM\x00":
+				content, err := readChunks(r)
+				if err != nil {
+					t.Errorf("%v", err)
+					return
+				}
+				switch {
+				case len(content) > 1000:
+					io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+				case bytes.Contains(content, []byte("EICAR")):
+					io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+				default:
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			default:
+				io.WriteString(conn, "UNKNOWN COMMAND\x00")
+			}
+		}()
+	}
+}
+
+func TestScanner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	go serve(t, l)
+	scanner := New("tcp", l.Addr().String())
+	if err := scanner.Ping(); err != nil {
+		t.Errorf("%v", err)
+	}
+	oldChunkSize := ChunkSize
+	ChunkSize = 3
+	defer func() {
+		ChunkSize = oldChunkSize
+	}()
+	if threat, err := scanner.Scan("clean.txt", strings.NewReader("hello world")); err != nil || threat != "" {
+		t.Errorf("Wanted a clean scan, got %q, %v", threat, err)
+	}
+	if threat, err := scanner.Scan("eicar.com", strings.NewReader("X5O!P%@AP EICAR test")); err != nil || threat != "Eicar-Signature" {
+		t.Errorf("Wanted the EICAR signature, got %q, %v", threat, err)
+	}
+	if _, err := scanner.Scan("large.bin", bytes.NewReader(make([]byte, 2000))); err == nil {
+		t.Errorf("Wanted an error for too large attachments")
+	} else if scanErr, ok := err.(ScanError); !ok || scanErr.Name != "large.bin" {
+		t.Errorf("Wanted a ScanError for large.bin, got %#v", err)
+	} else if _, ok := err.(imap.Unscannable); !ok {
+		t.Errorf("Wanted the ScanError to be unscannable, so that it isn't retried")
+	}
+}
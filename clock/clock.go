@@ -0,0 +1,168 @@
+// Package clock lets time based behavior be driven by a fake clock in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Real is the wall clock, backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (self realTimer) C() <-chan time.Time {
+	return self.Timer.C
+}
+
+// Fake only moves when Advance is called.
+type Fake struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiting []*fakeTimer
+}
+
+func NewFake(now time.Time) (result *Fake) {
+	result = &Fake{
+		now: now,
+	}
+	result.cond = sync.NewCond(&result.lock)
+	return
+}
+
+func (self *Fake) Now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now
+}
+
+func (self *Fake) After(d time.Duration) <-chan time.Time {
+	return self.NewTimer(d).C()
+}
+
+func (self *Fake) NewTimer(d time.Duration) Timer {
+	return self.add(d, nil)
+}
+
+func (self *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	return self.add(d, f)
+}
+
+func (self *Fake) add(d time.Duration, f func()) *fakeTimer {
+	timer := &fakeTimer{
+		clock: self,
+		c:     make(chan time.Time, 1),
+		f:     f,
+	}
+	timer.Reset(d)
+	return timer
+}
+
+// Advance moves the clock forward, firing all timers that expire on the way in order.
+func (self *Fake) Advance(d time.Duration) {
+	self.lock.Lock()
+	target := self.now.Add(d)
+	for {
+		sort.SliceStable(self.waiting, func(i, j int) bool {
+			return self.waiting[i].deadline.Before(self.waiting[j].deadline)
+		})
+		if len(self.waiting) == 0 || self.waiting[0].deadline.After(target) {
+			break
+		}
+		timer := self.waiting[0]
+		self.waiting = self.waiting[1:]
+		self.now = timer.deadline
+		if timer.f != nil {
+			go timer.f()
+		} else {
+			select {
+			case timer.c <- self.now:
+			default:
+			}
+		}
+	}
+	self.now = target
+	self.lock.Unlock()
+}
+
+// BlockUntil waits until at least n timers are waiting for the clock to advance.
+func (self *Fake) BlockUntil(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for len(self.waiting) < n {
+		self.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	f        func()
+	deadline time.Time
+}
+
+func (self *fakeTimer) C() <-chan time.Time {
+	return self.c
+}
+
+func (self *fakeTimer) Stop() bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	return self.remove()
+}
+
+func (self *fakeTimer) remove() bool {
+	for i, timer := range self.clock.waiting {
+		if timer == self {
+			self.clock.waiting = append(self.clock.waiting[:i], self.clock.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *fakeTimer) Reset(d time.Duration) bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	active := self.remove()
+	self.deadline = self.clock.now.Add(d)
+	self.clock.waiting = append(self.clock.waiting, self)
+	self.clock.cond.Broadcast()
+	return active
+}
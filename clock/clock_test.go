@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+	short := c.NewTimer(time.Second)
+	long := c.After(time.Minute)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Errorf("Wanted an active timer to be stopped")
+	}
+	fired := make(chan time.Time, 1)
+	c.AfterFunc(2*time.Second, func() {
+		fired <- c.Now()
+	})
+	c.BlockUntil(3)
+	c.Advance(2 * time.Second)
+	select {
+	case now := <-short.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("Wanted %v but got %v", start.Add(time.Second), now)
+		}
+	default:
+		t.Errorf("Short timer didn't fire")
+	}
+	if now := <-fired; !now.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("Wanted %v but got %v", start.Add(2*time.Second), now)
+	}
+	select {
+	case <-long:
+		t.Errorf("Long timer fired early")
+	case <-stopped.C():
+		t.Errorf("Stopped timer fired")
+	default:
+	}
+	c.Advance(time.Minute)
+	<-long
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/cmd/gmailnotifyd/watchpb"
+	"github.com/zond/gmail/imap"
+)
+
+var limit = flag.Int("limit", 20, "The number of messages shown by list.")
+
+// commands are the subcommands operating on the inbox of -account, as an alternative to running the daemon.
+var commands = map[string]func(client *imap.Client, args []string) error{
+	"list":      list,
+	"show":      show,
+	"archive":   modify(func(msg *imap.Mail) { msg.Archive() }),
+	"mark-read": modify(func(msg *imap.Mail) { msg.MarkRead() }),
+	"backup":    backup,
+}
+
+const commandUsage = `
+Commands:
+  authorize           authorize -account with OAuth2 on another device, and save the token to -token
+  list [criteria...]  list the latest messages matching the IMAP search criteria, like UNSEEN, or all
+  show UID            print a message
+  archive UID...      remove messages from the inbox
+  mark-read UID...    mark messages as read
+  backup -dest DIR    copy the messages not yet backed up to DIR, see backup -h
+  replay SINCE        send the notifications recorded in -state since SINCE, like 2020-01-31 or
+                      2020-01-31T15:04:05Z, through the sinks of -account again, or have the daemon
+                      serving -grpc do it
+`
+
+// runCommand runs the command named by the first argument.
+func runCommand(args []string) (err error) {
+	flagged, err := flagAccount()
+	if err != nil {
+		return
+	}
+	if args[0] == "authorize" {
+		return authorize(flagged)
+	}
+	if args[0] == "replay" {
+		return replay(args[1:])
+	}
+	command, found := commands[args[0]]
+	if !found {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	credentials, err := flagged.credentials(nil)
+	if err != nil {
+		return
+	}
+	return command(imap.New(flagged.Account, "").UpdateCredentials(credentials), args[1:])
+}
+
+// authorize runs the OAuth2 device flow for -account, and saves the token to -token.
+func authorize(flagged accountConfig) error {
+	if flagged.TokenFile == "" || *clientID == "" {
+		return fmt.Errorf("authorize needs -token and -client-id")
+	}
+	provider := auth.NewOAuth2(flagged.Account, oauth2Config(), auth.TokenFile(flagged.TokenFile))
+	return provider.Authorize(context.Background(), func(code auth.DeviceCode) {
+		fmt.Printf("Sign in as %v at %v and enter the code %v\n", flagged.Account, code.VerificationURL, code.UserCode)
+	})
+}
+
+// replay sends the notifications recorded in -state since the given time through the sinks of -account again.
+func replay(args []string) (err error) {
+	if len(args) != 1 {
+		return fmt.Errorf("replay needs the time to replay from")
+	}
+	since, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		if since, err = time.ParseInLocation("2006-01-02", args[0], time.Local); err != nil {
+			return
+		}
+	}
+	if *grpcAddr != "" {
+		// The daemon keeps the state file locked while it runs.
+		return replayRemote(since)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return
+	}
+	var accountConfig *accountConfig
+	for i := range cfg.Accounts {
+		if cfg.Accounts[i].Account == *account {
+			accountConfig = &cfg.Accounts[i]
+		}
+	}
+	if accountConfig == nil {
+		return fmt.Errorf("%v is not configured", *account)
+	}
+	state, err := openState()
+	if err != nil {
+		return
+	}
+	if state == nil {
+		return fmt.Errorf("replay needs -state")
+	}
+	defer state.Close()
+	replayed, err := newManager(nil, state).replay(*accountConfig, since)
+	log.Printf("Replayed %v notifications", replayed)
+	return
+}
+
+// replayRemote has the daemon serving -grpc replay the notifications of -account since the given time.
+func replayRemote(since time.Time) (err error) {
+	conn, err := grpc.Dial(*grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rsp, err := watchpb.NewNotificationsClient(conn).Replay(context.Background(), &watchpb.ReplayRequest{
+		Account: *account,
+		Since:   timestamppb.New(since),
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("Replayed %v notifications", rsp.Replayed)
+	return
+}
+
+func parseUIDs(args []string) (result []uint32, err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("no UIDs given")
+		return
+	}
+	for _, arg := range args {
+		var uid uint64
+		if uid, err = strconv.ParseUint(arg, 10, 32); err != nil {
+			return
+		}
+		result = append(result, uint32(uid))
+	}
+	return
+}
+
+func list(client *imap.Client, args []string) (err error) {
+	if *limit < 0 {
+		return fmt.Errorf("-limit must not be negative, got %v", *limit)
+	}
+	if len(args) == 0 {
+		args = []string{"ALL"}
+	}
+	uids, err := client.Search(strings.Join(args, " "))
+	if err != nil {
+		return
+	}
+	if len(uids) > *limit {
+		uids = uids[len(uids)-*limit:]
+	}
+	msgs, err := client.Fetch(uids...)
+	if err != nil {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		msg := msgs[i]
+		read := " "
+		for _, flag := range msg.Flags {
+			if flag == `\Seen` {
+				read = "*"
+			}
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", msg.UID, read, msg.InternalDate.Local().Format("2006-01-02 15:04"), msg.GetHeader("From"), msg.GetHeader("Subject"))
+	}
+	return w.Flush()
+}
+
+func show(client *imap.Client, args []string) (err error) {
+	uids, err := parseUIDs(args)
+	if err != nil {
+		return
+	}
+	msgs, err := client.Fetch(uids[0])
+	if err != nil {
+		return
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("no message with UID %v", uids[0])
+	}
+	msg := msgs[0]
+	for _, header := range []string{"From", "To", "Cc", "Date", "Subject"} {
+		if value := msg.GetHeader(header); value != "" {
+			fmt.Printf("%v: %v\n", header, value)
+		}
+	}
+	if link := msg.Link(); link != "" {
+		fmt.Printf("Link: %v\n", link)
+	}
+	for _, part := range msg.Attachments {
+		fmt.Printf("Attachment: %v (%v, %v bytes)\n", part.FileName(), part.ContentType(), len(part.Content()))
+	}
+	text := msg.Text
+	if text == "" {
+		text = msg.Snippet
+	}
+	fmt.Printf("\n%v\n", text)
+	return
+}
+
+func modify(f func(msg *imap.Mail)) func(client *imap.Client, args []string) error {
+	return func(client *imap.Client, args []string) (err error) {
+		uids, err := parseUIDs(args)
+		if err != nil {
+			return
+		}
+		return client.Modify(f, uids...)
+	}
+}
+
+// backupState is the file in the backup directory remembering the last message backed up.
+const backupState = ".gmailnotifyd-backup.db"
+
+// backup exports the messages not yet exported to a maildir or mbox files, so that running it regularly keeps an
+// incremental local archive.
+func backup(client *imap.Client, args []string) (err error) {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dest := flags.String("dest", "", "The directory to back up to. It's a maildir, unless -mbox is given.")
+	since := flags.String("since", "", "Only back up messages received on or after this date, like 2020-01-31.")
+	mailbox := flags.String("mailbox", "INBOX", "The mailbox to back up, like "+imap.AllMailbox+".")
+	mbox := flags.Bool("mbox", false, "Write the messages of each run to a new mbox file in -dest instead.")
+	compress := flags.Bool("gzip", false, "Compress the mbox files, needs -mbox.")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if *dest == "" {
+		return fmt.Errorf("backup needs -dest")
+	}
+	if *compress && !*mbox {
+		return fmt.Errorf("-gzip needs -mbox")
+	}
+	criteria := []string{"ALL"}
+	if *since != "" {
+		var t time.Time
+		if t, err = time.Parse("2006-01-02", *since); err != nil {
+			return
+		}
+		criteria = []string{"SINCE " + t.Format("2-Jan-2006")}
+	}
+	if err = os.MkdirAll(*dest, 0700); err != nil {
+		return
+	}
+	state, err := boltstore.Open(filepath.Join(*dest, backupState))
+	if err != nil {
+		return
+	}
+	defer state.Close()
+	var sink imap.ExportSink
+	var closeSink func() error
+	if *mbox {
+		if sink, closeSink, err = mboxFile(*dest, *compress); err != nil {
+			return
+		}
+	} else if sink, err = imap.Maildir(*dest); err != nil {
+		return
+	}
+	progress := &backupProgress{sink: sink, last: time.Now()}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	err = client.ForMailbox(*mailbox).Checkpoint(state).Export(ctx, criteria, progress)
+	if closeSink != nil {
+		if e := closeSink(); err == nil {
+			err = e
+		}
+	}
+	log.Printf("Backed up %v messages, %v bytes", progress.messages, progress.bytes)
+	return
+}
+
+// backupProgress logs how far a backup has come every few seconds.
+type backupProgress struct {
+	sink     imap.ExportSink
+	messages int
+	bytes    int
+	last     time.Time
+}
+
+func (self *backupProgress) Export(msg imap.Message) (err error) {
+	if err = self.sink.Export(msg); err != nil {
+		return
+	}
+	self.messages++
+	self.bytes += len(msg.Body)
+	if time.Since(self.last) > 5*time.Second {
+		self.last = time.Now()
+		log.Printf("Backed up %v messages, %v bytes, up to %v", self.messages, self.bytes, msg.InternalDate.Local().Format("2006-01-02"))
+	}
+	return
+}
+
+// Flush flushes the sink, if it buffers.
+func (self *backupProgress) Flush() error {
+	if flusher, ok := self.sink.(imap.ExportFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// flushingSink is an ExportFunc with a Flush, see imap.ExportFlusher.
+type flushingSink struct {
+	imap.ExportFunc
+	flush func() error
+}
+
+func (self flushingSink) Flush() error {
+	return self.flush()
+}
+
+// mboxFile creates a new mbox file in dir, named after the current time, and removes it again on close if nothing was
+// written to it. The sink is an imap.ExportFlusher, so that the backup state never runs ahead of the file.
+func mboxFile(dir string, compress bool) (sink imap.ExportSink, closeSink func() error, err error) {
+	name := filepath.Join(dir, time.Now().Format("20060102-150405")+".mbox")
+	if compress {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	written := false
+	mbox := imap.Mbox(w)
+	sink = flushingSink{imap.ExportFunc(func(msg imap.Message) error {
+		written = true
+		return mbox.Export(msg)
+	}), func() (err error) {
+		if gz != nil {
+			if err = gz.Flush(); err != nil {
+				return
+			}
+		}
+		return f.Sync()
+	}}
+	closeSink = func() (err error) {
+		if gz != nil {
+			err = gz.Close()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err == nil && !written {
+			err = os.Remove(name)
+		}
+		return
+	}
+	return
+}
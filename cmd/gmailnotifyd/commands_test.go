@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestListNegativeLimit(t *testing.T) {
+	defer func(n int) {
+		*limit = n
+	}(*limit)
+	*limit = -1
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: sender@example.com\r\nSubject: hello\r\n\r\nbody\r\n")
+	if err := list(imap.New("user@example.com", "secret").MailStore(mailbox.Open), nil); err == nil {
+		t.Errorf("Wanted a negative -limit refused")
+	}
+}
+
+// checkedCheckpoint fails the export if the mbox file in dir holds fewer messages than the checkpoint claims.
+type checkedCheckpoint struct {
+	dir  string
+	last uint32
+}
+
+func (self *checkedCheckpoint) LastUID(mailbox string, uidValidity uint32) (uint32, error) {
+	return self.last, nil
+}
+
+func (self *checkedCheckpoint) SetLastUID(mailbox string, uidValidity uint32, uid uint32) (err error) {
+	names, err := filepath.Glob(filepath.Join(self.dir, "*.mbox.gz"))
+	if err != nil || len(names) != 1 {
+		return fmt.Errorf("wanted one mbox file, got %v and %v", names, err)
+	}
+	f, err := os.Open(names[0])
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("checkpoint at %v before any data: %v", uid, err)
+	}
+	// The stream isn't closed yet, so it ends unexpectedly after the flushed data.
+	b, _ := ioutil.ReadAll(r)
+	if written := strings.Count(string(b), "From MAILER-DAEMON "); written < int(uid) {
+		return fmt.Errorf("checkpoint at %v with %v messages in the file", uid, written)
+	}
+	self.last = uid
+	return
+}
+
+func TestBackupCheckpoint(t *testing.T) {
+	defer func(n int) {
+		imap.PageSize = n
+	}(imap.PageSize)
+	imap.PageSize = 2
+	mailbox := imaptest.New()
+	for i := 0; i < 5; i++ {
+		mailbox.Deliver(fmt.Sprintf("From: sender@example.com\r\nSubject: %v\r\n\r\nbody\r\n", i))
+	}
+	dir := t.TempDir()
+	sink, closeSink, err := mboxFile(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := &checkedCheckpoint{dir: dir}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(checkpoint)
+	if err := c.Export(context.Background(), []string{"ALL"}, &backupProgress{sink: sink, last: time.Now()}); err != nil {
+		t.Errorf("%v", err)
+	}
+	if err := closeSink(); err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.last != 5 {
+		t.Errorf("Wanted the checkpoint at the last message, got %v", checkpoint.last)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/clamd"
+	"github.com/zond/gmail/digest"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/rules"
+	"github.com/zond/gmail/sinks"
+)
+
+// config is the file given with -config.
+//
+//	{"accounts": [{
+//		"account": "user@gmail.com",
+//		"password_env": "USER_PASSWORD",
+//		"token_file": "/var/lib/gmailnotifyd/user.json",
+//		"filters": {"from_domains": ["example.com"], "subject": "^Invoice"},
+//		"sinks": [{"type": "stdout"}, {"type": "slack", "url": "https://hooks.slack.com/..."}]
+//	}]}
+type config struct {
+	Accounts []accountConfig `json:"accounts"`
+}
+
+type accountConfig struct {
+	Account string `json:"account"`
+	// PasswordEnv is the environment variable holding the password, GMAIL_PASSWORD by default.
+	PasswordEnv string `json:"password_env,omitempty"`
+	// TokenFile, if set, holds the OAuth2 token created by the authorize command, and is used instead of the password.
+	TokenFile string `json:"token_file,omitempty"`
+	// ServiceAccountFile, if set, is the JSON key of a Google Workspace service account with domain-wide delegation,
+	// used to impersonate the account instead of logging in with a password.
+	ServiceAccountFile string `json:"service_account_file,omitempty"`
+	// Mailbox, if set, is watched for new mail instead of the inbox, like a label or "[Gmail]/All Mail".
+	Mailbox string `json:"mailbox,omitempty"`
+	// Notifier, if set, replaces the XMPP notifications, which notice new mail, by another notifier.
+	Notifier notifierConfig `json:"notifier"`
+	// ReadOnly, if set, never modifies the mailbox, and only remembers which mail was notified until restarted.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// QuietHours, if set, holds back the notifications during the windows of a digest.ParseSchedule schedule in local
+	// time, like "Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00", and sends them when the window ends.
+	QuietHours string `json:"quiet_hours,omitempty"`
+	// DigestInterval, if set, like "15m", collects the notifications for that long after the first one, and sends a
+	// single notification listing the senders and subjects instead. Notifications held back during QuietHours are
+	// summarized the same way, and a digest falling due during QuietHours waits for the window to end.
+	DigestInterval string         `json:"digest_interval,omitempty"`
+	Priority       priorityConfig `json:"priority"`
+	Senders        senderConfig   `json:"senders"`
+	// Attachments, if it has rules, like {"rules": [{"extensions": [".exe"], "action": "skip"}]}, skips or saves the
+	// attachments of the notified mail. See imap.AttachmentPolicy.
+	Attachments imap.AttachmentPolicy `json:"attachments"`
+	Scan        scanConfig            `json:"scan"`
+	Filters     filterConfig          `json:"filters"`
+	Sinks       []sinkConfig          `json:"sinks"`
+}
+
+// notifierConfig selects a notifier registered with the notify package by Name, like "idle", "poll" or "push", and
+// configures it with the Options, like {"interval": "1m"} for poll or {"topic": "projects/p/topics/gmail", "addr":
+// ":8025"} for push. The "failover" notifier, with options like {"notifiers": [{"name": "xmpp"}, {"name": "idle"}]},
+// switches to the next notifier when one fails, and back when an earlier one recovers.
+type notifierConfig struct {
+	Name    string          `json:"name,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// scanConfig, if Addr is set, scans the attachments with clamd, and moves infected mail to the Quarantine label instead
+// of notifying about it, or notifies about it along with the threats if Quarantine is empty. Mail with attachments clamd
+// refuses to scan, like those over its StreamMaxLength, counts as infected.
+type scanConfig struct {
+	Network    string `json:"network,omitempty"`
+	Addr       string `json:"addr,omitempty"`
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// priorityConfig classifies the mail, for the notifications to include its priority and for sinks with min_priority.
+type priorityConfig struct {
+	// GmailImportance makes the mail Gmail marked as important important, and mailing list mail bulk.
+	GmailImportance bool `json:"gmail_importance,omitempty"`
+	// UrgentFromDomains makes the mail from these domains, or their subdomains, urgent.
+	UrgentFromDomains []string `json:"urgent_from_domains,omitempty"`
+}
+
+// senderConfig decides whose mail is notified at all, before the filters, see rules.NewSenderPolicy for the patterns.
+type senderConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// filterConfig selects the mail sent to the sinks. Other mail is ignored. Empty fields match all mail.
+type filterConfig struct {
+	FromDomains   []string `json:"from_domains,omitempty"`
+	Subject       string   `json:"subject,omitempty"`
+	HasAttachment bool     `json:"has_attachment,omitempty"`
+}
+
+// sinkConfig is one of stdout, desktop, slack and discord (using URL), exec (using Command), or nats, mqtt and kafka (using URL and Topic).
+type sinkConfig struct {
+	Type    string   `json:"type"`
+	URL     string   `json:"url,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	// MinPriority, if set, like "urgent", only sends the mail classified with at least that priority to the sink.
+	MinPriority string `json:"min_priority,omitempty"`
+}
+
+func readConfig(path string) (result config, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &result); err != nil {
+		err = fmt.Errorf("%v: %v", path, err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, account := range result.Accounts {
+		if account.Account == "" {
+			err = fmt.Errorf("%v: account without address", path)
+			return
+		}
+		if seen[account.Account] {
+			err = fmt.Errorf("%v: %v configured twice", path, account.Account)
+			return
+		}
+		seen[account.Account] = true
+	}
+	return
+}
+
+// credentials returns the provider of the account, getting OAuth2 tokens using httpClient, or auth.HTTPClient if nil.
+func (self accountConfig) credentials(httpClient *http.Client) (result auth.Provider, err error) {
+	if self.ServiceAccountFile != "" {
+		var key []byte
+		if key, err = os.ReadFile(self.ServiceAccountFile); err != nil {
+			return
+		}
+		var serviceAccount *auth.ServiceAccount
+		if serviceAccount, err = auth.NewServiceAccount(key, self.Account); err != nil {
+			return
+		}
+		result = serviceAccount.WithHTTPClient(httpClient)
+		return
+	}
+	if self.TokenFile != "" {
+		result = auth.NewOAuth2(self.Account, oauth2Config(), auth.TokenFile(self.TokenFile)).WithHTTPClient(httpClient)
+		return
+	}
+	password := os.Getenv("GMAIL_PASSWORD")
+	if self.PasswordEnv != "" {
+		password = os.Getenv(self.PasswordEnv)
+	}
+	result = auth.Static{
+		User:     self.Account,
+		Password: password,
+	}
+	return
+}
+
+// handler builds the filters and sinks. The closers must be closed when the handler is no longer used. The mail held
+// back for digests is kept in state, if not nil, see restoreDigest.
+func (self accountConfig) handler(state *boltstore.Store) (result imap.MailHandler, closers []io.Closer, err error) {
+	policy, err := rules.NewSenderPolicy(self.Senders.Allow, self.Senders.Deny)
+	if err != nil {
+		err = fmt.Errorf("%v: %v", self.Account, err)
+		return
+	}
+	conditions := []rules.Condition{policy.Allowed}
+	if len(self.Filters.FromDomains) > 0 {
+		domains := []rules.Condition{}
+		for _, domain := range self.Filters.FromDomains {
+			domains = append(domains, rules.FromDomain(domain))
+		}
+		conditions = append(conditions, func(msg *imap.Mail) bool {
+			for _, domain := range domains {
+				if domain(msg) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if self.Filters.Subject != "" {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(self.Filters.Subject); err != nil {
+			return
+		}
+		conditions = append(conditions, rules.SubjectMatches(re))
+	}
+	if self.Filters.HasAttachment {
+		conditions = append(conditions, rules.HasAttachment)
+	}
+	handlers := []imap.MailHandler{}
+	defer func() {
+		if err != nil {
+			for _, closer := range closers {
+				closer.Close()
+			}
+			closers = nil
+		}
+	}()
+	for _, sink := range self.Sinks {
+		switch sink.Type {
+		case "stdout":
+			handlers = append(handlers, stdout)
+		case "desktop":
+			handlers = append(handlers, sinks.Desktop("gmailnotifyd"))
+		case "slack":
+			handlers = append(handlers, sinks.Slack(sink.URL))
+		case "discord":
+			handlers = append(handlers, sinks.Discord(sink.URL))
+		case "exec":
+			if len(sink.Command) == 0 {
+				err = fmt.Errorf("%v: exec sink without command", self.Account)
+				return
+			}
+			handlers = append(handlers, sinks.Exec(sink.Command[0], sink.Command[1:]...))
+		case "nats":
+			var nats *sinks.NATS
+			if nats, err = sinks.NewNATS(sink.URL); err != nil {
+				return
+			}
+			closers = append(closers, nats)
+			handlers = append(handlers, sinks.Publish(nats, sink.Topic))
+		case "mqtt":
+			var mqtt *sinks.MQTT
+			if mqtt, err = sinks.NewMQTT(sink.URL); err != nil {
+				return
+			}
+			closers = append(closers, mqtt)
+			handlers = append(handlers, sinks.Publish(mqtt, sink.Topic))
+		case "kafka":
+			var kafka *sinks.Kafka
+			if kafka, err = sinks.NewKafka(sink.URL); err != nil {
+				return
+			}
+			closers = append(closers, kafka)
+			handlers = append(handlers, sinks.Publish(kafka, sink.Topic))
+		default:
+			err = fmt.Errorf("%v: unknown sink type %q", self.Account, sink.Type)
+			return
+		}
+		if sink.MinPriority != "" {
+			var priority imap.Priority
+			if priority, err = imap.ParsePriority(sink.MinPriority); err != nil {
+				err = fmt.Errorf("%v: %v", self.Account, err)
+				return
+			}
+			next, urgent := handlers[len(handlers)-1], rules.PriorityAtLeast(priority)
+			handlers[len(handlers)-1] = func(msg *imap.Mail) error {
+				if !urgent(msg) {
+					return nil
+				}
+				return next(msg)
+			}
+		}
+	}
+	all := sinks.All(handlers...)
+	if self.QuietHours != "" || self.DigestInterval != "" {
+		send := all
+		deliver := func(d digest.Digest) (err error) {
+			for _, msg := range d.Mail {
+				if err = send(msg); err != nil {
+					return
+				}
+			}
+			return
+		}
+		var interval time.Duration
+		if self.DigestInterval != "" {
+			if interval, err = time.ParseDuration(self.DigestInterval); err != nil {
+				err = fmt.Errorf("%v: %v", self.Account, err)
+				return
+			}
+			deliver = func(d digest.Digest) (err error) {
+				msg, err := summary(self.Account, d)
+				if err != nil {
+					return
+				}
+				return send(msg)
+			}
+		}
+		account := self.Account
+		collector := digest.New(deliver)
+		collector.ErrorHandler = func(err error) {
+			log.Printf("%v: sending the notifications held back: %v", account, err)
+		}
+		if state != nil {
+			collector.Store = digestStore{state: state, account: account}
+		}
+		// The held back notifications are sent when closing, before the sinks are closed.
+		closers = append([]io.Closer{collector}, closers...)
+		if interval > 0 {
+			all = collector.Every(interval)
+		}
+		if self.QuietHours != "" {
+			var schedule digest.Schedule
+			if schedule, err = digest.ParseSchedule(self.QuietHours); err != nil {
+				err = fmt.Errorf("%v: %v", self.Account, err)
+				return
+			}
+			all = collector.Quiet(schedule, all)
+		}
+	}
+	result = func(msg *imap.Mail) error {
+		for _, condition := range conditions {
+			if !condition(msg) {
+				return nil
+			}
+		}
+		return all(msg)
+	}
+	classifiers := []imap.Classifier{}
+	if self.Priority.GmailImportance {
+		classifiers = append(classifiers, imap.GmailImportance)
+	}
+	for _, domain := range self.Priority.UrgentFromDomains {
+		from := rules.FromDomain(domain)
+		classifiers = append(classifiers, func(msg *imap.Mail) imap.Priority {
+			if from(msg) {
+				return imap.Urgent
+			}
+			return imap.Normal
+		})
+	}
+	if len(classifiers) > 0 {
+		result = imap.Classify(result, classifiers...)
+	}
+	if len(self.Attachments.Rules) > 0 {
+		result = self.Attachments.Handler(result)
+	}
+	if self.Scan.Addr != "" {
+		network := self.Scan.Network
+		if network == "" {
+			network = "unix"
+		}
+		var quarantine imap.MailHandler
+		if self.Scan.Quarantine != "" {
+			quarantine = imap.Quarantine(self.Scan.Quarantine)
+		}
+		result = imap.Scan(result, clamd.New(network, self.Scan.Addr), quarantine)
+	}
+	return
+}
+
+// digestStore keeps the mail held back for the digest of an account in the state file, as the notifications of the
+// mail. Like replayed mail, the mail restored from it only has the headers and the snippet of the notifications.
+type digestStore struct {
+	state   *boltstore.Store
+	account string
+}
+
+type storedDigest struct {
+	Since         time.Time            `json:"since"`
+	Due           time.Time            `json:"due"`
+	Notifications []sinks.Notification `json:"notifications"`
+}
+
+func (self digestStore) SaveDigest(d digest.Digest) error {
+	if len(d.Mail) == 0 {
+		return self.state.PutDigest(self.account, nil)
+	}
+	stored := storedDigest{
+		Since: d.Since,
+		Due:   d.Until,
+	}
+	for _, msg := range d.Mail {
+		stored.Notifications = append(stored.Notifications, sinks.NewNotification(msg))
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return self.state.PutDigest(self.account, b)
+}
+
+func (self digestStore) LoadDigest() (result digest.Digest, err error) {
+	b, err := self.state.Digest(self.account)
+	if err != nil || b == nil {
+		return
+	}
+	stored := storedDigest{}
+	if err = json.Unmarshal(b, &stored); err != nil {
+		return
+	}
+	result.Since, result.Until = stored.Since, stored.Due
+	for _, notification := range stored.Notifications {
+		var msg *imap.Mail
+		if msg, err = notification.Mail(); err != nil {
+			return
+		}
+		result.Mail = append(result.Mail, msg)
+	}
+	return
+}
+
+// restoreDigest makes the digest among closers, if any, collect the mail it held back before the process stopped.
+func restoreDigest(closers []io.Closer) error {
+	for _, closer := range closers {
+		if collector, ok := closer.(*digest.Collector); ok && collector.Store != nil {
+			return collector.Restore()
+		}
+	}
+	return nil
+}
+
+// summary returns a notification of the mail in d, listing the subjects from each sender, or the only message in d.
+func summary(account string, d digest.Digest) (result *imap.Mail, err error) {
+	if len(d.Mail) == 1 {
+		return d.Mail[0], nil
+	}
+	senders := d.Senders()
+	lines := []string{}
+	for _, sender := range senders {
+		subjects := []string{}
+		for _, msg := range sender.Mail {
+			subjects = append(subjects, msg.GetHeader("Subject"))
+		}
+		name := sender.Name
+		if name == "" {
+			name = sender.Address
+		}
+		lines = append(lines, fmt.Sprintf("%v (%v): %v", name, len(sender.Mail), strings.Join(subjects, ", ")))
+	}
+	notification := sinks.Notification{
+		From:     "gmailnotifyd",
+		To:       account,
+		Subject:  fmt.Sprintf("%v new messages from %v senders", len(d.Mail), len(senders)),
+		Date:     d.Until,
+		Snippet:  strings.Join(lines, "\n"),
+		Priority: imap.Bulk,
+	}
+	for _, msg := range d.Mail {
+		if msg.Priority > notification.Priority {
+			notification.Priority = msg.Priority
+		}
+	}
+	return notification.Mail()
+}
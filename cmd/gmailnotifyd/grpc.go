@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zond/gmail/cmd/gmailnotifyd/watchpb"
+)
+
+// watchServer serves the notifications of a manager as the Notifications service of watchpb.
+type watchServer struct {
+	watchpb.UnimplementedNotificationsServer
+	manager *manager
+}
+
+func newGRPCServer(m *manager) (result *grpc.Server) {
+	result = grpc.NewServer()
+	watchpb.RegisterNotificationsServer(result, watchServer{manager: m})
+	return
+}
+
+func (self watchServer) Watch(req *watchpb.WatchRequest, stream watchpb.Notifications_WatchServer) (err error) {
+	if req.Account != "" && !self.manager.running(req.Account) {
+		return status.Errorf(codes.NotFound, "%v is not watched", req.Account)
+	}
+	s := self.manager.subscribe(req.Account)
+	defer self.manager.unsubscribe(s)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.behind:
+			return status.Errorf(codes.ResourceExhausted, "fell more than %v notifications behind", subscriberBuffer)
+		case e := <-s.events:
+			if err = stream.Send(mailEvent(e)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (self watchServer) Replay(ctx context.Context, req *watchpb.ReplayRequest) (result *watchpb.ReplayResponse, err error) {
+	if self.manager.state == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "replaying needs -state")
+	}
+	replayed, err := self.manager.replayRunning(req.Account, req.Since.AsTime())
+	if err == errNotRunning {
+		return nil, status.Errorf(codes.NotFound, "%v is not watched", req.Account)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unknown, "%v, after replaying %v notifications", err, replayed)
+	}
+	return &watchpb.ReplayResponse{Replayed: uint32(replayed)}, nil
+}
+
+func mailEvent(e event) *watchpb.MailEvent {
+	return &watchpb.MailEvent{
+		Account:  e.account,
+		Uid:      e.notification.UID,
+		GmailId:  e.notification.GmailID,
+		ThreadId: e.notification.ThreadID,
+		From:     e.notification.From,
+		To:       e.notification.To,
+		Subject:  e.notification.Subject,
+		Date:     timestamppb.New(e.notification.Date),
+		Snippet:  e.notification.Snippet,
+		Link:     e.notification.Link,
+		Priority: e.notification.Priority.String(),
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/cmd/gmailnotifyd/watchpb"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+	"github.com/zond/gmail/sinks"
+)
+
+func watchClient(t *testing.T, m *manager) watchpb.NotificationsClient {
+	listener := bufconn.Listen(1 << 16)
+	server := newGRPCServer(m)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return watchpb.NewNotificationsClient(conn)
+}
+
+func awaitSubscribers(t *testing.T, m *manager, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		m.subscribersLock.Lock()
+		subscribed := len(m.subscribers)
+		m.subscribersLock.Unlock()
+		if subscribed == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted %v subscribers, got %v", n, subscribed)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	m := newManager(nil, nil)
+	failing := true
+	for _, account := range []string{"a@example.com", "b@example.com"} {
+		m.accounts[account] = &managed{
+			config: accountConfig{Account: account},
+			handler: func(msg *imap.Mail) error {
+				if failing {
+					failing = false
+					return errors.New("sink down")
+				}
+				return nil
+			},
+			publish: m.publish,
+		}
+	}
+	client := watchClient(t, m)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &watchpb.WatchRequest{Account: "a@example.com"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	all, err := client.Watch(ctx, &watchpb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	awaitSubscribers(t, m, 2)
+	msg := imaptest.Fetch(t, "From: sender@example.com\r\nTo: a@example.com\r\nSubject: hello\r\n\r\nbody\r\n")
+	// Mail is only published once the sinks delivered it.
+	if err := m.accounts["a@example.com"].handle(msg); err == nil {
+		t.Fatalf("wanted the failing handler to fail")
+	}
+	if err := m.accounts["a@example.com"].handle(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := m.accounts["b@example.com"].handle(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if event.Account != "a@example.com" || event.Uid != msg.UID || event.Subject != "hello" || event.From != "sender@example.com" || event.Priority != "normal" {
+		t.Errorf("got %+v", event)
+	}
+	for _, wanted := range []string{"a@example.com", "b@example.com"} {
+		if event, err = all.Recv(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if event.Account != wanted {
+			t.Errorf("wanted %v, got %+v", wanted, event)
+		}
+	}
+	cancel()
+	awaitSubscribers(t, m, 0)
+}
+
+func TestWatchUnknownAccount(t *testing.T) {
+	client := watchClient(t, newManager(nil, nil))
+	stream, err := client.Watch(context.Background(), &watchpb.WatchRequest{Account: "a@example.com"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err = stream.Recv(); status.Code(err) != codes.NotFound {
+		t.Errorf("wanted NotFound, got %v", err)
+	}
+}
+
+func TestWatchFallingBehind(t *testing.T) {
+	m := newManager(nil, nil)
+	s := m.subscribe("")
+	for i := 0; i <= subscriberBuffer; i++ {
+		m.publish("a@example.com", sinks.Notification{UID: uint32(i)})
+	}
+	select {
+	case <-s.behind:
+	default:
+		t.Fatalf("wanted the subscriber to be dropped")
+	}
+	if len(m.subscribers) != 0 {
+		t.Errorf("got %v subscribers", len(m.subscribers))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	if _, err := watchClient(t, newManager(nil, nil)).Replay(context.Background(), &watchpb.ReplayRequest{Account: "a@example.com"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("wanted FailedPrecondition without a state file, got %v", err)
+	}
+	state, err := boltstore.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	m := newManager(nil, state)
+	subjects := []string{}
+	m.accounts["a@example.com"] = &managed{
+		config: accountConfig{Account: "a@example.com"},
+		handler: func(msg *imap.Mail) error {
+			subjects = append(subjects, msg.GetHeader("Subject"))
+			return nil
+		},
+		state: state,
+	}
+	start := time.Now()
+	for i, subject := range []string{"old", "new"} {
+		b, err := json.Marshal(sinks.NewNotification(imaptest.Fetch(t, "From: sender@example.com\r\nSubject: "+subject+"\r\n\r\nbody\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.AddNotification("a@example.com", start.Add(time.Duration(i)*time.Hour), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := watchClient(t, m)
+	rsp, err := client.Replay(context.Background(), &watchpb.ReplayRequest{Account: "a@example.com", Since: timestamppb.New(start.Add(time.Minute))})
+	if err != nil || rsp.Replayed != 1 || !reflect.DeepEqual(subjects, []string{"new"}) {
+		t.Errorf("wanted the new notification replayed, got %v, %v and %v", rsp, err, subjects)
+	}
+	if _, err := client.Replay(context.Background(), &watchpb.ReplayRequest{Account: "b@example.com"}); status.Code(err) != codes.NotFound {
+		t.Errorf("wanted NotFound, got %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Command gmailnotifyd watches a Gmail inbox and prints a JSON notification line on stdout for each new message, or
+// shows a desktop notification when run with -desktop.
+//
+// The account is given with -account or GMAIL_ACCOUNT, and the password with GMAIL_PASSWORD. To watch several accounts,
+// or send notifications elsewhere, use -config. The config file is reloaded on SIGHUP.
+// Under systemd, use Type=notify, and optionally WatchdogSec. Elsewhere, like on Kubernetes, -health serves probes. On Windows it can run as a service, see -install, in which
+// case GMAIL_PASSWORD has to be a system environment variable.
+//
+// Given a command, like list, show, archive or mark-read, it instead runs that on the inbox of -account and exits. The
+// backup command copies new messages to a local maildir or mbox files each time it runs.
+// With -state, the notifications sent are recorded, and the replay command sends them through the sinks again, for
+// when they were lost downstream. It needs the daemon to be stopped, since that keeps the state file locked.
+// On servers without a browser, authorize with OAuth2 instead of a password using the authorize command, which
+// prints a code to enter on another device and saves the token to -token. Google Workspace admins can instead use
+// -service-account, or service_account_file in the config, to watch the mailboxes of their users.
+// With -grpc, applications in other languages can stream the new mail of the accounts using watchpb/watch.proto.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/health"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/sinks"
+)
+
+var (
+	account        = flag.String("account", os.Getenv("GMAIL_ACCOUNT"), "The Gmail address to watch.")
+	configPath     = flag.String("config", "", "A JSON file configuring the accounts to watch, replacing -account.")
+	tokenPath      = flag.String("token", "", "A file with the OAuth2 token for -account, used instead of GMAIL_PASSWORD. Create it with the authorize command.")
+	clientID       = flag.String("client-id", os.Getenv("GMAIL_CLIENT_ID"), "The OAuth2 client id, needed with -token.")
+	clientSecret   = flag.String("client-secret", os.Getenv("GMAIL_CLIENT_SECRET"), "The OAuth2 client secret, needed with -token.")
+	serviceAccount = flag.String("service-account", "", "The JSON key of a Google Workspace service account with domain-wide delegation, used to impersonate -account instead of GMAIL_PASSWORD.")
+	authLog        = flag.String("auth-log", "", "A file to append every login attempt to, as JSON lines.")
+	desktop        = flag.Bool("desktop", false, "Show desktop notifications instead of printing to stdout.")
+	logLatency     = flag.Bool("log-latency", false, "Log how long each new message took to fetch and handle after the notification arrived.")
+	statePath      = flag.String("state", "", "A file recording the notifications sent, so that the replay command can send them again.")
+	stateRetention = flag.Duration("state-retention", 30*24*time.Hour, "How long -state keeps the notifications.")
+	healthAddr     = flag.String("health", "", "An address, like :8080, to serve /healthz and /readyz on for liveness and readiness probes.")
+	grpcAddr       = flag.String("grpc", "", "An address, like localhost:50051, to serve the Notifications gRPC service of watchpb/watch.proto on, streaming the new mail of the accounts. The replay command uses it to have the daemon replay notifications.")
+	pprofAddr      = flag.String("pprof", "", "An address, like localhost:6060, to serve the pprof profiles on under /debug/pprof/, with the goroutines of each account labelled.")
+)
+
+var stdoutLock sync.Mutex
+
+// stdout prints the notification as a JSON line.
+func stdout(msg *imap.Mail) (err error) {
+	b, err := json.Marshal(sinks.NewNotification(msg))
+	if err != nil {
+		return
+	}
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+	_, err = fmt.Printf("%s\n", b)
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if handled, err := platformMain(); handled {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	stop := make(chan struct{})
+	reload := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			log.Printf("Got %v, stopping", sig)
+			close(stop)
+			return
+		}
+	}()
+	if err := run(stop, reload); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func oauth2Config() auth.OAuth2Config {
+	return auth.OAuth2Config{
+		ClientID:     *clientID,
+		ClientSecret: *clientSecret,
+	}
+}
+
+// flagAccount is the account configured by the flags.
+func flagAccount() (result accountConfig, err error) {
+	if *account == "" {
+		err = fmt.Errorf("no account given, use -account or GMAIL_ACCOUNT")
+		return
+	}
+	result = accountConfig{
+		Account:            *account,
+		TokenFile:          *tokenPath,
+		ServiceAccountFile: *serviceAccount,
+	}
+	return
+}
+
+func loadConfig() (result config, err error) {
+	if *configPath != "" {
+		return readConfig(*configPath)
+	}
+	flagged, err := flagAccount()
+	if err != nil {
+		return
+	}
+	sink := sinkConfig{Type: "stdout"}
+	if *desktop {
+		sink.Type = "desktop"
+	}
+	flagged.Sinks = []sinkConfig{sink}
+	result.Accounts = []accountConfig{flagged}
+	return
+}
+
+// run watches the configured accounts until stop is closed, and reloads the configuration when reload receives.
+func run(stop <-chan struct{}, reload <-chan struct{}) (err error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return
+	}
+	var authHandler func(e auth.Event)
+	if *authLog != "" {
+		var f *os.File
+		if f, err = os.OpenFile(*authLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return
+		}
+		defer f.Close()
+		authHandler = auth.JSONLines(f)
+	}
+	state, err := openState()
+	if err != nil {
+		return
+	}
+	if state != nil {
+		defer state.Close()
+	}
+	m := newManager(authHandler, state)
+	if *healthAddr != "" {
+		server := &http.Server{Addr: *healthAddr, Handler: health.New(m.health)}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("Serving health: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
+	if *grpcAddr != "" {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", *grpcAddr); err != nil {
+			return
+		}
+		server := newGRPCServer(m)
+		go func() {
+			if err := server.Serve(listener); err != nil {
+				log.Printf("Serving gRPC: %v", err)
+			}
+		}()
+		defer server.Stop()
+	}
+	if *pprofAddr != "" {
+		profile.Labels = true
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		server := &http.Server{Addr: *pprofAddr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("Serving pprof: %v", err)
+			}
+		}()
+		defer server.Close()
+	}
+	if err = m.apply(cfg); err != nil {
+		m.close()
+		return
+	}
+	m.prune(*stateRetention)
+	sdNotify("READY=1")
+	watchdogDone := make(chan struct{})
+	defer close(watchdogDone)
+	go watchdog(watchdogDone)
+	for {
+		select {
+		case <-stop:
+			sdNotify("STOPPING=1")
+			return m.close()
+		case <-reload:
+			sdNotify("RELOADING=1")
+			if cfg, err := loadConfig(); err != nil {
+				log.Printf("Keeping the old configuration: %v", err)
+			} else if err = m.apply(cfg); err != nil {
+				log.Print(err)
+			}
+			sdNotify("READY=1")
+		}
+	}
+}
+
+// openState opens the -state file. It returns nil without -state.
+func openState() (result *boltstore.Store, err error) {
+	if *statePath == "" {
+		return
+	}
+	return boltstore.Open(*statePath)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail"
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/digest"
+	"github.com/zond/gmail/health"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/notify"
+	"github.com/zond/gmail/sinks"
+	"github.com/zond/gmail/stats"
+)
+
+// isolation is the TLS session cache and HTTP client of one account, so that no session state is shared between the
+// accounts. It is kept while the account is configured, to let reconnects resume their sessions.
+type isolation struct {
+	tlsCache   tls.ClientSessionCache
+	httpClient *http.Client
+}
+
+func newIsolation() isolation {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	return isolation{
+		tlsCache: tls.NewLRUClientSessionCache(0),
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transport,
+		},
+	}
+}
+
+// managed is a running account, whose handler can be replaced without reconnecting.
+type managed struct {
+	config    accountConfig
+	client    *gmail.Client
+	isolation isolation
+	lock      sync.RWMutex
+	handler   imap.MailHandler
+	closers   []io.Closer
+	state     *boltstore.Store
+	publish   func(account string, notification sinks.Notification)
+}
+
+// handle handles msg, and once it was delivered publishes the notification to the watchers and records it in the state
+// file, if any.
+func (self *managed) handle(msg *imap.Mail) (err error) {
+	if err = self.deliver(msg); err != nil {
+		return
+	}
+	notification := sinks.NewNotification(msg)
+	if self.publish != nil {
+		self.publish(self.config.Account, notification)
+	}
+	if self.state == nil {
+		return
+	}
+	b, e := json.Marshal(notification)
+	if e == nil {
+		e = self.state.AddNotification(self.config.Account, time.Now(), b)
+	}
+	if e != nil {
+		log.Printf("%v: recording the notification: %v", self.config.Account, e)
+	}
+	return
+}
+
+// errStopped is returned for mail arriving after the account was stopped, which is left unhandled for the next start.
+var errStopped = errors.New("the account is stopped")
+
+// deliver sends msg through the filters and sinks, without recording it.
+func (self *managed) deliver(msg *imap.Mail) error {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.handler == nil {
+		return errStopped
+	}
+	return self.handler(msg)
+}
+
+// swap replaces the handler, and closes the sinks of the old one once the calls to it returned. The mail the old one held
+// back for a digest is handed over to the digest of the new one, if it has one, instead of being delivered early.
+func (self *managed) swap(handler imap.MailHandler, closers []io.Closer) {
+	self.lock.Lock()
+	old := self.closers
+	self.handler, self.closers = handler, closers
+	self.lock.Unlock()
+	var next *digest.Collector
+	for _, closer := range closers {
+		if collector, ok := closer.(*digest.Collector); ok {
+			next = collector
+		}
+	}
+	for _, closer := range old {
+		if collector, ok := closer.(*digest.Collector); ok && next != nil {
+			if err := next.Take(collector.Stop()); err != nil {
+				log.Printf("%v: handing over the notifications held back: %v", self.config.Account, err)
+			}
+			continue
+		}
+		closer.Close()
+	}
+}
+
+// close stops the client. Mail the client is still handling when the sinks are closed is left unhandled.
+func (self *managed) close() (err error) {
+	err = self.client.Close()
+	self.swap(nil, nil)
+	self.isolation.httpClient.CloseIdleConnections()
+	return
+}
+
+// manager runs one client per configured account, and records the notifications they send in state, if not nil.
+type manager struct {
+	lock        sync.Mutex
+	accounts    map[string]*managed
+	authHandler func(e auth.Event)
+	state       *boltstore.Store
+	// newClient returns the client of an account, replaced by tests.
+	newClient func(account string) *gmail.Client
+	// subscribersLock is separate from lock, so that handlers never wait for apply to publish.
+	subscribersLock sync.Mutex
+	subscribers     map[*subscriber]bool
+	clock           clock.Clock
+	// stopPruning stops the goroutine started by prune, which closes pruned when it returns. They are guarded by lock.
+	stopPruning chan struct{}
+	pruned      chan struct{}
+}
+
+func newManager(authHandler func(e auth.Event), state *boltstore.Store) *manager {
+	return &manager{
+		accounts:    map[string]*managed{},
+		authHandler: authHandler,
+		state:       state,
+		newClient: func(account string) *gmail.Client {
+			return gmail.New(account, "")
+		},
+		subscribers: map[*subscriber]bool{},
+		clock:       clock.Real,
+	}
+}
+
+// apply makes the running accounts match cfg. Accounts whose settings are unchanged keep running untouched, and
+// changed filters, sinks or credentials are applied without reconnecting, while accounts watching another mailbox, or
+// switching to or from read-only, are restarted. Accounts that fail to start are reported in the error, and will be
+// tried again by the next apply.
+func (self *manager) apply(cfg config) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	wanted := map[string]bool{}
+	for _, accountConfig := range cfg.Accounts {
+		wanted[accountConfig.Account] = true
+		running := self.accounts[accountConfig.Account]
+		if running != nil && reflect.DeepEqual(running.config, accountConfig) {
+			continue
+		}
+		isolated := newIsolation()
+		if running != nil {
+			isolated = running.isolation
+		}
+		credentials, e := accountConfig.credentials(isolated.httpClient)
+		if e != nil {
+			err = joinErrors(err, fmt.Errorf("%v: %v", accountConfig.Account, e))
+			continue
+		}
+		handler, closers, e := accountConfig.handler(self.state)
+		if e != nil {
+			err = joinErrors(err, e)
+			continue
+		}
+		if running != nil && (running.config.Mailbox != accountConfig.Mailbox || running.config.ReadOnly != accountConfig.ReadOnly || !reflect.DeepEqual(running.config.Notifier, accountConfig.Notifier)) {
+			// Running clients can't change mailbox, mode or notifier, so this one is restarted.
+			if e := running.close(); e != nil {
+				log.Printf("%v: %v", accountConfig.Account, e)
+			}
+			delete(self.accounts, accountConfig.Account)
+			running = nil
+		}
+		if running != nil {
+			running.swap(handler, closers)
+			running.client.UpdateCredentials(credentials)
+			running.config = accountConfig
+			log.Printf("Reconfigured %v", accountConfig.Account)
+			continue
+		}
+		running = &managed{
+			config:    accountConfig,
+			isolation: isolated,
+			handler:   handler,
+			closers:   closers,
+			state:     self.state,
+			publish:   self.publish,
+		}
+		account := accountConfig.Account
+		running.client = self.newClient(account).UpdateCredentials(credentials).TLSSessionCache(isolated.tlsCache).AuthHandler(self.authHandler).MailHandler(running.handle).ErrorHandler(func(e error) {
+			log.Printf("%v: %v", account, e)
+		})
+		if accountConfig.Mailbox != "" {
+			running.client.Scope(accountConfig.Mailbox)
+		}
+		if accountConfig.ReadOnly {
+			running.client.ReadOnly()
+		}
+		if accountConfig.Notifier.Name != "" {
+			env := running.client.NotifierEnv()
+			env.SwitchHandler = func(e notify.Switch) {
+				if e.Err != nil {
+					log.Printf("%v: failed over from %v to %v: %v", account, e.From, e.To, e.Err)
+				} else {
+					log.Printf("%v: failed back from %v to %v", account, e.From, e.To)
+				}
+			}
+			notifier, e := notify.New(accountConfig.Notifier.Name, env, accountConfig.Notifier.Options)
+			if e != nil {
+				running.swap(nil, nil)
+				err = joinErrors(err, fmt.Errorf("%v: %v", accountConfig.Account, e))
+				continue
+			}
+			running.client.Notifier(notifier)
+		}
+		if *logLatency {
+			running.client.LatencyHandler(func(latency stats.Latency) {
+				log.Printf("%v: uid=%v fetch=%v handle=%v total=%v", account, latency.UID, latency.Fetch(), latency.Handle(), latency.Total())
+			})
+		}
+		if _, e = running.client.Start(); e != nil {
+			running.swap(nil, nil)
+			err = joinErrors(err, fmt.Errorf("%v: %v", accountConfig.Account, e))
+			continue
+		}
+		// Only restored once started, since an account failing to start delivers what its digest holds.
+		if e = restoreDigest(closers); e != nil {
+			log.Printf("%v: restoring the notifications held back: %v", account, e)
+		}
+		self.accounts[accountConfig.Account] = running
+		log.Printf("Started %v", accountConfig.Account)
+	}
+	for account, running := range self.accounts {
+		if !wanted[account] {
+			if e := running.close(); e != nil {
+				log.Printf("%v: %v", account, e)
+			}
+			delete(self.accounts, account)
+			log.Printf("Stopped %v", account)
+		}
+	}
+	return
+}
+
+// close stops the accounts, and the pruning of the state file.
+func (self *manager) close() error {
+	self.lock.Lock()
+	stop, pruned := self.stopPruning, self.pruned
+	self.stopPruning = nil
+	self.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-pruned
+	}
+	return self.apply(config{})
+}
+
+// pruneInterval is how often the manager forgets the notifications that are too old.
+var pruneInterval = time.Hour
+
+// prune forgets the notifications in the state file older than retention at once, and then every pruneInterval until
+// the manager is closed.
+func (self *manager) prune(retention time.Duration) {
+	if self.state == nil {
+		return
+	}
+	stop, pruned := make(chan struct{}), make(chan struct{})
+	self.lock.Lock()
+	self.stopPruning, self.pruned = stop, pruned
+	self.lock.Unlock()
+	go func() {
+		defer close(pruned)
+		for {
+			if err := self.state.PruneNotifications(self.clock.Now().Add(-retention)); err != nil {
+				log.Printf("Pruning the notifications: %v", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-self.clock.After(pruneInterval):
+			}
+		}
+	}()
+}
+
+// health returns the running accounts.
+func (self *manager) health() (result map[string]health.Account) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result = map[string]health.Account{}
+	for account, running := range self.accounts {
+		result[account] = running.client
+	}
+	return
+}
+
+// errNotRunning is returned when replaying the notifications of an account that isn't running.
+var errNotRunning = errors.New("the account is not running")
+
+// replayRunning is replay for an account that is running, which is what the Replay method of the gRPC service uses.
+func (self *manager) replayRunning(account string, since time.Time) (replayed int, err error) {
+	self.lock.Lock()
+	running := self.accounts[account]
+	var accountConfig accountConfig
+	if running != nil {
+		accountConfig = running.config
+	}
+	self.lock.Unlock()
+	if running == nil {
+		err = errNotRunning
+		return
+	}
+	return self.replay(accountConfig, since)
+}
+
+// replay sends the notifications recorded for the account since the given time through its filters and sinks again,
+// without touching Gmail or recording them twice. It uses the handler of the account if it's running, and otherwise
+// one built from accountConfig.
+func (self *manager) replay(accountConfig accountConfig, since time.Time) (replayed int, err error) {
+	if self.state == nil {
+		err = fmt.Errorf("replaying needs a state file")
+		return
+	}
+	self.lock.Lock()
+	running := self.accounts[accountConfig.Account]
+	self.lock.Unlock()
+	var handler imap.MailHandler
+	if running != nil {
+		handler = running.deliver
+	} else {
+		var closers []io.Closer
+		// The digests of the account are left alone in the state file.
+		if handler, closers, err = accountConfig.handler(nil); err != nil {
+			return
+		}
+		defer func() {
+			for _, closer := range closers {
+				closer.Close()
+			}
+		}()
+	}
+	recorded, err := self.state.Notifications(accountConfig.Account, since)
+	if err != nil {
+		return
+	}
+	for _, b := range recorded {
+		var notification sinks.Notification
+		if err = json.Unmarshal(b, &notification); err != nil {
+			return
+		}
+		var msg *imap.Mail
+		if msg, err = notification.Mail(); err != nil {
+			return
+		}
+		if err = handler(msg); err != nil {
+			err = fmt.Errorf("%v: replaying %v: %v", accountConfig.Account, notification.GmailID, err)
+			return
+		}
+		replayed++
+	}
+	return
+}
+
+// subscriberBuffer is how many notifications a subscriber can fall behind before it's dropped.
+var subscriberBuffer = 64
+
+type event struct {
+	account      string
+	notification sinks.Notification
+}
+
+// subscriber receives the notifications of one account, or of all accounts if account is empty.
+type subscriber struct {
+	account string
+	events  chan event
+	// behind is closed when the subscriber was dropped for falling behind.
+	behind chan struct{}
+}
+
+// subscribe returns a subscriber receiving the notifications of account, or of all accounts if it's empty, until
+// unsubscribed.
+func (self *manager) subscribe(account string) (result *subscriber) {
+	result = &subscriber{
+		account: account,
+		events:  make(chan event, subscriberBuffer),
+		behind:  make(chan struct{}),
+	}
+	self.subscribersLock.Lock()
+	defer self.subscribersLock.Unlock()
+	self.subscribers[result] = true
+	return
+}
+
+func (self *manager) unsubscribe(s *subscriber) {
+	self.subscribersLock.Lock()
+	defer self.subscribersLock.Unlock()
+	delete(self.subscribers, s)
+}
+
+// publish sends the notification to the subscribers of the account, without waiting for any of them.
+func (self *manager) publish(account string, notification sinks.Notification) {
+	self.subscribersLock.Lock()
+	defer self.subscribersLock.Unlock()
+	for s := range self.subscribers {
+		if s.account != "" && s.account != account {
+			continue
+		}
+		select {
+		case s.events <- event{account: account, notification: notification}:
+		default:
+			close(s.behind)
+			delete(self.subscribers, s)
+		}
+	}
+}
+
+// running returns whether the account is running.
+func (self *manager) running(account string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.accounts[account] != nil
+}
+
+func joinErrors(err, e error) error {
+	if err == nil {
+		return e
+	}
+	return fmt.Errorf("%v; %v", err, e)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/digest"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+	"github.com/zond/gmail/simulate"
+)
+
+func simulatedManager() *manager {
+	m := newManager(nil, nil)
+	m.newClient = func(account string) *gmail.Client {
+		return simulate.New(account)
+	}
+	return m
+}
+
+func TestApply(t *testing.T) {
+	m := simulatedManager()
+	defer m.close()
+	stdoutSink := []sinkConfig{{Type: "stdout"}}
+	if err := m.apply(config{Accounts: []accountConfig{
+		{Account: "a@example.com", Sinks: stdoutSink},
+		{Account: "b@example.com", Sinks: stdoutSink},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := m.accounts["a@example.com"], m.accounts["b@example.com"]
+	if a == nil || b == nil || len(m.accounts) != 2 {
+		t.Fatalf("Wanted a and b running, got %v", m.accounts)
+	}
+	// a gets new filters, b is removed, and c added.
+	if err := m.apply(config{Accounts: []accountConfig{
+		{Account: "a@example.com", Sinks: stdoutSink, Filters: filterConfig{Subject: "^Invoice"}},
+		{Account: "c@example.com", Sinks: stdoutSink},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if m.accounts["a@example.com"] != a || a.config.Filters.Subject != "^Invoice" {
+		t.Errorf("Wanted a reconfigured without restarting")
+	}
+	if a.client.State() != connstate.Running {
+		t.Errorf("Wanted a running, got %v", a.client.State())
+	}
+	if m.accounts["b@example.com"] != nil || b.client.State() != connstate.Stopped {
+		t.Errorf("Wanted b stopped, got %v", b.client.State())
+	}
+	if c := m.accounts["c@example.com"]; c == nil || c.client.State() != connstate.Running {
+		t.Errorf("Wanted c started")
+	}
+	// Watching another mailbox restarts a.
+	if err := m.apply(config{Accounts: []accountConfig{
+		{Account: "a@example.com", Sinks: stdoutSink, Mailbox: "Receipts"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if restarted := m.accounts["a@example.com"]; restarted == nil || restarted == a || a.client.State() != connstate.Stopped {
+		t.Errorf("Wanted a restarted")
+	}
+	if len(m.accounts) != 1 {
+		t.Errorf("Wanted only a running, got %v", m.accounts)
+	}
+	// Accounts that fail to start are reported, and leave the others running.
+	if err := m.apply(config{Accounts: []accountConfig{
+		{Account: "a@example.com", Sinks: stdoutSink, Mailbox: "Receipts"},
+		{Account: "d@example.com", Sinks: []sinkConfig{{Type: "pager"}}},
+	}}); err == nil {
+		t.Errorf("Wanted the unknown sink of d reported")
+	}
+	if len(m.accounts) != 1 || m.accounts["a@example.com"] == nil {
+		t.Errorf("Wanted only a running, got %v", m.accounts)
+	}
+}
+
+func TestCloseWhileHandling(t *testing.T) {
+	msg := imaptest.Fetch(t, "From: sender@example.com\r\nSubject: hello\r\n\r\nbody\r\n")
+	running := &managed{
+		config:    accountConfig{Account: "a@example.com"},
+		client:    simulate.New("a@example.com"),
+		isolation: newIsolation(),
+		handler: func(msg *imap.Mail) error {
+			return nil
+		},
+	}
+	handled := make(chan error)
+	go func() {
+		for {
+			if err := running.handle(msg); err != nil {
+				handled <- err
+				return
+			}
+		}
+	}()
+	if err := running.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handled; err != errStopped {
+		t.Errorf("Wanted errStopped for mail handled after closing, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	state, err := boltstore.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	clk := clock.NewFake(time.Now())
+	m := newManager(nil, state)
+	m.clock = clk
+	for _, age := range []time.Duration{90 * time.Minute, 30 * time.Minute} {
+		if err := state.AddNotification("a@example.com", clk.Now().Add(-age), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			recorded, err := state.Notifications("a@example.com", time.Unix(0, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recorded) == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Wanted %v notifications kept, got %v", n, len(recorded))
+			}
+		}
+	}
+	m.prune(time.Hour)
+	kept(1)
+	clk.BlockUntil(1)
+	clk.Advance(pruneInterval)
+	kept(0)
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// heldBack stops the digest of the running account, and returns the subjects of the mail it held back.
+func heldBack(t *testing.T, running *managed) (result []string) {
+	for _, closer := range running.closers {
+		if collector, ok := closer.(*digest.Collector); ok {
+			for _, msg := range collector.Stop().Mail {
+				result = append(result, msg.GetHeader("Subject"))
+			}
+			return
+		}
+	}
+	t.Fatalf("Wanted a digest")
+	return
+}
+
+func TestDigestAcrossReloads(t *testing.T) {
+	state, err := boltstore.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	quiet := accountConfig{Account: "a@example.com", Sinks: []sinkConfig{{Type: "stdout"}}, QuietHours: "00:00-24:00"}
+	m := simulatedManager()
+	m.state = state
+	if err := m.apply(config{Accounts: []accountConfig{quiet}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.accounts["a@example.com"].handle(imaptest.Fetch(t, "From: sender@example.com\r\nSubject: hello\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Reloading with other filters hands the mail over to the new digest, instead of delivering it.
+	reloaded := quiet
+	reloaded.Filters.Subject = "^hello"
+	if err := m.apply(config{Accounts: []accountConfig{reloaded}}); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := heldBack(t, m.accounts["a@example.com"]); !reflect.DeepEqual(subjects, []string{"hello"}) {
+		t.Errorf("Wanted hello held back after reloading, got %v", subjects)
+	}
+	if err := m.close(); err != nil {
+		t.Fatal(err)
+	}
+	// A new process holds back what the state file kept.
+	restarted := simulatedManager()
+	restarted.state = state
+	defer restarted.close()
+	if err := restarted.apply(config{Accounts: []accountConfig{reloaded}}); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := heldBack(t, restarted.accounts["a@example.com"]); !reflect.DeepEqual(subjects, []string{"hello"}) {
+		t.Errorf("Wanted hello held back after restarting, got %v", subjects)
+	}
+}
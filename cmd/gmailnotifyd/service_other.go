@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// platformMain does nothing outside Windows.
+func platformMain() (handled bool, err error) {
+	return
+}
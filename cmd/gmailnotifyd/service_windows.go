@@ -0,0 +1,118 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "gmailnotifyd"
+
+var (
+	install   = flag.Bool("install", false, "Install as a Windows service, running with the given flags, and exit.")
+	uninstall = flag.Bool("uninstall", false, "Remove the Windows service and exit.")
+)
+
+// platformMain installs or removes the service when asked to, or runs as the service when started by the service manager.
+func platformMain() (handled bool, err error) {
+	switch {
+	case *install:
+		return true, installService()
+	case *uninstall:
+		return true, uninstallService()
+	}
+	if handled, err = svc.IsWindowsService(); err != nil || !handled {
+		return
+	}
+	return true, svc.Run(serviceName, service{})
+}
+
+type service struct{}
+
+func (service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (ssec bool, errno uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- run(stop, nil)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				if log, e := eventlog.Open(serviceName); e == nil {
+					log.Error(1, err.Error())
+					log.Close()
+				}
+				return false, 1
+			}
+			return
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return
+			}
+		}
+	}
+}
+
+func installService() (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer m.Disconnect()
+	args := []string{}
+	for _, arg := range os.Args[1:] {
+		if !strings.HasPrefix(strings.TrimLeft(arg, "-"), "install") {
+			args = append(args, arg)
+		}
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Gmail notifications",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	if err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("installing event log source: %v", err)
+	}
+	return
+}
+
+func uninstallService() (err error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return
+	}
+	return eventlog.Remove(serviceName)
+}
@@ -0,0 +1,5 @@
+// Package watchpb is the gRPC service of gmailnotifyd -grpc, generated from watch.proto, which clients in other
+// languages generate their stubs from.
+package watchpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative watch.proto
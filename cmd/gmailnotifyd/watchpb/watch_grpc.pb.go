@@ -0,0 +1,182 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: watch.proto
+
+package watchpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Notifications_Watch_FullMethodName  = "/gmailnotifyd.Notifications/Watch"
+	Notifications_Replay_FullMethodName = "/gmailnotifyd.Notifications/Replay"
+)
+
+// NotificationsClient is the client API for Notifications service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NotificationsClient interface {
+	// Watch streams the mail of the account, or of all accounts if it's empty, as it arrives. It ends with
+	// RESOURCE_EXHAUSTED if the client falls behind, after which it can use the replay command to catch up.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Notifications_WatchClient, error)
+	// Replay sends the notifications recorded in the state file for the account since the given time through its filters
+	// and sinks again. It fails with NOT_FOUND if the account isn't running, and FAILED_PRECONDITION without -state.
+	Replay(ctx context.Context, in *ReplayRequest, opts ...grpc.CallOption) (*ReplayResponse, error)
+}
+
+type notificationsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNotificationsClient(cc grpc.ClientConnInterface) NotificationsClient {
+	return &notificationsClient{cc}
+}
+
+func (c *notificationsClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Notifications_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Notifications_ServiceDesc.Streams[0], Notifications_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &notificationsWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Notifications_WatchClient interface {
+	Recv() (*MailEvent, error)
+	grpc.ClientStream
+}
+
+type notificationsWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *notificationsWatchClient) Recv() (*MailEvent, error) {
+	m := new(MailEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *notificationsClient) Replay(ctx context.Context, in *ReplayRequest, opts ...grpc.CallOption) (*ReplayResponse, error) {
+	out := new(ReplayResponse)
+	err := c.cc.Invoke(ctx, Notifications_Replay_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NotificationsServer is the server API for Notifications service.
+// All implementations must embed UnimplementedNotificationsServer
+// for forward compatibility
+type NotificationsServer interface {
+	// Watch streams the mail of the account, or of all accounts if it's empty, as it arrives. It ends with
+	// RESOURCE_EXHAUSTED if the client falls behind, after which it can use the replay command to catch up.
+	Watch(*WatchRequest, Notifications_WatchServer) error
+	// Replay sends the notifications recorded in the state file for the account since the given time through its filters
+	// and sinks again. It fails with NOT_FOUND if the account isn't running, and FAILED_PRECONDITION without -state.
+	Replay(context.Context, *ReplayRequest) (*ReplayResponse, error)
+	mustEmbedUnimplementedNotificationsServer()
+}
+
+// UnimplementedNotificationsServer must be embedded to have forward compatible implementations.
+type UnimplementedNotificationsServer struct {
+}
+
+func (UnimplementedNotificationsServer) Watch(*WatchRequest, Notifications_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedNotificationsServer) Replay(context.Context, *ReplayRequest) (*ReplayResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Replay not implemented")
+}
+func (UnimplementedNotificationsServer) mustEmbedUnimplementedNotificationsServer() {}
+
+// UnsafeNotificationsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NotificationsServer will
+// result in compilation errors.
+type UnsafeNotificationsServer interface {
+	mustEmbedUnimplementedNotificationsServer()
+}
+
+func RegisterNotificationsServer(s grpc.ServiceRegistrar, srv NotificationsServer) {
+	s.RegisterService(&Notifications_ServiceDesc, srv)
+}
+
+func _Notifications_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NotificationsServer).Watch(m, &notificationsWatchServer{stream})
+}
+
+type Notifications_WatchServer interface {
+	Send(*MailEvent) error
+	grpc.ServerStream
+}
+
+type notificationsWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *notificationsWatchServer) Send(m *MailEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Notifications_Replay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NotificationsServer).Replay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Notifications_Replay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NotificationsServer).Replay(ctx, req.(*ReplayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Notifications_ServiceDesc is the grpc.ServiceDesc for Notifications service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Notifications_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gmailnotifyd.Notifications",
+	HandlerType: (*NotificationsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Replay",
+			Handler:    _Notifications_Replay_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Notifications_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "watch.proto",
+}
@@ -0,0 +1,135 @@
+package compose
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlainText(t *testing.T) {
+	got := PlainText(`<html><head><title>x</title><style>p {}</style></head><body>
+<h1>Daily   report</h1>
+<p>Hello &amp; welcome,<br>see <a href="https://example.com/r?a=1&amp;b=2">the report</a>.</p>
+<ul><li>one</li><li>two</li></ul>
+<!-- hidden --><p>Bye</p></body></html>`)
+	want := "Daily report\n\nHello & welcome,\nsee the report (https://example.com/r?a=1&b=2).\n\n* one\n* two\n\nBye\n"
+	if got != want {
+		t.Errorf("Wanted %q, got %q", want, got)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"_layout.tmpl": `{{define "layout"}}<html><body>{{template "content" .}}{{template "footer"}}</body></html>{{end}}`,
+		"_footer.tmpl": `{{define "footer"}}<p>Sent by the bot</p>{{end}}`,
+		"report.tmpl": `{{define "subject"}}Report for
+{{.Day}}{{end}}{{define "html"}}{{template "layout" .}}{{end}}{{define "content"}}<h1>{{.Title}}</h1>{{end}}`,
+		"plain.tmpl": `{{define "subject"}}Plain {{.Title}}{{end}}{{define "text"}}Title: {{.Title}}{{end}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0600); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	templates, err := ParseDir(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data := map[string]string{"Day": "Monday", "Title": "<b>Fish & chips</b>"}
+	msg, err := templates.Compose("report", data)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if msg.Subject != "Report for Monday" {
+		t.Errorf("Wanted the subject on one line, got %q", msg.Subject)
+	}
+	if want := "<html><body><h1>&lt;b&gt;Fish &amp; chips&lt;/b&gt;</h1><p>Sent by the bot</p></body></html>"; msg.HTML != want {
+		t.Errorf("Wanted %q, got %q", want, msg.HTML)
+	}
+	if want := "<b>Fish & chips</b>\n\nSent by the bot\n"; msg.Text != want {
+		t.Errorf("Wanted the generated text %q, got %q", want, msg.Text)
+	}
+	if plain, err := templates.Compose("plain", data); err != nil || plain.Text != "Title: <b>Fish & chips</b>" || plain.HTML != "" {
+		t.Errorf("Wanted an unescaped plain text message, got %+v, %v", plain, err)
+	}
+	if _, err := templates.Compose("missing", data); err == nil {
+		t.Errorf("Wanted an unknown template to fail")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte(`{{define "text"}}x{{end}}`), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := ParseDir(dir); err == nil || !strings.Contains(err.Error(), "broken.tmpl") {
+		t.Errorf("Wanted a message without subject to fail, got %v", err)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	msg := &Message{
+		From:       "Bot <bot@example.com>",
+		To:         []string{"Ann <ann@example.com>", "bob@example.com"},
+		Cc:         []string{"carl@example.com"},
+		Subject:    "Räksmörgås",
+		Text:       "Hello\nthere",
+		HTML:       "<p>Hello</p>",
+		InReplyTo:  "a@example.com",
+		References: []string{"root@example.com", "a@example.com"},
+		Headers:    map[string]string{"x-mailer": "bot"},
+	}
+	recipients, err := msg.Recipients()
+	if err != nil || strings.Join(recipients, ",") != "ann@example.com,bob@example.com,carl@example.com" {
+		t.Errorf("Wanted the To and Cc addresses, got %v, %v", recipients, err)
+	}
+	b, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasSuffix(msg.MessageID, "@example.com") || msg.Date.IsZero() || time.Since(msg.Date) > time.Minute {
+		t.Errorf("Wanted a message id and date set, got %q and %v", msg.MessageID, msg.Date)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	subject, err := (&mime.WordDecoder{}).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("Wanted the subject %q, got %q, %v", msg.Subject, subject, err)
+	}
+	for name, want := range map[string]string{
+		"Message-Id":  "<" + msg.MessageID + ">",
+		"In-Reply-To": "<a@example.com>",
+		"References":  "<root@example.com> <a@example.com>",
+		"X-Mailer":    "bot",
+		"To":          "Ann <ann@example.com>, bob@example.com",
+	} {
+		if got := parsed.Header.Get(name); got != want {
+			t.Errorf("Wanted %v %q, got %q", name, want, got)
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Wanted multipart/alternative, got %q, %v", mediaType, err)
+	}
+	r := multipart.NewReader(parsed.Body, params["boundary"])
+	bodies := []string{}
+	for {
+		part, err := r.NextRawPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	if want := "text/plain; charset=utf-8: Hello\r\nthere|text/html; charset=utf-8: <p>Hello</p>"; strings.Join(bodies, "|") != want {
+		t.Errorf("Wanted %q, got %q", want, strings.Join(bodies, "|"))
+	}
+}
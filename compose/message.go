@@ -0,0 +1,158 @@
+// Package compose builds messages to send, optionally from templates with layouts and partials.
+//
+//	templates, err := compose.ParseDir("templates")
+//	msg, err := templates.Compose("report", data)
+//	msg.From, msg.To = "bot@example.com", []string{"team@example.com"}
+//	err = client.SendMessage(&msg)
+package compose
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is a message with a plain text body, an HTML body, or both as alternatives.
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	Subject string
+	Text    string
+	HTML    string
+	// MessageID, without angle brackets, and Date are set by Bytes if empty.
+	MessageID string
+	Date      time.Time
+	// InReplyTo and References, without angle brackets, make the message a reply in a conversation.
+	InReplyTo  string
+	References []string
+	// Headers are added as is.
+	Headers map[string]string
+}
+
+// Recipients returns the addresses in To and Cc.
+func (self *Message) Recipients() (result []string, err error) {
+	for _, list := range [][]string{self.To, self.Cc} {
+		for _, recipient := range list {
+			var addr *mail.Address
+			if addr, err = mail.ParseAddress(recipient); err != nil {
+				return
+			}
+			result = append(result, addr.Address)
+		}
+	}
+	return
+}
+
+// messageID returns a new random id in the domain of the From address.
+func (self *Message) messageID() (result string, err error) {
+	domain := "localhost"
+	if addr, parseErr := mail.ParseAddress(self.From); parseErr == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at != -1 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	result = fmt.Sprintf("%x@%v", b, domain)
+	return
+}
+
+func writePart(w io.Writer, body string) (err error) {
+	qp := quotedprintable.NewWriter(w)
+	if _, err = qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return
+	}
+	return qp.Close()
+}
+
+// Bytes encodes the message, setting MessageID and Date first if they are empty.
+func (self *Message) Bytes() (result []byte, err error) {
+	if self.MessageID == "" {
+		if self.MessageID, err = self.messageID(); err != nil {
+			return
+		}
+	}
+	if self.Date.IsZero() {
+		self.Date = time.Now()
+	}
+	buf := &bytes.Buffer{}
+	header := func(name, value string) {
+		fmt.Fprintf(buf, "%v: %v\r\n", name, value)
+	}
+	header("From", self.From)
+	header("To", strings.Join(self.To, ", "))
+	if len(self.Cc) > 0 {
+		header("Cc", strings.Join(self.Cc, ", "))
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", self.Subject))
+	header("Date", self.Date.Format(time.RFC1123Z))
+	header("Message-Id", "<"+self.MessageID+">")
+	if self.InReplyTo != "" {
+		header("In-Reply-To", "<"+self.InReplyTo+">")
+	}
+	if len(self.References) > 0 {
+		header("References", "<"+strings.Join(self.References, "> <")+">")
+	}
+	names := []string{}
+	for name := range self.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header(textproto.CanonicalMIMEHeaderKey(name), self.Headers[name])
+	}
+	header("MIME-Version", "1.0")
+	if self.Text == "" || self.HTML == "" {
+		contentType, body := "text/plain", self.Text
+		if self.HTML != "" {
+			contentType, body = "text/html", self.HTML
+		}
+		header("Content-Type", contentType+"; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err = writePart(buf, body); err != nil {
+			return
+		}
+		return buf.Bytes(), nil
+	}
+	parts := &bytes.Buffer{}
+	w := multipart.NewWriter(parts)
+	header("Content-Type", "multipart/alternative; boundary="+w.Boundary())
+	buf.WriteString("\r\n")
+	// The preferred alternative comes last.
+	for _, alternative := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", self.Text},
+		{"text/html", self.HTML},
+	} {
+		var part io.Writer
+		if part, err = w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alternative.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}); err != nil {
+			return
+		}
+		if err = writePart(part, alternative.body); err != nil {
+			return
+		}
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	buf.Write(parts.Bytes())
+	return buf.Bytes(), nil
+}
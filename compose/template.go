@@ -0,0 +1,141 @@
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Templates composes messages from templates. A message template defines the templates "subject", and "text", "html"
+// or both, which can use the shared templates, like layouts and partials:
+//
+//	{{define "layout"}}<html><body>{{template "content" .}}{{template "footer"}}</body></html>{{end}}
+//	{{define "footer"}}<p>Sent by the report bot</p>{{end}}
+//
+//	{{define "subject"}}Report for {{.Day}}{{end}}
+//	{{define "html"}}{{template "layout" .}}{{end}}
+//	{{define "content"}}<h1>{{.Title}}</h1>{{end}}
+//
+// "subject" and "text" are executed with text/template, and "html" with html/template, which escapes the data. Messages
+// with only "html" get a plain text alternative generated by PlainText.
+type Templates struct {
+	sharedText *texttemplate.Template
+	sharedHTML *htmltemplate.Template
+	messages   map[string]message
+}
+
+type message struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// New returns templates using funcs, in addition to the builtin functions.
+func New(funcs map[string]interface{}) *Templates {
+	return &Templates{
+		sharedText: texttemplate.New("").Funcs(funcs),
+		sharedHTML: htmltemplate.New("").Funcs(funcs),
+		messages:   map[string]message{},
+	}
+}
+
+// Shared parses src as templates usable by all messages added after it, like layouts and partials.
+func (self *Templates) Shared(src string) (err error) {
+	if _, err = self.sharedText.Parse(src); err != nil {
+		return
+	}
+	_, err = self.sharedHTML.Parse(src)
+	return
+}
+
+// Message parses src as the message template name.
+func (self *Templates) Message(name, src string) (err error) {
+	result := message{}
+	if result.text, err = self.sharedText.Clone(); err != nil {
+		return
+	}
+	if _, err = result.text.Parse(src); err != nil {
+		return
+	}
+	if result.html, err = self.sharedHTML.Clone(); err != nil {
+		return
+	}
+	if _, err = result.html.Parse(src); err != nil {
+		return
+	}
+	if result.text.Lookup("subject") == nil {
+		return fmt.Errorf("compose: message template %q defines no subject", name)
+	}
+	if result.text.Lookup("text") == nil && result.html.Lookup("html") == nil {
+		return fmt.Errorf("compose: message template %q defines neither text nor html", name)
+	}
+	self.messages[name] = result
+	return
+}
+
+// ParseDir parses the files in dir, without using any functions. Files whose names start with an underscore, like
+// "_layout.tmpl", are shared, and the others are messages named by their file names without extension.
+func ParseDir(dir string) (result *Templates, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	result = New(nil)
+	// The shared templates must be parsed before the messages using them.
+	for _, shared := range []bool{true, false} {
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") || strings.HasPrefix(file.Name(), "_") != shared {
+				continue
+			}
+			var b []byte
+			if b, err = ioutil.ReadFile(filepath.Join(dir, file.Name())); err != nil {
+				return
+			}
+			if shared {
+				err = result.Shared(string(b))
+			} else {
+				err = result.Message(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), string(b))
+			}
+			if err != nil {
+				err = fmt.Errorf("compose: %v: %v", file.Name(), err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// Compose executes the message template name with data, and returns a message with its subject and bodies.
+func (self *Templates) Compose(name string, data interface{}) (result Message, err error) {
+	tmpl, found := self.messages[name]
+	if !found {
+		err = fmt.Errorf("compose: no message template %q", name)
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err = tmpl.text.ExecuteTemplate(buf, "subject", data); err != nil {
+		return
+	}
+	// Subjects are a single line.
+	result.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	if tmpl.html.Lookup("html") != nil {
+		buf.Reset()
+		if err = tmpl.html.ExecuteTemplate(buf, "html", data); err != nil {
+			return
+		}
+		result.HTML = buf.String()
+	}
+	if tmpl.text.Lookup("text") != nil {
+		buf.Reset()
+		if err = tmpl.text.ExecuteTemplate(buf, "text", data); err != nil {
+			return
+		}
+		result.Text = buf.String()
+	} else {
+		result.Text = PlainText(result.HTML)
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package compose
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	blankLines = regexp.MustCompile(`\n{3,}`)
+	hrefAttr   = regexp.MustCompile(`(?is)\bhref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// paragraphTags start and end paragraphs, separated by blank lines, and lineTags start new lines.
+var (
+	paragraphTags = map[string]bool{
+		"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "table": true, "blockquote": true,
+		"pre": true,
+	}
+	lineTags = map[string]bool{
+		"br": true, "div": true, "tr": true, "ul": true, "ol": true, "hr": true,
+	}
+)
+
+// PlainText converts an HTML body to a plain text alternative, keeping paragraphs and line breaks, prefixing list items
+// with "* ", and writing link targets after the link text.
+func PlainText(s string) string {
+	result := &strings.Builder{}
+	links := []string{}
+	for len(s) > 0 {
+		start := strings.IndexByte(s, '<')
+		if start == -1 {
+			result.WriteString(collapse(s))
+			break
+		}
+		result.WriteString(collapse(s[:start]))
+		s = s[start:]
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end == -1 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			break
+		}
+		element := s[1:end]
+		s = s[end+1:]
+		closing := strings.HasPrefix(element, "/")
+		tag := strings.ToLower(strings.Trim(strings.Fields(strings.TrimPrefix(element, "/") + " ")[0], "/"))
+		switch {
+		case !closing && (tag == "script" || tag == "style" || tag == "head" || tag == "title"):
+			if close := strings.Index(strings.ToLower(s), "</"+tag); close != -1 {
+				s = s[close:]
+			} else {
+				s = ""
+			}
+		case tag == "a" && !closing:
+			href := ""
+			if match := hrefAttr.FindStringSubmatch(element); match != nil {
+				href = html.UnescapeString(strings.Trim(match[1], `"'`))
+			}
+			links = append(links, href)
+		case tag == "a" && closing && len(links) > 0:
+			if href := links[len(links)-1]; href != "" && !strings.HasPrefix(href, "#") {
+				result.WriteString(" (" + href + ")")
+			}
+			links = links[:len(links)-1]
+		case tag == "li" && !closing:
+			result.WriteString("\n* ")
+		case paragraphTags[tag]:
+			result.WriteString("\n\n")
+		case lineTags[tag]:
+			result.WriteString("\n")
+		}
+	}
+	lines := strings.Split(html.UnescapeString(result.String()), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")) + "\n"
+}
+
+// collapse replaces the whitespace in text outside tags with single spaces, like browsers do.
+func collapse(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		if s != "" {
+			return " "
+		}
+		return ""
+	}
+	result := strings.Join(fields, " ")
+	if strings.TrimLeft(s[:1], " \t\r\n") == "" {
+		result = " " + result
+	}
+	if strings.TrimRight(s[len(s)-1:], " \t\r\n") == "" {
+		result += " "
+	}
+	return result
+}
@@ -0,0 +1,29 @@
+// Package connstate holds the connection states of the notifiers, so that they can be reported without depending on
+// the xmpp package.
+package connstate
+
+// State is the connection state of a notifier, or of a client using one.
+type State int
+
+const (
+	// Idle notifiers haven't been started, or failed to start.
+	Idle State = iota
+	Connecting
+	Running
+	// Backoff notifiers lost the connection and failed to reconnect, and are waiting before trying again.
+	Backoff
+	// Stopped notifiers have been closed.
+	Stopped
+)
+
+var stateNames = map[State]string{
+	Idle:       "Idle",
+	Connecting: "Connecting",
+	Running:    "Running",
+	Backoff:    "Backoff",
+	Stopped:    "Stopped",
+}
+
+func (self State) String() string {
+	return stateNames[self]
+}
@@ -0,0 +1,392 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+var Timeout = 30 * time.Second
+
+// AttemptDelay is how long to wait for one address before racing the next one, the Connection Attempt Delay of RFC 8305.
+var AttemptDelay = 250 * time.Millisecond
+
+// PreferIPv4 makes IPv4 addresses be tried first, instead of IPv6 as RFC 8305 recommends.
+var PreferIPv4 = false
+
+// Proxy returns the proxy to use when connecting to addr, or nil for a direct connection.
+// It defaults to FromEnvironment.
+var Proxy = FromEnvironment
+
+// FromEnvironment uses the HTTPS_PROXY and NO_PROXY environment variables (or their lower case versions) the same way net/http does.
+func FromEnvironment(addr string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   addr,
+		},
+	})
+}
+
+type ProxyError struct {
+	Proxy  string
+	Status string
+}
+
+func (self ProxyError) Error() string {
+	return fmt.Sprintf("proxy %v refused CONNECT: %v", self.Proxy, self.Status)
+}
+
+// Dialer connects like Dial, with its own clock driving the attempt delays.
+type Dialer struct {
+	clock clock.Clock
+}
+
+func New() *Dialer {
+	return &Dialer{
+		clock: clock.Real,
+	}
+}
+
+// Clock replaces the clock driving the attempt delays, to let tests drive them.
+func (self *Dialer) Clock(c clock.Clock) *Dialer {
+	self.clock = c
+	return self
+}
+
+// Dial connects to addr, tunneling through an HTTP CONNECT proxy if Proxy returns one.
+// Credentials in the proxy URL are used for basic or digest authentication when the proxy asks for it.
+func Dial(addr string) (conn net.Conn, err error) {
+	return New().DialContext(context.Background(), addr)
+}
+
+// DialContext is Dial, but gives up when ctx is done.
+func DialContext(ctx context.Context, addr string) (conn net.Conn, err error) {
+	return New().DialContext(ctx, addr)
+}
+
+// Dial is the package Dial, using the clock of the Dialer.
+func (self *Dialer) Dial(addr string) (conn net.Conn, err error) {
+	return self.DialContext(context.Background(), addr)
+}
+
+// DialContext is the package DialContext, using the clock of the Dialer.
+func (self *Dialer) DialContext(ctx context.Context, addr string) (conn net.Conn, err error) {
+	proxyURL, err := Proxy(addr)
+	if err != nil {
+		return
+	}
+	if proxyURL == nil {
+		return self.dialDirect(ctx, addr)
+	}
+	return self.dialProxy(ctx, proxyURL, addr)
+}
+
+// interleave sorts the addresses to alternate between the address families, starting with the preferred one.
+func interleave(addrs []net.IPAddr) (result []net.IPAddr) {
+	preferred, other := []net.IPAddr{}, []net.IPAddr{}
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == PreferIPv4 {
+			preferred = append(preferred, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+	for len(preferred) > 0 || len(other) > 0 {
+		if len(preferred) > 0 {
+			result = append(result, preferred[0])
+			preferred = preferred[1:]
+		}
+		if len(other) > 0 {
+			result = append(result, other[0])
+			other = other[1:]
+		}
+	}
+	return
+}
+
+type attempt struct {
+	conn net.Conn
+	err  error
+}
+
+// dialDirect races connections to all addresses of the host, starting a new one every AttemptDelay or as soon as the previous one fails.
+func (self *Dialer) dialDirect(ctx context.Context, addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+	candidates := interleave(ips)
+	if len(candidates) == 0 {
+		err = fmt.Errorf("no addresses found for %v", host)
+		return
+	}
+	attempts := make(chan attempt, len(candidates))
+	d := &net.Dialer{}
+	pending := 0
+	start := func() {
+		target := net.JoinHostPort(candidates[0].String(), port)
+		candidates = candidates[1:]
+		pending++
+		go func() {
+			c, e := d.DialContext(ctx, "tcp", target)
+			attempts <- attempt{c, e}
+		}()
+	}
+	start()
+	for pending > 0 {
+		var timer clock.Timer
+		var timeout <-chan time.Time
+		if len(candidates) > 0 {
+			timer = self.clock.NewTimer(AttemptDelay)
+			timeout = timer.C()
+		}
+		var a attempt
+		fired := false
+		select {
+		case a = <-attempts:
+		case <-timeout:
+			fired = true
+		}
+		// Each attempt has its own timer, which is stopped before the next one is started.
+		if timer != nil {
+			timer.Stop()
+		}
+		if fired {
+			start()
+			continue
+		}
+		pending--
+		if a.err == nil {
+			go func(losers int) {
+				for ; losers > 0; losers-- {
+					if a := <-attempts; a.conn != nil {
+						a.conn.Close()
+					}
+				}
+			}(pending)
+			conn, err = a.conn, nil
+			return
+		}
+		if err == nil {
+			err = a.err
+		}
+		if len(candidates) > 0 {
+			start()
+		}
+	}
+	return
+}
+
+func (self *Dialer) dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (conn net.Conn, err error) {
+	conn, rsp, err := self.connect(ctx, proxyURL, addr, "")
+	if err != nil {
+		return
+	}
+	if rsp.StatusCode == http.StatusProxyAuthRequired && proxyURL.User != nil {
+		conn.Close()
+		var authorization string
+		if authorization, err = authorize(proxyURL.User, addr, rsp.Header["Proxy-Authenticate"]); err != nil {
+			return
+		}
+		if conn, rsp, err = self.connect(ctx, proxyURL, addr, authorization); err != nil {
+			return
+		}
+	}
+	if rsp.StatusCode != http.StatusOK {
+		conn.Close()
+		err = ProxyError{
+			Proxy:  proxyURL.Host,
+			Status: rsp.Status,
+		}
+		return
+	}
+	return
+}
+
+func (self *Dialer) connect(ctx context.Context, proxyURL *url.URL, addr, authorization string) (result net.Conn, rsp *http.Response, err error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := self.dialDirect(ctx, proxyAddr)
+	if err != nil {
+		return
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: proxyURL.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(Timeout))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return
+	}
+	r := bufio.NewReader(conn)
+	if rsp, err = http.ReadResponse(r, req); err != nil {
+		conn.Close()
+		return
+	}
+	rsp.Body.Close()
+	conn.SetDeadline(time.Time{})
+	result = bufferedConn{conn, r}
+	return
+}
+
+// bufferedConn makes sure that whatever the server sent right after the CONNECT response isn't lost in the bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (self bufferedConn) Read(b []byte) (int, error) {
+	return self.r.Read(b)
+}
+
+func authorize(user *url.Userinfo, addr string, challenges []string) (result string, err error) {
+	password, _ := user.Password()
+	basic := false
+	for _, challenge := range challenges {
+		scheme, params := parseChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "digest":
+			return digest(user.Username(), password, addr, params)
+		case "basic":
+			basic = true
+		}
+	}
+	if !basic {
+		err = fmt.Errorf("no supported proxy authentication scheme in %q", challenges)
+		return
+	}
+	result = "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+	return
+}
+
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i == -1 {
+		scheme = challenge
+		return
+	}
+	scheme = challenge[:i]
+	rest := challenge[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(rest) {
+				end = len(rest)
+			}
+			value = strings.Replace(rest[1:end], "\\", "", -1)
+			if end < len(rest) {
+				end++
+			}
+			rest = rest[end:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return
+}
+
+func digest(username, password, uri string, params map[string]string) (result string, err error) {
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		err = fmt.Errorf("unsupported proxy digest algorithm %q", algorithm)
+		return
+	}
+	h := func(s string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	realm := params["realm"]
+	nonce := params["nonce"]
+	ha1 := h(username + ":" + realm + ":" + password)
+	ha2 := h("CONNECT:" + uri)
+	result = fmt.Sprintf("Digest username=%q, realm=%q, nonce=%q, uri=%q", username, realm, nonce, uri)
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop == "" {
+		result += fmt.Sprintf(", response=%q", h(ha1+":"+nonce+":"+ha2))
+	} else {
+		b := make([]byte, 8)
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+		cnonce := fmt.Sprintf("%x", b)
+		nc := "00000001"
+		result += fmt.Sprintf(", qop=%v, nc=%v, cnonce=%q, response=%q", qop, nc, cnonce, h(ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2))
+	}
+	if opaque, found := params["opaque"]; found {
+		result += fmt.Sprintf(", opaque=%q", opaque)
+	}
+	if _, found := params["algorithm"]; found {
+		result += ", algorithm=MD5"
+	}
+	return
+}
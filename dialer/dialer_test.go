@@ -0,0 +1,154 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+func runProxy(t *testing.T, scheme string) (proxyURL *url.URL, target string) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "hello\n")
+			conn.Close()
+		}
+	}()
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				auth := req.Header.Get("Proxy-Authorization")
+				ok := false
+				switch scheme {
+				case "Basic":
+					ok = auth == "Basic dXNlcjpzZWNyZXQ="
+				case "Digest":
+					_, params := parseChallenge(auth)
+					ha1 := fmt.Sprintf("%x", md5.Sum([]byte("user:test:secret")))
+					ha2 := fmt.Sprintf("%x", md5.Sum([]byte("CONNECT:"+params["uri"])))
+					want := fmt.Sprintf("%x", md5.Sum([]byte(ha1+":abc:"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)))
+					ok = strings.HasPrefix(auth, "Digest ") && params["response"] == want && params["opaque"] == "xyz"
+				}
+				if !ok {
+					fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %v realm=\"test\", nonce=\"abc\", qop=\"auth\", opaque=\"xyz\"\r\nContent-Length: 0\r\n\r\n", scheme)
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	proxyURL = &url.URL{
+		Scheme: "http",
+		Host:   proxy.Addr().String(),
+	}
+	target = backend.Addr().String()
+	return
+}
+
+func testProxyAuth(t *testing.T, scheme string) {
+	proxyURL, target := runProxy(t, scheme)
+	defer func(p func(string) (*url.URL, error)) { Proxy = p }(Proxy)
+
+	Proxy = func(string) (*url.URL, error) { return proxyURL, nil }
+	if _, err := Dial(target); err == nil {
+		t.Errorf("Wanted an error when dialing without credentials")
+	}
+
+	proxyURL.User = url.UserPassword("user", "secret")
+	conn, err := Dial(target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if line != "hello\n" {
+		t.Errorf("Wanted %#v but got %#v", "hello\n", line)
+	}
+}
+
+func TestBasicProxy(t *testing.T) {
+	testProxyAuth(t, "Basic")
+}
+
+func TestDigestProxy(t *testing.T) {
+	testProxyAuth(t, "Digest")
+}
+
+func TestInterleave(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+		{IP: net.ParseIP("10.0.0.3")},
+		{IP: net.ParseIP("fe80::1")},
+		{IP: net.ParseIP("fe80::2")},
+	}
+	got := []string{}
+	for _, addr := range interleave(addrs) {
+		got = append(got, addr.String())
+	}
+	want := "fe80::1 10.0.0.1 fe80::2 10.0.0.2 10.0.0.3"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Wanted %#v but got %#v", want, strings.Join(got, " "))
+	}
+}
+
+func TestDialFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// The fake clock never fires the attempt delay, so only a failed attempt can start the next one.
+	conn, err := New().Clock(clock.NewFake(time.Now())).dialDirect(context.Background(), net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	conn.Close()
+}
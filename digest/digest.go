@@ -0,0 +1,265 @@
+// Package digest delays mail to notify of it in batches, instead of one message at a time.
+//
+//	collector := digest.New(func(d digest.Digest) error {
+//		return sendSummary(d.Mail)
+//	})
+//	defer collector.Close()
+//	quiet, _ := digest.ParseSchedule("Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00")
+//	client.MailHandler(collector.Quiet(quiet, handler))
+//
+// or, to get a digest of all mail every 15 minutes, client.MailHandler(collector.Every(15 * time.Minute)).
+//
+// Collected mail is counted as handled at once, so it is lost if the process stops before the digest is delivered,
+// unless Close is called first, or the Collector has a Store to Restore it from.
+package digest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/addr"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+// RetryDelay is how long a Collector waits before trying again after the Handler failed for a digest.
+var RetryDelay = time.Minute
+
+// Digest is the mail collected from Since until Until, oldest first.
+type Digest struct {
+	Mail  []*imap.Mail
+	Since time.Time
+	Until time.Time
+}
+
+// Sender is the mail in a digest from one address.
+type Sender struct {
+	// Address is the From address normalized by addr.Normalize, or empty for mail without a valid one.
+	Address string
+	// Name is the display name in the first message from the address.
+	Name string
+	Mail []*imap.Mail
+}
+
+// Senders groups the mail by normalized From address, in the order the senders first appear.
+func (self Digest) Senders() (result []Sender) {
+	index := map[string]int{}
+	for _, msg := range self.Mail {
+		sender := Sender{}
+		if from := addr.From(msg); from != nil {
+			sender.Address, sender.Name = addr.Normalize(from.Address), from.Name
+		}
+		i, found := index[sender.Address]
+		if !found {
+			i = len(result)
+			index[sender.Address] = i
+			result = append(result, sender)
+		}
+		result[i].Mail = append(result[i].Mail, msg)
+	}
+	return
+}
+
+// Handler is called with each digest. If it fails, the mail is kept for the next try.
+type Handler func(digest Digest) error
+
+// Store keeps the mail collected by a Collector, so that it isn't lost when the process stops before delivering it.
+type Store interface {
+	// SaveDigest replaces the saved mail by the mail of d, which is due at d.Until. A digest without mail forgets it.
+	SaveDigest(d Digest) error
+	// LoadDigest returns the saved mail, if any.
+	LoadDigest() (Digest, error)
+}
+
+// Collector collects mail, and hands it to its Handler as one Digest when the time comes.
+type Collector struct {
+	// ErrorHandler, if set, is called when the Handler fails.
+	ErrorHandler func(err error)
+	Clock        clock.Clock
+	// Store, if set, is given the collected mail whenever it changes.
+	Store Store
+
+	handler Handler
+	lock    sync.Mutex
+	// deliverLock makes digests be delivered one at a time, in order.
+	deliverLock sync.Mutex
+	pending     []*imap.Mail
+	since       time.Time
+	timer       clock.Timer
+	due         time.Time
+	// quiet holds the schedules of Quiet, which no digest is delivered during.
+	quiet []Schedule
+}
+
+func New(handler Handler) *Collector {
+	return &Collector{
+		Clock:   clock.Real,
+		handler: handler,
+	}
+}
+
+// Quiet returns a handler collecting the mail arriving during the windows of schedule until they end, and passing
+// other mail on to next. No digest of the Collector is delivered during the windows.
+func (self *Collector) Quiet(schedule Schedule, next imap.MailHandler) imap.MailHandler {
+	self.lock.Lock()
+	self.quiet = append(self.quiet, schedule)
+	self.lock.Unlock()
+	return func(msg *imap.Mail) error {
+		if end := schedule.End(self.Clock.Now()); !end.IsZero() {
+			return self.add(msg, end)
+		}
+		return next(msg)
+	}
+}
+
+// Every returns a handler collecting all mail, and delivering it as a digest interval after the first message of each
+// digest arrived.
+func (self *Collector) Every(interval time.Duration) imap.MailHandler {
+	return func(msg *imap.Mail) error {
+		return self.add(msg, self.Clock.Now().Add(interval))
+	}
+}
+
+// add collects msg, and makes the digest be delivered at due, unless it already is due earlier. If the Store fails, msg
+// is left out, and the error returned for it to be handled again.
+func (self *Collector) add(msg *imap.Mail, due time.Time) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.pending) == 0 {
+		self.since = self.Clock.Now()
+	}
+	self.pending = append(self.pending, msg)
+	self.schedule(due)
+	if err = self.save(); err != nil {
+		self.pending = self.pending[:len(self.pending)-1]
+	}
+	return
+}
+
+// save gives the collected mail to the Store, if any. It must be called with lock held.
+func (self *Collector) save() error {
+	if self.Store == nil {
+		return nil
+	}
+	return self.Store.SaveDigest(Digest{
+		Mail:  self.pending,
+		Since: self.since,
+		Until: self.due,
+	})
+}
+
+// schedule makes the digest be delivered at due, or at the end of the quiet window due falls in, unless it already is
+// due earlier. It must be called with lock held.
+func (self *Collector) schedule(due time.Time) {
+	for _, schedule := range self.quiet {
+		if end := schedule.End(due); !end.IsZero() {
+			due = end
+		}
+	}
+	if self.timer != nil && !self.due.After(due) {
+		return
+	}
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+	self.due = due
+	self.timer = self.Clock.AfterFunc(due.Sub(self.Clock.Now()), func() {
+		if err := self.Flush(); err != nil && self.ErrorHandler != nil {
+			self.ErrorHandler(err)
+		}
+	})
+}
+
+// Flush delivers the mail collected so far at once. If the Handler fails, the mail is kept and delivered again after
+// RetryDelay, together with mail collected in the meantime.
+func (self *Collector) Flush() (err error) {
+	self.deliverLock.Lock()
+	defer self.deliverLock.Unlock()
+	self.lock.Lock()
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+	digest := Digest{
+		Mail:  self.pending,
+		Since: self.since,
+		Until: self.Clock.Now(),
+	}
+	self.pending = nil
+	self.lock.Unlock()
+	if len(digest.Mail) == 0 {
+		return
+	}
+	if err = self.handler(digest); err == nil {
+		// The Store forgets the delivered mail, and keeps what was collected during the delivery.
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		return self.save()
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pending = append(digest.Mail, self.pending...)
+	self.since = digest.Since
+	self.schedule(self.Clock.Now().Add(RetryDelay))
+	if e := self.save(); e != nil && self.ErrorHandler != nil {
+		self.ErrorHandler(e)
+	}
+	return
+}
+
+// Stop stops the Collector without delivering the mail collected so far, and returns it, due at Until, for another
+// Collector to Take. The Store keeps it.
+func (self *Collector) Stop() (result Digest) {
+	self.deliverLock.Lock()
+	defer self.deliverLock.Unlock()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+	result = Digest{
+		Mail:  self.pending,
+		Since: self.since,
+		Until: self.due,
+	}
+	self.pending = nil
+	return
+}
+
+// Take collects the mail of d, like the mail returned by Stop, and makes it be delivered at d.Until, unless the digest
+// already is due earlier.
+func (self *Collector) Take(d Digest) error {
+	if len(d.Mail) == 0 {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.pending) == 0 || d.Since.Before(self.since) {
+		self.since = d.Since
+	}
+	self.pending = append(append([]*imap.Mail{}, d.Mail...), self.pending...)
+	self.schedule(d.Until)
+	return self.save()
+}
+
+// Restore collects the mail saved in the Store, to deliver it when it was due, or at once if that has passed.
+func (self *Collector) Restore() (err error) {
+	d, err := self.Store.LoadDigest()
+	if err != nil {
+		return
+	}
+	return self.Take(d)
+}
+
+// Close delivers the mail collected so far, and stops the Collector from delivering more on its own.
+func (self *Collector) Close() (err error) {
+	err = self.Flush()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package digest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+func TestSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	schedule.Location = time.UTC
+	at := func(day, hour, minute int) time.Time {
+		// 2020-06-01 is a Monday.
+		return time.Date(2020, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		t   time.Time
+		end time.Time
+	}{
+		{at(1, 12, 0), time.Time{}},
+		{at(1, 21, 59), time.Time{}},
+		{at(1, 22, 0), at(2, 7, 0)},
+		{at(2, 6, 59), at(2, 7, 0)},
+		{at(2, 7, 0), time.Time{}},
+		// Friday night continues into the weekend, but Monday morning isn't covered by Sunday.
+		{at(5, 23, 0), at(8, 0, 0)},
+		{at(7, 12, 0), at(8, 0, 0)},
+		{at(8, 0, 0), time.Time{}},
+	} {
+		if end := schedule.End(test.t); !end.Equal(test.end) {
+			t.Errorf("Wanted %v to end at %v, got %v", test.t, test.end, end)
+		}
+	}
+	always, err := ParseSchedule("00:00-24:00")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if end := always.End(at(1, 12, 0)); end.Sub(at(1, 12, 0)) < 7*24*time.Hour {
+		t.Errorf("Wanted a schedule covering all time to end in a week, got %v", end)
+	}
+	for _, spec := range []string{"Mon 22:00", "Foo 22:00-07:00", "22:00-25:00", "Mon Tue 22:00-07:00"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("Wanted %q to be invalid", spec)
+		}
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 21, 0, 0, 0, time.UTC))
+	digests := make(chan Digest, 1)
+	failing := true
+	collector := New(func(d Digest) error {
+		if failing {
+			failing = false
+			return fmt.Errorf("failing")
+		}
+		digests <- d
+		return nil
+	})
+	collector.Clock = fake
+	collector.ErrorHandler = func(err error) {}
+	delivered := []uint32{}
+	handler := collector.Quiet(Schedule{Windows: []Window{{Start: 22 * time.Hour, End: 7 * time.Hour}}, Location: time.UTC}, func(msg *imap.Mail) error {
+		delivered = append(delivered, msg.UID)
+		return nil
+	})
+	handler(&imap.Mail{UID: 1})
+	fake.Advance(2 * time.Hour)
+	handler(&imap.Mail{UID: 2})
+	fake.Advance(time.Hour)
+	handler(&imap.Mail{UID: 3})
+	if fmt.Sprint(delivered) != "[1]" {
+		t.Errorf("Wanted only the mail before the window to be delivered, got %v", delivered)
+	}
+	fake.Advance(7 * time.Hour)
+	fake.BlockUntil(1)
+	fake.Advance(RetryDelay)
+	select {
+	case d := <-digests:
+		if len(d.Mail) != 2 || d.Mail[0].UID != 2 || d.Mail[1].UID != 3 {
+			t.Errorf("Wanted 2 and 3 in the digest, got %+v", d.Mail)
+		}
+		if want := time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC); !d.Since.Equal(want) {
+			t.Errorf("Wanted the digest to start at %v, got %v", want, d.Since)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No digest delivered")
+	}
+	handler(&imap.Mail{UID: 4})
+	if fmt.Sprint(delivered) != "[1 4]" {
+		t.Errorf("Wanted the mail after the window to be delivered, got %v", delivered)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	digests := make(chan Digest, 1)
+	collector := New(func(d Digest) error {
+		digests <- d
+		return nil
+	})
+	collector.Clock = fake
+	handler := collector.Every(15 * time.Minute)
+	for _, raw := range []string{
+		"From: Alice <alice@example.com>\r\nSubject: one\r\n\r\nbody",
+		"From: bob@example.com\r\nSubject: two\r\n\r\nbody",
+		"From: Alice <ALICE@example.com>\r\nSubject: three\r\n\r\nbody",
+	} {
+		msg, err := imap.Parse(imap.Message{Body: []byte(raw)})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		handler(msg)
+		fake.Advance(5 * time.Minute)
+	}
+	select {
+	case d := <-digests:
+		senders := d.Senders()
+		if len(d.Mail) != 3 || len(senders) != 2 {
+			t.Fatalf("Wanted 3 messages from 2 senders, got %v from %+v", len(d.Mail), senders)
+		}
+		if senders[0].Address != "alice@example.com" || senders[0].Name != "Alice" || len(senders[0].Mail) != 2 || senders[0].Mail[1].GetHeader("Subject") != "three" {
+			t.Errorf("Wanted both messages from Alice grouped, got %+v", senders[0])
+		}
+		if senders[1].Address != "bob@example.com" || len(senders[1].Mail) != 1 {
+			t.Errorf("Wanted one message from Bob, got %+v", senders[1])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No digest delivered")
+	}
+	if err := collector.Close(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+type memoryStore struct {
+	saved Digest
+}
+
+func (self *memoryStore) SaveDigest(d Digest) error {
+	self.saved = Digest{Mail: append([]*imap.Mail{}, d.Mail...), Since: d.Since, Until: d.Until}
+	return nil
+}
+
+func (self *memoryStore) LoadDigest() (Digest, error) {
+	return self.saved, nil
+}
+
+func TestStore(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	store := &memoryStore{}
+	digests := make(chan Digest, 1)
+	collector := New(func(d Digest) error {
+		digests <- d
+		return nil
+	})
+	collector.Clock = fake
+	collector.Store = store
+	handler := collector.Every(15 * time.Minute)
+	handler(&imap.Mail{UID: 1})
+	handler(&imap.Mail{UID: 2})
+	if len(store.saved.Mail) != 2 || !store.saved.Until.Equal(fake.Now().Add(15*time.Minute)) {
+		t.Fatalf("Wanted the collected mail saved, got %+v", store.saved)
+	}
+	// Stopping hands the mail over without delivering it, and the Store keeps it.
+	stopped := collector.Stop()
+	if len(stopped.Mail) != 2 || len(store.saved.Mail) != 2 {
+		t.Fatalf("Wanted 2 messages stopped and kept, got %+v and %+v", stopped, store.saved)
+	}
+	fake.Advance(time.Hour)
+	select {
+	case d := <-digests:
+		t.Fatalf("Wanted nothing delivered after stopping, got %+v", d)
+	default:
+	}
+	// A new Collector restores the saved mail, and delivers it at once since it is overdue.
+	restored := New(func(d Digest) error {
+		digests <- d
+		return nil
+	})
+	restored.Clock = fake
+	restored.Store = store
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(0)
+	select {
+	case d := <-digests:
+		if len(d.Mail) != 2 || d.Mail[0].UID != 1 || d.Mail[1].UID != 2 {
+			t.Errorf("Wanted 1 and 2 in the digest, got %+v", d.Mail)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No digest delivered")
+	}
+	if err := restored.Close(); err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(store.saved.Mail) != 0 {
+		t.Errorf("Wanted the delivered mail forgotten, got %+v", store.saved)
+	}
+}
+
+func TestQuietEvery(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		arrivals []time.Time
+		due      time.Time
+	}{
+		{[]time.Time{at(1, 12, 0)}, at(1, 12, 15)},
+		{[]time.Time{at(1, 21, 40)}, at(1, 21, 55)},
+		{[]time.Time{at(1, 21, 50)}, at(2, 7, 0)},
+		{[]time.Time{at(1, 23, 0)}, at(2, 7, 0)},
+		{[]time.Time{at(1, 21, 50), at(1, 23, 0)}, at(2, 7, 0)},
+		{[]time.Time{at(2, 6, 59)}, at(2, 7, 0)},
+		{[]time.Time{at(2, 7, 0)}, at(2, 7, 15)},
+	} {
+		fake := clock.NewFake(test.arrivals[0])
+		collector := New(func(d Digest) error {
+			return nil
+		})
+		collector.Clock = fake
+		handler := collector.Quiet(Schedule{Windows: []Window{{Start: 22 * time.Hour, End: 7 * time.Hour}}, Location: time.UTC}, collector.Every(15*time.Minute))
+		for _, arrival := range test.arrivals {
+			fake.Advance(arrival.Sub(fake.Now()))
+			handler(&imap.Mail{UID: 1})
+		}
+		if due := collector.Stop().Until; !due.Equal(test.due) {
+			t.Errorf("Wanted mail arriving at %v to be due at %v, got %v", test.arrivals, test.due, due)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package digest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily period from Start to End after midnight, on the given Days, or every day if there are none. A
+// window ending before it starts ends on the next day, so 22:00-07:00 on Friday lasts until Saturday morning.
+type Window struct {
+	Days       []time.Weekday
+	Start, End time.Duration
+}
+
+// Schedule is a set of windows in Location, or the local time zone if nil.
+type Schedule struct {
+	Windows  []Window
+	Location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		weekdays[strings.ToLower(day.String()[:3])] = day
+	}
+}
+
+// ParseSchedule parses windows separated by semicolons, each being an optional comma separated list of days or ranges
+// of days followed by a period, like "Mon-Fri 22:00-07:00; Sat,Sun 00:00-24:00".
+func ParseSchedule(spec string) (result Schedule, err error) {
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			err = fmt.Errorf("digest: invalid window %q", strings.TrimSpace(part))
+			return
+		}
+		window := Window{}
+		if len(fields) == 2 {
+			if window.Days, err = parseDays(fields[0]); err != nil {
+				return
+			}
+		}
+		period := strings.SplitN(fields[len(fields)-1], "-", 2)
+		if len(period) != 2 {
+			err = fmt.Errorf("digest: invalid period %q", fields[len(fields)-1])
+			return
+		}
+		if window.Start, err = parseClock(period[0]); err != nil {
+			return
+		}
+		if window.End, err = parseClock(period[1]); err != nil {
+			return
+		}
+		result.Windows = append(result.Windows, window)
+	}
+	return
+}
+
+func parseDays(spec string) (result []time.Weekday, err error) {
+	for _, days := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(days, "-", 2)
+		first, found := weekdays[strings.ToLower(bounds[0])]
+		last := first
+		if found && len(bounds) == 2 {
+			last, found = weekdays[strings.ToLower(bounds[1])]
+		}
+		if !found {
+			err = fmt.Errorf("digest: invalid days %q", days)
+			return
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			result = append(result, day)
+			if day == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+func parseClock(spec string) (result time.Duration, err error) {
+	var hours, minutes int
+	if _, err = fmt.Sscanf(spec, "%d:%d", &hours, &minutes); err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		err = fmt.Errorf("digest: invalid time %q", spec)
+		return
+	}
+	result = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	return
+}
+
+func (self Window) on(day time.Weekday) bool {
+	if len(self.Days) == 0 {
+		return true
+	}
+	for _, d := range self.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// End returns when the windows containing t end, following windows that start as others end for at most a week, or the
+// zero time if t is outside all windows.
+func (self Schedule) End(t time.Time) (result time.Time) {
+	location := self.Location
+	if location == nil {
+		location = time.Local
+	}
+	for at := t.In(location); at.Sub(t) < 7*24*time.Hour; {
+		end := self.end(at)
+		if !end.After(at) {
+			return
+		}
+		result, at = end, end
+	}
+	return
+}
+
+// clockTime returns the time offset after midnight of the date of day, in wall clock time.
+func clockTime(day time.Time, offset time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, int(offset/time.Minute), 0, 0, day.Location())
+}
+
+// end returns the latest end of the windows containing t, or t if there are none.
+func (self Schedule) end(t time.Time) (result time.Time) {
+	result = t
+	for _, window := range self.Windows {
+		// Windows containing t started today or yesterday.
+		for days := -1; days <= 0; days++ {
+			day := time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, t.Location())
+			if !window.on(day.Weekday()) {
+				continue
+			}
+			start, end := clockTime(day, window.Start), clockTime(day, window.End)
+			if window.End <= window.Start {
+				end = clockTime(day, window.End+24*time.Hour)
+			}
+			if !t.Before(start) && t.Before(end) && end.After(result) {
+				result = end
+			}
+		}
+	}
+	return
+}
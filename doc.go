@@ -0,0 +1,18 @@
+// Package gmail receives and sends the mail of a Gmail account. A Client learns of new mail from the Gmail XMPP
+// notifications, or another notify.Notifier, fetches it over IMAP and gives it to its handlers, and sends mail over
+// SMTP.
+//
+//	client := gmail.New("user@gmail.com", "app password").MailHandler(func(msg *imap.Mail) error {
+//		fmt.Println(msg.GetHeader("Subject"))
+//		return nil
+//	})
+//	if _, err := client.Start(); err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//
+// From v1 on, the exported API of this package and of the xmpp, imap, mimeutil and sinks packages is stable, and only
+// changes in backwards compatible ways until a new major version. Those are the client facade, the XMPP notification
+// client, the IMAP mail store with the Mail type, the MIME parsing of the fetched mail, and the handlers forwarding it.
+// The other packages may still change between minor versions.
+package gmail
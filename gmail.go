@@ -1,80 +1,360 @@
 package gmail
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"mime"
+	"io"
 	"net/smtp"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
-	"code.google.com/p/mahonia"
-
-	"github.com/jhillyerd/go.enmime"
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/compose"
+	"github.com/zond/gmail/connstate"
 	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/mimeutil"
+	"github.com/zond/gmail/notify"
+	"github.com/zond/gmail/outbox"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/quota"
+	"github.com/zond/gmail/rest"
+	"github.com/zond/gmail/retry"
+	"github.com/zond/gmail/rules"
+	"github.com/zond/gmail/stats"
+	"github.com/zond/gmail/watch"
 	"github.com/zond/gmail/xmpp"
 )
 
 func DecodeText(body, mimeContent string) string {
-	_, params, err := mime.ParseMediaType(mimeContent)
-	if err != nil {
-		return body
-	}
-	charset := params["charset"]
-	if charset == "" {
-		return body
-	}
-	decoder := mahonia.NewDecoder(charset)
-	if decoder == nil {
-		return body
-	}
-	return decoder.ConvertString(body)
+	return mimeutil.DecodeText(body, mimeContent)
+}
+
+var (
+	ErrAlreadyStarted = errors.New("gmail: client already started")
+	ErrClosed         = errors.New("gmail: client closed while starting")
+	ErrNoReplyHandler = errors.New("gmail: no reply handler to watch replies with")
+	ErrNotSimulated   = errors.New("gmail: mail can only be injected into simulated clients")
+)
+
+// ErrForeignSender is returned by the Outbox of a Client for messages from another address than the account, which
+// the client can't send as, nor count against the SendLimits of. It is outbox.Permanent.
+type ErrForeignSender struct {
+	From    string
+	Account string
+}
+
+func (self ErrForeignSender) Error() string {
+	return fmt.Sprintf("gmail: can't send mail from %v as %v", self.From, self.Account)
+}
+
+func (self ErrForeignSender) Permanent() {}
+
+// MonitorInterval is how often the folders without push notifications, like spam, are checked.
+var MonitorInterval = 5 * time.Minute
+
+// monitorKeywords are appended to imap.OldKeyword to mark the mail the monitors handled. Gmail shares keywords between
+// all the folders of a message, so mail handled by a monitor, like a message sent to oneself, would otherwise never be
+// handled in the inbox.
+var monitorKeywords = map[string]string{
+	imap.SpamMailbox:  "_SPAM",
+	imap.TrashMailbox: "_TRASH",
+	imap.SentMailbox:  "_SENT",
+}
+
+// RetryMin and RetryMax limit the delay before inbox mail is handled again after the mail handler failed, for clients
+// without a FetchPolicy or DeliveryPolicy. The delay doubles for each consecutive failure.
+var (
+	RetryMin = 30 * time.Second
+	RetryMax = 30 * time.Minute
+)
+
+// ScanPolicy decides which of the mail already in the inbox when the client starts is handled.
+type ScanPolicy struct {
+	since     time.Time
+	fromStart bool
+}
+
+var (
+	// ReportExistingUnseen handles all inbox mail not handled before, however old.
+	ReportExistingUnseen = ScanPolicy{}
+	// OnlyNewAfterStart only handles mail received after Start, and marks the rest as handled.
+	OnlyNewAfterStart = ScanPolicy{fromStart: true}
+)
+
+// SinceTime only handles mail received after t, and marks the rest as handled.
+func SinceTime(t time.Time) ScanPolicy {
+	return ScanPolicy{since: t}
 }
 
 type Client struct {
 	account      string
-	password     string
+	credentials  *auth.Swappable
 	xmppClient   *xmpp.Client
 	imapClient   *imap.Client
+	notifier     notify.Notifier
 	mailHandler  imap.MailHandler
 	errorHandler func(e error)
+	stats        *stats.Stats
+	monitors     map[string]imap.MailHandler
+	checkLabels  bool
+	lazyIMAP     bool
+	readOnly     bool
+	simulated    Simulator
+	scanPolicy   ScanPolicy
+	maxInitial   int
+	scoped       bool
+	stopLock     sync.Mutex
+	stop         chan struct{}
+	// retrying are the scheduled retries of each mailbox, guarded by stopLock.
+	retrying map[string]*retrying
+	// lastNotification is when the last new mail notification arrived, and senderPolicy whose inbox mail is handled,
+	// both guarded by stopLock.
+	lastNotification time.Time
+	senderPolicy     rules.SenderPolicy
+	authHandler      func(e auth.Event)
+	classifiers      []imap.Classifier
+	sendLimiter      *quota.Limiter
+	sendLimitStore   quota.Store
+	watcher          *watch.Watcher
+	// latencyHandler is called with the timing of each message handled after a notification.
+	latencyHandler func(latency stats.Latency)
+	// fetchPolicy and deliveryPolicy decide the delays before a mailbox is checked again.
+	fetchPolicy    retry.Policy
+	deliveryPolicy retry.Policy
+	clock          clock.Clock
 }
 
 func New(account, password string) (result *Client) {
 	result = &Client{
-		account:    account,
-		password:   password,
+		account: account,
+		credentials: auth.NewSwappable(auth.Static{
+			User:     account,
+			Password: password,
+		}),
 		xmppClient: xmpp.New(account, password),
 		imapClient: imap.New(account, password),
-		mailHandler: func(msg *enmime.MIMEBody) error {
+		mailHandler: func(msg *imap.Mail) error {
 			fmt.Println("Got", msg)
 			return nil
 		},
 		errorHandler: func(e error) {
 			fmt.Println("Error", e)
 		},
+		stats:    stats.New(time.Local),
+		monitors: map[string]imap.MailHandler{},
+		retrying: map[string]*retrying{},
+		clock:    clock.Real,
 	}
-	result.xmppClient.MailHandler(func() {
-		if err := result.imapClient.HandleNew(result.mailHandler); err != nil {
-			result.errorHandler(err)
-		}
-	}).ErrorHandler(func(e error) {
+	result.notifier = notify.XMPP(result.xmppClient)
+	result.xmppClient.ErrorHandler(func(e error) {
+		result.errorHandler(e)
+	})
+	result.imapClient.UnparsableHandler(func(fetched imap.Message, e error) {
 		result.errorHandler(e)
 	})
 	return
 }
 
+// notified checks the inbox after the notifier told that new mail may have arrived.
+func (self *Client) notified() {
+	if err := self.handleNotification(); err != nil {
+		self.errorHandler(err)
+	}
+}
+
+// handleNotification records a new mail notification, and checks the inbox.
+func (self *Client) handleNotification() error {
+	notified := time.Now()
+	self.stopLock.Lock()
+	self.lastNotification = notified
+	self.stopLock.Unlock()
+	return self.checkInbox(notified)
+}
+
+// xoauth2 is the Google XOAUTH2 SMTP authentication.
+type xoauth2 auth.Credentials
+
+func (self xoauth2) Start(server *smtp.ServerInfo) (proto string, toServer []byte, err error) {
+	return "XOAUTH2", []byte(fmt.Sprintf("user=%v\x01auth=Bearer %v\x01\x01", self.User, self.Token)), nil
+}
+
+// Next answers the error challenge sent on failure with an empty response, which makes the server send the failure.
+func (self xoauth2) Next(fromServer []byte, more bool) (toServer []byte, err error) {
+	if more {
+		toServer = []byte{}
+	}
+	return
+}
+
+const smtpHost = "smtp.gmail.com"
+
 var AddrReg = regexp.MustCompile("(?i)[=A-Z0-9._%+-]+@[A-Z0-9.-]+\\.[A-Z]{2,4}")
 
 func (self *Client) Send(from, subject, message string, recips ...string) (err error) {
 	body := fmt.Sprintf("Content-Type: text/plain; charset=\"utf-8\"\r\nReply-To: %v\r\nFrom: %v\r\nTo: %v\r\nSubject: %v\r\n\r\n%v", from, from, strings.Join(recips, ", "), subject, message)
-	auth := smtp.PlainAuth("", self.account, self.password, "smtp.gmail.com")
 	actualRecips := []string{}
 	for _, recip := range recips {
 		if match := AddrReg.FindString(recip); match != "" {
 			actualRecips = append(actualRecips, match)
 		}
 	}
-	return smtp.SendMail("smtp.gmail.com:587", auth, self.account, actualRecips, []byte(body))
+	return self.SendRaw(actualRecips, []byte(body))
+}
+
+// SendLimits makes Send and SendRaw fail with quota.ErrQuotaExceeded instead of sending more than limits allow, like
+// quota.Gmail. Only the mail sent by this client is counted, since it started, unless SendLimitStore is given a store.
+func (self *Client) SendLimits(limits quota.Limits) *Client {
+	self.sendLimiter = quota.New(limits)
+	if self.sendLimitStore != nil {
+		self.sendLimiter.Persist(self.sendLimitStore, self.account)
+	}
+	return self
+}
+
+// SendLimitStore makes the SendLimits count the mail sent by the account in store, like boltstore.Store, so that
+// restarting doesn't reset them.
+func (self *Client) SendLimitStore(store quota.Store) *Client {
+	self.sendLimitStore = store
+	if self.sendLimiter != nil {
+		self.sendLimiter.Persist(store, self.account)
+	}
+	return self
+}
+
+// SendRaw sends body, a whole message with headers, to the recipient addresses.
+func (self *Client) SendRaw(recips []string, body []byte) (err error) {
+	if self.readOnly {
+		return imap.ErrReadOnly
+	}
+	if self.sendLimiter != nil {
+		if err = self.sendLimiter.Reserve(len(recips)); err != nil {
+			return
+		}
+		// Mail that wasn't sent mustn't use up the quota.
+		defer func() {
+			if err != nil {
+				self.sendLimiter.Release(len(recips))
+			}
+		}()
+	}
+	creds, err := self.credentials.Credentials()
+	if err != nil {
+		return
+	}
+	return self.sendMail(creds, recips, body)
+}
+
+// SendMessage sends msg to its To and Cc addresses, setting its MessageID and Date if they are empty.
+func (self *Client) SendMessage(msg *compose.Message) (err error) {
+	recips, err := msg.Recipients()
+	if err != nil {
+		return
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return
+	}
+	return self.SendRaw(recips, body)
+}
+
+// ReplyHandler will be called when replies arrive in the conversations of the messages sent with SendAndWatch, after
+// the mail handler handled them. See the watch package.
+func (self *Client) ReplyHandler(f func(e watch.ThreadUpdated)) *Client {
+	self.watcher = watch.New(f)
+	return self
+}
+
+// SendAndWatch sends msg like SendMessage, and then reports the replies in its conversation to the ReplyHandler until
+// the given time.
+func (self *Client) SendAndWatch(msg *compose.Message, until time.Time) (err error) {
+	if self.watcher == nil {
+		return ErrNoReplyHandler
+	}
+	if err = self.SendMessage(msg); err != nil {
+		return
+	}
+	self.watcher.Watch(msg.MessageID, until)
+	return
+}
+
+// Outbox returns an outbox.Outbox queueing mail in store, and sending it with SendRaw once started. Messages from
+// another address than the account fail with ErrForeignSender.
+func (self *Client) Outbox(store outbox.Store) *outbox.Outbox {
+	return outbox.New(store, func(msg outbox.Message) error {
+		creds, err := self.credentials.Credentials()
+		if err != nil {
+			return err
+		}
+		if from := AddrReg.FindString(msg.From); from != "" && !strings.EqualFold(from, creds.User) {
+			return ErrForeignSender{From: msg.From, Account: creds.User}
+		}
+		return self.SendRaw(msg.To, msg.Body)
+	})
+}
+
+// sendMail is smtp.SendMail, but reports the authentication to the auth handler.
+func (self *Client) sendMail(creds auth.Credentials, recips []string, body []byte) (err error) {
+	client, err := smtp.Dial(smtpHost + ":587")
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	if err = client.StartTLS(&tls.Config{ServerName: smtpHost, MinVersion: tls.VersionTLS12}); err != nil {
+		return
+	}
+	var smtpAuth smtp.Auth = smtp.PlainAuth("", creds.User, creds.Password, smtpHost)
+	mechanism := "PLAIN"
+	if creds.Token != "" {
+		smtpAuth, mechanism = xoauth2(creds), "XOAUTH2"
+	}
+	err = client.Auth(smtpAuth)
+	if self.authHandler != nil {
+		self.authHandler(auth.NewEvent("smtp", smtpHost, creds.User, mechanism, err))
+	}
+	if err != nil {
+		return
+	}
+	if err = client.Mail(creds.User); err != nil {
+		return
+	}
+	for _, recip := range recips {
+		if err = client.Rcpt(recip); err != nil {
+			return
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(body); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return client.Quit()
+}
+
+// AuthHandler will be called after each XMPP, IMAP or SMTP authentication attempt, successful or not.
+func (self *Client) AuthHandler(f func(e auth.Event)) *Client {
+	self.authHandler = f
+	self.xmppClient.AuthHandler(f)
+	self.imapClient.AuthHandler(f)
+	return self
+}
+
+// UpdateCredentials replaces the credentials provider for XMPP, IMAP and SMTP.
+// Established connections are kept, the new credentials are used the next time each of them logs in.
+func (self *Client) UpdateCredentials(provider auth.Provider) *Client {
+	self.credentials.Swap(provider)
+	self.xmppClient.UpdateCredentials(provider)
+	self.imapClient.UpdateCredentials(provider)
+	return self
 }
 
 func (self *Client) Debug() *Client {
@@ -87,22 +367,578 @@ func (self *Client) ErrorHandler(f func(e error)) *Client {
 	return self
 }
 
+// TLSVersions limits the TLS versions negotiated on both the XMPP and IMAP connections.
+// Both default to TLS 1.2 and up.
+func (self *Client) TLSVersions(min, max uint16) *Client {
+	self.xmppClient.TLSVersions(min, max)
+	self.imapClient.TLSVersions(min, max)
+	return self
+}
+
+// CipherSuites limits the TLS 1.0-1.2 cipher suites offered on both the XMPP and IMAP connections.
+func (self *Client) CipherSuites(suites ...uint16) *Client {
+	self.xmppClient.CipherSuites(suites...)
+	self.imapClient.CipherSuites(suites...)
+	return self
+}
+
+// TLSSessionCache lets the XMPP and IMAP reconnects resume earlier TLS sessions stored in cache. Give every account its
+// own cache to keep their sessions apart.
+func (self *Client) TLSSessionCache(cache tls.ClientSessionCache) *Client {
+	self.xmppClient.TLSSessionCache(cache)
+	self.imapClient.TLSSessionCache(cache)
+	return self
+}
+
+// TLSHandler will be called with the negotiated connection state after each XMPP or IMAP handshake.
+// Returning an error aborts that connection.
+func (self *Client) TLSHandler(f func(state tls.ConnectionState) error) *Client {
+	self.xmppClient.TLSHandler(f)
+	self.imapClient.TLSHandler(f)
+	return self
+}
+
+// InitialScan decides which of the mail already in the inbox is handled, ReportExistingUnseen by default. The policy
+// applies to the monitored folders as well.
+func (self *Client) InitialScan(policy ScanPolicy) *Client {
+	self.scanPolicy = policy
+	return self
+}
+
+// MaxInitialMessages limits the first inbox check after each Start to the n newest messages. The older ones are marked
+// as handled, and the handled ones have imap.Mail#Truncated set.
+func (self *Client) MaxInitialMessages(n int) *Client {
+	self.maxInitial = n
+	return self
+}
+
+// UnseenSince makes the inbox checks only look for mail received within d. See imap.Client#UnseenSince.
+func (self *Client) UnseenSince(d time.Duration) *Client {
+	self.imapClient.UnseenSince(d)
+	return self
+}
+
+// Folders returns the localized names of the Gmail system folders. See imap.Client#Folders.
+func (self *Client) Folders() (imap.Folders, error) {
+	return self.imapClient.Folders()
+}
+
+// LazyIMAP makes Start only set up the XMPP connection, and leaves connecting to IMAP until the first new mail
+// notification, monitor check or operation needs it. Mail already in the inbox is then handled when new mail arrives.
+func (self *Client) LazyIMAP() *Client {
+	self.lazyIMAP = true
+	return self
+}
+
+// ReadOnly makes the client refuse to send or modify mail, see imap.Client#ReadOnly. Mail handlers can still queue
+// changes, like MarkRead, but handling the message then fails with imap.ErrReadOnly.
+func (self *Client) ReadOnly() *Client {
+	self.readOnly = true
+	self.imapClient.ReadOnly()
+	return self
+}
+
+// Checkpoint makes the client remember the last message handled in each mailbox in c, see imap.Client#Checkpoint. With
+// a persistent Checkpoint implementing imap.Unacked, like boltstore.Store, the mail the handlers failed for is retried
+// after restarting too, even by read-only clients.
+func (self *Client) Checkpoint(c imap.Checkpoint) *Client {
+	self.imapClient.Checkpoint(c)
+	return self
+}
+
+// Simulator keeps the inbox of a simulated client in memory. The simulate package has one.
+type Simulator interface {
+	// Open opens the inbox, like the MailStore of an imap.Client.
+	Open(ctx context.Context) (imap.MailStore, error)
+	// DeliverMessage adds msg to the inbox.
+	DeliverMessage(msg imap.Message) (uid uint32)
+}
+
+// Simulate makes the client keep its inbox in inbox instead of connecting to Gmail, and only notice the new mail given
+// to InjectMail, to let applications test their mail handlers without network access. Only the inbox is simulated, so
+// the handlers of other folders, like SpamHandler, are not called, and sending mail still needs Gmail. See the simulate
+// package.
+func (self *Client) Simulate(inbox Simulator) *Client {
+	self.simulated = inbox
+	self.imapClient.MailStore(inbox.Open)
+	self.notifier = notify.NewManual()
+	return self
+}
+
+// InjectMail delivers msg, with its Body, Flags, Labels and InternalDate, or the current time if that is zero, to the
+// inbox of a simulated client, and notifies the client of it. The mail then goes through the sender policy,
+// classifiers, mail handler and statistics like any new mail, and is marked as handled. It returns the error of the
+// inbox check, like an imap.DeliveryError if the mail handler failed, and ErrNotSimulated unless Simulate was called.
+func (self *Client) InjectMail(msg imap.Message) (err error) {
+	if self.simulated == nil {
+		return ErrNotSimulated
+	}
+	if msg.InternalDate.IsZero() {
+		msg.InternalDate = time.Now()
+	}
+	self.simulated.DeliverMessage(msg)
+	return self.handleNotification()
+}
+
+// RESTFallback makes the client fetch and modify mail using the Gmail API when IMAP is disabled for the account, which
+// needs OAuth2 credentials with a scope allowing it. See the rest package.
+func (self *Client) RESTFallback() *Client {
+	return self.RESTFallbackWith(rest.New(self.credentials))
+}
+
+// RESTFallbackWith is RESTFallback using api, like one with its own HTTP client.
+func (self *Client) RESTFallbackWith(api *rest.API) *Client {
+	self.imapClient.Fallback(api.Open)
+	return self
+}
+
+// Clock replaces the clock timing the monitored folders, the retries and the IMAP sessions, to let tests drive them.
+func (self *Client) Clock(c clock.Clock) *Client {
+	self.clock = c
+	self.imapClient.Clock(c)
+	return self
+}
+
+// ParkIMAPAfter keeps the IMAP sessions logged in between operations, and logs them out after idle without use. See
+// imap.Client#ParkAfter.
+func (self *Client) ParkIMAPAfter(idle time.Duration) *Client {
+	self.imapClient.ParkAfter(idle)
+	return self
+}
+
+// IMAPSessionStats returns how often the inbox IMAP session was parked and resumed.
+func (self *Client) IMAPSessionStats() imap.SessionStats {
+	return self.imapClient.SessionStats()
+}
+
+// XMPPReconnectPolicy decides the delays between attempts to reconnect the XMPP connection after it was lost.
+func (self *Client) XMPPReconnectPolicy(policy retry.Policy) *Client {
+	self.xmppClient.ReconnectPolicy(policy)
+	return self
+}
+
+// XMPPEndpoints replaces the server addresses tried in turn when connecting for notifications, see xmpp.DefaultEndpoints.
+func (self *Client) XMPPEndpoints(endpoints ...xmpp.Endpoint) *Client {
+	self.xmppClient.Endpoints(endpoints...)
+	return self
+}
+
+// XMPPCharsetReader lets the notification stream declare encodings other than UTF-8, see xmpp.Client.CharsetReader.
+func (self *Client) XMPPCharsetReader(f func(charset string, input io.Reader) (io.Reader, error)) *Client {
+	self.xmppClient.CharsetReader(f)
+	return self
+}
+
+// XMPPEntities lets the notification stream use the named entities in entities, see xmpp.Client.Entities.
+func (self *Client) XMPPEntities(entities map[string]string) *Client {
+	self.xmppClient.Entities(entities)
+	return self
+}
+
+// XMPPResource makes the notification connection bind resource, renamed after conflicts with other sessions, see
+// xmpp.Client.Resource.
+func (self *Client) XMPPResource(resource string) *Client {
+	self.xmppClient.Resource(resource)
+	return self
+}
+
+// IMAPReconnectPolicy makes each IMAP operation retry connecting when it fails, instead of failing at once.
+func (self *Client) IMAPReconnectPolicy(policy retry.Policy) *Client {
+	self.imapClient.ReconnectPolicy(policy)
+	return self
+}
+
+// FetchPolicy decides the delays before inbox mail is checked again after the IMAP server timed out.
+func (self *Client) FetchPolicy(policy retry.Policy) *Client {
+	self.fetchPolicy = policy
+	return self
+}
+
+// DeliveryPolicy decides the delays before inbox mail is handled again after the mail handler failed for it.
+func (self *Client) DeliveryPolicy(policy retry.Policy) *Client {
+	self.deliveryPolicy = policy
+	return self
+}
+
+// MailboxResetHandler will be called when Gmail renumbered the UIDs of the inbox, so that any UIDs seen before are stale.
+func (self *Client) MailboxResetHandler(f func(reset imap.MailboxReset)) *Client {
+	self.imapClient.MailboxResetHandler(f)
+	return self
+}
+
+// Notifier replaces how the client notices new mail, which is using the Gmail XMPP notifications by default. See the
+// notify package. It must be called before Start.
+func (self *Client) Notifier(notifier notify.Notifier) *Client {
+	self.notifier = notifier
+	return self
+}
+
+// NotifierEnv returns what notify.New needs to build notifiers for the account and mailbox of the client, so it must be
+// called after Scope.
+func (self *Client) NotifierEnv() notify.Env {
+	return notify.Env{
+		XMPP:        self.xmppClient,
+		IMAP:        self.imapClient,
+		Credentials: self.credentials,
+		ErrorHandler: func(e error) {
+			self.errorHandler(e)
+		},
+	}
+}
+
+// State is the state of the notifier, which notices new mail.
+func (self *Client) State() connstate.State {
+	return self.notifier.State()
+}
+
+// LastNotification returns when Gmail last notified the client of new mail, or the zero time if it hasn't since the
+// client was created.
+func (self *Client) LastNotification() time.Time {
+	self.stopLock.Lock()
+	defer self.stopLock.Unlock()
+	return self.lastNotification
+}
+
+// Stats returns statistics about the inbox mail handled without error since the client was created.
+func (self *Client) Stats() *stats.Stats {
+	return self.stats
+}
+
+// handleMail returns the mail handler for inbox mail found after a notification arriving at notified, or a zero
+// time if the check wasn't caused by a notification.
+func (self *Client) handleMail(notified time.Time) imap.MailHandler {
+	handler := self.stats.Handler(self.mailHandler)
+	if self.watcher != nil {
+		handler = self.watcher.Handler(handler)
+	}
+	if len(self.classifiers) > 0 {
+		handler = imap.Classify(handler, self.classifiers...)
+	}
+	return func(msg *imap.Mail) (err error) {
+		self.stopLock.Lock()
+		policy := self.senderPolicy
+		self.stopLock.Unlock()
+		if !policy.Allowed(msg) {
+			return
+		}
+		err = handler(msg)
+		if notified.IsZero() || msg.Fetched.IsZero() {
+			return
+		}
+		latency := stats.Latency{
+			UID:      msg.UID,
+			Notified: notified,
+			Fetched:  msg.Fetched,
+			Handled:  time.Now(),
+		}
+		self.stats.AddLatency(latency)
+		if self.latencyHandler != nil {
+			self.latencyHandler(latency)
+		}
+		return
+	}
+}
+
+// LatencyHandler will be called with the timing of each message handled after a new mail notification. The timings
+// are also added to the latency histograms of Stats.
+func (self *Client) LatencyHandler(f func(latency stats.Latency)) *Client {
+	self.latencyHandler = f
+	return self
+}
+
+// SetSenderPolicy makes new inbox mail from senders the policy doesn't allow be skipped without calling the mail handler,
+// or counting it in Stats. It may be called while the client is running.
+func (self *Client) SetSenderPolicy(policy rules.SenderPolicy) *Client {
+	self.stopLock.Lock()
+	defer self.stopLock.Unlock()
+	self.senderPolicy = policy
+	return self
+}
+
+// Classifiers decide the priority of new inbox mail, combined like imap.Classify does, before the mail handler is
+// called. imap.GmailImportance uses the importance Gmail decided.
+func (self *Client) Classifiers(classifiers ...imap.Classifier) *Client {
+	self.classifiers = classifiers
+	return self
+}
+
 func (self *Client) MailHandler(f imap.MailHandler) *Client {
 	self.mailHandler = f
 	return self
 }
 
+// Scope makes the client look for new mail in mailbox, like a label or imap.AllMailbox, instead of the inbox. XMPP only
+// notifies about inbox mail, so the mailbox is also checked every MonitorInterval.
+func (self *Client) Scope(mailbox string) *Client {
+	self.imapClient = self.imapClient.ForMailbox(mailbox)
+	self.scoped = mailbox != "INBOX"
+	return self
+}
+
+// SpamHandler makes the client also check imap.SpamMailbox every MonitorInterval, and call f with new mail found there.
+// Useful to notice when mail from a sender starts being classified as spam.
+func (self *Client) SpamHandler(f imap.MailHandler) *Client {
+	self.monitors[imap.SpamMailbox] = f
+	return self
+}
+
+// TrashHandler makes the client also check imap.TrashMailbox every MonitorInterval, and call f with new mail found there.
+func (self *Client) TrashHandler(f imap.MailHandler) *Client {
+	self.monitors[imap.TrashMailbox] = f
+	return self
+}
+
+// SentHandler makes the client also check imap.SentMailbox every MonitorInterval, and call f with mail sent since the
+// last check, to follow mail sent from other devices. Mail sent using Send will show up here as well.
+func (self *Client) SentHandler(f imap.MailHandler) *Client {
+	self.monitors[imap.SentMailbox] = f
+	return self
+}
+
+// LabelsHandler makes the client check the labels of recently handled inbox mail every MonitorInterval, and call f
+// for each message whose labels changed.
+func (self *Client) LabelsHandler(f func(change imap.LabelsChanged)) *Client {
+	self.imapClient.LabelsHandler(f)
+	self.checkLabels = true
+	return self
+}
+
+// fatal returns whether err from checkInbox is something other than a failure that will be retried.
+func fatal(err error) bool {
+	if _, failed := err.(imap.DeliveryError); failed || err == imap.ErrTimeout {
+		return false
+	}
+	return err != nil
+}
+
+// checkInbox handles new inbox mail, and schedules a retry if that failed.
+func (self *Client) checkInbox(notified time.Time) (err error) {
+	err = self.imapClient.HandleNew(self.handleMail(notified))
+	self.retry("INBOX", err, func() error {
+		return self.checkInbox(time.Time{})
+	})
+	return
+}
+
+// retrying is the retry schedule of a mailbox.
+type retrying struct {
+	timer   clock.Timer
+	retries int
+}
+
+// retry schedules check of mailbox after err. The mail the handler failed for, or all of it if the server timed out,
+// is checked again after the delays decided by the DeliveryPolicy or the FetchPolicy, until the handler succeeds or
+// the policy gives up. What to retry is left to the Checkpoint, or OldKeyword, so mail still failing when the client
+// stops is retried by the next Start.
+func (self *Client) retry(mailbox string, err error, check func() error) {
+	self.stopLock.Lock()
+	defer self.stopLock.Unlock()
+	r := self.retrying[mailbox]
+	if r == nil {
+		r = &retrying{}
+		self.retrying[mailbox] = r
+	}
+	policy := self.deliveryPolicy
+	if _, failed := err.(imap.DeliveryError); !failed {
+		if err != imap.ErrTimeout {
+			if err == nil {
+				r.retries = 0
+			}
+			return
+		}
+		policy = self.fetchPolicy
+	}
+	if self.stop == nil || r.timer != nil {
+		return
+	}
+	if policy == nil {
+		policy = retry.Exponential{
+			Min: RetryMin,
+			Max: RetryMax,
+		}
+	}
+	r.retries++
+	delay, ok := policy.Next(r.retries)
+	if !ok {
+		r.retries = 0
+		return
+	}
+	r.timer = self.clock.AfterFunc(delay, func() {
+		self.stopLock.Lock()
+		r.timer = nil
+		self.stopLock.Unlock()
+		if err := check(); err != nil {
+			self.errorHandler(err)
+		}
+	})
+}
+
+// stopRetries stops the scheduled retries. It is called with stopLock held.
+func (self *Client) stopRetries() {
+	for _, r := range self.retrying {
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+		}
+	}
+}
+
+// Start connects and starts handling new mail. It returns ErrAlreadyStarted if the client is already started, and may
+// be called again after Close. If both the XMPP connection and the first inbox check fail, both errors are returned.
 func (self *Client) Start() (result *Client, err error) {
-	if err = self.xmppClient.Start(); err != nil {
+	self.stopLock.Lock()
+	if self.stop != nil {
+		self.stopLock.Unlock()
+		err = ErrAlreadyStarted
+		return
+	}
+	stop := make(chan struct{})
+	self.stop = stop
+	self.stopLock.Unlock()
+	if self.scanPolicy.fromStart {
+		self.imapClient.SkipBefore(time.Now())
+	} else {
+		self.imapClient.SkipBefore(self.scanPolicy.since)
+	}
+	self.imapClient.MaxInitialMessages(self.maxInitial)
+	// The notifier and the first inbox check are set up concurrently. Mail arriving after the check searched the inbox,
+	// but before the notifier started, would go unnoticed, so then the inbox is checked again.
+	notifierErr := make(chan error, 1)
+	go func() {
+		notifierErr <- self.notifier.Start(self.notified)
+	}()
+	var inboxErr error
+	recheck := false
+	if !self.lazyIMAP {
+		inboxErr = self.checkInbox(time.Time{})
+		recheck = self.notifier.State() != connstate.Running
+	}
+	err = <-notifierErr
+	if err == nil && recheck && !fatal(inboxErr) {
+		inboxErr = self.checkInbox(time.Time{})
+	}
+	if inboxErr != nil && !fatal(inboxErr) {
+		self.errorHandler(inboxErr)
+		inboxErr = nil
+	}
+	if err == nil {
+		err = inboxErr
+	} else if inboxErr != nil {
+		err = errors.Join(err, inboxErr)
+	}
+	if err != nil {
+		self.stopLock.Lock()
+		if self.stop == stop {
+			close(stop)
+			self.stop = nil
+			self.stopRetries()
+		}
+		self.stopLock.Unlock()
+		self.notifier.Close()
 		return
 	}
-	if err = self.imapClient.HandleNew(self.mailHandler); err != nil {
+	select {
+	case <-stop:
+		// Close was called while connecting, possibly before the notifier was started.
+		self.notifier.Close()
+		err = ErrClosed
 		return
+	default:
+	}
+	for mailbox, handler := range self.monitors {
+		if handler != nil && self.simulated == nil {
+			mailbox, handler := mailbox, handler
+			profile.Go("gmail.monitor", func() {
+				// The folder name is resolved by the first check, to keep LazyIMAP lazy.
+				var client *imap.Client
+				var check func() error
+				check = func() (err error) {
+					if client == nil {
+						localized, err := self.localized(mailbox)
+						if err != nil {
+							return err
+						}
+						client = self.imapClient.ForMailbox(localized).Keyword(imap.OldKeyword + monitorKeywords[mailbox])
+					}
+					err = client.HandleNew(handler)
+					self.retry(mailbox, err, check)
+					return
+				}
+				self.monitor(check, stop, self.lazyIMAP)
+				if client != nil {
+					client.Park()
+				}
+			}, "mailbox", mailbox)
+		}
+	}
+	if self.checkLabels && self.simulated == nil {
+		profile.Go("gmail.monitor", func() {
+			self.monitor(self.imapClient.CheckLabels, stop, self.lazyIMAP)
+		}, "mailbox", "labels")
+	}
+	if self.scoped {
+		// The first check was made above, or is left to the notifications with LazyIMAP.
+		profile.Go("gmail.monitor", func() {
+			self.monitor(func() error {
+				return self.checkInbox(time.Time{})
+			}, stop, true)
+		}, "mailbox", "inbox")
 	}
 	result = self
 	return
 }
 
+// localized returns the name of the system folder mailbox, like imap.SpamMailbox, in the language of the account.
+func (self *Client) localized(mailbox string) (result string, err error) {
+	folders, err := self.imapClient.Folders()
+	if err != nil {
+		return
+	}
+	switch mailbox {
+	case imap.SpamMailbox:
+		result = folders.Spam
+	case imap.TrashMailbox:
+		result = folders.Trash
+	case imap.SentMailbox:
+		result = folders.Sent
+	default:
+		result = mailbox
+	}
+	return
+}
+
+// monitor calls check every MonitorInterval until stop is closed, starting at once unless wait is set.
+func (self *Client) monitor(check func() error, stop chan struct{}, wait bool) {
+	for checking := !wait; ; checking = true {
+		if checking {
+			if err := check(); err != nil {
+				self.errorHandler(err)
+			}
+		}
+		timer := self.clock.NewTimer(MonitorInterval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// Close stops the client. Closing a client that isn't started does nothing.
 func (self *Client) Close() error {
-	return self.xmppClient.Close()
+	self.stopLock.Lock()
+	if self.stop == nil {
+		self.stopLock.Unlock()
+		return nil
+	}
+	close(self.stop)
+	self.stop = nil
+	self.stopRetries()
+	self.stopLock.Unlock()
+	err := self.notifier.Close()
+	if e := self.imapClient.Park(); err == nil {
+		err = e
+	}
+	return err
 }
@@ -4,16 +4,27 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/jhillyerd/go.enmime"
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/boltstore"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+	"github.com/zond/gmail/notify"
+	"github.com/zond/gmail/outbox"
+	"github.com/zond/gmail/quota"
+	"github.com/zond/gmail/retry"
+	"github.com/zond/gmail/rules"
 )
 
 func TestNotifications(t *testing.T) {
-	inc := make(chan *enmime.MIMEBody)
-	c, err := New(os.Getenv("GMAIL_ACCOUNT"), os.Getenv("GMAIL_PASSWORD")).MailHandler(func(msg *enmime.MIMEBody) error {
+	inc := make(chan *imap.Mail)
+	c, err := New(os.Getenv("GMAIL_ACCOUNT"), os.Getenv("GMAIL_PASSWORD")).MailHandler(func(msg *imap.Mail) error {
 		inc <- msg
 		return nil
 	}).Start()
@@ -37,3 +48,251 @@ func TestNotifications(t *testing.T) {
 	}
 	c.Close()
 }
+
+func TestInjectMail(t *testing.T) {
+	if err := New("user@example.com", "").InjectMail(imap.Message{}); err != ErrNotSimulated {
+		t.Errorf("Wanted ErrNotSimulated, got %v", err)
+	}
+	policy, err := rules.NewSenderPolicy(nil, []string{"spammer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := []*imap.Mail{}
+	failing := false
+	c, err := New("user@example.com", "").Simulate(imaptest.New()).SetSenderPolicy(policy).Classifiers(imap.GmailImportance).MailHandler(func(msg *imap.Mail) error {
+		if failing {
+			return fmt.Errorf("failing")
+		}
+		handled = append(handled, msg)
+		return nil
+	}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.State() != connstate.Running {
+		t.Errorf("Wanted a started simulated client to be running, got %v", c.State())
+	}
+	for _, msg := range []imap.Message{
+		{Body: []byte("From: friend@example.com\r\nSubject: hello\r\n\r\nbody"), Labels: []string{`\Important`}},
+		{Body: []byte("From: spammer@example.com\r\nSubject: buy\r\n\r\nbody")},
+	} {
+		if err := c.InjectMail(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handled) != 1 || handled[0].GetHeader("Subject") != "hello" || handled[0].Priority != imap.Important {
+		t.Fatalf("Wanted only the important mail from the friend handled, got %+v", handled)
+	}
+	if c.LastNotification().IsZero() || c.Stats().Total() != 1 {
+		t.Errorf("Wanted the injected mail counted as notified and handled, got %v and %v", c.LastNotification(), c.Stats().Total())
+	}
+	failing = true
+	if _, failed := c.InjectMail(imap.Message{Body: []byte("From: friend@example.com\r\nSubject: again\r\n\r\nbody")}).(imap.DeliveryError); !failed {
+		t.Errorf("Wanted the failure of the mail handler returned")
+	}
+	failing = false
+	if err := c.InjectMail(imap.Message{Body: []byte("From: friend@example.com\r\nSubject: third\r\n\r\nbody")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 3 || handled[1].GetHeader("Subject") != "again" || handled[2].GetHeader("Subject") != "third" {
+		t.Errorf("Wanted the failed mail handled again before the new one, got %v messages", len(handled))
+	}
+}
+
+func TestMonitorsLeaveInboxMail(t *testing.T) {
+	await := func(c chan *imap.Mail, what string) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v never handled the mail", what)
+		}
+	}
+	for _, monitored := range []string{imap.SpamMailbox, imap.TrashMailbox, imap.SentMailbox} {
+		// The simulated mailbox serves every folder, like Gmail shares the keywords between the folders of a message.
+		mailbox := imaptest.New()
+		fake := clock.NewFake(time.Now())
+		notifier := notify.NewManual()
+		inbox := make(chan *imap.Mail, 1)
+		monitor := make(chan *imap.Mail, 1)
+		c := New("user@example.com", "").Clock(fake).LazyIMAP().Notifier(notifier).MailHandler(func(msg *imap.Mail) error {
+			inbox <- msg
+			return nil
+		})
+		c.imapClient.MailStore(mailbox.Open)
+		c.monitors[monitored] = func(msg *imap.Mail) error {
+			monitor <- msg
+			return nil
+		}
+		if _, err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		mailbox.Deliver("From: user@example.com\r\nTo: user@example.com\r\nSubject: note to self\r\n\r\nbody")
+		fake.BlockUntil(1)
+		fake.Advance(MonitorInterval)
+		await(monitor, monitored)
+		notifier.Notify()
+		await(inbox, "the inbox")
+		c.Close()
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	mailbox := imaptest.New()
+	fake := clock.NewFake(time.Now())
+	notifier := notify.NewManual()
+	attempts := make(chan int, 3)
+	attempt := 0
+	c := New("user@example.com", "").Clock(fake).Notifier(notifier).DeliveryPolicy(retry.Func(func(n int) (time.Duration, bool) {
+		return time.Duration(n) * time.Minute, true
+	})).MailHandler(func(msg *imap.Mail) error {
+		attempt++
+		attempts <- attempt
+		if attempt < 3 {
+			return fmt.Errorf("failing")
+		}
+		return nil
+	})
+	c.imapClient.MailStore(mailbox.Open)
+	c.ErrorHandler(func(e error) {})
+	if _, err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mailbox.Deliver("From: friend@example.com\r\nSubject: hello\r\n\r\nbody")
+	notifier.Notify()
+	for wanted, delay := range []time.Duration{0, time.Minute, 2 * time.Minute} {
+		if delay > 0 {
+			fake.BlockUntil(1)
+			fake.Advance(delay)
+		}
+		select {
+		case got := <-attempts:
+			if got != wanted+1 {
+				t.Fatalf("Wanted attempt %v, got %v", wanted+1, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Attempt %v never happened", wanted+1)
+		}
+	}
+	if flags := mailbox.Flags(1); len(flags) != 1 || flags[0] != imap.OldKeyword {
+		t.Errorf("Wanted the retried mail marked as handled, got %v", flags)
+	}
+}
+
+func TestMonitorRetry(t *testing.T) {
+	store, err := boltstore.Open(filepath.Join(t.TempDir(), "gmail.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	mailbox := imaptest.New()
+	uid := mailbox.Deliver("From: spammer@example.com\r\nSubject: buy\r\n\r\nbody")
+	attempts := make(chan bool, 4)
+	failing := true
+	start := func() (c *Client, fake *clock.Fake) {
+		fake = clock.NewFake(time.Now())
+		c = New("user@example.com", "").Clock(fake).LazyIMAP().Checkpoint(store).Notifier(notify.NewManual()).DeliveryPolicy(retry.Func(func(n int) (time.Duration, bool) {
+			return time.Minute, true
+		})).SpamHandler(func(msg *imap.Mail) error {
+			attempts <- failing
+			if failing {
+				return fmt.Errorf("failing")
+			}
+			return nil
+		})
+		c.imapClient.MailStore(mailbox.Open)
+		c.ErrorHandler(func(e error) {})
+		if _, err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	await := func() {
+		select {
+		case <-attempts:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The spam was never handled")
+		}
+	}
+	c, fake := start()
+	fake.BlockUntil(1)
+	fake.Advance(MonitorInterval)
+	await()
+	// The monitor timer and the retry are waiting.
+	fake.BlockUntil(2)
+	fake.Advance(time.Minute)
+	await()
+	c.Close()
+	if unacked, err := store.UnackedUIDs(imap.SpamMailbox, mailbox.UIDValidity()); err != nil || len(unacked) != 1 || unacked[0] != uid {
+		t.Fatalf("Wanted the failed spam saved as unacked, got %v and %v", unacked, err)
+	}
+	failing = false
+	c, fake = start()
+	defer c.Close()
+	fake.BlockUntil(1)
+	fake.Advance(MonitorInterval)
+	await()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if unacked, _ := store.UnackedUIDs(imap.SpamMailbox, mailbox.UIDValidity()); len(unacked) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The retried spam was never acked")
+		}
+	}
+}
+
+func TestOutboxForeignSender(t *testing.T) {
+	store, err := boltstore.Open(filepath.Join(t.TempDir(), "gmail.db"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	box := New("me@example.com", "secret").Outbox(store)
+	box.Policy = retry.Exponential{Min: time.Minute, Max: time.Hour, Attempts: 5}
+	events := make(chan outbox.Event, 4)
+	box.EventHandler = func(e outbox.Event) {
+		events <- e
+	}
+	box.Start()
+	defer box.Close()
+	if _, err := box.Send("Someone Else <else@example.com>", []string{"you@example.com"}, []byte("body")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Status == outbox.Queued {
+				continue
+			}
+			if foreign, ok := e.Err.(ErrForeignSender); e.Status != outbox.Failed || !ok || foreign.Account != "me@example.com" {
+				t.Errorf("Wanted the message from someone else to fail at once, got %+v", e)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("No event")
+		}
+	}
+}
+
+type failingProvider struct {
+	err error
+}
+
+func (self failingProvider) Credentials() (auth.Credentials, error) {
+	return auth.Credentials{}, self.err
+}
+
+func TestSendLimitsCountSentMail(t *testing.T) {
+	refused := fmt.Errorf("refused")
+	c := New("user@example.com", "secret").SendLimits(quota.Limits{PerDay: 1}).UpdateCredentials(failingProvider{refused})
+	for i := 0; i < 2; i++ {
+		if err := c.SendRaw([]string{"a@example.com"}, []byte("Subject: hi\r\n\r\nbody")); err != refused {
+			t.Fatalf("Wanted the send to fail with %v, not the quota, got %v", refused, err)
+		}
+	}
+	if remaining := c.sendLimiter.Remaining(); remaining != 1 {
+		t.Errorf("Wanted mail that failed to be sent not to use up the quota, got %v remaining", remaining)
+	}
+}
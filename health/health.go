@@ -0,0 +1,98 @@
+// Package health serves the state of running clients over HTTP, for load balancers and Kubernetes probes.
+//
+//	http.Handle("/", health.New(func() map[string]health.Account {
+//		return map[string]health.Account{"user@gmail.com": client}
+//	}))
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+)
+
+// Account is a watched account, like a *gmail.Client.
+type Account interface {
+	State() connstate.State
+	LastNotification() time.Time
+}
+
+// Status is the health of an account.
+type Status struct {
+	State            string     `json:"state"`
+	LastNotification *time.Time `json:"last_notification,omitempty"`
+	// LastNotificationAge is the number of seconds since LastNotification.
+	LastNotificationAge *float64 `json:"last_notification_age,omitempty"`
+	Healthy             bool     `json:"healthy"`
+	Ready               bool     `json:"ready"`
+}
+
+// Report is the response of both endpoints.
+type Report struct {
+	Accounts map[string]Status `json:"accounts"`
+}
+
+// Handler is an http.Handler serving /healthz, which fails with 503 when an account gave up reconnecting, and /readyz,
+// which fails until all accounts, and at least one, are connected. Both respond with a Report.
+type Handler struct {
+	// MaxSilence, if not zero, makes accounts that haven't been notified of new mail for longer unhealthy. Only use it
+	// for mailboxes known to get mail regularly.
+	MaxSilence time.Duration
+	Clock      clock.Clock
+
+	accounts func() map[string]Account
+}
+
+// New returns a Handler reporting the accounts returned by accounts, by address, on each request.
+func New(accounts func() map[string]Account) *Handler {
+	return &Handler{
+		Clock:    clock.Real,
+		accounts: accounts,
+	}
+}
+
+// Check returns the status of each account.
+func (self *Handler) Check() (result Report) {
+	now := self.Clock.Now()
+	result.Accounts = map[string]Status{}
+	for address, account := range self.accounts() {
+		state := account.State()
+		status := Status{
+			State:   state.String(),
+			Healthy: state != connstate.Idle && state != connstate.Stopped,
+			Ready:   state == connstate.Running,
+		}
+		if last := account.LastNotification(); !last.IsZero() {
+			age := now.Sub(last).Seconds()
+			status.LastNotification, status.LastNotificationAge = &last, &age
+			if self.MaxSilence > 0 && now.Sub(last) > self.MaxSilence {
+				status.Healthy = false
+			}
+		}
+		result.Accounts[address] = status
+	}
+	return
+}
+
+func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+		http.NotFound(w, r)
+		return
+	}
+	report := self.Check()
+	ok := r.URL.Path == "/healthz" || len(report.Accounts) > 0
+	for _, status := range report.Accounts {
+		if (r.URL.Path == "/healthz" && !status.Healthy) || (r.URL.Path == "/readyz" && !status.Ready) {
+			ok = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
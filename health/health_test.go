@@ -0,0 +1,83 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+)
+
+type account struct {
+	state connstate.State
+	last  time.Time
+}
+
+func (self account) State() connstate.State {
+	return self.state
+}
+
+func (self account) LastNotification() time.Time {
+	return self.last
+}
+
+func get(t *testing.T, handler http.Handler, path string) (status int, report Report) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code == http.StatusNotFound {
+		return rec.Code, report
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return rec.Code, report
+}
+
+func TestHealth(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	accounts := map[string]Account{}
+	handler := New(func() map[string]Account {
+		return accounts
+	})
+	handler.Clock = clock.NewFake(now)
+	if status, _ := get(t, handler, "/healthz"); status != http.StatusOK {
+		t.Errorf("Wanted healthy without accounts, got %v", status)
+	}
+	if status, _ := get(t, handler, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Wanted not ready without accounts, got %v", status)
+	}
+	accounts["a@example.com"] = account{state: connstate.Running, last: now.Add(-time.Minute)}
+	accounts["b@example.com"] = account{state: connstate.Backoff}
+	status, report := get(t, handler, "/healthz")
+	if status != http.StatusOK {
+		t.Errorf("Wanted healthy while reconnecting, got %v", status)
+	}
+	if a := report.Accounts["a@example.com"]; a.State != "Running" || a.LastNotificationAge == nil || *a.LastNotificationAge != 60 {
+		t.Errorf("Wanted a running account notified a minute ago, got %+v", a)
+	}
+	if b := report.Accounts["b@example.com"]; b.State != "Backoff" || b.LastNotification != nil || b.Ready {
+		t.Errorf("Wanted an unready account never notified, got %+v", b)
+	}
+	if status, _ := get(t, handler, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Wanted not ready while reconnecting, got %v", status)
+	}
+	accounts["b@example.com"] = account{state: connstate.Running}
+	if status, _ := get(t, handler, "/readyz"); status != http.StatusOK {
+		t.Errorf("Wanted ready, got %v", status)
+	}
+	handler.MaxSilence = 30 * time.Second
+	if status, report := get(t, handler, "/healthz"); status != http.StatusServiceUnavailable || report.Accounts["a@example.com"].Healthy || !report.Accounts["b@example.com"].Healthy {
+		t.Errorf("Wanted only the silent account unhealthy, got %v %+v", status, report)
+	}
+	handler.MaxSilence = 0
+	accounts["b@example.com"] = account{state: connstate.Idle}
+	if status, _ := get(t, handler, "/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Wanted unhealthy after giving up, got %v", status)
+	}
+	if status, _ := get(t, handler, "/other"); status != http.StatusNotFound {
+		t.Errorf("Wanted 404, got %v", status)
+	}
+}
@@ -0,0 +1,177 @@
+package imap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zond/gmail/mimeutil"
+)
+
+// AttachmentAction is what an AttachmentPolicy does with an attachment.
+type AttachmentAction int
+
+const (
+	// KeepAttachment leaves the attachment in Mail.Attachments.
+	KeepAttachment AttachmentAction = iota
+	// SkipAttachment removes the attachment from Mail.Attachments before the handler is called, to not keep large or
+	// unwanted content around.
+	SkipAttachment
+	// SaveAttachment writes the attachment to the Dir of the policy before the handler is called, and keeps it.
+	SaveAttachment
+)
+
+var attachmentActionNames = map[AttachmentAction]string{
+	KeepAttachment: "keep",
+	SkipAttachment: "skip",
+	SaveAttachment: "save",
+}
+
+func (self AttachmentAction) String() string {
+	if name, found := attachmentActionNames[self]; found {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", int(self))
+}
+
+func (self AttachmentAction) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+func (self *AttachmentAction) UnmarshalText(b []byte) error {
+	for action, name := range attachmentActionNames {
+		if strings.EqualFold(string(b), name) {
+			*self = action
+			return nil
+		}
+	}
+	return fmt.Errorf("imap: unknown attachment action %q", b)
+}
+
+// AttachmentRule matches attachments by media type, file name extension and size.
+type AttachmentRule struct {
+	// ContentTypes are media types, like "application/pdf" or "image/*". If empty, all types match.
+	ContentTypes []string `json:"content_types,omitempty"`
+	// Extensions are file name extensions, like ".exe". If empty, all file names match.
+	Extensions []string `json:"extensions,omitempty"`
+	// MinSize and MaxSize, unless zero, limit the sizes in bytes that match.
+	MinSize int              `json:"min_size,omitempty"`
+	MaxSize int              `json:"max_size,omitempty"`
+	Action  AttachmentAction `json:"action"`
+}
+
+func (self AttachmentRule) matches(part mimeutil.MIMEPart) bool {
+	if len(self.ContentTypes) > 0 {
+		mediaType, _, err := mime.ParseMediaType(part.ContentType())
+		if err != nil {
+			mediaType = part.ContentType()
+		}
+		found := false
+		for _, pattern := range self.ContentTypes {
+			if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(mediaType)); matched {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(self.Extensions) > 0 {
+		ext := strings.ToLower(filepath.Ext(part.FileName()))
+		found := false
+		for _, want := range self.Extensions {
+			if strings.ToLower(want) == ext || "."+strings.ToLower(want) == ext {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	size := len(part.Content())
+	return (self.MinSize == 0 || size >= self.MinSize) && (self.MaxSize == 0 || size <= self.MaxSize)
+}
+
+// AttachmentPolicy decides the action for each attachment by the first rule matching it, and keeps the attachments
+// matching none.
+type AttachmentPolicy struct {
+	Rules []AttachmentRule `json:"rules"`
+	// Dir is where SaveAttachment writes the attachments, in a directory per message named by its hexadecimal Gmail id,
+	// or its UID when that is unknown.
+	Dir string `json:"dir,omitempty"`
+}
+
+// AttachmentDecision records what an AttachmentPolicy did with an attachment.
+type AttachmentDecision struct {
+	FileName    string
+	ContentType string
+	Size        int
+	Action      AttachmentAction
+	// Path is where the attachment was saved, for SaveAttachment.
+	Path string
+}
+
+// Handler returns a handler applying the policy to the attachments of each message, recording the decisions in
+// Mail.AttachmentDecisions, and then calling next. Messages whose attachments can't be saved fail without calling next.
+func (self AttachmentPolicy) Handler(next MailHandler) MailHandler {
+	return func(msg *Mail) (err error) {
+		if msg.MIMEBody == nil || len(msg.Attachments) == 0 {
+			return next(msg)
+		}
+		kept := []mimeutil.MIMEPart{}
+		decisions := []AttachmentDecision{}
+		for i, part := range msg.Attachments {
+			decision := AttachmentDecision{
+				FileName:    part.FileName(),
+				ContentType: part.ContentType(),
+				Size:        len(part.Content()),
+			}
+			for _, rule := range self.Rules {
+				if rule.matches(part) {
+					decision.Action = rule.Action
+					break
+				}
+			}
+			if decision.Action == SaveAttachment {
+				if decision.Path, err = self.save(msg, i, part); err != nil {
+					return
+				}
+			}
+			if decision.Action != SkipAttachment {
+				kept = append(kept, part)
+			}
+			decisions = append(decisions, decision)
+		}
+		msg.Attachments, msg.AttachmentDecisions = kept, decisions
+		return next(msg)
+	}
+}
+
+// save writes the ith attachment of msg to the directory of the message, and returns the path.
+func (self AttachmentPolicy) save(msg *Mail, i int, part mimeutil.MIMEPart) (result string, err error) {
+	if self.Dir == "" {
+		err = fmt.Errorf("imap: saving attachments needs a directory")
+		return
+	}
+	dir := filepath.Join(self.Dir, fmt.Sprintf("uid-%v", msg.UID))
+	if msg.GmailID != 0 {
+		dir = filepath.Join(self.Dir, fmt.Sprintf("%x", msg.GmailID))
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	// The file name comes from the sender, so only its last element is used, prefixed by the index to keep it unique.
+	name := filepath.Base(filepath.FromSlash(strings.Replace(part.FileName(), `\`, "/", -1)))
+	if name == "." || name == string(filepath.Separator) {
+		name = "attachment"
+	}
+	result = filepath.Join(dir, fmt.Sprintf("%v-%v", i, name))
+	err = ioutil.WriteFile(result, part.Content(), 0600)
+	return
+}
@@ -0,0 +1,101 @@
+package imap_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestAttachmentPolicy(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver(strings.Join([]string{
+		"From: a@example.com",
+		"Subject: files",
+		"Content-Type: multipart/mixed; boundary=b",
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"see attached",
+		"--b",
+		"Content-Type: application/pdf",
+		"Content-Disposition: attachment; filename=\"../report.pdf\"",
+		"",
+		"pdf content",
+		"--b",
+		"Content-Type: application/octet-stream",
+		"Content-Disposition: attachment; filename=\"setup.EXE\"",
+		"",
+		"exe content",
+		"--b",
+		"Content-Type: image/png",
+		"Content-Disposition: attachment; filename=\"logo.png\"",
+		"",
+		"png",
+		"--b--",
+		"",
+	}, "\r\n"))
+	dir := t.TempDir()
+	policy := imap.AttachmentPolicy{
+		Rules: []imap.AttachmentRule{
+			{Extensions: []string{".exe"}, Action: imap.SkipAttachment},
+			{ContentTypes: []string{"image/*"}, MaxSize: 2, Action: imap.SaveAttachment},
+			{ContentTypes: []string{"application/pdf"}, Action: imap.SaveAttachment},
+		},
+		Dir: dir,
+	}
+	var handled *imap.Mail
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(policy.Handler(func(msg *imap.Mail) error {
+		handled = msg
+		return nil
+	})); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if handled == nil {
+		t.Fatalf("No mail handled")
+	}
+	names := []string{}
+	for _, part := range handled.Attachments {
+		names = append(names, part.FileName())
+	}
+	if want := "[../report.pdf logo.png]"; fmt.Sprint(names) != want {
+		t.Errorf("Wanted attachments %v, got %v", want, names)
+	}
+	actions := []string{}
+	for _, decision := range handled.AttachmentDecisions {
+		actions = append(actions, decision.Action.String())
+	}
+	if want := "[save skip keep]"; fmt.Sprint(actions) != want {
+		t.Errorf("Wanted decisions %v, got %v", want, actions)
+	}
+	saved := handled.AttachmentDecisions[0].Path
+	if filepath.Dir(filepath.Dir(saved)) != dir {
+		t.Errorf("Wanted %v to be saved in a directory in %v", saved, dir)
+	}
+	if b, err := ioutil.ReadFile(saved); err != nil || string(b) != "pdf content" {
+		t.Errorf("Wanted the saved attachment, got %q, %v", b, err)
+	}
+	b, err := json.Marshal(handled)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	decoded := struct {
+		Attachments []struct {
+			FileName string `json:"filename"`
+			Action   string `json:"action"`
+			Path     string `json:"path"`
+		} `json:"attachments"`
+	}{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(decoded.Attachments) != 3 || decoded.Attachments[1].FileName != "setup.EXE" || decoded.Attachments[1].Action != "skip" || decoded.Attachments[0].Path != saved {
+		t.Errorf("Wanted all decisions in the JSON, got %+v", decoded.Attachments)
+	}
+}
@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Checkpoint remembers the highest UID handled in each mailbox, so that only newer messages are searched.
+// Checkpoints are tied to a UIDVALIDITY, and are ignored when the mailbox is renumbered.
+type Checkpoint interface {
+	// LastUID returns the highest UID handled in mailbox, or 0 if none was saved for uidValidity.
+	LastUID(mailbox string, uidValidity uint32) (uint32, error)
+	SetLastUID(mailbox string, uidValidity uint32, uid uint32) error
+}
+
+// Unacked is implemented by Checkpoints that also remember the messages the handler failed for. The checkpoint can
+// then move past them, and HandleNew retries exactly those, even after a restart and without OldKeyword.
+type Unacked interface {
+	// UnackedUIDs returns the UIDs the handler failed for in mailbox, or nil if none were saved for uidValidity.
+	UnackedUIDs(mailbox string, uidValidity uint32) ([]uint32, error)
+	SetUnackedUIDs(mailbox string, uidValidity uint32, uids []uint32) error
+}
+
+// Dedup remembers which messages have been handled, to avoid handling the same message twice even when it loses its
+// OldKeyword, is moved between mailboxes or gets renumbered.
+type Dedup interface {
+	Seen(key string) (bool, error)
+	MarkSeen(key string) error
+}
+
+// Checkpoint makes the client only search for messages newer than the last one handled according to c.
+func (self *Client) Checkpoint(c Checkpoint) *Client {
+	self.checkpoint = c
+	return self
+}
+
+// Dedup makes the client skip messages that d has seen, and mark the ones handled without error as seen.
+func (self *Client) Dedup(d Dedup) *Client {
+	self.dedup = d
+	return self
+}
+
+// dedupKey identifies a message by its Key, or its UID if it has none.
+func (self *Client) dedupKey(uidValidity uint32, msg *Mail) string {
+	if key := msg.Key(); key != "" {
+		return key
+	}
+	return fmt.Sprintf("uid:%v/%v/%v", self.mailbox, uidValidity, msg.UID)
+}
+
+// memoryCheckpoint is a Checkpoint lasting as long as the process.
+type memoryCheckpoint struct {
+	lock    sync.Mutex
+	last    map[string][2]uint32
+	unacked map[string]unackedUIDs
+}
+
+type unackedUIDs struct {
+	uidValidity uint32
+	uids        []uint32
+}
+
+func (self *memoryCheckpoint) LastUID(mailbox string, uidValidity uint32) (uint32, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if saved := self.last[mailbox]; saved[0] == uidValidity {
+		return saved[1], nil
+	}
+	return 0, nil
+}
+
+func (self *memoryCheckpoint) SetLastUID(mailbox string, uidValidity uint32, uid uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.last == nil {
+		self.last = map[string][2]uint32{}
+	}
+	self.last[mailbox] = [2]uint32{uidValidity, uid}
+	return nil
+}
+
+func (self *memoryCheckpoint) UnackedUIDs(mailbox string, uidValidity uint32) ([]uint32, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if saved := self.unacked[mailbox]; saved.uidValidity == uidValidity {
+		return saved.uids, nil
+	}
+	return nil, nil
+}
+
+func (self *memoryCheckpoint) SetUnackedUIDs(mailbox string, uidValidity uint32, uids []uint32) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.unacked == nil {
+		self.unacked = map[string]unackedUIDs{}
+	}
+	self.unacked[mailbox] = unackedUIDs{uidValidity: uidValidity, uids: uids}
+	return nil
+}
@@ -0,0 +1,357 @@
+package imap_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+	"github.com/zond/gmail/retry"
+
+	goimap "github.com/mxk/go-imap/imap"
+)
+
+func TestHandleNew(t *testing.T) {
+	mailbox := imaptest.New()
+	ok := mailbox.Deliver("From: a@example.com\r\nSubject: ok\r\n\r\nbody")
+	failing := mailbox.Deliver("From: b@example.com\r\nSubject: fail\r\n\r\nbody")
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open)
+	seen := []string{}
+	handler := func(msg *imap.Mail) error {
+		seen = append(seen, msg.GetHeader("Subject"))
+		if msg.GetHeader("Subject") == "fail" {
+			return fmt.Errorf("failing")
+		}
+		return nil
+	}
+	if err, ok := c.HandleNew(handler).(imap.DeliveryError); !ok || len(err) != 1 || err[failing] == nil {
+		t.Fatalf("Wanted a DeliveryError for %v, got %v", failing, err)
+	}
+	if want := []string{"ok", "fail"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("Wanted %v but got %v", want, seen)
+	}
+	if flags := mailbox.Flags(ok); !reflect.DeepEqual(flags, []string{imap.OldKeyword}) {
+		t.Errorf("Wanted %v to be flagged, got %v", ok, flags)
+	}
+	if flags := mailbox.Flags(failing); len(flags) != 0 {
+		t.Errorf("Wanted %v to be unflagged, got %v", failing, flags)
+	}
+	seen = nil
+	if _, ok := c.HandleNew(handler).(imap.DeliveryError); !ok {
+		t.Fatalf("Wanted a DeliveryError")
+	}
+	if want := []string{"fail"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("Wanted %v but got %v", want, seen)
+	}
+}
+
+func TestMalformedMail(t *testing.T) {
+	mailbox := imaptest.New()
+	malformed := mailbox.Deliver(strings.Join([]string{
+		"From: a@example.com",
+		"Subject: broken",
+		"Content-Type: multipart/mixed; boundary=b",
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"body",
+		"--b",
+		"Content-Type: application/octet-stream",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"cGRm!!!!",
+		"--b--",
+		"",
+	}, "\r\n"))
+	var handled *imap.Mail
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(func(msg *imap.Mail) error {
+		handled = msg
+		return nil
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if handled == nil || handled.GetHeader("Subject") != "broken" || len(handled.Errors) == 0 {
+		t.Fatalf("Wanted the malformed message handled with its errors, got %+v", handled)
+	}
+	if flags := mailbox.Flags(malformed); !reflect.DeepEqual(flags, []string{imap.OldKeyword}) {
+		t.Errorf("Wanted the malformed message flagged, got %v", flags)
+	}
+}
+
+func TestUnparsableMail(t *testing.T) {
+	mailbox := imaptest.New()
+	before := mailbox.Deliver("From: a@example.com\r\nSubject: before\r\n\r\nbody")
+	broken := mailbox.Deliver("not a header line\r\n\r\nbody")
+	after := mailbox.Deliver("From: b@example.com\r\nSubject: after\r\n\r\nbody")
+	progress := checkpoint{}
+	var unparsable []error
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(progress).UnparsableHandler(func(fetched imap.Message, err error) {
+		unparsable = append(unparsable, err)
+	})
+	seen := []string{}
+	handler := func(msg *imap.Mail) error {
+		seen = append(seen, msg.GetHeader("Subject"))
+		return nil
+	}
+	if err := c.HandleNew(handler); err != nil {
+		t.Fatalf("Wanted the unparsable message passed over, got %v", err)
+	}
+	if want := []string{"before", "after"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("Wanted %v, got %v", want, seen)
+	}
+	if len(unparsable) != 1 || unparsable[0].(imap.UnparsableError).UID != broken {
+		t.Errorf("Wanted an UnparsableError for %v, got %v", broken, unparsable)
+	}
+	for _, uid := range []uint32{before, broken, after} {
+		if flags := mailbox.Flags(uid); !reflect.DeepEqual(flags, []string{imap.OldKeyword}) {
+			t.Errorf("Wanted %v flagged, got %v", uid, flags)
+		}
+	}
+	if last, _ := progress.LastUID("INBOX", mailbox.UIDValidity()); last != after {
+		t.Errorf("Wanted the checkpoint at %v, got %v", after, last)
+	}
+	seen = nil
+	if err := c.HandleNew(handler); err != nil || len(seen) != 0 || len(unparsable) != 1 {
+		t.Errorf("Wanted nothing handled again, got %v, %v and %v", err, seen, unparsable)
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNewContext(ctx, func(*imap.Mail) error {
+		t.Errorf("Handler called with a cancelled context")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Wanted %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestMailboxReset(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	resets := []imap.MailboxReset{}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).MailboxResetHandler(func(reset imap.MailboxReset) {
+		resets = append(resets, reset)
+	})
+	if _, err := c.GetNew(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := c.GetNew(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(resets) != 0 {
+		t.Fatalf("Wanted no resets but got %+v", resets)
+	}
+	mailbox.Renumber()
+	msgs, err := c.GetNew()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("Wanted the already handled message to stay handled, got %+v", msgs)
+	}
+	if want := []imap.MailboxReset{{Mailbox: "INBOX", OldUIDValidity: 1, NewUIDValidity: 2}}; !reflect.DeepEqual(resets, want) {
+		t.Errorf("Wanted %+v but got %+v", want, resets)
+	}
+}
+
+func TestRawIMAP(t *testing.T) {
+	called := false
+	if err := imap.New("user@example.com", "secret").MailStore(imaptest.New().Open).RawIMAP(func(*goimap.Client) error {
+		called = true
+		return nil
+	}); err != imap.ErrNoRawClient {
+		t.Errorf("Wanted %v but got %v", imap.ErrNoRawClient, err)
+	}
+	if called {
+		t.Errorf("Wanted f not to be called without a real connection")
+	}
+}
+
+func TestForMailbox(t *testing.T) {
+	inbox, spam := imaptest.New(), imaptest.New()
+	spam.Deliver("From: a@example.com\r\nSubject: spam\r\n\r\nbody")
+	resets := []imap.MailboxReset{}
+	c := imap.New("user@example.com", "secret").MailStore(inbox.Open).MailboxResetHandler(func(reset imap.MailboxReset) {
+		resets = append(resets, reset)
+	})
+	spamClient := c.ForMailbox(imap.SpamMailbox).MailStore(spam.Open)
+	for i := 0; i < 2; i++ {
+		msgs, err := spamClient.GetNew()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if want := 1 - i; len(msgs) != want {
+			t.Errorf("Wanted %v messages but got %+v", want, msgs)
+		}
+		spam.Renumber()
+	}
+	if msgs, err := c.GetNew(); err != nil || len(msgs) != 0 {
+		t.Errorf("Wanted an empty inbox, got %+v, %v", msgs, err)
+	}
+	if len(resets) != 1 || resets[0].Mailbox != imap.SpamMailbox {
+		t.Errorf("Wanted a single reset of %v, got %+v", imap.SpamMailbox, resets)
+	}
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	failures := 0
+	open := func(ctx context.Context) (imap.MailStore, error) {
+		if failures < 2 {
+			failures++
+			return nil, fmt.Errorf("refused")
+		}
+		return mailbox.Open(ctx)
+	}
+	c := imap.New("user@example.com", "secret").MailStore(open).ReconnectPolicy(retry.Exponential{Min: time.Millisecond, Attempts: 2})
+	handled := 0
+	if err := c.HandleNew(func(*imap.Mail) error {
+		handled++
+		return nil
+	}); err != nil || handled != 1 {
+		t.Errorf("Wanted the mail handled after two failures, got %v handled and %v", handled, err)
+	}
+	failures = 0
+	c.ReconnectPolicy(retry.Exponential{Min: time.Millisecond, Attempts: 1})
+	if err := c.HandleNew(func(*imap.Mail) error {
+		return nil
+	}); err == nil || failures != 2 {
+		t.Errorf("Wanted the policy to give up after one retry, got %v after %v failures", err, failures)
+	}
+}
+
+func TestReconnectClock(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	var lock sync.Mutex
+	failures := 0
+	fake := clock.NewFake(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	c := imap.New("user@example.com", "secret").MailStore(func(ctx context.Context) (imap.MailStore, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures < 1 {
+			failures++
+			return nil, fmt.Errorf("refused")
+		}
+		return mailbox.Open(ctx)
+	}).ReconnectPolicy(retry.Exponential{Min: time.Hour, Attempts: 1}).Clock(fake)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.HandleNew(func(*imap.Mail) error {
+			return nil
+		})
+	}()
+	fake.BlockUntil(1)
+	select {
+	case err := <-done:
+		t.Fatalf("Wanted the retry to wait for the clock, got %v", err)
+	default:
+	}
+	fake.Advance(time.Hour)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wanted the retry to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Retry not made when the clock advanced")
+	}
+}
+
+func TestSkipBefore(t *testing.T) {
+	mailbox := imaptest.New()
+	start := time.Now()
+	mailbox.Append(context.Background(), nil, start.Add(-72*time.Hour), []byte("From: a@example.com\r\nSubject: old\r\n\r\nbody"))
+	mailbox.Append(context.Background(), nil, start.Add(-time.Minute), []byte("From: a@example.com\r\nSubject: earlier\r\n\r\nbody"))
+	mailbox.Append(context.Background(), nil, start.Add(time.Minute), []byte("From: a@example.com\r\nSubject: new\r\n\r\nbody"))
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).SkipBefore(start)
+	subjects := []string{}
+	if err := c.HandleNew(func(msg *imap.Mail) error {
+		subjects = append(subjects, msg.GetHeader("Subject"))
+		return nil
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []string{"new"}; !reflect.DeepEqual(subjects, want) {
+		t.Errorf("Wanted %v handled, got %v", want, subjects)
+	}
+	if unhandled, err := c.Search("UNKEYWORD " + imap.OldKeyword); err != nil || len(unhandled) != 0 {
+		t.Errorf("Wanted the skipped mail marked, got %v unmarked and %v", unhandled, err)
+	}
+}
+
+func TestMaxInitialMessages(t *testing.T) {
+	mailbox := imaptest.New()
+	for _, subject := range []string{"a", "b", "c"} {
+		mailbox.Deliver("From: a@example.com\r\nSubject: " + subject + "\r\n\r\nbody")
+	}
+	mailbox.Append(context.Background(), nil, time.Now().Add(-72*time.Hour), []byte("From: a@example.com\r\nSubject: old\r\n\r\nbody"))
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).MaxInitialMessages(2).UnseenSince(24 * time.Hour)
+	handle := func() (subjects []string) {
+		if err := c.HandleNew(func(msg *imap.Mail) error {
+			if !msg.Truncated {
+				t.Errorf("Wanted %v to be marked as truncated", msg.GetHeader("Subject"))
+			}
+			subjects = append(subjects, msg.GetHeader("Subject"))
+			return nil
+		}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return
+	}
+	if got, want := handle(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wanted %v but got %v", want, got)
+	}
+	mailbox.Deliver("From: a@example.com\r\nSubject: d\r\n\r\nbody")
+	if err := c.HandleNew(func(msg *imap.Mail) error {
+		if subject := msg.GetHeader("Subject"); subject != "d" || msg.Truncated {
+			t.Errorf("Wanted only d, untruncated, got %v", subject)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if unhandled, err := c.Search("UNKEYWORD " + imap.OldKeyword); err != nil || len(unhandled) != 1 {
+		t.Errorf("Wanted only the mail outside the window unmarked, got %v and %v", unhandled, err)
+	}
+}
+
+type checkpoint map[string]uint32
+
+func (self checkpoint) LastUID(mailbox string, uidValidity uint32) (uint32, error) {
+	return self[fmt.Sprintf("%v/%v", mailbox, uidValidity)], nil
+}
+
+func (self checkpoint) SetLastUID(mailbox string, uidValidity uint32, uid uint32) error {
+	self[fmt.Sprintf("%v/%v", mailbox, uidValidity)] = uid
+	return nil
+}
+
+func BenchmarkParse(b *testing.B) {
+	body := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: =?UTF-8?Q?r=C3=A4ksm=C3=B6rg=C3=A5s?=\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		strings.Repeat("hello there =C3=A5=C3=A4=C3=B6\r\n", 50) +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"a.bin\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		strings.Repeat("aGVsbG8gdGhlcmUgaGVsbG8gdGhlcmUgaGVsbG8gdGhlcmUgaGVsbG8gdGhlcmUgaGVsbG8g\r\n", 50) +
+		"--b--\r\n")
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := imap.Parse(imap.Message{UID: 1, Body: body}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
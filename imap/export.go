@@ -0,0 +1,251 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportSink receives the messages of an export, in ascending UID order.
+type ExportSink interface {
+	Export(msg Message) error
+}
+
+// ExportFunc is an ExportSink calling itself.
+type ExportFunc func(msg Message) error
+
+func (self ExportFunc) Export(msg Message) error {
+	return self(msg)
+}
+
+// ExportFlusher is an ExportSink buffering what it writes. Export flushes it before saving its progress in the
+// Checkpoint, so that the checkpoint never runs ahead of the messages written.
+type ExportFlusher interface {
+	ExportSink
+	Flush() error
+}
+
+// ExportCheckpointPrefix is prepended to the mailbox name when Export saves its progress in the Checkpoint of the
+// client, to keep it apart from the progress of HandleNew.
+var ExportCheckpointPrefix = "export:"
+
+// Export sends the complete messages matching all the IMAP search criteria, like "SINCE 1-Jan-2020", to sink, fetching
+// PageSize messages at a time. It doesn't mark the messages in any way.
+//
+// When the client has a Checkpoint, the UID of the last exported message of each page is saved in it, after flushing
+// sink if it's an ExportFlusher, and a later Export of the same mailbox continues after it. Use the same criteria when resuming, or messages between the two may be left out.
+func (self *Client) Export(ctx context.Context, criteria []string, sink ExportSink) (err error) {
+	checkpointName := ExportCheckpointPrefix + self.mailbox
+	var uidValidity uint32
+	var uids []uint32
+	if err = self.withStore(ctx, func(store MailStore) (err error) {
+		uidValidity = store.UIDValidity()
+		search := append([]string{}, criteria...)
+		var last uint32
+		if self.checkpoint != nil {
+			if last, err = self.checkpoint.LastUID(checkpointName, uidValidity); err != nil {
+				return
+			}
+			if last > 0 {
+				search = append(search, fmt.Sprintf("UID %v:*", last+1))
+			}
+		}
+		found, err := store.Search(ctx, search...)
+		if err != nil {
+			return
+		}
+		// UID n:* always matches the newest message, even when it's older than n.
+		for _, uid := range found {
+			if uid > last {
+				uids = append(uids, uid)
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+	for len(uids) > 0 {
+		n := PageSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err = self.withStore(ctx, func(store MailStore) (err error) {
+			if store.UIDValidity() != uidValidity {
+				return fmt.Errorf("imap: %v was renumbered during the export", self.mailbox)
+			}
+			fetched, err := store.Fetch(ctx, uids[:n]...)
+			if err != nil {
+				return
+			}
+			sort.Slice(fetched, func(i, j int) bool {
+				return fetched[i].UID < fetched[j].UID
+			})
+			var last uint32
+			for _, msg := range fetched {
+				if err = sink.Export(msg); err != nil {
+					break
+				}
+				last = msg.UID
+			}
+			if self.checkpoint == nil || last == 0 {
+				return
+			}
+			// The messages exported before a failing one are saved as well.
+			if flusher, ok := sink.(ExportFlusher); ok {
+				if e := flusher.Flush(); e != nil {
+					if err == nil {
+						err = e
+					}
+					return
+				}
+			}
+			if e := self.checkpoint.SetLastUID(checkpointName, uidValidity, last); err == nil {
+				err = e
+			}
+			return
+		}); err != nil {
+			return
+		}
+		uids = uids[n:]
+	}
+	return
+}
+
+// Mbox returns an ExportSink appending the messages to w in the mboxrd format, with the line endings converted to
+// LF. It isn't buffered, so wrap w in a bufio.Writer when that matters.
+func Mbox(w io.Writer) ExportSink {
+	lock := &sync.Mutex{}
+	return ExportFunc(func(msg Message) (err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "From MAILER-DAEMON %v\n", msg.InternalDate.UTC().Format(time.ANSIC))
+		scanner := bufio.NewScanner(bytes.NewReader(msg.Body))
+		scanner.Buffer(nil, len(msg.Body)+1)
+		for scanner.Scan() {
+			line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				buf.WriteByte('>')
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+		buf.WriteByte('\n')
+		_, err = w.Write(buf.Bytes())
+		return
+	})
+}
+
+// maildirFlags are the maildir info letters of the IMAP flags, in the alphabetical order maildir wants.
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', `\Draft`},
+	{'F', `\Flagged`},
+	{'R', `\Answered`},
+	{'S', `\Seen`},
+	{'T', `\Deleted`},
+}
+
+// Maildir returns an ExportSink writing the messages as files in the cur directory of the maildir dir, which is
+// created if necessary. The files are named after the UID, so exporting a message again replaces it. It's an
+// ExportFlusher syncing the files written since the last flush to disk.
+func Maildir(dir string) (result ExportSink, err error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	written := []string{}
+	export := ExportFunc(func(msg Message) (err error) {
+		has := map[string]bool{}
+		for _, flag := range msg.Flags {
+			has[flag] = true
+		}
+		info := []byte{}
+		for _, f := range maildirFlags {
+			if has[f.flag] {
+				info = append(info, f.letter)
+			}
+		}
+		name := fmt.Sprintf("%v.U%v.%v", msg.InternalDate.Unix(), msg.UID, hostname)
+		tmp := filepath.Join(dir, "tmp", name)
+		if err = ioutil.WriteFile(tmp, msg.Body, 0600); err != nil {
+			return
+		}
+		if err = os.Chtimes(tmp, msg.InternalDate, msg.InternalDate); err != nil {
+			os.Remove(tmp)
+			return
+		}
+		// Earlier exports of the message may have had other flags, and so other file names.
+		dest := filepath.Join(dir, "cur", name+":2,"+string(info))
+		earlier, err := filepath.Glob(filepath.Join(dir, "cur", name+":2,*"))
+		if err != nil {
+			return
+		}
+		if err = os.Rename(tmp, dest); err != nil {
+			os.Remove(tmp)
+			return
+		}
+		written = append(written, dest)
+		for _, path := range earlier {
+			if path != dest {
+				if err = os.Remove(path); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+	result = exportFlusher{export, func() (err error) {
+		for _, path := range append(written, filepath.Join(dir, "cur")) {
+			if err = syncPath(path); err != nil {
+				return
+			}
+		}
+		written = written[:0]
+		return
+	}}
+	return
+}
+
+// exportFlusher is an ExportFunc with a Flush.
+type exportFlusher struct {
+	ExportFunc
+	flush func() error
+}
+
+func (self exportFlusher) Flush() error {
+	return self.flush()
+}
+
+// syncPath commits the file or directory at path to disk.
+func syncPath(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return f.Sync()
+}
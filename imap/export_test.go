@@ -0,0 +1,81 @@
+package imap_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestExport(t *testing.T) {
+	mailbox := imaptest.New()
+	for _, subject := range []string{"a", "b", "c"} {
+		mailbox.Deliver("From: a@example.com\r\nSubject: " + subject + "\r\n\r\nFrom here\r\n")
+	}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(checkpoint{})
+	exported := []uint32{}
+	failing := imap.ExportFunc(func(msg imap.Message) error {
+		if msg.UID == 2 {
+			return fmt.Errorf("full")
+		}
+		exported = append(exported, msg.UID)
+		return nil
+	})
+	if err := c.Export(context.Background(), []string{"ALL"}, failing); err == nil {
+		t.Errorf("Wanted the sink error")
+	}
+	buf := &bytes.Buffer{}
+	mbox := imap.Mbox(buf)
+	if err := c.Export(context.Background(), []string{"ALL"}, imap.ExportFunc(func(msg imap.Message) error {
+		exported = append(exported, msg.UID)
+		return mbox.Export(msg)
+	})); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(exported, want) {
+		t.Errorf("Wanted %v exported but got %v", want, exported)
+	}
+	if got := strings.Count(buf.String(), "\nFrom MAILER-DAEMON "); got != 1 || strings.Count(buf.String(), "\n>From here\n") != 2 || strings.Contains(buf.String(), "\r") {
+		t.Errorf("Wanted two escaped messages with LF line endings, got %q", buf.String())
+	}
+	if handled := 0; c.HandleNew(func(*imap.Mail) error {
+		handled++
+		return nil
+	}) != nil || handled != 3 {
+		t.Errorf("Wanted the export to leave the messages for HandleNew, got %v handled", handled)
+	}
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildir, err := imap.Maildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func() []string {
+		if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Export(context.Background(), []string{"ALL"}, maildir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "cur", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	if files := export(); len(files) != 3 || !strings.HasSuffix(files[0], ":2,") {
+		t.Errorf("Wanted three unflagged messages, got %v", files)
+	}
+	mailbox.AddFlags(context.Background(), []string{`\Flagged`}, 1)
+	if files := export(); len(files) != 3 || !strings.HasSuffix(files[0], ":2,F") {
+		t.Errorf("Wanted the flagged message replaced, got %v", files)
+	}
+}
@@ -0,0 +1,112 @@
+package imap
+
+import (
+	"context"
+)
+
+// Folders are the names of the Gmail system folders, which are localized to the interface language of the account.
+type Folders struct {
+	All       string
+	Drafts    string
+	Important string
+	Sent      string
+	Spam      string
+	Starred   string
+	Trash     string
+}
+
+// MailboxInfo is a mailbox of the account, with its attributes, like \Sent or \Noselect.
+type MailboxInfo struct {
+	Name  string
+	Attrs []string
+}
+
+// MailboxLister is implemented by MailStores that can list the mailboxes of the account.
+type MailboxLister interface {
+	ListMailboxes(ctx context.Context) ([]MailboxInfo, error)
+}
+
+// Folders returns the system folders of the account. They are resolved from the mailbox attributes the first time,
+// and cached. Folders the server doesn't mark keep the English names, like SentMailbox.
+func (self *Client) Folders() (Folders, error) {
+	return self.FoldersContext(context.Background())
+}
+
+// FoldersContext is Folders, but gives up when ctx is done.
+func (self *Client) FoldersContext(ctx context.Context) (result Folders, err error) {
+	self.lock.Lock()
+	if self.folders != nil {
+		result = *self.folders
+		self.lock.Unlock()
+		return
+	}
+	self.lock.Unlock()
+	result = Folders{
+		All:       AllMailbox,
+		Drafts:    "[Gmail]/Drafts",
+		Important: "[Gmail]/Important",
+		Sent:      SentMailbox,
+		Spam:      SpamMailbox,
+		Starred:   "[Gmail]/Starred",
+		Trash:     TrashMailbox,
+	}
+	err = self.withStore(ctx, func(store MailStore) (err error) {
+		lister, ok := store.(MailboxLister)
+		if !ok {
+			return
+		}
+		mailboxes, err := lister.ListMailboxes(ctx)
+		if err != nil {
+			return
+		}
+		// Both the SPECIAL-USE (RFC 6154) attributes and the older XLIST names of them are recognized.
+		for _, mailbox := range mailboxes {
+			for _, attr := range mailbox.Attrs {
+				switch attr {
+				case `\All`, `\AllMail`:
+					result.All = mailbox.Name
+				case `\Drafts`:
+					result.Drafts = mailbox.Name
+				case `\Important`:
+					result.Important = mailbox.Name
+				case `\Sent`:
+					result.Sent = mailbox.Name
+				case `\Junk`, `\Spam`:
+					result.Spam = mailbox.Name
+				case `\Flagged`, `\Starred`:
+					result.Starred = mailbox.Name
+				case `\Trash`:
+					result.Trash = mailbox.Name
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.folders = &result
+	self.lock.Unlock()
+	return
+}
+
+// ListMailboxes uses LIST, since Gmail marks the system folders with their SPECIAL-USE attributes there as well.
+func (self *store) ListMailboxes(ctx context.Context) (result []MailboxInfo, err error) {
+	cmd, err := self.wait(ctx)(self.client.List("", "*"))
+	if err != nil {
+		return
+	}
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			mailbox := MailboxInfo{
+				Name: info.Name,
+			}
+			for attr := range info.Attrs {
+				mailbox.Attrs = append(mailbox.Attrs, attr)
+			}
+			result = append(result, mailbox)
+		}
+	}
+	return
+}
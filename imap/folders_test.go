@@ -0,0 +1,33 @@
+package imap_test
+
+import (
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestFolders(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.SetMailboxes(
+		imap.MailboxInfo{Name: "INBOX"},
+		imap.MailboxInfo{Name: "[Gmail]/Gesendet", Attrs: []string{`\HasNoChildren`, `\Sent`}},
+		imap.MailboxInfo{Name: "[Gmail]/Papierkorb", Attrs: []string{`\Trash`}},
+		imap.MailboxInfo{Name: "[Gmail]/Alle Nachrichten", Attrs: []string{`\AllMail`}},
+	)
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open)
+	folders, err := c.Folders()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if folders.Sent != "[Gmail]/Gesendet" || folders.Trash != "[Gmail]/Papierkorb" || folders.All != "[Gmail]/Alle Nachrichten" {
+		t.Errorf("Wanted the localized folders, got %+v", folders)
+	}
+	if folders.Spam != imap.SpamMailbox {
+		t.Errorf("Wanted unmarked folders to keep their default names, got %+v", folders)
+	}
+	mailbox.SetMailboxes()
+	if cached, err := c.ForMailbox("other").Folders(); err != nil || cached != folders {
+		t.Errorf("Wanted the folders cached, got %+v and %v", cached, err)
+	}
+}
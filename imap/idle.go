@@ -0,0 +1,65 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// IdleRenew is how often Idle restarts the IDLE command, since servers may end it after 30 minutes.
+var IdleRenew = 25 * time.Minute
+
+// Idle waits for new mail in the mailbox of the client using IMAP IDLE, on a connection of its own, and calls notify
+// every time the server reports that the mailbox grew. ready, if not nil, is called once the server accepted the first
+// IDLE command. Idle returns nil when stop is closed, and an error when connecting fails or the connection is lost.
+// Clients with a replaced MailStore can't idle, and get ErrNoRawClient.
+func (self *Client) Idle(stop <-chan struct{}, ready, notify func()) (err error) {
+	if self.mailStore != nil {
+		return ErrNoRawClient
+	}
+	opened, err := self.connect(context.Background())
+	if err != nil {
+		return
+	}
+	defer opened.Close()
+	return idle(opened.(*store).client, stop, ready, notify)
+}
+
+// idle runs IDLE commands on client, which must have a mailbox selected, until stop is closed or the connection fails.
+func idle(client *imap.Client, stop <-chan struct{}, ready, notify func()) (err error) {
+	for {
+		if _, err = client.Idle(); err != nil {
+			return
+		}
+		if ready != nil {
+			ready()
+			ready = nil
+		}
+		for renew := time.Now().Add(IdleRenew); time.Now().Before(renew); {
+			select {
+			case <-stop:
+				_, err = client.IdleTerm()
+				return
+			default:
+			}
+			if err = client.Recv(PollInterval); err != nil && err != imap.ErrTimeout {
+				return
+			}
+			err = nil
+			grew := false
+			for _, rsp := range client.Data {
+				if rsp.Label == "EXISTS" {
+					grew = true
+				}
+			}
+			client.Data = nil
+			if grew {
+				notify()
+			}
+		}
+		if _, err = client.IdleTerm(); err != nil {
+			return
+		}
+	}
+}
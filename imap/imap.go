@@ -2,103 +2,669 @@ package imap
 
 import (
 	"bytes"
-	"io"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/mail"
-	"github.com/jhillyerd/go.enmime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"code.google.com/p/go-imap/go1/imap"
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/dialer"
+	"github.com/zond/gmail/mimeutil"
+	"github.com/zond/gmail/retry"
+
+	"github.com/mxk/go-imap/imap"
 )
 
-type MailHandler func(*enmime.MIMEBody) error
+type MailHandler func(*Mail) error
+
+// MailboxReset is emitted when the UIDVALIDITY of the mailbox changed since the last time the client saw it,
+// which means that any UIDs seen before are stale.
+type MailboxReset struct {
+	Mailbox        string
+	OldUIDValidity uint32
+	NewUIDValidity uint32
+}
 
 var OldKeyword = "FETCHEDBYAPI"
 
+// The English names of the Gmail system folders. Folders resolves the names used by accounts in other languages, and
+// falls back to these.
+var (
+	SpamMailbox  = "[Gmail]/Spam"
+	TrashMailbox = "[Gmail]/Trash"
+	SentMailbox  = "[Gmail]/Sent Mail"
+	// AllMailbox contains all mail except spam and trash, whatever its labels.
+	AllMailbox = "[Gmail]/All Mail"
+)
+
+const (
+	imapHost = "imap.gmail.com"
+	imapAddr = "imap.gmail.com:993"
+)
+
+var DefaultConfig = tls.Config{
+	ServerName: imapHost,
+	MinVersion: tls.VersionTLS12,
+}
+
+var GreetingTimeout = 30 * time.Second
+
+var ErrNoRawClient = errors.New("the mail store is not an IMAP connection")
+
+// ErrReadOnly is returned by the operations that would modify mail when the client is ReadOnly.
+var ErrReadOnly = errors.New("imap: the client is read-only")
+
+// ErrIMAPDisabled is returned when logging in fails because IMAP is disabled in the Gmail settings of the account, and
+// there is no Fallback.
+var ErrIMAPDisabled = errors.New("imap: IMAP is disabled for the account")
+
 type Client struct {
-	user     string
-	password string
+	mailbox     string
+	credentials *auth.Swappable
+	tlsConfig   *tls.Config
+	tlsHandler  func(state tls.ConnectionState) error
+	mailStore   func(ctx context.Context) (MailStore, error)
+	// opLock serializes the operations that use a connection.
+	opLock        sync.Mutex
+	lock          sync.Mutex
+	uidValidity   uint32
+	labels        labelCache
+	resetHandler  func(reset MailboxReset)
+	labelsHandler func(change LabelsChanged)
+	// unparsableHandler is told about the messages HandleNew passed over since they can't be parsed.
+	unparsableHandler func(fetched Message, err error)
+	checkpoint        Checkpoint
+	dedup             Dedup
+	authHandler       func(e auth.Event)
+	retryPolicy       retry.Policy
+	parkAfter         time.Duration
+	skipBefore        time.Time
+	// skipMarked is whether the mail before skipBefore was marked in bulk. It is guarded by opLock.
+	skipMarked bool
+	// maxInitial is guarded by opLock, and reset by the first HandleNew using it.
+	maxInitial  int
+	unseenSince time.Duration
+	// session, sessionExpiry, parkTimer, sessionGeneration and parked are guarded by opLock, and sessionStats by lock.
+	// sessionExpiry is when the credentials the session logged in with expire, if they do.
+	session           MailStore
+	sessionExpiry     time.Time
+	parkTimer         clock.Timer
+	sessionGeneration int
+	parked            bool
+	sessionStats      SessionStats
+	// folders caches the result of Folders, and is guarded by lock.
+	folders      *Folders
+	skipExisting bool
+	fallback     func(ctx context.Context, mailbox string) (MailStore, error)
+	readOnly     bool
+	keyword      string
+	clock        clock.Clock
+}
+
+func New(user, password string) (result *Client) {
+	result = &Client{
+		mailbox: "INBOX",
+		credentials: auth.NewSwappable(auth.Static{
+			User:     user,
+			Password: password,
+		}),
+		tlsConfig: DefaultConfig.Clone(),
+		clock:     clock.Real,
+	}
+	return
 }
 
-func New(user, password string) *Client {
+// ForMailbox returns a client for another mailbox, like SpamMailbox, sharing the credentials and TLS settings of this one.
+// A replaced MailStore is shared as well, so replace it again if the copy needs another one.
+func (self *Client) ForMailbox(name string) *Client {
+	self.lock.Lock()
+	folders := self.folders
+	self.lock.Unlock()
 	return &Client{
-		user:     user,
-		password: password,
+		mailbox:           name,
+		credentials:       self.credentials,
+		tlsConfig:         self.tlsConfig,
+		tlsHandler:        self.tlsHandler,
+		mailStore:         self.mailStore,
+		resetHandler:      self.resetHandler,
+		labelsHandler:     self.labelsHandler,
+		unparsableHandler: self.unparsableHandler,
+		checkpoint:        self.checkpoint,
+		dedup:             self.dedup,
+		authHandler:       self.authHandler,
+		retryPolicy:       self.retryPolicy,
+		parkAfter:         self.parkAfter,
+		skipBefore:        self.skipBefore,
+		unseenSince:       self.unseenSince,
+		folders:           folders,
+		skipExisting:      self.skipExisting,
+		fallback:          self.fallback,
+		readOnly:          self.readOnly,
+		keyword:           self.keyword,
+		clock:             self.clock,
 	}
 }
 
-func (self *Client) connect() (result *imap.Client, err error) {
-	result, err = imap.DialTLS("imap.gmail.com:993", nil)
+// MailStore replaces the IMAP connection with whatever f returns. Every call to f should return a fresh MailStore with
+// the mailbox of the client selected, which will be closed when no longer needed.
+func (self *Client) MailStore(f func(ctx context.Context) (MailStore, error)) *Client {
+	self.mailStore = f
+	return self
+}
+
+// Fallback makes the client use the MailStore f returns for its mailbox instead of IMAP when IMAP is disabled for the
+// account, like rest.API#Open does.
+func (self *Client) Fallback(f func(ctx context.Context, mailbox string) (MailStore, error)) *Client {
+	self.fallback = f
+	return self
+}
+
+// MailboxResetHandler will be called, before any new mail is handled, when the client notices that the UIDs of the
+// mailbox were renumbered.
+func (self *Client) MailboxResetHandler(f func(reset MailboxReset)) *Client {
+	self.resetHandler = f
+	return self
+}
+
+// UnparsableHandler will be called with the messages HandleNew can't parse, and an UnparsableError. Those messages are
+// marked and checkpointed like handled ones, so that they don't hold back the mail after them, and left in the mailbox.
+func (self *Client) UnparsableHandler(f func(fetched Message, err error)) *Client {
+	self.unparsableHandler = f
+	return self
+}
+
+// Keyword makes HandleNew mark the mail it handled with keyword instead of OldKeyword. Gmail shares keywords between
+// all the folders of a message, so clients handling the same messages in different folders need different keywords.
+func (self *Client) Keyword(keyword string) *Client {
+	self.keyword = keyword
+	return self
+}
+
+// handledKeyword is the keyword marking the handled mail.
+func (self *Client) handledKeyword() string {
+	if self.keyword != "" {
+		return self.keyword
+	}
+	return OldKeyword
+}
+
+// SkipBefore makes HandleNew mark mail received before t with OldKeyword without calling the handler, so that a
+// mailbox full of old unread mail doesn't flood the handler. A zero t handles all mail.
+func (self *Client) SkipBefore(t time.Time) *Client {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	self.skipBefore = t
+	self.skipMarked = false
+	return self
+}
+
+// MaxInitialMessages makes the next HandleNew handle at most the n newest messages. The older ones are marked with
+// OldKeyword without calling the handler, and the handled ones have Truncated set.
+func (self *Client) MaxInitialMessages(n int) *Client {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	self.maxInitial = n
+	return self
+}
+
+// UnseenSince makes HandleNew only look for mail received within d, using SEARCH SINCE, which ignores the time of day.
+// Older mail is left as is. Zero looks for all mail.
+func (self *Client) UnseenSince(d time.Duration) *Client {
+	self.unseenSince = d
+	return self
+}
+
+// ReconnectPolicy makes operations retry connecting, or opening the replaced MailStore, when it fails. By default they
+// fail at once.
+func (self *Client) ReconnectPolicy(policy retry.Policy) *Client {
+	self.retryPolicy = policy
+	return self
+}
+
+// AuthHandler will be called after each login attempt, successful or not.
+func (self *Client) AuthHandler(f func(e auth.Event)) *Client {
+	self.authHandler = f
+	return self
+}
+
+// UpdateCredentials replaces the credentials provider. The new credentials will be used the next time the client logs in.
+func (self *Client) UpdateCredentials(provider auth.Provider) *Client {
+	self.credentials.Swap(provider)
+	return self
+}
+
+// TLSVersions limits the TLS versions negotiated with the server. A zero max means no upper limit.
+func (self *Client) TLSVersions(min, max uint16) *Client {
+	self.tlsConfig.MinVersion = min
+	self.tlsConfig.MaxVersion = max
+	return self
+}
+
+// CipherSuites limits the TLS 1.0-1.2 cipher suites offered to the server.
+func (self *Client) CipherSuites(suites ...uint16) *Client {
+	self.tlsConfig.CipherSuites = suites
+	return self
+}
+
+// TLSSessionCache lets reconnects resume earlier TLS sessions stored in cache, which isn't done by default.
+func (self *Client) TLSSessionCache(cache tls.ClientSessionCache) *Client {
+	self.tlsConfig.ClientSessionCache = cache
+	return self
+}
+
+// TLSHandler will be called with the negotiated connection state after each handshake.
+// If it returns an error the connection is closed and the error returned to the caller.
+func (self *Client) TLSHandler(f func(state tls.ConnectionState) error) *Client {
+	self.tlsHandler = f
+	return self
+}
+
+func (self *Client) dial(ctx context.Context) (result *imap.Client, conn *tls.Conn, err error) {
+	c, err := dialer.DialContext(ctx, imapAddr)
+	if err != nil {
+		return
+	}
+	conn = tls.Client(c, self.tlsConfig)
+	if err = conn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return
+	}
+	if self.tlsHandler != nil {
+		if err = self.tlsHandler(conn.ConnectionState()); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	if result, err = imap.NewClient(conn, imapHost, GreetingTimeout); err != nil {
+		conn.Close()
+		return
+	}
+	return
+}
+
+// xoauth2 is the Google XOAUTH2 SASL mechanism.
+type xoauth2 struct {
+	creds auth.Credentials
+	ir    []byte
+}
+
+func (self *xoauth2) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	self.ir = append([]byte("user="+self.creds.User+"\x01auth=Bearer "), self.creds.Token...)
+	self.ir = append(self.ir, "\x01\x01"...)
+	return "XOAUTH2", self.ir, nil
+}
+
+// Next answers the error challenge sent on failure with an empty response, which makes the server send the failure.
+func (self *xoauth2) Next(challenge []byte) (response []byte, err error) {
+	return []byte{}, nil
+}
+
+func (self *Client) connect(ctx context.Context) (result MailStore, err error) {
+	creds, err := self.credentials.Credentials()
+	if err != nil {
+		return
+	}
+	client, conn, err := self.dial(ctx)
 	if err != nil {
 		return
 	}
-	if _, err = result.Login(self.user, self.password); err != nil {
+	// Login and Select are synchronous, so the only way to interrupt them is to close the connection.
+	loginCtx, cancel := context.WithTimeout(ctx, CommandTimeout)
+	defer cancel()
+	stop := context.AfterFunc(loginCtx, func() {
+		conn.Close()
+	})
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() == nil && loginCtx.Err() != nil {
+			err = ErrTimeout
+		}
+	}()
+	mechanism := "LOGIN"
+	if creds.Token != "" {
+		mechanism = "XOAUTH2"
+		sasl := &xoauth2{creds: creds}
+		_, err = client.Auth(sasl)
+		auth.Zero(sasl.ir)
+	} else {
+		_, err = client.Login(creds.User, creds.Password)
+	}
+	if self.authHandler != nil {
+		self.authHandler(auth.NewEvent("imap", imapHost, creds.User, mechanism, err))
+	}
+	if err != nil {
+		client.Logout(GreetingTimeout)
+		if strings.Contains(err.Error(), "not enabled for IMAP") {
+			err = ErrIMAPDisabled
+		}
 		return
 	}
-	if _, err = result.Select("INBOX", false); err != nil {
+	if _, err = client.Select(self.mailbox, self.readOnly); err != nil {
+		client.Logout(GreetingTimeout)
 		return
 	}
+	result = &store{
+		client:  client,
+		mailbox: self.mailbox,
+	}
 	return
 }
 
-func (self *Client) GetNew() (result []enmime.MIMEBody, err error) {
-	handler := func(msg *enmime.MIMEBody) error {
+func (self *Client) GetNew() (result []Mail, err error) {
+	return self.GetNewContext(context.Background())
+}
+
+func (self *Client) GetNewContext(ctx context.Context) (result []Mail, err error) {
+	handler := func(msg *Mail) error {
 		result = append(result, *msg)
 		return nil
 	}
-	if err = self.HandleNew(handler); err != nil {
+	if err = self.HandleNewContext(ctx, handler); err != nil {
 		return
 	}
 	return
 }
 
+// DeliveryError is returned when the handler failed for some messages, and contains the error for each failed UID.
+// Those messages are neither marked as handled nor checkpointed, so the next call will try them again.
+type DeliveryError map[uint32]error
+
+func (self DeliveryError) Error() string {
+	uids := []uint32{}
+	for uid := range self {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+	return fmt.Sprintf("handler failed for %v message(s), first UID %v: %v", len(uids), uids[0], self[uids[0]])
+}
+
+// UnparsableError is given to the UnparsableHandler for a message that can't be parsed.
+type UnparsableError struct {
+	Mailbox string
+	UID     uint32
+	Err     error
+}
+
+func (self UnparsableError) Error() string {
+	return fmt.Sprintf("imap: passing over message %v in %v, which can't be parsed: %v", self.UID, self.Mailbox, self.Err)
+}
+
+// HandleNew calls handler with each message without OldKeyword, or the Keyword of the client, and marks the ones where
+// it returned no error with it. If it failed for any message, a DeliveryError is returned.
 func (self *Client) HandleNew(handler MailHandler) (err error) {
-	client, err := self.connect()
+	return self.HandleNewContext(context.Background(), handler)
+}
+
+func (self *Client) open(ctx context.Context) (result MailStore, err error) {
+	for attempt := 1; ; attempt++ {
+		if self.mailStore != nil {
+			result, err = self.mailStore(ctx)
+		} else if result, err = self.connect(ctx); err == ErrIMAPDisabled && self.fallback != nil {
+			result, err = self.fallback(ctx, self.mailbox)
+		}
+		if err == nil && self.readOnly {
+			result = readOnlyStore{result}
+		}
+		if err == nil || err == ErrIMAPDisabled || self.retryPolicy == nil || ctx.Err() != nil {
+			return
+		}
+		delay, ok := self.retryPolicy.Next(attempt)
+		if !ok {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-self.clock.After(delay):
+		}
+	}
+}
+
+// RawIMAP runs f with a logged in go-imap client with the mailbox of the client selected, to allow using commands this package doesn't wrap.
+// The connection is closed when f returns, and f must not keep any reference to it.
+// Calls are serialized with all other operations of the client.
+func (self *Client) RawIMAP(f func(client *imap.Client) error) error {
+	return self.RawIMAPContext(context.Background(), f)
+}
+
+// RawIMAPContext is RawIMAP, but gives up connecting when ctx is done.
+func (self *Client) RawIMAPContext(ctx context.Context, f func(client *imap.Client) error) (err error) {
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	opened, err := self.acquire(ctx)
 	if err != nil {
 		return
 	}
-	defer client.Close(false)
-	cmd, err := imap.Wait(client.UIDSearch("UNKEYWORD " + OldKeyword))
+	// The session isn't kept, since f may change its state.
+	defer opened.Close()
+	raw, ok := opened.(*store)
+	if !ok {
+		err = ErrNoRawClient
+		return
+	}
+	return f(raw.client)
+}
+
+// HandleNewContext is HandleNew, but gives up when ctx is done.
+func (self *Client) HandleNewContext(ctx context.Context, handler MailHandler) (err error) {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	store, err := self.acquire(ctx)
 	if err != nil {
 		return
 	}
-	foundSeq := &imap.SeqSet{}
-	for _, rsp := range cmd.Data {
-		for _, res := range rsp.SearchResults() {
-			foundSeq.AddNum(res)
+	defer func() {
+		self.release(store, err)
+	}()
+	uidValidity := store.UIDValidity()
+	self.checkUIDValidity(uidValidity)
+	if !self.skipBefore.IsZero() && !self.skipMarked && !self.readOnly {
+		// SEARCH BEFORE ignores the time of day and the time zone, so only the bulk of the older mail is marked here,
+		// and the rest is skipped one message at a time below.
+		var old []uint32
+		if old, err = store.Search(ctx, "UNKEYWORD "+self.handledKeyword(), "BEFORE "+self.skipBefore.AddDate(0, 0, -1).Format("2-Jan-2006")); err != nil {
+			return
 		}
+		if err = store.AddFlags(ctx, []string{self.handledKeyword()}, old...); err != nil {
+			return
+		}
+		self.skipMarked = true
 	}
-
-	if !foundSeq.Empty() {
-		var fetchCmd *imap.Command
-		fetchCmd, err = imap.Wait(client.UIDFetch(foundSeq, "RFC822.TEXT", "RFC822.HEADER"))
-		if err != nil {
+	criteria := []string{"UNKEYWORD " + self.handledKeyword()}
+	if self.unseenSince > 0 {
+		criteria = append(criteria, "SINCE "+time.Now().Add(-self.unseenSince).Format("2-Jan-2006"))
+	}
+	var last uint32
+	if self.checkpoint != nil {
+		if last, err = self.checkpoint.LastUID(self.mailbox, uidValidity); err != nil {
 			return
 		}
-		markSeq := &imap.SeqSet{}
-		for _, rsp := range fetchCmd.Data {
-			buf := &bytes.Buffer{}
-			if _, err = rsp.MessageInfo().Attrs["RFC822.HEADER"].(io.WriterTo).WriteTo(buf); err != nil {
-				return
+		if last > 0 {
+			criteria = append(criteria, fmt.Sprintf("UID %v:*", last+1))
+		}
+	}
+	// With an Unacked checkpoint, the messages the handler failed for are below the checkpoint, and retried by UID.
+	unacked, tracked := self.checkpoint.(Unacked)
+	var pending []uint32
+	if tracked {
+		if pending, err = unacked.UnackedUIDs(self.mailbox, uidValidity); err != nil {
+			return
+		}
+	}
+	found, err := store.Search(ctx, criteria...)
+	if err != nil {
+		return
+	}
+	// UID n:* always matches the last message, even if its UID is lower than n.
+	uids := []uint32{}
+	for _, uid := range found {
+		if uid > last {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+	// The older messages left out by MaxInitialMessages are marked as if handled.
+	handled := []uint32{}
+	truncated := false
+	if self.maxInitial > 0 {
+		if len(uids) > self.maxInitial {
+			handled = append(handled, uids[:len(uids)-self.maxInitial]...)
+			uids = uids[len(uids)-self.maxInitial:]
+			last = handled[len(handled)-1]
+			truncated = true
+		}
+		self.maxInitial = 0
+	}
+	uids = append(append([]uint32{}, pending...), uids...)
+	msgs, err := store.Fetch(ctx, uids...)
+	if err != nil {
+		return
+	}
+	fetchedAt := time.Now()
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].UID < msgs[j].UID
+	})
+	failures := DeliveryError{}
+	// Without an Unacked checkpoint, failed messages are retried, so the checkpoint can't move past them.
+	advance := func(uid uint32) {
+		if (tracked || len(failures) == 0) && uid > last {
+			last = uid
+		}
+	}
+	for _, fetched := range msgs {
+		var parsed *Mail
+		if parsed, err = Parse(fetched); err != nil {
+			// Parsing it again won't help, so the message is passed over instead of holding back the rest for good.
+			if self.unparsableHandler != nil {
+				self.unparsableHandler(fetched, UnparsableError{Mailbox: self.mailbox, UID: fetched.UID, Err: err})
 			}
-			if _, err = rsp.MessageInfo().Attrs["RFC822.TEXT"].(io.WriterTo).WriteTo(buf); err != nil {
+			err = nil
+			handled = append(handled, fetched.UID)
+			advance(fetched.UID)
+			continue
+		}
+		parsed.Fetched = fetchedAt
+		parsed.Truncated = truncated
+		if parsed.InternalDate.Before(self.skipBefore) {
+			handled = append(handled, fetched.UID)
+			advance(fetched.UID)
+			continue
+		}
+		key := ""
+		if self.dedup != nil {
+			key = self.dedupKey(uidValidity, parsed)
+			var seen bool
+			if seen, err = self.dedup.Seen(key); err != nil {
 				return
 			}
-			var msg *mail.Message
-			if msg, err = mail.ReadMessage(buf); err != nil {
-				return
+			if seen {
+				handled = append(handled, fetched.UID)
+				advance(fetched.UID)
+				continue
 			}
-			var mimebod *enmime.MIMEBody
-			if mimebod, err = enmime.ParseMIMEBody(msg); err != nil {
+		}
+		if e := handler(parsed); e == nil {
+			if err = parsed.apply(ctx, store); err != nil {
 				return
 			}
-			if e := handler(mimebod); e == nil {
-				markSeq.AddNum(rsp.MessageInfo().UID)
+			if self.dedup != nil {
+				if err = self.dedup.MarkSeen(key); err != nil {
+					return
+				}
 			}
+			handled = append(handled, fetched.UID)
+			self.lock.Lock()
+			self.labels.set(fetched.UID, fetched.Labels)
+			self.lock.Unlock()
+			advance(fetched.UID)
+		} else {
+			failures[fetched.UID] = e
+			advance(fetched.UID)
 		}
-		if !markSeq.Empty() {
-			if _, err = imap.Wait(client.Store(markSeq, "FLAGS", []imap.Field{OldKeyword})); err != nil {
-				return
-			}
+	}
+	if !self.readOnly {
+		if err = store.AddFlags(ctx, []string{self.handledKeyword()}, handled...); err != nil {
+			return
+		}
+	}
+	if tracked && (len(pending) > 0 || len(failures) > 0) {
+		failed := []uint32{}
+		for uid := range failures {
+			failed = append(failed, uid)
+		}
+		sort.Slice(failed, func(i, j int) bool {
+			return failed[i] < failed[j]
+		})
+		// The failures are saved before the checkpoint moves past them.
+		if err = unacked.SetUnackedUIDs(self.mailbox, uidValidity, failed); err != nil {
+			return
 		}
 	}
+	if self.checkpoint != nil && (len(handled) > 0 || tracked && len(failures) > 0) {
+		if err = self.checkpoint.SetLastUID(self.mailbox, uidValidity, last); err != nil {
+			return
+		}
+	}
+	if len(failures) > 0 {
+		err = failures
+	}
+	return
+}
+
+// Parse parses a message fetched from a MailStore, the way the messages given to a MailHandler are.
+func Parse(fetched Message) (result *Mail, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(fetched.Body))
+	if err != nil {
+		return
+	}
+	mimebod, err := mimeutil.ParseMIMEBody(msg)
+	if err != nil {
+		return
+	}
+	result = &Mail{
+		MIMEBody:     mimebod,
+		UID:          fetched.UID,
+		GmailID:      fetched.GmailID,
+		ThreadID:     fetched.ThreadID,
+		Flags:        fetched.Flags,
+		Labels:       fetched.Labels,
+		InternalDate: fetched.InternalDate,
+		Snippet:      snippet(mimebod),
+		Verdict:      verdict(msg.Header),
+	}
+	if result.ThreadID == 0 {
+		// Without X-GM-THRID, the thread is identified by the oldest message referred to, see Threads.
+		Threads([]*Mail{result})
+	}
 	return
 }
+
+func (self *Client) checkUIDValidity(uidValidity uint32) {
+	self.lock.Lock()
+	old := self.uidValidity
+	self.uidValidity = uidValidity
+	if old != uidValidity {
+		self.labels.clear()
+	}
+	self.lock.Unlock()
+	if old != 0 && old != uidValidity && self.resetHandler != nil {
+		self.resetHandler(MailboxReset{
+			Mailbox:        self.mailbox,
+			OldUIDValidity: old,
+			NewUIDValidity: uidValidity,
+		})
+	}
+}
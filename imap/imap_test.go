@@ -1,8 +1,16 @@
 package imap
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
 )
 
 func TestIMAPGet(t *testing.T) {
@@ -12,3 +20,129 @@ func TestIMAPGet(t *testing.T) {
 		panic(err)
 	}
 }
+
+// stallingStore returns a store on a server that only answers SELECT, and stalls everything else.
+func stallingStore(t *testing.T) *store {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { serverConn.Close() })
+	go func() {
+		fmt.Fprintf(serverConn, "* PREAUTH [CAPABILITY IMAP4rev1] ready\r\n")
+		r := bufio.NewReader(serverConn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "SELECT" {
+				fmt.Fprintf(serverConn, "* 0 EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n%v OK [READ-WRITE] done\r\n", fields[0])
+			}
+		}
+	}()
+	client, err := imap.NewClient(clientConn, "example.com", time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := client.Select("INBOX", false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return &store{client: client, mailbox: "INBOX"}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		CommandTimeout = timeout
+	}(CommandTimeout)
+	CommandTimeout = 50 * time.Millisecond
+	s := stallingStore(t)
+	if _, err := s.Search(context.Background(), "ALL"); err != ErrTimeout {
+		t.Errorf("Wanted ErrTimeout, got %v", err)
+	}
+}
+
+// expiredContext has a deadline that passed, without being done yet.
+type expiredContext struct {
+	context.Context
+}
+
+func (self expiredContext) Deadline() (time.Time, bool) {
+	return time.Now().Add(-time.Second), true
+}
+
+func TestExpiredDeadline(t *testing.T) {
+	s := stallingStore(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Search(expiredContext{context.Background()}, "ALL")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Wanted DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Search never gave up")
+	}
+}
+
+func TestIdle(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	idling := make(chan string, 1)
+	go func() {
+		fmt.Fprintf(serverConn, "* PREAUTH [CAPABILITY IMAP4rev1 IDLE] ready\r\n")
+		r := bufio.NewReader(serverConn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) > 1 && fields[1] == "SELECT":
+				fmt.Fprintf(serverConn, "* 0 EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n%v OK [READ-WRITE] done\r\n", fields[0])
+			case len(fields) > 1 && fields[1] == "IDLE":
+				fmt.Fprintf(serverConn, "+ idling\r\n")
+				idling <- fields[0]
+			case len(fields) == 1 && fields[0] == "DONE":
+				fmt.Fprintf(serverConn, "%v OK done\r\n", <-idling)
+			}
+		}
+	}()
+	client, err := imap.NewClient(clientConn, "example.com", time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := client.Select("INBOX", false); err != nil {
+		t.Fatalf("%v", err)
+	}
+	stop := make(chan struct{})
+	ready, notified, done := make(chan struct{}), make(chan struct{}, 1), make(chan error)
+	go func() {
+		done <- idle(client, stop, func() {
+			close(ready)
+		}, func() {
+			notified <- struct{}{}
+		})
+	}()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatalf("Never idling")
+	}
+	fmt.Fprintf(serverConn, "* 1 EXISTS\r\n")
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatalf("Not notified of new mail")
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wanted idling to stop without error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Idling didn't stop")
+	}
+}
@@ -0,0 +1,477 @@
+// Package imaptest provides an in-memory imap.MailStore, to let code using github.com/zond/gmail/imap be tested
+// deterministically and without network access.
+//
+//	mailbox := imaptest.New()
+//	mailbox.Deliver("From: someone@example.com\r\nSubject: hello\r\n\r\nbody")
+//	client := imap.New("user@example.com", "password").MailStore(mailbox.Open)
+package imaptest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+const dateFormat = "2-Jan-2006"
+
+// GmailIDBase is added to the original UID of each message to create its fake X-GM-MSGID and X-GM-THRID.
+const GmailIDBase = 1 << 60
+
+type message struct {
+	uid uint32
+	// gmailID is kept when the mailbox is renumbered, like on Gmail.
+	gmailID uint64
+	flags   map[string]bool
+	labels  []string
+	date    time.Time
+	body    []byte
+}
+
+// Mailbox is a thread safe in-memory mailbox implementing imap.MailStore.
+type Mailbox struct {
+	lock        sync.Mutex
+	nextUID     uint32
+	uidValidity uint32
+	messages    []*message
+	mailboxes   []imap.MailboxInfo
+}
+
+func New() *Mailbox {
+	return &Mailbox{
+		nextUID:     1,
+		uidValidity: 1,
+	}
+}
+
+// Open has the signature expected by imap.Client#MailStore.
+func (self *Mailbox) Open(ctx context.Context) (imap.MailStore, error) {
+	return self, ctx.Err()
+}
+
+// Fetch returns raw as the Mail an imap.Client hands its mail handler, to test handlers with. It fails t if raw can't be
+// delivered or handled.
+func Fetch(t testing.TB, raw string) (result *imap.Mail) {
+	t.Helper()
+	mailbox := New()
+	mailbox.Deliver(raw)
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(func(msg *imap.Mail) error {
+		result = msg
+		return nil
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if result == nil {
+		t.Fatalf("%q wasn't handled", raw)
+	}
+	return
+}
+
+// Deliver appends a message without flags and returns its UID.
+func (self *Mailbox) Deliver(body string) uint32 {
+	return self.add(nil, nil, time.Now(), []byte(body))
+}
+
+// DeliverMessage appends a message with the Body, Flags, Labels and InternalDate of msg, and returns its UID.
+func (self *Mailbox) DeliverMessage(msg imap.Message) (uid uint32) {
+	return self.add(msg.Flags, msg.Labels, msg.InternalDate, msg.Body)
+}
+
+func (self *Mailbox) Append(ctx context.Context, flags []string, date time.Time, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	self.add(flags, nil, date, body)
+	return nil
+}
+
+func (self *Mailbox) add(flags, labels []string, date time.Time, body []byte) (uid uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	msg := &message{
+		uid:     self.nextUID,
+		gmailID: GmailIDBase + uint64(self.nextUID),
+		flags:   map[string]bool{},
+		labels:  append([]string{}, labels...),
+		date:    date,
+		body:    append([]byte{}, body...),
+	}
+	for _, flag := range flags {
+		msg.flags[flag] = true
+	}
+	self.nextUID++
+	self.messages = append(self.messages, msg)
+	return msg.uid
+}
+
+func (self *Mailbox) UIDValidity() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.uidValidity
+}
+
+// Renumber simulates the server renumbering the mailbox: the UIDVALIDITY is incremented and all messages get
+// new UIDs, starting after the highest UID previously used.
+func (self *Mailbox) Renumber() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.uidValidity++
+	for _, msg := range self.messages {
+		msg.uid = self.nextUID
+		self.nextUID++
+	}
+}
+
+// SetLabels replaces the Gmail labels of the message with the given UID.
+func (self *Mailbox) SetLabels(uid uint32, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		if msg.uid == uid {
+			msg.labels = append([]string{}, labels...)
+		}
+	}
+}
+
+// SetMailboxes replaces the mailboxes returned by ListMailboxes.
+func (self *Mailbox) SetMailboxes(mailboxes ...imap.MailboxInfo) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mailboxes = append([]imap.MailboxInfo{}, mailboxes...)
+}
+
+// ListMailboxes implements imap.MailboxLister.
+func (self *Mailbox) ListMailboxes(ctx context.Context) ([]imap.MailboxInfo, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]imap.MailboxInfo{}, self.mailboxes...), ctx.Err()
+}
+
+// Flags returns the sorted flags of the message with the given UID.
+func (self *Mailbox) Flags(uid uint32) (result []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		if msg.uid == uid {
+			for flag := range msg.flags {
+				result = append(result, flag)
+			}
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+func (self *Mailbox) Search(ctx context.Context, criteria ...string) (result []uint32, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	tokens := []string{}
+	for _, criterion := range criteria {
+		tokens = append(tokens, tokenize(criterion)...)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		var match bool
+		if match, err = matches(msg, tokens); err != nil {
+			return
+		}
+		if match {
+			result = append(result, msg.uid)
+		}
+	}
+	return
+}
+
+// FetchHeaders implements imap.HeaderFetcher.
+func (self *Mailbox) FetchHeaders(ctx context.Context, uids ...uint32) (result []imap.Message, err error) {
+	if result, err = self.Fetch(ctx, uids...); err != nil {
+		return
+	}
+	for i := range result {
+		if end := bytes.Index(result[i].Body, []byte("\r\n\r\n")); end != -1 {
+			result[i].Body = result[i].Body[:end+4]
+		}
+	}
+	return
+}
+
+func (self *Mailbox) Fetch(ctx context.Context, uids ...uint32) (result []imap.Message, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	wanted := map[uint32]bool{}
+	for _, uid := range uids {
+		wanted[uid] = true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		if wanted[msg.uid] {
+			fetched := imap.Message{
+				UID:          msg.uid,
+				GmailID:      msg.gmailID,
+				ThreadID:     msg.gmailID,
+				Labels:       append([]string{}, msg.labels...),
+				InternalDate: msg.date,
+				Body:         append([]byte{}, msg.body...),
+			}
+			for flag := range msg.flags {
+				fetched.Flags = append(fetched.Flags, flag)
+			}
+			sort.Strings(fetched.Flags)
+			result = append(result, fetched)
+		}
+	}
+	return
+}
+
+func (self *Mailbox) AddFlags(ctx context.Context, flags []string, uids ...uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	wanted := map[uint32]bool{}
+	for _, uid := range uids {
+		wanted[uid] = true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		if wanted[msg.uid] {
+			for _, flag := range flags {
+				msg.flags[flag] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (self *Mailbox) AddLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return self.updateLabels(ctx, uids, func(current []string) []string {
+		for _, label := range labels {
+			found := false
+			for _, existing := range current {
+				found = found || existing == label
+			}
+			if !found {
+				current = append(current, label)
+			}
+		}
+		return current
+	})
+}
+
+func (self *Mailbox) RemoveLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return self.updateLabels(ctx, uids, func(current []string) (result []string) {
+		removed := map[string]bool{}
+		for _, label := range labels {
+			removed[label] = true
+		}
+		for _, label := range current {
+			if !removed[label] {
+				result = append(result, label)
+			}
+		}
+		return
+	})
+}
+
+func (self *Mailbox) updateLabels(ctx context.Context, uids []uint32, f func(current []string) []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	wanted := map[uint32]bool{}
+	for _, uid := range uids {
+		wanted[uid] = true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, msg := range self.messages {
+		if wanted[msg.uid] {
+			msg.labels = f(msg.labels)
+		}
+	}
+	return nil
+}
+
+// Labels returns the labels of the messages with the given UIDs.
+func (self *Mailbox) Labels(ctx context.Context, uids ...uint32) (result map[uint32][]string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	wanted := map[uint32]bool{}
+	for _, uid := range uids {
+		wanted[uid] = true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result = map[uint32][]string{}
+	for _, msg := range self.messages {
+		if wanted[msg.uid] {
+			result[msg.uid] = append([]string{}, msg.labels...)
+		}
+	}
+	return
+}
+
+func (self *Mailbox) Close() error {
+	return nil
+}
+
+func tokenize(s string) (result []string) {
+	current := &bytes.Buffer{}
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+		case c == ' ' && !quoted:
+			if current.Len() > 0 {
+				result = append(result, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 {
+		result = append(result, current.String())
+	}
+	return
+}
+
+var flagKeys = map[string]string{
+	"SEEN":     `\Seen`,
+	"ANSWERED": `\Answered`,
+	"FLAGGED":  `\Flagged`,
+	"DELETED":  `\Deleted`,
+	"DRAFT":    `\Draft`,
+}
+
+func matches(msg *message, tokens []string) (result bool, err error) {
+	var header mail.Header
+	getHeader := func(key string) string {
+		if header == nil {
+			if parsed, e := mail.ReadMessage(bytes.NewReader(msg.body)); e == nil {
+				header = parsed.Header
+			} else {
+				header = mail.Header{}
+			}
+		}
+		return header.Get(key)
+	}
+	arg := func() (string, error) {
+		if len(tokens) < 2 {
+			return "", fmt.Errorf("imaptest: missing argument to %v", tokens[0])
+		}
+		tokens = tokens[1:]
+		return tokens[0], nil
+	}
+	for ; len(tokens) > 0; tokens = tokens[1:] {
+		key := strings.ToUpper(tokens[0])
+		match := true
+		var value string
+		switch {
+		case key == "ALL":
+		case flagKeys[key] != "":
+			match = msg.flags[flagKeys[key]]
+		case strings.HasPrefix(key, "UN") && flagKeys[key[2:]] != "":
+			match = !msg.flags[flagKeys[key[2:]]]
+		case key == "KEYWORD" || key == "UNKEYWORD":
+			if value, err = arg(); err != nil {
+				return
+			}
+			match = msg.flags[value] == (key == "KEYWORD")
+		case key == "SINCE" || key == "BEFORE" || key == "ON":
+			if value, err = arg(); err != nil {
+				return
+			}
+			var date time.Time
+			if date, err = time.Parse(dateFormat, value); err != nil {
+				return
+			}
+			day := time.Date(msg.date.Year(), msg.date.Month(), msg.date.Day(), 0, 0, 0, 0, time.UTC)
+			switch key {
+			case "SINCE":
+				match = !day.Before(date)
+			case "BEFORE":
+				match = day.Before(date)
+			case "ON":
+				match = day.Equal(date)
+			}
+		case key == "FROM" || key == "TO" || key == "CC" || key == "SUBJECT":
+			if value, err = arg(); err != nil {
+				return
+			}
+			match = strings.Contains(strings.ToLower(getHeader(key)), strings.ToLower(value))
+		case key == "HEADER":
+			var field string
+			if field, err = arg(); err != nil {
+				return
+			}
+			if value, err = arg(); err != nil {
+				return
+			}
+			match = strings.Contains(strings.ToLower(getHeader(field)), strings.ToLower(value))
+		case key == "UID":
+			if value, err = arg(); err != nil {
+				return
+			}
+			if match, err = inSet(msg.uid, value); err != nil {
+				return
+			}
+		default:
+			err = fmt.Errorf("imaptest: unsupported search key %v", tokens[0])
+			return
+		}
+		if !match {
+			return
+		}
+	}
+	result = true
+	return
+}
+
+func inSet(uid uint32, set string) (result bool, err error) {
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		var low, high uint64
+		if low, err = parseSeq(bounds[0]); err != nil {
+			return
+		}
+		high = low
+		if len(bounds) == 2 {
+			if high, err = parseSeq(bounds[1]); err != nil {
+				return
+			}
+		}
+		if low > high {
+			low, high = high, low
+		}
+		if uint64(uid) >= low && uint64(uid) <= high {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+func parseSeq(s string) (uint64, error) {
+	if s == "*" {
+		return 1<<32 - 1, nil
+	}
+	return strconv.ParseUint(s, 10, 32)
+}
@@ -0,0 +1,33 @@
+package imaptest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	mailbox := New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: first\r\n\r\nbody")
+	second := mailbox.Deliver("From: b@example.com\r\nSubject: \"second\" one\r\n\r\nbody")
+	mailbox.AddFlags(context.Background(), []string{`\Seen`}, second)
+	for criteria, want := range map[string][]uint32{
+		"ALL":                 {1, 2},
+		"UNSEEN":              {1},
+		"SEEN FROM b@":        {2},
+		`SUBJECT "\"second"`:  {2},
+		"UID 2:*":             {2},
+		"UNKEYWORD \\Seen":    {1},
+		"SINCE 1-Jan-2000":    {1, 2},
+		"BEFORE 1-Jan-2000":   nil,
+		"HEADER Subject firs": {1},
+	} {
+		got, err := mailbox.Search(context.Background(), criteria)
+		if err != nil {
+			t.Fatalf("%v: %v", criteria, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: wanted %v but got %v", criteria, want, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SkipExistingImports makes the imports skip messages whose Message-ID header is already found in the target mailbox,
+// so that importing the same archive again doesn't create duplicates. Messages without a Message-ID are always
+// imported.
+func (self *Client) SkipExistingImports(skip bool) *Client {
+	self.skipExisting = skip
+	return self
+}
+
+// Import appends the messages of the mbox read from r to the mailbox labeled label, or the mailbox of the client if
+// label is empty, with the given flags, like `\Seen`. The internal dates are taken from the From lines of the mbox,
+// or the Date headers when those can't be parsed. Both mboxo and mboxrd files are read, assuming mboxrd.
+func (self *Client) Import(r io.Reader, label string, flags ...string) (int, error) {
+	return self.ImportContext(context.Background(), r, label, flags...)
+}
+
+// ImportContext is Import, but gives up when ctx is done.
+func (self *Client) ImportContext(ctx context.Context, r io.Reader, label string, flags ...string) (imported int, err error) {
+	err = self.importTo(label).withStore(ctx, func(store MailStore) (err error) {
+		reader := bufio.NewReader(r)
+		var body *bytes.Buffer
+		var date time.Time
+		appendMessage := func() (err error) {
+			if body == nil {
+				return
+			}
+			// The message is followed by an empty line separating it from the next one.
+			b := bytes.TrimSuffix(body.Bytes(), []byte("\r\n"))
+			appended, err := self.appendMail(ctx, store, flags, date, b)
+			if appended {
+				imported++
+			}
+			return
+		}
+		for {
+			line, e := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				if bytes.HasPrefix(line, []byte("From ")) {
+					if err = appendMessage(); err != nil {
+						return
+					}
+					body = &bytes.Buffer{}
+					date = mboxDate(string(line))
+				} else if body != nil {
+					line = bytes.TrimRight(line, "\r\n")
+					if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+						line = line[1:]
+					}
+					body.Write(line)
+					body.WriteString("\r\n")
+				}
+			}
+			if e == io.EOF {
+				return appendMessage()
+			} else if e != nil {
+				return e
+			}
+		}
+	})
+	return
+}
+
+// ImportMaildir appends the messages in the cur and new directories of the maildir dir like Import does, in the order
+// of their modification times, which are used as internal dates. The flags in the file names, like S for `\Seen`, are
+// added to the given flags.
+func (self *Client) ImportMaildir(ctx context.Context, dir string, label string, flags ...string) (imported int, err error) {
+	var files []os.FileInfo
+	var paths []string
+	for _, sub := range []string{"cur", "new"} {
+		var infos []os.FileInfo
+		if infos, err = ioutil.ReadDir(filepath.Join(dir, sub)); err != nil {
+			return
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, info)
+				paths = append(paths, filepath.Join(dir, sub, info.Name()))
+			}
+		}
+	}
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return files[order[i]].ModTime().Before(files[order[j]].ModTime())
+	})
+	err = self.importTo(label).withStore(ctx, func(store MailStore) (err error) {
+		for _, i := range order {
+			var b []byte
+			if b, err = ioutil.ReadFile(paths[i]); err != nil {
+				return
+			}
+			b = bytes.Replace(bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+			msgFlags := append([]string{}, flags...)
+			if info := strings.SplitN(files[i].Name(), ":2,", 2); len(info) == 2 {
+				for _, f := range maildirFlags {
+					if strings.IndexByte(info[1], f.letter) != -1 {
+						msgFlags = append(msgFlags, f.flag)
+					}
+				}
+			}
+			var appended bool
+			if appended, err = self.appendMail(ctx, store, msgFlags, files[i].ModTime(), b); err != nil {
+				return
+			}
+			if appended {
+				imported++
+			}
+		}
+		return
+	})
+	return
+}
+
+// importTo returns the client to append messages labeled label to.
+func (self *Client) importTo(label string) *Client {
+	if label == "" || label == self.mailbox {
+		return self
+	}
+	return self.ForMailbox(label)
+}
+
+// appendMail appends the message, using its Date header for the internal date if date is zero, unless it already
+// exists and SkipExistingImports is set.
+func (self *Client) appendMail(ctx context.Context, store MailStore, flags []string, date time.Time, body []byte) (appended bool, err error) {
+	var header mail.Header
+	if msg, e := mail.ReadMessage(bytes.NewReader(body)); e == nil {
+		header = msg.Header
+	}
+	if id := header.Get("Message-ID"); self.skipExisting && id != "" {
+		var found []uint32
+		if found, err = store.Search(ctx, "HEADER Message-ID "+quote(id)); err != nil || len(found) > 0 {
+			return
+		}
+	}
+	if date.IsZero() {
+		date = time.Now()
+		if sent, e := header.Date(); e == nil {
+			date = sent
+		}
+	}
+	if err = store.Append(ctx, flags, date, body); err == nil {
+		appended = true
+	}
+	return
+}
+
+// quote returns s as an IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// mboxDate returns the date of an mbox From line, or the zero time if it has none.
+func mboxDate(line string) (result time.Time) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) < 3 {
+		return
+	}
+	for _, layout := range []string{time.ANSIC, "Mon Jan 2 15:04:05 2006", "Mon Jan _2 15:04:05 MST 2006", "Mon Jan _2 15:04:05 -0700 2006"} {
+		var err error
+		if result, err = time.Parse(layout, strings.TrimSpace(fields[2])); err == nil {
+			return
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,77 @@
+package imap_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestImport(t *testing.T) {
+	source := imaptest.New()
+	date := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, subject := range []string{"a", "b"} {
+		source.Append(context.Background(), []string{`\Seen`}, date, []byte("From: a@example.com\r\nSubject: "+subject+"\r\n\r\nFrom here\r\n>From there\r\n"))
+	}
+	buf := &bytes.Buffer{}
+	if err := imap.New("user@example.com", "secret").MailStore(source.Open).Export(context.Background(), []string{"ALL"}, imap.Mbox(buf)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildir, err := imap.Maildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imap.New("user@example.com", "secret").MailStore(source.Open).Export(context.Background(), []string{"ALL"}, maildir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want, err := source.Fetch(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(target *imaptest.Mailbox, imported int, err error) {
+		if err != nil || imported != 2 {
+			t.Fatalf("Wanted two messages imported, got %v and %v", imported, err)
+		}
+		got, err := target.Fetch(context.Background(), 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if !bytes.Equal(got[i].Body, want[i].Body) || !got[i].InternalDate.Equal(date) || !reflect.DeepEqual(got[i].Flags, []string{`\Seen`}) {
+				t.Errorf("Wanted %+v imported but got %+v", want[i], got[i])
+			}
+		}
+	}
+	target := imaptest.New()
+	imported, err := imap.New("user@example.com", "secret").MailStore(target.Open).Import(buf, "", `\Seen`)
+	check(target, imported, err)
+	target = imaptest.New()
+	imported, err = imap.New("user@example.com", "secret").MailStore(target.Open).ImportMaildir(context.Background(), dir, "Restored")
+	check(target, imported, err)
+}
+
+func TestSkipExistingImports(t *testing.T) {
+	archive := "From MAILER-DAEMON Fri Jan 31 12:00:00 2020\nMessage-ID: <a@example.com>\nSubject: a\n\nbody\n\nFrom MAILER-DAEMON Fri Jan 31 12:00:00 2020\nSubject: no id\n\nbody\n\n"
+	target := imaptest.New()
+	c := imap.New("user@example.com", "secret").MailStore(target.Open).SkipExistingImports(true)
+	for _, want := range []int{2, 1} {
+		if imported, err := c.Import(strings.NewReader(archive), ""); err != nil || imported != want {
+			t.Errorf("Wanted %v imported, got %v and %v", want, imported, err)
+		}
+	}
+	if all, err := c.Search("ALL"); err != nil || len(all) != 3 {
+		t.Errorf("Wanted only the message without Message-ID imported twice, got %v and %v", all, err)
+	}
+}
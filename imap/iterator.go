@@ -0,0 +1,102 @@
+package imap
+
+import (
+	"context"
+	"time"
+)
+
+// PageSize is the number of messages an Iterator fetches at a time.
+var PageSize = 100
+
+// Iterator walks the messages matching a search, fetching their headers a page at a time. It isn't safe for
+// concurrent use.
+type Iterator struct {
+	client   *Client
+	criteria []string
+	reverse  bool
+	searched bool
+	uids     []uint32
+	page     []*Mail
+}
+
+// Messages returns an iterator over the messages matching all the IMAP search criteria, in ascending UID order. The
+// messages have their headers, but no text, when the MailStore is a HeaderFetcher.
+func (self *Client) Messages(criteria ...string) *Iterator {
+	return &Iterator{
+		client:   self,
+		criteria: criteria,
+	}
+}
+
+// Reverse makes the iterator return the newest messages first.
+func (self *Iterator) Reverse() *Iterator {
+	self.reverse = true
+	return self
+}
+
+// Next returns the next message, or nil when there are no more. The first call searches, and the calls that need a
+// new page fetch it.
+func (self *Iterator) Next(ctx context.Context) (result *Mail, err error) {
+	if !self.searched {
+		if self.uids, err = self.client.SearchContext(ctx, self.criteria...); err != nil {
+			return
+		}
+		if self.reverse {
+			for i, j := 0, len(self.uids)-1; i < j; i, j = i+1, j-1 {
+				self.uids[i], self.uids[j] = self.uids[j], self.uids[i]
+			}
+		}
+		self.searched = true
+	}
+	// Pages may come back short, or empty, if messages were deleted since the search.
+	for len(self.page) == 0 {
+		if len(self.uids) == 0 {
+			return
+		}
+		n := PageSize
+		if n > len(self.uids) {
+			n = len(self.uids)
+		}
+		if self.page, err = self.client.fetchPage(ctx, self.uids[:n]); err != nil {
+			return
+		}
+		self.uids = self.uids[n:]
+	}
+	result, self.page = self.page[0], self.page[1:]
+	return
+}
+
+// fetchPage fetches the headers of the messages, or the complete messages if the store can't fetch only headers, in
+// the order of uids.
+func (self *Client) fetchPage(ctx context.Context, uids []uint32) (result []*Mail, err error) {
+	err = self.withStore(ctx, func(store MailStore) (err error) {
+		var fetched []Message
+		if headers, ok := store.(HeaderFetcher); ok {
+			fetched, err = headers.FetchHeaders(ctx, uids...)
+		} else {
+			fetched, err = store.Fetch(ctx, uids...)
+		}
+		if err != nil {
+			return
+		}
+		fetchedAt := time.Now()
+		byUID := map[uint32]Message{}
+		for _, msg := range fetched {
+			byUID[msg.UID] = msg
+		}
+		for _, uid := range uids {
+			msg, found := byUID[uid]
+			if !found {
+				continue
+			}
+			var parsed *Mail
+			if parsed, err = Parse(msg); err != nil {
+				return
+			}
+			parsed.Fetched = fetchedAt
+			result = append(result, parsed)
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,41 @@
+package imap_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestMessages(t *testing.T) {
+	defer func(old int) { imap.PageSize = old }(imap.PageSize)
+	imap.PageSize = 2
+	mailbox := imaptest.New()
+	for _, subject := range []string{"a", "b", "c", "d", "e"} {
+		mailbox.Deliver("From: a@example.com\r\nSubject: " + subject + "\r\n\r\nbody")
+	}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open)
+	list := func(it *imap.Iterator) (subjects []string) {
+		for {
+			msg, err := it.Next(context.Background())
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if msg == nil {
+				return
+			}
+			if msg.Text != "" {
+				t.Errorf("Wanted only headers, got text %q", msg.Text)
+			}
+			subjects = append(subjects, msg.GetHeader("Subject"))
+		}
+	}
+	if got, want := list(c.Messages("ALL")), []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wanted %v but got %v", want, got)
+	}
+	if got, want := list(c.Messages("ALL").Reverse()), []string{"e", "d", "c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wanted %v but got %v", want, got)
+	}
+}
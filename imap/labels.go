@@ -0,0 +1,124 @@
+package imap
+
+import (
+	"context"
+	"sort"
+)
+
+// LabelCacheSize is the number of messages whose labels are remembered to detect changes.
+// When more messages are handled, the labels of the oldest ones are forgotten.
+var LabelCacheSize = 1000
+
+// LabelsChanged is emitted when the Gmail labels of a handled message changed since they were last seen.
+type LabelsChanged struct {
+	UID     uint32
+	Added   []string
+	Removed []string
+}
+
+type labelCache struct {
+	order  []uint32
+	labels map[uint32][]string
+}
+
+func (self *labelCache) set(uid uint32, labels []string) {
+	if self.labels == nil {
+		self.labels = map[uint32][]string{}
+	}
+	if _, found := self.labels[uid]; !found {
+		self.order = append(self.order, uid)
+		for len(self.order) > LabelCacheSize {
+			delete(self.labels, self.order[0])
+			self.order = self.order[1:]
+		}
+	}
+	self.labels[uid] = labels
+}
+
+func (self *labelCache) uids() []uint32 {
+	return append([]uint32{}, self.order...)
+}
+
+func (self *labelCache) clear() {
+	self.order = nil
+	self.labels = nil
+}
+
+// diff returns the labels in after but not in before, and the ones in before but not in after, both sorted.
+func diff(before, after []string) (added, removed []string) {
+	had := map[string]bool{}
+	for _, label := range before {
+		had[label] = true
+	}
+	has := map[string]bool{}
+	for _, label := range after {
+		has[label] = true
+		if !had[label] {
+			added = append(added, label)
+		}
+	}
+	for _, label := range before {
+		if !has[label] {
+			removed = append(removed, label)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// LabelsHandler will be called by CheckLabels for each handled message whose labels changed.
+func (self *Client) LabelsHandler(f func(change LabelsChanged)) *Client {
+	self.labelsHandler = f
+	return self
+}
+
+func (self *Client) CheckLabels() error {
+	return self.CheckLabelsContext(context.Background())
+}
+
+// CheckLabelsContext fetches the labels of the last LabelCacheSize messages handled by HandleNew, and calls the
+// LabelsHandler for each one that changed since the last check.
+func (self *Client) CheckLabelsContext(ctx context.Context) (err error) {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	store, err := self.acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		self.release(store, err)
+	}()
+	self.checkUIDValidity(store.UIDValidity())
+	self.lock.Lock()
+	uids := self.labels.uids()
+	self.lock.Unlock()
+	current, err := store.Labels(ctx, uids...)
+	if err != nil {
+		return
+	}
+	changes := []LabelsChanged{}
+	self.lock.Lock()
+	for _, uid := range uids {
+		after, found := current[uid]
+		if !found {
+			continue
+		}
+		added, removed := diff(self.labels.labels[uid], after)
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, LabelsChanged{
+				UID:     uid,
+				Added:   added,
+				Removed: removed,
+			})
+		}
+		self.labels.set(uid, after)
+	}
+	self.lock.Unlock()
+	if self.labelsHandler != nil {
+		for _, change := range changes {
+			self.labelsHandler(change)
+		}
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package imap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestLabelsChanged(t *testing.T) {
+	mailbox := imaptest.New()
+	uid := mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	mailbox.SetLabels(uid, `\Inbox`, "work")
+	changes := []imap.LabelsChanged{}
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).LabelsHandler(func(change imap.LabelsChanged) {
+		changes = append(changes, change)
+	})
+	msgs, err := c.GetNew()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []string{`\Inbox`, "work"}; !reflect.DeepEqual(msgs[0].Labels, want) {
+		t.Errorf("Wanted %v but got %v", want, msgs[0].Labels)
+	}
+	if err := c.CheckLabels(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Wanted no changes, got %+v", changes)
+	}
+	mailbox.SetLabels(uid, "work", "urgent")
+	if err := c.CheckLabels(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []imap.LabelsChanged{{UID: uid, Added: []string{"urgent"}, Removed: []string{`\Inbox`}}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Wanted %+v but got %+v", want, changes)
+	}
+	changes = nil
+	mailbox.Renumber()
+	mailbox.SetLabels(uid+1, "other")
+	if err := c.CheckLabels(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("Wanted the label cache to be dropped after renumbering, got %+v", changes)
+	}
+}
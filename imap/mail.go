@@ -0,0 +1,188 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zond/gmail/mimeutil"
+)
+
+// Mail is a parsed message along with its IMAP and Gmail metadata.
+type Mail struct {
+	*mimeutil.MIMEBody
+	UID          uint32
+	GmailID      uint64
+	ThreadID     uint64
+	Flags        []string
+	Labels       []string
+	InternalDate time.Time
+	// Snippet is the beginning of the text, with whitespace collapsed. See SnippetLength and SnippetStripHTML.
+	Snippet string
+	// Fetched is when the client finished fetching the message from the server.
+	Fetched time.Time
+	// Truncated is set when older messages were left out of the batch this one was handled in, see MaxInitialMessages.
+	Truncated bool
+	// Verdict is what Gmail decided about the message, parsed from its headers.
+	Verdict Verdict
+	// Priority is decided by the classifiers of Classify, if the handler was wrapped by it.
+	Priority Priority
+	// AttachmentDecisions record what an AttachmentPolicy did with each attachment, if the handler was wrapped by one.
+	AttachmentDecisions []AttachmentDecision
+	// Threats are the malware Scan found in the attachments, if the handler was wrapped by it.
+	Threats      []Threat
+	addFlags     []string
+	addLabels    []string
+	removeLabels []string
+}
+
+// AddFlags queues flags to be added to the message when the handler returns without error.
+func (self *Mail) AddFlags(flags ...string) {
+	self.addFlags = append(self.addFlags, flags...)
+}
+
+// AddLabels queues Gmail labels to be added to the message when the handler returns without error.
+func (self *Mail) AddLabels(labels ...string) {
+	self.addLabels = append(self.addLabels, labels...)
+}
+
+// RemoveLabels queues Gmail labels to be removed from the message when the handler returns without error.
+func (self *Mail) RemoveLabels(labels ...string) {
+	self.removeLabels = append(self.removeLabels, labels...)
+}
+
+func (self *Mail) MarkRead() {
+	self.AddFlags(`\Seen`)
+}
+
+func (self *Mail) Star() {
+	self.AddFlags(`\Flagged`)
+}
+
+// Archive removes the message from the inbox, like the Gmail archive button.
+func (self *Mail) Archive() {
+	self.RemoveLabels(`\Inbox`)
+}
+
+// apply performs the queued changes.
+func (self *Mail) apply(ctx context.Context, store MailStore) (err error) {
+	if len(self.addFlags) > 0 {
+		if err = store.AddFlags(ctx, self.addFlags, self.UID); err != nil {
+			return
+		}
+	}
+	if len(self.addLabels) > 0 {
+		if err = store.AddLabels(ctx, self.addLabels, self.UID); err != nil {
+			return
+		}
+	}
+	if len(self.removeLabels) > 0 {
+		if err = store.RemoveLabels(ctx, self.removeLabels, self.UID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Link returns a link to the message in the Gmail web interface, or an empty string if the Gmail id is unknown.
+func (self *Mail) Link() string {
+	if self.GmailID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("https://mail.google.com/mail/#all/%x", self.GmailID)
+}
+
+// Key identifies the message across mailboxes and connections using its Gmail id, or its Message-Id when the Gmail id is
+// unknown. It returns an empty string if neither is known.
+func (self *Mail) Key() string {
+	if self.GmailID != 0 {
+		return fmt.Sprintf("gmail:%x", self.GmailID)
+	}
+	if self.MIMEBody != nil {
+		if id := self.GetHeader("Message-Id"); id != "" {
+			return "message-id:" + id
+		}
+	}
+	return ""
+}
+
+type attachment struct {
+	FileName    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Size        int               `json:"size"`
+	Action      *AttachmentAction `json:"action,omitempty"`
+	Path        string            `json:"path,omitempty"`
+}
+
+// MarshalJSON encodes the mail as an object with the fields uid, gmail_id, thread_id, flags, labels, priority, verdict,
+// internal_date (RFC 3339), from, to, cc, subject, message_id, snippet, text, html and attachments (each with filename,
+// content_type and size, and the action and path of the AttachmentDecisions, which include skipped attachments, when
+// there are any) and threats.
+func (self *Mail) MarshalJSON() ([]byte, error) {
+	result := struct {
+		UID          uint32       `json:"uid"`
+		GmailID      uint64       `json:"gmail_id,omitempty"`
+		ThreadID     uint64       `json:"thread_id,omitempty"`
+		Flags        []string     `json:"flags"`
+		Labels       []string     `json:"labels,omitempty"`
+		Priority     Priority     `json:"priority"`
+		Verdict      Verdict      `json:"verdict"`
+		InternalDate string       `json:"internal_date"`
+		From         string       `json:"from"`
+		To           string       `json:"to"`
+		Cc           string       `json:"cc,omitempty"`
+		Subject      string       `json:"subject"`
+		MessageID    string       `json:"message_id,omitempty"`
+		Snippet      string       `json:"snippet"`
+		Text         string       `json:"text"`
+		HTML         string       `json:"html,omitempty"`
+		Attachments  []attachment `json:"attachments"`
+		Threats      []Threat     `json:"threats,omitempty"`
+	}{
+		UID:          self.UID,
+		GmailID:      self.GmailID,
+		ThreadID:     self.ThreadID,
+		Flags:        self.Flags,
+		Labels:       self.Labels,
+		Priority:     self.Priority,
+		Verdict:      self.Verdict,
+		InternalDate: self.InternalDate.Format(time.RFC3339),
+		Snippet:      self.Snippet,
+		Attachments:  []attachment{},
+		Threats:      self.Threats,
+	}
+	if result.Flags == nil {
+		result.Flags = []string{}
+	}
+	if self.MIMEBody != nil {
+		result.From = self.GetHeader("From")
+		result.To = self.GetHeader("To")
+		result.Cc = self.GetHeader("Cc")
+		result.Subject = self.GetHeader("Subject")
+		result.MessageID = self.GetHeader("Message-Id")
+		result.Text = self.Text
+		result.HTML = self.Html
+		for _, part := range self.Attachments {
+			result.Attachments = append(result.Attachments, attachment{
+				FileName:    part.FileName(),
+				ContentType: part.ContentType(),
+				Size:        len(part.Content()),
+			})
+		}
+	}
+	if self.AttachmentDecisions != nil {
+		result.Attachments = []attachment{}
+		for i := range self.AttachmentDecisions {
+			decision := &self.AttachmentDecisions[i]
+			result.Attachments = append(result.Attachments, attachment{
+				FileName:    decision.FileName,
+				ContentType: decision.ContentType,
+				Size:        decision.Size,
+				Action:      &decision.Action,
+				Path:        decision.Path,
+			})
+		}
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,42 @@
+package imap_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestMailJSON(t *testing.T) {
+	mailbox := imaptest.New()
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mailbox.Append(context.Background(), []string{`\Seen`}, date, []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody"))
+	msgs, err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).GetNew()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b, err := json.Marshal(&msgs[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for key, want := range map[string]interface{}{
+		"uid":           1.0,
+		"internal_date": "2020-01-02T03:04:05Z",
+		"from":          "a@example.com",
+		"subject":       "hi",
+		"flags":         []interface{}{`\Seen`},
+		"attachments":   []interface{}{},
+	} {
+		if !reflect.DeepEqual(decoded[key], want) {
+			t.Errorf("%v: wanted %#v but got %#v", key, want, decoded[key])
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// withStore runs f with an open store, serialized with the other operations of the client.
+func (self *Client) withStore(ctx context.Context, f func(store MailStore) error) (err error) {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	store, err := self.acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		self.release(store, err)
+	}()
+	self.checkUIDValidity(store.UIDValidity())
+	return f(store)
+}
+
+// Search returns the UIDs of the messages matching all the IMAP search criteria, like "UNSEEN" or "FROM someone", in
+// ascending order.
+func (self *Client) Search(criteria ...string) ([]uint32, error) {
+	return self.SearchContext(context.Background(), criteria...)
+}
+
+// SearchContext is Search, but gives up when ctx is done.
+func (self *Client) SearchContext(ctx context.Context, criteria ...string) (result []uint32, err error) {
+	err = self.withStore(ctx, func(store MailStore) (err error) {
+		result, err = store.Search(ctx, criteria...)
+		return
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return
+}
+
+// Fetch returns the messages with the given UIDs, in ascending UID order. Unlike HandleNew it doesn't mark them in
+// any way.
+func (self *Client) Fetch(uids ...uint32) ([]*Mail, error) {
+	return self.FetchContext(context.Background(), uids...)
+}
+
+// FetchContext is Fetch, but gives up when ctx is done.
+func (self *Client) FetchContext(ctx context.Context, uids ...uint32) (result []*Mail, err error) {
+	err = self.withStore(ctx, func(store MailStore) (err error) {
+		fetched, err := store.Fetch(ctx, uids...)
+		if err != nil {
+			return
+		}
+		fetchedAt := time.Now()
+		sort.Slice(fetched, func(i, j int) bool {
+			return fetched[i].UID < fetched[j].UID
+		})
+		for _, msg := range fetched {
+			var parsed *Mail
+			if parsed, err = Parse(msg); err != nil {
+				return
+			}
+			parsed.Fetched = fetchedAt
+			result = append(result, parsed)
+		}
+		return
+	})
+	return
+}
+
+// Modify calls f with an otherwise empty Mail for each UID, and performs the changes it queued, like Archive or
+// MarkRead, without fetching the messages.
+func (self *Client) Modify(f func(msg *Mail), uids ...uint32) error {
+	return self.ModifyContext(context.Background(), f, uids...)
+}
+
+// ModifyContext is Modify, but gives up when ctx is done.
+func (self *Client) ModifyContext(ctx context.Context, f func(msg *Mail), uids ...uint32) error {
+	return self.withStore(ctx, func(store MailStore) (err error) {
+		for _, uid := range uids {
+			msg := &Mail{UID: uid}
+			f(msg)
+			if err = msg.apply(ctx, store); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
@@ -0,0 +1,41 @@
+package imap_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestFetchAndModify(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: first\r\n\r\nbody")
+	second := mailbox.Deliver("From: b@example.com\r\nSubject: second\r\n\r\nbody")
+	mailbox.SetLabels(second, `\Inbox`, "work")
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open)
+	uids, err := c.Search("FROM b@")
+	if err != nil || !reflect.DeepEqual(uids, []uint32{second}) {
+		t.Fatalf("Wanted [%v], got %v, %v", second, uids, err)
+	}
+	msgs, err := c.Fetch(second)
+	if err != nil || len(msgs) != 1 || msgs[0].GetHeader("Subject") != "second" {
+		t.Fatalf("Wanted the second message, got %+v, %v", msgs, err)
+	}
+	if err := c.Modify(func(msg *imap.Mail) {
+		msg.MarkRead()
+		msg.Archive()
+	}, second); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if flags := mailbox.Flags(second); !reflect.DeepEqual(flags, []string{`\Seen`}) {
+		t.Errorf("Wanted %v to be read, got %v", second, flags)
+	}
+	if labels, _ := mailbox.Labels(context.Background(), second); !reflect.DeepEqual(labels[second], []string{"work"}) {
+		t.Errorf("Wanted %v to be archived, got %v", second, labels[second])
+	}
+	if msgs, err := c.GetNew(); err != nil || len(msgs) != 2 {
+		t.Errorf("Wanted Fetch and Modify to leave the messages new, got %+v, %v", msgs, err)
+	}
+}
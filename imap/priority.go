@@ -0,0 +1,93 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority is how urgent a message is, set on Mail.Priority by Classify. The zero value is Normal.
+type Priority int
+
+const (
+	Bulk Priority = iota - 1
+	Normal
+	Important
+	Urgent
+)
+
+var priorityNames = map[Priority]string{
+	Bulk:      "bulk",
+	Normal:    "normal",
+	Important: "important",
+	Urgent:    "urgent",
+}
+
+func (self Priority) String() string {
+	if name, found := priorityNames[self]; found {
+		return name
+	}
+	return fmt.Sprintf("priority(%d)", int(self))
+}
+
+// ParsePriority returns the priority with the given name, like "urgent".
+func ParsePriority(name string) (result Priority, err error) {
+	for priority, priorityName := range priorityNames {
+		if strings.EqualFold(name, priorityName) {
+			return priority, nil
+		}
+	}
+	err = fmt.Errorf("imap: unknown priority %q", name)
+	return
+}
+
+func (self Priority) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+func (self *Priority) UnmarshalText(b []byte) (err error) {
+	*self, err = ParsePriority(string(b))
+	return
+}
+
+// Classifier decides the priority of a message.
+type Classifier func(msg *Mail) Priority
+
+// Classify returns a handler setting the priority of each message, and then calling next. Classifiers without an
+// opinion return Normal, so the priority is the highest one above Normal the classifiers decide, or else the lowest.
+func Classify(next MailHandler, classifiers ...Classifier) MailHandler {
+	return func(msg *Mail) error {
+		highest, lowest := Normal, Normal
+		for _, classifier := range classifiers {
+			if priority := classifier(msg); priority > highest {
+				highest = priority
+			} else if priority < lowest {
+				lowest = priority
+			}
+		}
+		msg.Priority = lowest
+		if highest > Normal {
+			msg.Priority = highest
+		}
+		return next(msg)
+	}
+}
+
+// GmailImportance classifies the messages Gmail marked as important, shown in the Priority Inbox, as Important, and
+// mailing list and bulk mail as Bulk.
+func GmailImportance(msg *Mail) Priority {
+	for _, label := range msg.Labels {
+		if label == `\Important` {
+			return Important
+		}
+	}
+	if msg.MIMEBody != nil {
+		switch strings.ToLower(strings.TrimSpace(msg.GetHeader("Precedence"))) {
+		case "bulk", "list", "junk":
+			return Bulk
+		}
+		if msg.GetHeader("List-Id") != "" || msg.GetHeader("List-Unsubscribe") != "" {
+			return Bulk
+		}
+	}
+	return Normal
+}
@@ -0,0 +1,53 @@
+package imap_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestClassify(t *testing.T) {
+	mailbox := imaptest.New()
+	important := mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	mailbox.SetLabels(important, `\Important`)
+	mailbox.Deliver("From: list@example.com\r\nList-Id: <list.example.com>\r\nSubject: news\r\n\r\nbody")
+	mailbox.Deliver("From: b@example.com\r\nSubject: hello\r\n\r\nbody")
+	mailbox.Deliver("From: list@example.com\r\nList-Id: <list.example.com>\r\nSubject: urgent\r\n\r\nbody")
+	urgent := func(msg *imap.Mail) imap.Priority {
+		if msg.GetHeader("Subject") == "urgent" {
+			return imap.Urgent
+		}
+		return imap.Normal
+	}
+	priorities := []string{}
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(imap.Classify(func(msg *imap.Mail) error {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		decoded := map[string]interface{}{}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			return err
+		}
+		priorities = append(priorities, fmt.Sprint(decoded["priority"]))
+		return nil
+	}, imap.GmailImportance, urgent)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := "[important bulk normal urgent]"; fmt.Sprint(priorities) != want {
+		t.Errorf("Wanted %v, got %v", want, priorities)
+	}
+	for _, name := range []string{"bulk", "Normal", "important", "URGENT"} {
+		var priority imap.Priority
+		if err := priority.UnmarshalText([]byte(name)); err != nil || !strings.EqualFold(priority.String(), name) {
+			t.Errorf("Wanted %v, got %v, %v", name, priority, err)
+		}
+	}
+	if _, err := imap.ParsePriority("high"); err == nil {
+		t.Errorf("Wanted an unknown priority to fail")
+	}
+}
@@ -0,0 +1,41 @@
+package imap
+
+import (
+	"context"
+	"time"
+)
+
+// ReadOnly makes the client refuse every operation that would modify mail with ErrReadOnly, including RawIMAP, and
+// open the mailbox with EXAMINE so that fetching doesn't mark messages as read either.
+//
+// Since the mail HandleNew handled can't be marked with OldKeyword, the client remembers the last message handled in
+// memory, unless it has a Checkpoint. Use a persistent Checkpoint, or Dedup, to avoid handling the same mail again
+// after restarting.
+func (self *Client) ReadOnly() *Client {
+	self.readOnly = true
+	if self.checkpoint == nil {
+		self.checkpoint = &memoryCheckpoint{}
+	}
+	return self
+}
+
+// readOnlyStore refuses the operations of the MailStore that would modify mail.
+type readOnlyStore struct {
+	MailStore
+}
+
+func (self readOnlyStore) Append(ctx context.Context, flags []string, date time.Time, body []byte) error {
+	return ErrReadOnly
+}
+
+func (self readOnlyStore) AddFlags(ctx context.Context, flags []string, uids ...uint32) error {
+	return ErrReadOnly
+}
+
+func (self readOnlyStore) AddLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return ErrReadOnly
+}
+
+func (self readOnlyStore) RemoveLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,75 @@
+package imap_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestReadOnly(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: a\r\n\r\nbody")
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).ReadOnly()
+	handle := func(f func(msg *imap.Mail)) (subjects []string, err error) {
+		err = c.HandleNew(func(msg *imap.Mail) error {
+			f(msg)
+			subjects = append(subjects, msg.GetHeader("Subject"))
+			return nil
+		})
+		return
+	}
+	if subjects, err := handle(func(*imap.Mail) {}); err != nil || !reflect.DeepEqual(subjects, []string{"a"}) {
+		t.Errorf("Wanted a handled, got %v and %v", subjects, err)
+	}
+	if flags := mailbox.Flags(1); len(flags) != 0 {
+		t.Errorf("Wanted the mail left unmarked, got %v", flags)
+	}
+	if subjects, err := handle(func(*imap.Mail) {}); err != nil || len(subjects) != 0 {
+		t.Errorf("Wanted the handled mail remembered, got %v and %v", subjects, err)
+	}
+	mailbox.Deliver("From: a@example.com\r\nSubject: b\r\n\r\nbody")
+	if _, err := handle(func(msg *imap.Mail) { msg.MarkRead() }); err != imap.ErrReadOnly {
+		t.Errorf("Wanted ErrReadOnly when marking as read, got %v", err)
+	}
+	if err := c.Modify(func(msg *imap.Mail) { msg.Archive() }, 1); err != imap.ErrReadOnly {
+		t.Errorf("Wanted ErrReadOnly when archiving, got %v", err)
+	}
+	if _, err := c.Import(strings.NewReader("From MAILER-DAEMON Fri Jan 31 12:00:00 2020\nSubject: c\n\nbody\n"), ""); err != imap.ErrReadOnly {
+		t.Errorf("Wanted ErrReadOnly when importing, got %v", err)
+	}
+}
+
+func TestReadOnlyRetries(t *testing.T) {
+	mailbox := imaptest.New()
+	failing := mailbox.Deliver("From: a@example.com\r\nSubject: fail\r\n\r\nbody")
+	mailbox.Deliver("From: a@example.com\r\nSubject: ok\r\n\r\nbody")
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).ReadOnly()
+	fail := true
+	handle := func() (subjects []string, err error) {
+		err = c.HandleNew(func(msg *imap.Mail) error {
+			subjects = append(subjects, msg.GetHeader("Subject"))
+			if fail && msg.UID == failing {
+				return fmt.Errorf("failing")
+			}
+			return nil
+		})
+		return
+	}
+	if subjects, err := handle(); !reflect.DeepEqual(subjects, []string{"fail", "ok"}) {
+		t.Errorf("Wanted both handled, got %v and %v", subjects, err)
+	} else if _, failed := err.(imap.DeliveryError); !failed {
+		t.Errorf("Wanted a DeliveryError, got %v", err)
+	}
+	// Only the unacked message is retried, although the read-only client can't mark the other one.
+	fail = false
+	if subjects, err := handle(); err != nil || !reflect.DeepEqual(subjects, []string{"fail"}) {
+		t.Errorf("Wanted only the failed mail retried, got %v and %v", subjects, err)
+	}
+	if subjects, err := handle(); err != nil || len(subjects) != 0 {
+		t.Errorf("Wanted nothing left to retry, got %v and %v", subjects, err)
+	}
+}
@@ -0,0 +1,78 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/zond/gmail/mimeutil"
+)
+
+// AttachmentScanner scans attachments for malware, like the ClamAV adapter in package clamd.
+type AttachmentScanner interface {
+	// Scan reads the content of the attachment named name, and returns the name of the threat found in it, or an empty
+	// string if it is clean.
+	Scan(name string, r io.Reader) (threat string, err error)
+}
+
+// Unscannable is implemented by the errors of an AttachmentScanner that will fail the same way if retried, like
+// clamd.ScanError for an attachment larger than clamd accepts.
+type Unscannable interface {
+	error
+	Unscannable()
+}
+
+// Threat is malware an AttachmentScanner found in an attachment, or, if Error is set, an attachment it couldn't scan.
+type Threat struct {
+	FileName string `json:"filename"`
+	Name     string `json:"name"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Scan returns a handler scanning the attachments and inline parts of each message, recording the threats found in
+// Mail.Threats, and then calling next for clean messages and quarantine for infected ones. If quarantine is nil,
+// infected messages are passed to next as well. Attachments failing with an Unscannable error count as threats, since
+// retrying won't help, while messages failing to be scanned otherwise fail without calling either, to be retried.
+func Scan(next MailHandler, scanner AttachmentScanner, quarantine MailHandler) MailHandler {
+	return func(msg *Mail) (err error) {
+		if msg.MIMEBody == nil {
+			return next(msg)
+		}
+		threats := []Threat{}
+		for _, parts := range [][]mimeutil.MIMEPart{msg.Attachments, msg.Inlines} {
+			for _, part := range parts {
+				threat := ""
+				if threat, err = scanner.Scan(part.FileName(), bytes.NewReader(part.Content())); err != nil {
+					unscannable, ok := err.(Unscannable)
+					if !ok {
+						return
+					}
+					err = nil
+					threats = append(threats, Threat{
+						FileName: part.FileName(),
+						Error:    unscannable.Error(),
+					})
+				} else if threat != "" {
+					threats = append(threats, Threat{
+						FileName: part.FileName(),
+						Name:     threat,
+					})
+				}
+			}
+		}
+		msg.Threats = threats
+		if len(threats) > 0 && quarantine != nil {
+			return quarantine(msg)
+		}
+		return next(msg)
+	}
+}
+
+// Quarantine returns a handler moving each message out of the inbox to label, and marking it read, for use with Scan.
+func Quarantine(label string) MailHandler {
+	return func(msg *Mail) error {
+		msg.AddLabels(label)
+		msg.Archive()
+		msg.MarkRead()
+		return nil
+	}
+}
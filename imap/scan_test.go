@@ -0,0 +1,95 @@
+package imap_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+type fakeScanner map[string]string
+
+type unscannableError string
+
+func (self unscannableError) Error() string {
+	return string(self)
+}
+
+func (self unscannableError) Unscannable() {}
+
+func (self fakeScanner) Scan(name string, r io.Reader) (threat string, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if strings.Contains(string(b), "HUGE") {
+		return "", unscannableError("too large")
+	}
+	for signature, name := range self {
+		if strings.Contains(string(b), signature) {
+			threat = name
+		}
+	}
+	return
+}
+
+func TestScan(t *testing.T) {
+	mailbox := imaptest.New()
+	attached := func(content string) string {
+		return strings.Join([]string{
+			"From: a@example.com",
+			"Subject: files",
+			"Content-Type: multipart/mixed; boundary=b",
+			"",
+			"--b",
+			"Content-Type: text/plain",
+			"",
+			"see attached",
+			"--b",
+			"Content-Type: application/octet-stream",
+			"Content-Disposition: attachment; filename=\"file.bin\"",
+			"",
+			content,
+			"--b--",
+			"",
+		}, "\r\n")
+	}
+	clean := mailbox.Deliver(attached("harmless"))
+	infected := mailbox.Deliver(attached("EICAR"))
+	huge := mailbox.Deliver(attached("HUGE"))
+	mailbox.SetLabels(clean, `\Inbox`)
+	mailbox.SetLabels(infected, `\Inbox`)
+	mailbox.SetLabels(huge, `\Inbox`)
+	handled := []uint32{}
+	threats := map[uint32][]imap.Threat{}
+	handler := imap.Scan(func(msg *imap.Mail) error {
+		handled = append(handled, msg.UID)
+		return nil
+	}, fakeScanner{"EICAR": "Eicar-Signature"}, func(msg *imap.Mail) error {
+		threats[msg.UID] = msg.Threats
+		return imap.Quarantine("Quarantine")(msg)
+	})
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(handler); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fmt.Sprint(handled) != fmt.Sprint([]uint32{clean}) {
+		t.Errorf("Wanted only the clean message handled, got %v", handled)
+	}
+	if found := threats[infected]; len(found) != 1 || found[0].FileName != "file.bin" || found[0].Name != "Eicar-Signature" {
+		t.Errorf("Wanted the threat in file.bin, got %+v", found)
+	}
+	// An attachment that can never be scanned is quarantined instead of failing the message forever.
+	if found := threats[huge]; len(found) != 1 || found[0].FileName != "file.bin" || found[0].Error != "too large" {
+		t.Errorf("Wanted file.bin to be unscannable, got %+v", found)
+	}
+	labels, _ := mailbox.Labels(context.Background(), clean, infected, huge)
+	if !reflect.DeepEqual(labels[clean], []string{`\Inbox`}) || !reflect.DeepEqual(labels[infected], []string{"Quarantine"}) || !reflect.DeepEqual(labels[huge], []string{"Quarantine"}) {
+		t.Errorf("Wanted the infected and unscannable messages quarantined, got %v", labels)
+	}
+}
@@ -0,0 +1,109 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+)
+
+// SessionStats counts how often an idle session was parked by logging out, and how often an operation resumed after
+// that by logging in again.
+type SessionStats struct {
+	Parked  int
+	Resumed int
+}
+
+// ParkAfter keeps the session logged in between operations, instead of logging out after each of them, and parks it
+// by logging out once no operation used it for idle, to stay under the Gmail connection limits. The next operation
+// logs in again. The default, zero, logs out after every operation.
+func (self *Client) ParkAfter(idle time.Duration) *Client {
+	self.parkAfter = idle
+	return self
+}
+
+// Clock replaces the clock timing the parking of idle sessions and the expiry of their credentials, to let tests drive
+// them.
+func (self *Client) Clock(c clock.Clock) *Client {
+	self.clock = c
+	return self
+}
+
+// SessionStats returns how often the session was parked and resumed.
+func (self *Client) SessionStats() SessionStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.sessionStats
+}
+
+// Park logs out the session kept by ParkAfter at once, if there is one.
+func (self *Client) Park() (err error) {
+	self.opLock.Lock()
+	defer self.opLock.Unlock()
+	if self.session != nil {
+		self.parkTimer.Stop()
+		err = self.park()
+	}
+	return
+}
+
+// acquire returns the kept session, or opens a new one. A kept session whose credentials are about to expire is closed
+// instead, since the server drops it once they do. The caller must hold opLock, and pass the store to release when done.
+func (self *Client) acquire(ctx context.Context) (result MailStore, err error) {
+	if self.session != nil {
+		self.parkTimer.Stop()
+		result, self.session = self.session, nil
+		if self.sessionExpiry.IsZero() || self.clock.Now().Add(auth.RefreshMargin).Before(self.sessionExpiry) {
+			return
+		}
+		result.Close()
+	}
+	// Providers cache their credentials, so these are the ones open logs in with.
+	self.sessionExpiry = time.Time{}
+	if creds, e := self.credentials.Credentials(); e == nil {
+		self.sessionExpiry = creds.Expiry
+	}
+	if result, err = self.open(ctx); err != nil {
+		return
+	}
+	if self.parked {
+		self.parked = false
+		self.lock.Lock()
+		self.sessionStats.Resumed++
+		self.lock.Unlock()
+	}
+	return
+}
+
+// release keeps the store for the next operation if the client parks idle sessions and the operation using it didn't
+// fail, and closes it otherwise. Mail handler failures don't count, since they leave the session intact. The caller
+// must hold opLock.
+func (self *Client) release(store MailStore, err error) {
+	if _, failed := err.(DeliveryError); self.parkAfter <= 0 || (err != nil && !failed) {
+		store.Close()
+		return
+	}
+	self.session = store
+	self.sessionGeneration++
+	generation := self.sessionGeneration
+	self.parkTimer = self.clock.AfterFunc(self.parkAfter, func() {
+		self.opLock.Lock()
+		defer self.opLock.Unlock()
+		// The session may have been used, and kept again, while waiting for the lock.
+		if self.session != nil && self.sessionGeneration == generation {
+			self.park()
+		}
+	})
+}
+
+// park logs out the kept session. The caller must hold opLock.
+func (self *Client) park() error {
+	err := self.session.Close()
+	self.session = nil
+	self.parked = true
+	self.lock.Lock()
+	self.sessionStats.Parked++
+	self.lock.Unlock()
+	return err
+}
@@ -0,0 +1,84 @@
+package imap_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestParkAfter(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	var lock sync.Mutex
+	opens := 0
+	c := imap.New("user@example.com", "secret").MailStore(func(ctx context.Context) (imap.MailStore, error) {
+		lock.Lock()
+		opens++
+		lock.Unlock()
+		return mailbox.Open(ctx)
+	}).ParkAfter(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Search("ALL"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	lock.Lock()
+	if opens != 1 {
+		t.Errorf("Wanted the session kept between operations, got %v opens", opens)
+	}
+	lock.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if stats := c.SessionStats(); stats.Parked != 1 || stats.Resumed != 0 {
+		t.Errorf("Wanted the idle session parked, got %+v", stats)
+	}
+	if _, err := c.Search("ALL"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stats := c.SessionStats(); stats.Resumed != 1 || opens != 2 {
+		t.Errorf("Wanted the session resumed, got %+v after %v opens", stats, opens)
+	}
+	if err := c.Park(); err != nil || c.SessionStats().Parked != 2 {
+		t.Errorf("Wanted Park to log out at once, got %v and %+v", err, c.SessionStats())
+	}
+}
+
+func TestParkedSessionExpiry(t *testing.T) {
+	mailbox := imaptest.New()
+	clk := clock.NewFake(time.Now())
+	opens := 0
+	c := imap.New("user@example.com", "").MailStore(func(ctx context.Context) (imap.MailStore, error) {
+		opens++
+		return mailbox.Open(ctx)
+	}).UpdateCredentials(auth.Static{
+		User:   "user@example.com",
+		Token:  "token",
+		Expiry: clk.Now().Add(auth.RefreshMargin + time.Hour),
+	}).Clock(clk).ParkAfter(24 * time.Hour)
+	search := func(after time.Duration) {
+		clk.Advance(after)
+		if _, err := c.Search("ALL"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	search(0)
+	search(30 * time.Minute)
+	if opens != 1 {
+		t.Errorf("Wanted the session kept while the token is valid, got %v opens", opens)
+	}
+	search(31 * time.Minute)
+	if opens != 2 {
+		t.Errorf("Wanted a new session once the token was about to expire, got %v opens", opens)
+	}
+	clk.Advance(24 * time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); c.SessionStats().Parked != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Wanted the session parked on the clock of the client, got %+v", c.SessionStats())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package imap
+
+import (
+	"html"
+	"strings"
+
+	"github.com/zond/gmail/mimeutil"
+)
+
+// SnippetLength is the maximum number of characters in Mail.Snippet, not counting the ellipsis added to truncated snippets.
+var SnippetLength = 200
+
+// SnippetStripHTML makes snippets of mail without a text part use the HTML part, with tags removed.
+var SnippetStripHTML = true
+
+func snippet(body *mimeutil.MIMEBody) string {
+	if body == nil {
+		return ""
+	}
+	text := body.Text
+	if strings.TrimSpace(text) == "" && SnippetStripHTML {
+		text = stripHTML(body.Html)
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > SnippetLength {
+		text = string(runes[:SnippetLength]) + "…"
+	}
+	return text
+}
+
+// stripHTML removes tags, comments and the contents of script and style elements, and decodes entities.
+func stripHTML(s string) string {
+	result := &strings.Builder{}
+	for len(s) > 0 {
+		start := strings.IndexByte(s, '<')
+		if start == -1 {
+			result.WriteString(s)
+			break
+		}
+		result.WriteString(s[:start])
+		s = s[start:]
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end == -1 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			break
+		}
+		tag := strings.ToLower(strings.Fields(s[1:end] + " ")[0])
+		s = s[end+1:]
+		if tag == "script" || tag == "style" {
+			if close := strings.Index(strings.ToLower(s), "</"+tag); close != -1 {
+				s = s[close:]
+			} else {
+				s = ""
+			}
+		}
+		// Tags usually separate words.
+		result.WriteByte(' ')
+	}
+	return html.UnescapeString(result.String())
+}
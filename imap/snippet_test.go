@@ -0,0 +1,30 @@
+package imap_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestSnippet(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: text\r\n\r\nSome   text\r\non two lines")
+	mailbox.Deliver("From: a@example.com\r\nSubject: html\r\nContent-Type: text/html\r\n\r\n<html><style>p {}</style><p>Fish &amp; chips</p><!-- hidden --><p>today</p></html>")
+	defer func(length int) {
+		imap.SnippetLength = length
+	}(imap.SnippetLength)
+	imap.SnippetLength = 12
+	msgs, err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).GetNew()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	snippets := []string{}
+	for _, msg := range msgs {
+		snippets = append(snippets, msg.Snippet)
+	}
+	if want := []string{"Some text on…", "Fish & chips…"}; !reflect.DeepEqual(snippets, want) {
+		t.Errorf("Wanted %q but got %q", want, snippets)
+	}
+}
@@ -0,0 +1,259 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Message is a message as fetched from a MailStore.
+type Message struct {
+	UID uint32
+	// GmailID and ThreadID are the X-GM-MSGID and X-GM-THRID, when the server supports them.
+	GmailID  uint64
+	ThreadID uint64
+	Flags    []string
+	// Labels are the X-GM-LABELS, when the server supports them.
+	Labels       []string
+	InternalDate time.Time
+	// Body is the complete RFC 822 message, header and text, or only the header when fetched by FetchHeaders.
+	Body []byte
+}
+
+// HeaderFetcher is implemented by MailStores that can fetch messages without their text.
+type HeaderFetcher interface {
+	FetchHeaders(ctx context.Context, uids ...uint32) ([]Message, error)
+}
+
+// MailStore is the subset of IMAP the Client needs, operating on an already selected mailbox.
+// Search criteria are IMAP search keys, like "UNSEEN" or "UNKEYWORD FETCHEDBYAPI", which all have to match.
+// All operations should give up and return the context error when the context is done.
+type MailStore interface {
+	Append(ctx context.Context, flags []string, date time.Time, body []byte) error
+	Search(ctx context.Context, criteria ...string) ([]uint32, error)
+	Fetch(ctx context.Context, uids ...uint32) ([]Message, error)
+	AddFlags(ctx context.Context, flags []string, uids ...uint32) error
+	AddLabels(ctx context.Context, labels []string, uids ...uint32) error
+	RemoveLabels(ctx context.Context, labels []string, uids ...uint32) error
+	// Labels returns the Gmail labels of the messages, or nil if the server doesn't support them.
+	Labels(ctx context.Context, uids ...uint32) (map[uint32][]string, error)
+	// UIDValidity is the UIDVALIDITY of the mailbox. When it changes, all previously seen UIDs are meaningless.
+	UIDValidity() uint32
+	Close() error
+}
+
+// PollInterval is the longest time a cancelled operation keeps waiting for a response from the server.
+var PollInterval = 100 * time.Millisecond
+
+// CommandTimeout is the longest time to wait for the server to complete a command, including logging in, before giving
+// up with ErrTimeout.
+var CommandTimeout = 2 * time.Minute
+
+// ErrTimeout is returned when the server didn't complete a command within CommandTimeout. The connection is closed,
+// and the operation can be retried on a new one.
+var ErrTimeout = errors.New("imap: timed out waiting for the server")
+
+type store struct {
+	client  *imap.Client
+	mailbox string
+}
+
+// wait returns the equivalent of imap.Wait, except it gives up when ctx is done or CommandTimeout has passed. Since the
+// server may still respond to the abandoned command, the connection is closed when that happens.
+func (self *store) wait(ctx context.Context) func(cmd *imap.Command, err error) (*imap.Command, error) {
+	return func(cmd *imap.Command, err error) (*imap.Command, error) {
+		if err != nil {
+			return cmd, err
+		}
+		giveUp := time.Now().Add(CommandTimeout)
+		for cmd.InProgress() {
+			if err = ctx.Err(); err != nil {
+				self.client.Logout(0)
+				return cmd, err
+			}
+			if !time.Now().Before(giveUp) {
+				self.client.Logout(0)
+				return cmd, ErrTimeout
+			}
+			timeout := PollInterval
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+				// The deadline can pass before ctx is done, and Recv blocks forever given a negative timeout.
+				if timeout = time.Until(deadline); timeout <= 0 {
+					self.client.Logout(0)
+					return cmd, context.DeadlineExceeded
+				}
+			}
+			if time.Until(giveUp) < timeout {
+				if timeout = time.Until(giveUp); timeout <= 0 {
+					self.client.Logout(0)
+					return cmd, ErrTimeout
+				}
+			}
+			if err = self.client.Recv(timeout); err != nil && err != imap.ErrTimeout {
+				return cmd, err
+			}
+		}
+		_, err = cmd.Result(imap.OK)
+		return cmd, err
+	}
+}
+
+func (self *store) Append(ctx context.Context, flags []string, date time.Time, body []byte) (err error) {
+	_, err = self.wait(ctx)(self.client.Append(self.mailbox, imap.NewFlagSet(flags...), &date, imap.NewLiteral(body)))
+	return
+}
+
+func (self *store) Search(ctx context.Context, criteria ...string) (result []uint32, err error) {
+	fields := []imap.Field{}
+	for _, criterion := range criteria {
+		fields = append(fields, criterion)
+	}
+	cmd, err := self.wait(ctx)(self.client.UIDSearch(fields...))
+	if err != nil {
+		return
+	}
+	for _, rsp := range cmd.Data {
+		result = append(result, rsp.SearchResults()...)
+	}
+	return
+}
+
+func (self *store) Fetch(ctx context.Context, uids ...uint32) (result []Message, err error) {
+	return self.fetch(ctx, []string{"RFC822.HEADER", "RFC822.TEXT"}, uids)
+}
+
+func (self *store) FetchHeaders(ctx context.Context, uids ...uint32) (result []Message, err error) {
+	return self.fetch(ctx, []string{"RFC822.HEADER"}, uids)
+}
+
+// fetch fetches the metadata of the messages, and the given parts concatenated as the body.
+func (self *store) fetch(ctx context.Context, parts []string, uids []uint32) (result []Message, err error) {
+	if len(uids) == 0 {
+		return
+	}
+	seq := &imap.SeqSet{}
+	seq.AddNum(uids...)
+	items := append([]string{"FLAGS", "INTERNALDATE"}, parts...)
+	if self.client.Caps["X-GM-EXT-1"] {
+		items = append(items, "X-GM-MSGID", "X-GM-THRID", "X-GM-LABELS")
+	}
+	cmd, err := self.wait(ctx)(self.client.UIDFetch(seq, items...))
+	if err != nil {
+		return
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		buf := &bytes.Buffer{}
+		for _, attr := range parts {
+			writer, ok := info.Attrs[attr].(io.WriterTo)
+			if !ok {
+				err = fmt.Errorf("missing %v for UID %v", attr, info.UID)
+				return
+			}
+			if _, err = writer.WriteTo(buf); err != nil {
+				return
+			}
+		}
+		msg := Message{
+			UID:          info.UID,
+			GmailID:      asNumber64(info.Attrs["X-GM-MSGID"]),
+			ThreadID:     asNumber64(info.Attrs["X-GM-THRID"]),
+			Labels:       asLabels(info.Attrs["X-GM-LABELS"]),
+			InternalDate: info.InternalDate,
+			Body:         buf.Bytes(),
+		}
+		for flag := range info.Flags {
+			msg.Flags = append(msg.Flags, flag)
+		}
+		result = append(result, msg)
+	}
+	return
+}
+
+func (self *store) AddFlags(ctx context.Context, flags []string, uids ...uint32) (err error) {
+	if len(uids) == 0 {
+		return
+	}
+	seq := &imap.SeqSet{}
+	seq.AddNum(uids...)
+	_, err = self.wait(ctx)(self.client.UIDStore(seq, "+FLAGS.SILENT", imap.NewFlagSet(flags...)))
+	return
+}
+
+func (self *store) AddLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return self.storeLabels(ctx, "+X-GM-LABELS.SILENT", labels, uids)
+}
+
+func (self *store) RemoveLabels(ctx context.Context, labels []string, uids ...uint32) error {
+	return self.storeLabels(ctx, "-X-GM-LABELS.SILENT", labels, uids)
+}
+
+func (self *store) storeLabels(ctx context.Context, item string, labels []string, uids []uint32) (err error) {
+	if len(uids) == 0 || len(labels) == 0 {
+		return
+	}
+	seq := &imap.SeqSet{}
+	seq.AddNum(uids...)
+	fields := []imap.Field{}
+	for _, label := range labels {
+		fields = append(fields, imap.Quote(imap.UTF7Encode(label), false))
+	}
+	_, err = self.wait(ctx)(self.client.UIDStore(seq, item, fields))
+	return
+}
+
+func (self *store) Labels(ctx context.Context, uids ...uint32) (result map[uint32][]string, err error) {
+	if len(uids) == 0 || !self.client.Caps["X-GM-EXT-1"] {
+		return
+	}
+	seq := &imap.SeqSet{}
+	seq.AddNum(uids...)
+	cmd, err := self.wait(ctx)(self.client.UIDFetch(seq, "X-GM-LABELS"))
+	if err != nil {
+		return
+	}
+	result = map[uint32][]string{}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		result[info.UID] = asLabels(info.Attrs["X-GM-LABELS"])
+	}
+	return
+}
+
+func (self *store) UIDValidity() uint32 {
+	return self.client.Mailbox.UIDValidity
+}
+
+func (self *store) Close() (err error) {
+	if self.client.State() == imap.Closed {
+		return
+	}
+	_, err = self.client.Logout(GreetingTimeout)
+	return
+}
+
+// asNumber64 handles numbers too large for go-imap, which parses them as atoms.
+func asNumber64(f imap.Field) uint64 {
+	switch v := f.(type) {
+	case uint32:
+		return uint64(v)
+	case string:
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func asLabels(f imap.Field) (result []string) {
+	for _, label := range imap.AsList(f) {
+		result = append(result, imap.AsMailbox(label))
+	}
+	return
+}
@@ -0,0 +1,192 @@
+package imap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Thread is a message in a conversation, with the replies to it. Mail is nil for messages that are referred to, but
+// weren't among those threaded.
+type Thread struct {
+	MessageID string
+	Mail      *Mail
+	Children  []*Thread
+	parent    *Thread
+	// key is the MessageID, made unique for messages without or with duplicate ids.
+	key string
+}
+
+// messageIDs returns the ids in a Message-Id, In-Reply-To or References header, without angle brackets.
+func messageIDs(header string) (result []string) {
+	for {
+		start := strings.IndexByte(header, '<')
+		if start == -1 {
+			return
+		}
+		end := strings.IndexByte(header[start:], '>')
+		if end == -1 {
+			return
+		}
+		if id := strings.TrimSpace(header[start+1 : start+end]); id != "" {
+			result = append(result, id)
+		}
+		header = header[start+end+1:]
+	}
+}
+
+// references returns the ids of the ancestors of msg, oldest first, from its References header, or its In-Reply-To
+// header if it has no References.
+func references(msg *Mail) (result []string) {
+	if result = messageIDs(msg.GetHeader("References")); len(result) == 0 {
+		if inReplyTo := messageIDs(msg.GetHeader("In-Reply-To")); len(inReplyTo) > 0 {
+			result = inReplyTo[:1]
+		}
+	}
+	return
+}
+
+// has returns whether other is self or one of its descendants.
+func (self *Thread) has(other *Thread) bool {
+	for ; other != nil; other = other.parent {
+		if other == self {
+			return true
+		}
+	}
+	return false
+}
+
+// detach removes self from the children of its parent.
+func (self *Thread) detach() {
+	if self.parent == nil {
+		return
+	}
+	siblings := self.parent.Children
+	for i, sibling := range siblings {
+		if sibling == self {
+			self.parent.Children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	self.parent = nil
+}
+
+func (self *Thread) adopt(child *Thread) {
+	child.detach()
+	child.parent = self
+	self.Children = append(self.Children, child)
+}
+
+// date returns when the thread started, for sorting.
+func (self *Thread) date() (result time.Time) {
+	if self.Mail != nil {
+		return self.Mail.InternalDate
+	}
+	for _, child := range self.Children {
+		if date := child.date(); result.IsZero() || date.Before(result) {
+			result = date
+		}
+	}
+	return
+}
+
+// prune replaces the threads without mail among threads by their children, except at the root where a thread without
+// mail is kept if it has more than one child, since it is the only thing connecting them.
+func prune(threads []*Thread, root bool) (result []*Thread) {
+	for _, thread := range threads {
+		thread.Children = prune(thread.Children, false)
+		if thread.Mail == nil && (!root || len(thread.Children) < 2) {
+			for _, child := range thread.Children {
+				child.parent = thread.parent
+				result = append(result, child)
+			}
+			continue
+		}
+		result = append(result, thread)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].date().Before(result[j].date())
+	})
+	return
+}
+
+// Threads groups msgs into conversations using their Message-Id, In-Reply-To and References headers, like the JWZ
+// algorithm (https://www.jwz.org/doc/threading.html) without grouping by subject, for servers without X-GM-THRID.
+// Messages without a ThreadID get one derived from the id of the oldest message their conversation refers to, so that
+// replies arriving later get the same ThreadID. It returns the roots of the conversations, oldest first.
+func Threads(msgs []*Mail) (result []*Thread) {
+	threads := map[string]*Thread{}
+	get := func(key string) *Thread {
+		thread, found := threads[key]
+		if !found {
+			thread = &Thread{MessageID: key, key: key}
+			threads[key] = thread
+		}
+		return thread
+	}
+	own := map[*Mail]*Thread{}
+	for _, msg := range msgs {
+		if msg.MIMEBody == nil {
+			continue
+		}
+		ids := messageIDs(msg.GetHeader("Message-Id"))
+		id := ""
+		if len(ids) > 0 {
+			id = ids[0]
+		}
+		thread := get(id)
+		if id == "" || thread.Mail != nil {
+			// Messages without, or with duplicate, ids get their own.
+			thread = get(fmt.Sprintf("%v\x00%v\x00%v", id, msg.UID, len(threads)))
+			thread.MessageID = id
+		}
+		thread.Mail = msg
+		own[msg] = thread
+		var parent *Thread
+		for _, ref := range references(msg) {
+			next := get(ref)
+			// Links between references are only added if missing, but the parent of msg is its last reference.
+			if parent != nil && next.parent == nil && !next.has(parent) {
+				parent.adopt(next)
+			}
+			parent = next
+		}
+		// Any parent presumed from the references of other messages is replaced by the one msg itself refers to.
+		if parent == nil {
+			thread.detach()
+		} else if !thread.has(parent) {
+			parent.adopt(thread)
+		}
+	}
+	for _, thread := range threads {
+		if thread.parent == nil {
+			result = append(result, thread)
+		}
+	}
+	// Threads of the same age stay sorted by key, to be deterministic.
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].key < result[j].key
+	})
+	roots := map[*Thread]*Thread{}
+	for _, root := range result {
+		var visit func(thread *Thread)
+		visit = func(thread *Thread) {
+			roots[thread] = root
+			for _, child := range thread.Children {
+				visit(child)
+			}
+		}
+		visit(root)
+	}
+	for msg, thread := range own {
+		if msg.ThreadID == 0 {
+			h := fnv.New64a()
+			h.Write([]byte(roots[thread].key))
+			msg.ThreadID = h.Sum64()
+		}
+	}
+	result = prune(result, true)
+	return
+}
@@ -0,0 +1,68 @@
+package imap_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+func TestThreads(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []*imap.Mail{}
+	for i, headers := range []string{
+		"Message-Id: <c@example.com>\r\nReferences: <a@example.com> <b@example.com>",
+		"Message-Id: <a@example.com>",
+		"Message-Id: <d@example.com>\r\nIn-Reply-To: <a@example.com> (sent by someone)",
+		"Message-Id: <x@example.com>\r\nReferences: <missing@example.com>",
+		"Message-Id: <y@example.com>\r\nReferences: <missing@example.com>",
+		"Message-Id: <lonely@example.com>\r\nReferences: <gone@example.com>",
+		"Message-Id: <loop1@example.com>\r\nReferences: <loop2@example.com>",
+		"Message-Id: <loop2@example.com>\r\nReferences: <loop1@example.com>",
+	} {
+		msg, err := imap.Parse(imap.Message{
+			UID:          uint32(i + 1),
+			InternalDate: start.Add(time.Duration(i) * time.Minute),
+			Body:         []byte(headers + "\r\nSubject: hi\r\n\r\nbody"),
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	var describe func(threads []*imap.Thread) string
+	describe = func(threads []*imap.Thread) string {
+		parts := []string{}
+		for _, thread := range threads {
+			part := strings.SplitN(thread.MessageID, "@", 2)[0]
+			if thread.Mail == nil {
+				part = "(" + part + ")"
+			}
+			if len(thread.Children) > 0 {
+				part += describe(thread.Children)
+			}
+			parts = append(parts, part)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	if got, want := describe(imap.Threads(msgs)), "[a[c d] (missing)[x y] lonely loop2[loop1]]"; got != want {
+		t.Errorf("Wanted %v, got %v", want, got)
+	}
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {3, 4}} {
+		if a, b := msgs[pair[0]], msgs[pair[1]]; a.ThreadID == 0 || a.ThreadID != b.ThreadID {
+			t.Errorf("Wanted %v and %v in the same thread, got %v and %v", a.UID, b.UID, a.ThreadID, b.ThreadID)
+		}
+	}
+	if msgs[0].ThreadID == msgs[3].ThreadID || msgs[0].ThreadID == msgs[5].ThreadID {
+		t.Errorf("Wanted separate conversations in separate threads")
+	}
+	reply, err := imap.Parse(imap.Message{Body: []byte("Message-Id: <e@example.com>\r\nReferences: <a@example.com> <d@example.com>\r\n\r\nbody")})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imap.Threads([]*imap.Mail{reply})
+	if reply.ThreadID != msgs[0].ThreadID {
+		t.Errorf("Wanted a later reply threaded alone to get the same ThreadID")
+	}
+}
@@ -0,0 +1,184 @@
+package imap
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// TrustedAuthServIDs are the authserv-ids of the Authentication-Results headers Verdict trusts. Headers from other
+// servers, including those added by the sender, are ignored.
+var TrustedAuthServIDs = []string{"mx.google.com"}
+
+// AuthResult is the result of one authentication method in an Authentication-Results header, as defined by RFC 8601.
+type AuthResult struct {
+	// Method is like "spf", "dkim", "dmarc" or "arc".
+	Method string `json:"method"`
+	// Result is like "pass", "fail", "softfail", "neutral" or "none".
+	Result string `json:"result"`
+	// Properties are like "header.from": "example.com" or "smtp.mailfrom": "a@example.com".
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// ARCSeal is an ARC-Seal header, as defined by RFC 8617.
+type ARCSeal struct {
+	Instance int `json:"instance"`
+	// Sealer is the domain that added the seal.
+	Sealer string `json:"sealer"`
+	// Chain is the chain validation status the sealer saw, "none", "pass" or "fail".
+	Chain string `json:"chain"`
+}
+
+// Verdict is what Gmail decided about a message, parsed from its headers when it is fetched.
+type Verdict struct {
+	// Spam is set when X-Gm-Spam is 1.
+	Spam bool `json:"spam"`
+	// Phishy is set when X-Gm-Phishy is 1.
+	Phishy bool `json:"phishy"`
+	// Results are from the newest Authentication-Results header added by one of the TrustedAuthServIDs.
+	Results []AuthResult `json:"results,omitempty"`
+	// ARC is the newest ARC-Seal, or nil if there is none.
+	ARC *ARCSeal `json:"arc,omitempty"`
+}
+
+// Result returns the result of the first of the Results for method, or "none" if there is none.
+func (self Verdict) Result(method string) string {
+	for _, result := range self.Results {
+		if strings.EqualFold(result.Method, method) {
+			return result.Result
+		}
+	}
+	return "none"
+}
+
+// Authenticated returns whether DMARC passed, or, for senders without a DMARC policy, DKIM or SPF did.
+func (self Verdict) Authenticated() bool {
+	switch self.Result("dmarc") {
+	case "pass":
+		return true
+	case "none":
+		return self.Result("dkim") == "pass" || self.Result("spf") == "pass"
+	}
+	return false
+}
+
+// Trusted returns whether the message is authenticated and neither spam nor phishing, and so safe to act on
+// automatically.
+func (self Verdict) Trusted() bool {
+	return !self.Spam && !self.Phishy && self.Authenticated()
+}
+
+// verdict parses the verdict from the headers of a message.
+func verdict(header mail.Header) (result Verdict) {
+	result.Spam = strings.TrimSpace(header.Get("X-Gm-Spam")) == "1"
+	result.Phishy = strings.TrimSpace(header.Get("X-Gm-Phishy")) == "1"
+	// Servers add their headers on top, so the first trusted one is the newest.
+	for _, value := range header["Authentication-Results"] {
+		id, results := parseAuthResults(value)
+		if trustedAuthServID(id) {
+			result.Results = results
+			break
+		}
+	}
+	for _, value := range header["Arc-Seal"] {
+		tags := parseTags(value)
+		instance, err := strconv.Atoi(tags["i"])
+		if err != nil {
+			continue
+		}
+		if result.ARC == nil || instance > result.ARC.Instance {
+			result.ARC = &ARCSeal{
+				Instance: instance,
+				Sealer:   strings.ToLower(tags["d"]),
+				Chain:    strings.ToLower(tags["cv"]),
+			}
+		}
+	}
+	return
+}
+
+func trustedAuthServID(id string) bool {
+	for _, trusted := range TrustedAuthServIDs {
+		if strings.EqualFold(id, trusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthResults parses an Authentication-Results header value, like
+// "mx.google.com; spf=pass (google.com: ...) smtp.mailfrom=a@example.com; dmarc=pass header.from=example.com".
+func parseAuthResults(value string) (id string, results []AuthResult) {
+	parts := strings.Split(stripComments(value), ";")
+	// The authserv-id may be followed by a version.
+	if fields := strings.Fields(parts[0]); len(fields) > 0 {
+		id = fields[0]
+	}
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		method := strings.SplitN(fields[0], "=", 2)
+		if len(method) != 2 {
+			// Like "none", when no methods were applied.
+			continue
+		}
+		result := AuthResult{
+			// The method may have a version, like "dkim/1".
+			Method: strings.ToLower(strings.SplitN(method[0], "/", 2)[0]),
+			Result: strings.ToLower(method[1]),
+		}
+		for _, field := range fields[1:] {
+			if property := strings.SplitN(field, "=", 2); len(property) == 2 {
+				if result.Properties == nil {
+					result.Properties = map[string]string{}
+				}
+				result.Properties[strings.ToLower(property[0])] = strings.Trim(property[1], `"`)
+			}
+		}
+		results = append(results, result)
+	}
+	return
+}
+
+// stripComments removes the parenthesized, possibly nested, comments from a header value.
+func stripComments(value string) string {
+	result := &strings.Builder{}
+	depth, quoted := 0, false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && (quoted || depth > 0) && i+1 < len(value):
+			i++
+			if depth == 0 {
+				result.WriteByte(value[i])
+			}
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			result.WriteByte(' ')
+			continue
+		}
+		if depth == 0 {
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// parseTags parses a tag list, like "i=1; a=rsa-sha256; cv=none; d=google.com".
+func parseTags(value string) (result map[string]string) {
+	result = map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			result[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Join(strings.Fields(kv[1]), "")
+		}
+	}
+	return
+}
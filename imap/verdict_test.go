@@ -0,0 +1,63 @@
+package imap_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestVerdict(t *testing.T) {
+	mailbox := imaptest.New()
+	mailbox.Deliver(strings.Join([]string{
+		"X-Gm-Spam: 0",
+		"X-Gm-Phishy: 0",
+		"ARC-Seal: i=2; a=rsa-sha256; t=1600000000; cv=pass; d=google.com; s=arc-20160816;",
+		"        b=abc",
+		"ARC-Seal: i=1; a=rsa-sha256; cv=none; d=lists.example.org; b=def",
+		"Authentication-Results: mx.google.com;",
+		"       dkim=pass header.i=@example.com header.s=s1 header.b=abc;",
+		"       spf=pass (google.com: domain of a@example.com (nested) designates 1.2.3.4 as permitted sender) smtp.mailfrom=a@example.com;",
+		"       dmarc=pass (p=NONE sp=NONE dis=NONE) header.from=example.com",
+		"Authentication-Results: evil.example.com; dmarc=fail header.from=example.com",
+		"From: a@example.com",
+		"Subject: authenticated",
+		"",
+		"body",
+	}, "\r\n"))
+	mailbox.Deliver(strings.Join([]string{
+		"X-Gm-Spam: 1",
+		"Authentication-Results: mx.google.com; spf=softfail smtp.mailfrom=b@example.com; dmarc=fail header.from=example.com",
+		"Authentication-Results: mx.google.com; dmarc=pass header.from=example.com",
+		"From: b@example.com",
+		"Subject: spam",
+		"",
+		"body",
+	}, "\r\n"))
+	mailbox.Deliver("Authentication-Results: example.com; dmarc=pass header.from=example.com\r\nFrom: c@example.com\r\nSubject: untrusted\r\n\r\nbody")
+	verdicts := map[string]imap.Verdict{}
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(func(msg *imap.Mail) error {
+		verdicts[msg.GetHeader("Subject")] = msg.Verdict
+		return nil
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	authenticated := verdicts["authenticated"]
+	if !authenticated.Trusted() || authenticated.Result("spf") != "pass" || authenticated.Result("arc") != "none" {
+		t.Errorf("Wanted a trusted verdict, got %+v", authenticated)
+	}
+	if len(authenticated.Results) != 3 || authenticated.Results[1].Properties["smtp.mailfrom"] != "a@example.com" || authenticated.Results[2].Properties["header.from"] != "example.com" {
+		t.Errorf("Wanted the results with their properties, got %+v", authenticated.Results)
+	}
+	if want := (imap.ARCSeal{Instance: 2, Sealer: "google.com", Chain: "pass"}); authenticated.ARC == nil || *authenticated.ARC != want {
+		t.Errorf("Wanted the newest seal %+v, got %+v", want, authenticated.ARC)
+	}
+	spam := verdicts["spam"]
+	if !spam.Spam || spam.Trusted() || spam.Result("dmarc") != "fail" || spam.Authenticated() {
+		t.Errorf("Wanted an untrusted spam verdict from the newest results, got %+v", spam)
+	}
+	if untrusted := verdicts["untrusted"]; untrusted.Results != nil || untrusted.Trusted() {
+		t.Errorf("Wanted results from other servers ignored, got %+v", untrusted)
+	}
+}
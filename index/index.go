@@ -0,0 +1,210 @@
+// Package index keeps a local full-text index of fetched mail, to search recent messages without asking the server.
+//
+//	idx := index.NewMemory()
+//	client.MailHandler(sinks.All(index.Handler(idx), handler))
+//	docs, err := idx.Search("from:alice invoice")
+package index
+
+import (
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/zond/gmail/imap"
+)
+
+// Document is the indexed part of a message.
+type Document struct {
+	UID     uint32
+	GmailID uint64
+	From    string
+	Subject string
+	Body    string
+	Date    time.Time
+}
+
+func NewDocument(msg *imap.Mail) (result Document) {
+	result = Document{
+		UID:     msg.UID,
+		GmailID: msg.GmailID,
+		Date:    msg.InternalDate,
+	}
+	if msg.MIMEBody != nil {
+		result.From = msg.GetHeader("From")
+		result.Subject = msg.GetHeader("Subject")
+		result.Body = msg.Text
+		if strings.TrimSpace(result.Body) == "" {
+			result.Body = msg.Snippet
+		}
+	}
+	return
+}
+
+// Index is implemented by full-text indexes, like Memory. Adapters for other engines only need these two methods.
+type Index interface {
+	// Index adds the document, replacing any previous document with the same GmailID, or UID if it has no GmailID.
+	Index(doc Document) error
+	// Search returns the documents matching the query, newest first. Queries are words that all have to match,
+	// optionally prefixed with from: or subject: to only match those fields.
+	Search(query string) ([]Document, error)
+}
+
+// Handler returns a handler adding each message to idx.
+func Handler(idx Index) imap.MailHandler {
+	return func(msg *imap.Mail) error {
+		return idx.Index(NewDocument(msg))
+	}
+}
+
+// DefaultMaxDocuments is the MaxDocuments of new Memory indexes.
+var DefaultMaxDocuments = 100000
+
+// Memory is a thread safe in-memory Index.
+type Memory struct {
+	// MaxDocuments is how many documents are kept, after which the first indexed ones are forgotten. Zero keeps all.
+	MaxDocuments int
+	lock         sync.RWMutex
+	docs         map[int]*Document
+	byKey        map[uint64]int
+	// terms are the terms posted for each document, to unpost them without going through all the postings.
+	terms map[int][]string
+	// order is the documents in the order they were first indexed.
+	order    []int
+	next     int
+	postings map[string]map[int]bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		MaxDocuments: DefaultMaxDocuments,
+		docs:         map[int]*Document{},
+		byKey:        map[uint64]int{},
+		terms:        map[int][]string{},
+		postings:     map[string]map[int]bool{},
+	}
+}
+
+func key(doc *Document) uint64 {
+	if doc.GmailID != 0 {
+		return doc.GmailID
+	}
+	return uint64(doc.UID)
+}
+
+func (self *Memory) Index(doc Document) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k := key(&doc)
+	i, found := self.byKey[k]
+	if found {
+		self.unpost(i)
+	} else {
+		i = self.next
+		self.next++
+		self.byKey[k] = i
+		self.order = append(self.order, i)
+	}
+	self.docs[i] = &doc
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"from", fromText(doc.From)},
+		{"subject", doc.Subject},
+		{"", doc.Body},
+	} {
+		for _, term := range tokenize(field.value) {
+			self.post(term, i)
+			if field.name != "" {
+				self.post(field.name+":"+term, i)
+			}
+		}
+	}
+	for self.MaxDocuments > 0 && len(self.order) > self.MaxDocuments {
+		self.evict(self.order[0])
+		self.order = self.order[1:]
+	}
+	return nil
+}
+
+func (self *Memory) post(term string, i int) {
+	if self.postings[term] == nil {
+		self.postings[term] = map[int]bool{}
+	}
+	if !self.postings[term][i] {
+		self.postings[term][i] = true
+		self.terms[i] = append(self.terms[i], term)
+	}
+}
+
+func (self *Memory) unpost(i int) {
+	for _, term := range self.terms[i] {
+		docs := self.postings[term]
+		delete(docs, i)
+		if len(docs) == 0 {
+			delete(self.postings, term)
+		}
+	}
+	delete(self.terms, i)
+}
+
+// evict forgets the document.
+func (self *Memory) evict(i int) {
+	self.unpost(i)
+	delete(self.byKey, key(self.docs[i]))
+	delete(self.docs, i)
+}
+
+func (self *Memory) Search(query string) (result []Document, err error) {
+	terms := []string{}
+	for _, word := range strings.Fields(query) {
+		prefix := ""
+		if colon := strings.IndexByte(word, ':'); colon != -1 {
+			if field := strings.ToLower(word[:colon]); field == "from" || field == "subject" {
+				prefix = field + ":"
+				word = word[colon+1:]
+			}
+		}
+		for _, term := range tokenize(word) {
+			terms = append(terms, prefix+term)
+		}
+	}
+	if len(terms) == 0 {
+		return
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for i := range self.postings[terms[0]] {
+		match := true
+		for _, term := range terms[1:] {
+			if !self.postings[term][i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			result = append(result, *self.docs[i])
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Date.After(result[j].Date)
+	})
+	return
+}
+
+// fromText makes both the name and the address of a From header searchable.
+func fromText(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Name + " " + addr.Address
+	}
+	return from
+}
+
+func tokenize(s string) (result []string) {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,75 @@
+package index
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestMemory(t *testing.T) {
+	mailbox := imaptest.New()
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mailbox.Append(context.Background(), nil, date, []byte("From: Alice <alice@example.com>\r\nSubject: Invoice 12\r\n\r\nPlease pay the invoice."))
+	mailbox.Append(context.Background(), nil, date.Add(time.Hour), []byte("From: bob@example.com\r\nSubject: Lunch?\r\n\r\nAbout that invoice from Alice..."))
+	idx := NewMemory()
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(Handler(idx)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for query, want := range map[string][]uint32{
+		"invoice":            {2, 1},
+		"from:alice":         {1},
+		"alice":              {2, 1},
+		"subject:lunch":      {2},
+		"Invoice from:bob":   {2},
+		"subject:invoice 12": {1},
+		"nothing":            nil,
+	} {
+		docs, err := idx.Search(query)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		got := []uint32{}
+		for _, doc := range docs {
+			got = append(got, doc.UID)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%v: wanted %v but got %v", query, want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%v: wanted %v but got %v", query, want, got)
+			}
+		}
+	}
+	if err := idx.Index(Document{UID: 1, GmailID: imaptest.GmailIDBase + 1, Subject: "replaced"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if docs, _ := idx.Search("from:alice"); len(docs) != 0 {
+		t.Errorf("Wanted the replaced document to be gone, got %+v", docs)
+	}
+}
+
+func TestMemoryMaxDocuments(t *testing.T) {
+	idx := NewMemory()
+	idx.MaxDocuments = 2
+	// Indexing a document again keeps its place.
+	for _, uid := range []uint32{1, 2, 1, 3} {
+		if err := idx.Index(Document{UID: uid, Subject: "report"}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	docs, err := idx.Search("report")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(docs) != 2 || docs[0].UID == 1 || docs[1].UID == 1 {
+		t.Errorf("Wanted the first indexed document forgotten, got %+v", docs)
+	}
+	if len(idx.docs) != 2 || len(idx.byKey) != 2 || len(idx.terms) != 2 || len(idx.postings["report"]) != 2 {
+		t.Errorf("Wanted nothing left of the forgotten document, got %v docs, %v keys, %v terms and %v postings", len(idx.docs), len(idx.byKey), len(idx.terms), len(idx.postings["report"]))
+	}
+}
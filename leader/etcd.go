@@ -0,0 +1,139 @@
+package leader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type etcdLease struct {
+	endpoint string
+	key      string
+	owner    string
+	client   *http.Client
+	// id is the etcd lease the key was put with, or empty if there is none.
+	id string
+}
+
+// Etcd returns a Lease stored under key in etcd, talking to the JSON gateway of the etcd v3 API at endpoint, like
+// http://localhost:2379. The key is put with an etcd lease of the ttl, only if it doesn't exist, and renewing keeps
+// that etcd lease alive, so the key disappears on its own when a replica stops renewing.
+func Etcd(endpoint, key string) Lease {
+	return &etcdLease{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		key:      key,
+		owner:    owner(),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (self *etcdLease) call(path string, request interface{}, response interface{}) (err error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	rsp, err := self.client.Post(self.endpoint+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	if b, err = io.ReadAll(io.LimitReader(rsp.Body, 1<<20)); err != nil {
+		return
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd: %v returned %v: %s", path, rsp.Status, b)
+	}
+	return json.Unmarshal(b, response)
+}
+
+// keepAlive renews the etcd lease, and returns whether it was still alive.
+func (self *etcdLease) keepAlive() (alive bool, err error) {
+	rsp := struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}{}
+	if err = self.call("/v3/lease/keepalive", map[string]string{"ID": self.id}, &rsp); err != nil {
+		return
+	}
+	ttl, _ := strconv.ParseInt(rsp.Result.TTL, 10, 64)
+	return ttl > 0, nil
+}
+
+func (self *etcdLease) revoke() (err error) {
+	id := self.id
+	self.id = ""
+	return self.call("/v3/lease/revoke", map[string]string{"ID": id}, &struct{}{})
+}
+
+func (self *etcdLease) Acquire(ttl time.Duration) (result bool, err error) {
+	if self.id != "" {
+		var alive bool
+		if alive, err = self.keepAlive(); err != nil {
+			return
+		}
+		if !alive {
+			self.id = ""
+		}
+	}
+	if self.id == "" {
+		granted := struct {
+			ID string `json:"ID"`
+		}{}
+		seconds := int64((ttl + time.Second - 1) / time.Second)
+		if err = self.call("/v3/lease/grant", map[string]int64{"TTL": seconds}, &granted); err != nil {
+			return
+		}
+		self.id = granted.ID
+	}
+	// Put the key with the etcd lease if it doesn't exist, or read who holds it.
+	key := []byte(self.key)
+	txn := struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			Range struct {
+				Kvs []struct {
+					Value []byte `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}{}
+	if err = self.call("/v3/kv/txn", map[string]interface{}{
+		"compare": []interface{}{map[string]interface{}{"key": key, "target": "CREATE", "create_revision": "0"}},
+		"success": []interface{}{map[string]interface{}{"request_put": map[string]interface{}{"key": key, "value": []byte(self.owner), "lease": self.id}}},
+		"failure": []interface{}{map[string]interface{}{"request_range": map[string]interface{}{"key": key}}},
+	}, &txn); err != nil {
+		return
+	}
+	if txn.Succeeded {
+		result = true
+		return
+	}
+	for _, response := range txn.Responses {
+		for _, kv := range response.Range.Kvs {
+			if string(kv.Value) == self.owner && kv.Lease == self.id {
+				result = true
+				return
+			}
+		}
+	}
+	// Another replica holds the key, so the etcd lease would only keep nothing alive.
+	err = self.revoke()
+	return
+}
+
+func (self *etcdLease) Release() (err error) {
+	if self.id == "" {
+		return
+	}
+	// Revoking the etcd lease deletes the key put with it.
+	return self.revoke()
+}
@@ -0,0 +1,139 @@
+package leader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is the part of the JSON gateway of etcd that the lease uses, with leases that only expire when told to.
+type fakeEtcd struct {
+	lock    sync.Mutex
+	nextID  int64
+	leases  map[string]bool
+	values  map[string]string
+	leaseOf map[string]string
+}
+
+func (self *fakeEtcd) serve(t *testing.T) string {
+	self.leases, self.values, self.leaseOf = map[string]bool{}, map[string]string{}, map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			ID      string `json:"ID"`
+			TTL     int64  `json:"TTL"`
+			Compare []struct {
+				Key            []byte `json:"key"`
+				Target         string `json:"target"`
+				CreateRevision string `json:"create_revision"`
+			} `json:"compare"`
+			Success []struct {
+				Put struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"request_put"`
+			} `json:"success"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("%v", err)
+		}
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		var response interface{}
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			self.nextID++
+			id := strconv.FormatInt(self.nextID, 10)
+			self.leases[id] = true
+			response = map[string]string{"ID": id, "TTL": strconv.FormatInt(request.TTL, 10)}
+		case "/v3/lease/keepalive":
+			result := map[string]string{"ID": request.ID}
+			if self.leases[request.ID] {
+				result["TTL"] = "60"
+			}
+			response = map[string]interface{}{"result": result}
+		case "/v3/lease/revoke":
+			self.expire(request.ID)
+			response = map[string]string{}
+		case "/v3/kv/txn":
+			if len(request.Compare) != 1 || request.Compare[0].Target != "CREATE" || request.Compare[0].CreateRevision != "0" || len(request.Success) != 1 {
+				t.Errorf("Unexpected transaction %+v", request)
+			}
+			key := string(request.Compare[0].Key)
+			if _, found := self.values[key]; !found {
+				put := request.Success[0].Put
+				if !self.leases[put.Lease] {
+					http.Error(w, `{"error":"etcdserver: requested lease not found"}`, http.StatusNotFound)
+					return
+				}
+				self.values[string(put.Key)], self.leaseOf[string(put.Key)] = string(put.Value), put.Lease
+				response = map[string]interface{}{"succeeded": true}
+			} else {
+				kv := map[string]interface{}{"key": []byte(key), "value": []byte(self.values[key]), "lease": self.leaseOf[key]}
+				response = map[string]interface{}{"responses": []interface{}{map[string]interface{}{"response_range": map[string]interface{}{"kvs": []interface{}{kv}}}}}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// expire drops the lease and the keys put with it. It must be called with lock held.
+func (self *fakeEtcd) expire(id string) {
+	delete(self.leases, id)
+	for key, lease := range self.leaseOf {
+		if lease == id {
+			delete(self.values, key)
+			delete(self.leaseOf, key)
+		}
+	}
+}
+
+func TestEtcdLease(t *testing.T) {
+	server := &fakeEtcd{}
+	endpoint := server.serve(t)
+	a, b := Etcd(endpoint, "lease"), Etcd(endpoint, "lease")
+	for _, step := range []struct {
+		lease Lease
+		want  bool
+	}{{a, true}, {b, false}, {a, true}} {
+		if held, err := step.lease.Acquire(time.Minute); err != nil || held != step.want {
+			t.Fatalf("Wanted %v, got %v and %v", step.want, held, err)
+		}
+	}
+	server.lock.Lock()
+	if len(server.leases) != 1 {
+		t.Errorf("Wanted the etcd lease of b revoked after failing, got %v leases", len(server.leases))
+	}
+	// The etcd lease of a expires, and b takes over before a renews it.
+	for id := range server.leases {
+		server.expire(id)
+	}
+	server.lock.Unlock()
+	if held, err := b.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted b to take over, got %v and %v", held, err)
+	}
+	if held, err := a.Acquire(time.Minute); err != nil || held {
+		t.Fatalf("Wanted a to lose the lease, got %v and %v", held, err)
+	}
+	if err := a.Release(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if held, err := b.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted a to leave the lease of b alone, got %v and %v", held, err)
+	}
+	if err := b.Release(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if held, err := a.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted the released lease free, got %v and %v", held, err)
+	}
+}
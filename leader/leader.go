@@ -0,0 +1,258 @@
+// Package leader lets several replicas of a service share an account, with only one of them connected at a time.
+//
+//	l := &leader.Leader{
+//		Lease: leader.File("/var/lib/gmail/lease"),
+//		TTL:   time.Minute,
+//		Start: func() error { _, err := client.Start(); return err },
+//		Stop:  client.Close,
+//	}
+//	err := l.Run(ctx)
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/redisstore"
+)
+
+// Lease is a lock that expires unless renewed, shared by the replicas.
+type Lease interface {
+	// Acquire takes the lease for ttl if it is free or already held by this instance, and returns whether it did.
+	Acquire(ttl time.Duration) (bool, error)
+	// Release frees the lease if this instance holds it.
+	Release() error
+}
+
+func owner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%v-%v-%x", host, os.Getpid(), b)
+}
+
+// Leader calls Start when it acquires the Lease, and Stop when it loses it.
+type Leader struct {
+	Lease Lease
+	// TTL is how long the lease lasts without being renewed. It is renewed every third of TTL.
+	TTL   time.Duration
+	Start func() error
+	Stop  func() error
+	// ErrorHandler, if set, is called with errors from the lease, Start and Stop.
+	ErrorHandler func(e error)
+	// Clock drives the renewals, or clock.Real if nil.
+	Clock clock.Clock
+}
+
+func (self *Leader) report(err error) {
+	if err != nil && self.ErrorHandler != nil {
+		self.ErrorHandler(err)
+	}
+}
+
+// Run tries to acquire or renew the lease until ctx is done, and then stops and releases it if held.
+// If the lease can't be renewed, Stop is called before any other replica can take it over.
+func (self *Leader) Run(ctx context.Context) error {
+	c := self.Clock
+	if c == nil {
+		c = clock.Real
+	}
+	renew := self.TTL / 3
+	held := false
+	var renewed time.Time
+	stop := func() {
+		held = false
+		self.report(self.Stop())
+	}
+	defer func() {
+		if held {
+			stop()
+			self.report(self.Lease.Release())
+		}
+	}()
+	for {
+		acquired, err := self.Lease.Acquire(self.TTL)
+		switch {
+		case err != nil:
+			self.report(err)
+			if held && c.Now().Sub(renewed) >= self.TTL-renew {
+				stop()
+			}
+		case acquired:
+			renewed = c.Now()
+			if !held {
+				if err = self.Start(); err != nil {
+					self.report(err)
+					self.report(self.Lease.Release())
+				} else {
+					held = true
+				}
+			}
+		case held:
+			stop()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.After(renew):
+		}
+	}
+}
+
+// FileLease is a Lease stored in a file, see File.
+type FileLease struct {
+	path  string
+	owner string
+	clock clock.Clock
+}
+
+// File returns a Lease stored in a file, for replicas sharing a file system. The file contains the owner and the
+// expiry time. Replicas change it one at a time, holding an exclusive lock on the file with the .lock suffix next to
+// it, so only one of them can take over an expired lease. The file system has to support flock, or LockFileEx on
+// Windows, which some network file systems don't.
+func File(path string) *FileLease {
+	return &FileLease{
+		path:  path,
+		owner: owner(),
+		clock: clock.Real,
+	}
+}
+
+// Clock replaces the clock timing the expiry of the lease, to let tests drive it.
+func (self *FileLease) Clock(c clock.Clock) *FileLease {
+	self.clock = c
+	return self
+}
+
+// locked calls f holding the lock of the lease.
+func (self *FileLease) locked(f func() error) (err error) {
+	lock, err := os.OpenFile(self.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+	if err = lockFile(lock); err != nil {
+		return
+	}
+	defer unlockFile(lock)
+	return f()
+}
+
+func (self *FileLease) read() (owner string, expires time.Time, err error) {
+	b, err := os.ReadFile(self.path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	parts := strings.Fields(string(b))
+	if len(parts) != 2 {
+		return
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		err = nil
+		return
+	}
+	return parts[0], time.Unix(0, nanos), nil
+}
+
+func (self *FileLease) write(expires time.Time) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(self.path), filepath.Base(self.path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = fmt.Fprintf(tmp, "%v %v\n", self.owner, expires.UnixNano()); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), self.path)
+}
+
+func (self *FileLease) Acquire(ttl time.Duration) (result bool, err error) {
+	err = self.locked(func() (err error) {
+		owner, expires, err := self.read()
+		if err != nil {
+			return
+		}
+		now := self.clock.Now()
+		if owner != self.owner && now.Before(expires) {
+			return
+		}
+		if err = self.write(now.Add(ttl)); err != nil {
+			return
+		}
+		result = true
+		return
+	})
+	return
+}
+
+func (self *FileLease) Release() error {
+	return self.locked(func() (err error) {
+		owner, _, err := self.read()
+		if err != nil || owner != self.owner {
+			return
+		}
+		if err = os.Remove(self.path); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	})
+}
+
+type redisLease struct {
+	store *redisstore.Store
+	key   string
+	owner string
+}
+
+// renewScript and releaseScript only touch the key if it still holds the owner, atomically.
+const (
+	renewScript   = `if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('pexpire', KEYS[1], ARGV[2]) else return 0 end`
+	releaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end`
+)
+
+// Redis returns a Lease stored under key in Redis. Renewal and release are Lua scripts checking the owner, so a replica
+// never renews or deletes a lease another replica took over.
+func Redis(store *redisstore.Store, key string) Lease {
+	return &redisLease{
+		store: store,
+		key:   key,
+		owner: owner(),
+	}
+}
+
+func (self *redisLease) Acquire(ttl time.Duration) (result bool, err error) {
+	millis := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	reply, err := self.store.Do("SET", self.key, self.owner, "NX", "PX", millis)
+	if err != nil {
+		return
+	}
+	if reply != nil {
+		result = true
+		return
+	}
+	if reply, err = self.store.Do("EVAL", renewScript, "1", self.key, self.owner, millis); err != nil {
+		return
+	}
+	result = reply == int64(1)
+	return
+}
+
+func (self *redisLease) Release() (err error) {
+	_, err = self.store.Do("EVAL", releaseScript, "1", self.key, self.owner)
+	return
+}
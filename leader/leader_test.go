@@ -0,0 +1,235 @@
+package leader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/redisstore"
+)
+
+func TestFailover(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	path := filepath.Join(t.TempDir(), "lease")
+	events := make(chan string, 10)
+	leader := func(name string) *Leader {
+		return &Leader{
+			Lease: File(path).Clock(fake),
+			TTL:   30 * time.Second,
+			Clock: fake,
+			Start: func() error {
+				events <- name + " started"
+				return nil
+			},
+			Stop: func() error {
+				events <- name + " stopped"
+				return nil
+			},
+			ErrorHandler: func(e error) {
+				t.Errorf("%v: %v", name, e)
+			},
+		}
+	}
+	expect := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("Wanted %q but got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Wanted %q", want)
+		}
+	}
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error)
+	go func() {
+		doneA <- leader("a").Run(ctxA)
+	}()
+	expect("a started")
+	fake.BlockUntil(1)
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneB := make(chan error)
+	go func() {
+		doneB <- leader("b").Run(ctxB)
+	}()
+	fake.BlockUntil(2)
+	fake.Advance(10 * time.Second)
+	fake.BlockUntil(2)
+	select {
+	case got := <-events:
+		t.Fatalf("Wanted nothing while a holds the lease, got %q", got)
+	default:
+	}
+	cancelA()
+	expect("a stopped")
+	<-doneA
+	fake.Advance(10 * time.Second)
+	expect("b started")
+	cancelB()
+	expect("b stopped")
+	<-doneB
+}
+
+func TestFileLeaseTakeover(t *testing.T) {
+	// The replicas only race when they run in parallel.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	path := filepath.Join(t.TempDir(), "lease")
+	for round := 0; round < 20; round++ {
+		leases := []Lease{}
+		for i := 0; i < 20; i++ {
+			leases = append(leases, File(path))
+		}
+		acquired := make(chan bool, len(leases))
+		start := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for _, lease := range leases {
+			wg.Add(1)
+			go func(lease Lease) {
+				defer wg.Done()
+				<-start
+				held, err := lease.Acquire(time.Minute)
+				if err != nil {
+					t.Errorf("%v", err)
+				}
+				acquired <- held
+			}(lease)
+		}
+		close(start)
+		wg.Wait()
+		close(acquired)
+		holders := 0
+		for held := range acquired {
+			if held {
+				holders++
+			}
+		}
+		if holders != 1 {
+			t.Fatalf("Wanted one holder, got %v", holders)
+		}
+		for _, lease := range leases {
+			if err := lease.Release(); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+}
+
+// fakeRedis serves SET NX and the lease scripts.
+type fakeRedis struct {
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func (self *fakeRedis) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go self.handle(conn)
+		}
+	}()
+	return "redis://" + listener.Addr().String()
+}
+
+func (self *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := []string{}
+		for i := 0; i < n; i++ {
+			if line, err = r.ReadString('\n'); err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err = io.ReadFull(r, b); err != nil {
+				return
+			}
+			args = append(args, string(b[:size]))
+		}
+		self.lock.Lock()
+		reply := fmt.Sprintf("-ERR unknown command %q\r\n", args[0])
+		switch {
+		case args[0] == "SET" && len(args) == 6 && args[3] == "NX":
+			if _, found := self.values[args[1]]; found {
+				reply = "$-1\r\n"
+			} else {
+				self.values[args[1]] = args[2]
+				reply = "+OK\r\n"
+			}
+		case args[0] == "EVAL" && (args[1] == renewScript || args[1] == releaseScript):
+			reply = ":0\r\n"
+			if self.values[args[3]] == args[4] {
+				if args[1] == releaseScript {
+					delete(self.values, args[3])
+				}
+				reply = ":1\r\n"
+			}
+		}
+		self.lock.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisLease(t *testing.T) {
+	server := &fakeRedis{values: map[string]string{}}
+	store, err := redisstore.New(server.serve(t))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	a, b := Redis(store, "lease"), Redis(store, "lease")
+	for _, step := range []struct {
+		lease Lease
+		want  bool
+	}{{a, true}, {b, false}, {a, true}} {
+		if held, err := step.lease.Acquire(time.Minute); err != nil || held != step.want {
+			t.Fatalf("Wanted %v, got %v and %v", step.want, held, err)
+		}
+	}
+	// The lease expires, and b takes it over before a renews it.
+	server.lock.Lock()
+	delete(server.values, "lease")
+	server.lock.Unlock()
+	if held, err := b.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted b to take over, got %v and %v", held, err)
+	}
+	if held, err := a.Acquire(time.Minute); err != nil || held {
+		t.Fatalf("Wanted a to lose the lease, got %v and %v", held, err)
+	}
+	if err := a.Release(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if held, err := b.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted a to leave the lease of b alone, got %v and %v", held, err)
+	}
+	if err := b.Release(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if held, err := a.Acquire(time.Minute); err != nil || !held {
+		t.Fatalf("Wanted the released lease free, got %v and %v", held, err)
+	}
+}
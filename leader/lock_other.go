@@ -0,0 +1,18 @@
+//go:build !unix && !windows
+
+package leader
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoLocks = errors.New("leader: file leases need file locks, which this platform lacks")
+
+func lockFile(f *os.File) error {
+	return errNoLocks
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
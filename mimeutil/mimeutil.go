@@ -0,0 +1,202 @@
+// Package mimeutil parses MIME messages into their text, HTML and attachments with github.com/jhillyerd/enmime,
+// decoding transfer encodings and converting the charsets they declare to UTF-8.
+package mimeutil
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/axgle/mahonia"
+	"github.com/jhillyerd/enmime"
+)
+
+// MIMEPart is a decoded part of a message.
+type MIMEPart interface {
+	ContentType() string
+	FileName() string
+	Content() []byte
+	Disposition() string
+}
+
+// part is a MIMEPart parsed by enmime. Parts without a Content-Type are text/plain.
+type part struct {
+	*enmime.Part
+}
+
+func (self *part) ContentType() string {
+	if self.Part.ContentType == "" {
+		return "text/plain"
+	}
+	return self.Part.ContentType
+}
+
+func (self *part) FileName() string    { return self.Part.FileName }
+func (self *part) Content() []byte     { return self.Part.Content }
+func (self *part) Disposition() string { return self.Part.Disposition }
+
+// MIMEBody is a parsed message. Text and Html are the first text/plain and text/html parts that aren't attachments,
+// converted to UTF-8. If the message has no text part, Text is made from the HTML and IsTextFromHtml is set.
+type MIMEBody struct {
+	Text           string
+	Html           string
+	IsTextFromHtml bool
+	Root           MIMEPart
+	Attachments    []MIMEPart
+	Inlines        []MIMEPart
+	OtherParts     []MIMEPart
+	// Errors are the parts of the message that were lost while parsing it, like the content of a part with malformed
+	// base64.
+	Errors []error
+
+	header mail.Header
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: CharsetReader}
+
+// GetHeader returns the named header of the message, with RFC 2047 encoded words decoded.
+func (self *MIMEBody) GetHeader(name string) string {
+	value := self.header.Get(name)
+	if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// CharsetReader returns a reader converting input from charset to UTF-8. It can be used as the CharsetReader of
+// xml.Decoder and mime.WordDecoder.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	decoder := mahonia.NewDecoder(charset)
+	if decoder == nil {
+		return nil, fmt.Errorf("mimeutil: unsupported charset %q", charset)
+	}
+	return decoder.NewReader(input), nil
+}
+
+// DecodeText converts body to UTF-8 from the charset of contentType, and returns it unchanged if the charset is
+// missing or unknown.
+func DecodeText(body, contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body
+	}
+	return convert([]byte(body), params["charset"])
+}
+
+// convert converts content from charset to UTF-8, and returns it unchanged if the charset is missing or unknown.
+func convert(content []byte, charset string) string {
+	if charset == "" {
+		return string(content)
+	}
+	reader, err := CharsetReader(charset, bytes.NewReader(content))
+	if err != nil {
+		return string(content)
+	}
+	converted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return string(content)
+	}
+	return string(converted)
+}
+
+// IsMultipartMessage returns whether msg is a multipart message.
+func IsMultipartMessage(msg *mail.Message) bool {
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "multipart/")
+}
+
+// parser keeps what it can of malformed mail, recording the errors on the parts, and only converts the charsets the
+// parts declare.
+var parser = enmime.NewParser(
+	enmime.SkipMalformedParts(true),
+	enmime.SetReadPartErrorPolicy(enmime.AllowCorruptTextPartErrorPolicy),
+	enmime.DisableCharacterDetection(true),
+	enmime.DisableTextConversion(true),
+)
+
+// ParseMIMEBody reads and parses the body of msg. Parts that fail to decode, like malformed base64, don't fail the
+// message, but keep what could be decoded of their content, and are listed in Errors.
+func ParseMIMEBody(msg *mail.Message) (result *MIMEBody, err error) {
+	header := &bytes.Buffer{}
+	keys := []string{}
+	for key := range msg.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range msg.Header[key] {
+			fmt.Fprintf(header, "%v: %v\r\n", key, value)
+		}
+	}
+	header.WriteString("\r\n")
+	root, err := parser.ReadParts(io.MultiReader(header, msg.Body))
+	if err != nil {
+		return
+	}
+	result = &MIMEBody{
+		Root:   &part{root},
+		header: msg.Header,
+	}
+	for _, p := range root.DepthMatchAll(func(p *enmime.Part) bool {
+		return true
+	}) {
+		for _, e := range p.Errors {
+			if e.Severe || e.Name == enmime.ErrorMalformedBase64 || e.Name == enmime.ErrorMalformedChildPart {
+				result.Errors = append(result.Errors, e)
+			}
+		}
+		if !strings.HasPrefix(p.ContentType, "multipart/") {
+			result.add(&part{p}, p == root)
+		}
+	}
+	if result.Text == "" && result.Html != "" {
+		result.Text, result.IsTextFromHtml = htmlToText(result.Html), true
+	}
+	return
+}
+
+// add sorts p into the text, HTML, attachments, inlines or other parts.
+func (self *MIMEBody) add(p *part, root bool) {
+	switch contentType, disposition := p.ContentType(), p.Disposition(); {
+	case disposition == "attachment" || (p.FileName() != "" && disposition != "inline"):
+		self.Attachments = append(self.Attachments, p)
+	case disposition == "inline" && !strings.HasPrefix(contentType, "text/"):
+		self.Inlines = append(self.Inlines, p)
+	case contentType == "text/plain" && self.Text == "":
+		self.Text = string(p.Content())
+		if !root {
+			self.Text = strings.TrimRight(self.Text, "\r\n") + "\n"
+		}
+	case contentType == "text/html" && self.Html == "":
+		self.Html = string(p.Content())
+	default:
+		self.OtherParts = append(self.OtherParts, p)
+	}
+}
+
+var (
+	htmlDropped = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	htmlBreaks  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/h[1-6]|/li)\b[^>]*>`)
+	htmlTags    = regexp.MustCompile(`<[^>]*>`)
+	blankLines  = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+)
+
+// htmlToText makes a plain text version of an HTML body, for messages without one.
+func htmlToText(body string) string {
+	body = htmlDropped.ReplaceAllString(body, "")
+	body = htmlBreaks.ReplaceAllString(body, "\n")
+	body = htmlTags.ReplaceAllString(body, "")
+	body = blankLines.ReplaceAllString(html.UnescapeString(body), "\n\n")
+	return strings.TrimSpace(body) + "\n"
+}
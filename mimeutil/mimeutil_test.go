@@ -0,0 +1,88 @@
+package mimeutil
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, raw string) *MIMEBody {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ParseMIMEBody(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseMIMEBody(t *testing.T) {
+	body := parse(t, "Subject: =?ISO-8859-1?Q?r=E4ksm=F6rg=E5s?=\r\n"+
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n"+
+		"--outer\r\nContent-Type: multipart/alternative; boundary=\"inner\"\r\n\r\n"+
+		"--inner\r\nContent-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nh=E4j\r\n"+
+		"--inner\r\nContent-Type: text/html\r\n\r\n<p>h&auml;j</p>\r\n"+
+		"--inner--\r\n"+
+		"--outer\r\nContent-Type: image/png\r\nContent-Disposition: inline\r\nContent-Transfer-Encoding: base64\r\n\r\naW1h\r\nZ2U=\r\n"+
+		"--outer\r\nContent-Type: application/pdf; name=\"=?UTF-8?Q?f=C3=B6rslag.pdf?=\"\r\nContent-Transfer-Encoding: base64\r\n\r\ncGRm\r\n"+
+		"--outer--\r\n")
+	if subject := body.GetHeader("Subject"); subject != "räksmörgås" {
+		t.Errorf("Wanted the decoded subject, got %q", subject)
+	}
+	if body.Text != "häj\n" || body.Html != "<p>h&auml;j</p>" || body.IsTextFromHtml {
+		t.Errorf("Wanted the converted text and the HTML, got %q and %q", body.Text, body.Html)
+	}
+	if len(body.Inlines) != 1 || string(body.Inlines[0].Content()) != "image" {
+		t.Errorf("Wanted the decoded inline image, got %v", body.Inlines)
+	}
+	if len(body.Attachments) != 1 || body.Attachments[0].FileName() != "förslag.pdf" || string(body.Attachments[0].Content()) != "pdf" {
+		t.Errorf("Wanted the attachment with its decoded name, got %v", body.Attachments)
+	}
+	if body.Root.ContentType() != "multipart/mixed" {
+		t.Errorf("Wanted the root to be multipart/mixed, got %v", body.Root.ContentType())
+	}
+}
+
+func TestTextFromHtml(t *testing.T) {
+	body := parse(t, "Content-Type: text/html; charset=utf-8\r\n\r\n<html><head><title>x</title></head><body><p>Hello &amp; welcome</p><p>Bye</p></body></html>")
+	if !body.IsTextFromHtml || body.Text != "Hello & welcome\nBye\n" {
+		t.Errorf("Wanted text made from the HTML, got %q", body.Text)
+	}
+}
+
+func TestCharsetReader(t *testing.T) {
+	if DecodeText("h\xe4j", "text/plain; charset=ISO-8859-1") != "häj" {
+		t.Errorf("Wanted Latin-1 converted to UTF-8")
+	}
+	if DecodeText("h\xe4j", "text/plain; charset=x-unknown") != "h\xe4j" {
+		t.Errorf("Wanted an unknown charset left alone")
+	}
+	decoder := xml.NewDecoder(bytes.NewReader([]byte("<?xml version='1.0' encoding='ISO-8859-1'?><body>h\xe4j</body>")))
+	decoder.CharsetReader = CharsetReader
+	parsed := struct {
+		Body string `xml:",chardata"`
+	}{}
+	if err := decoder.Decode(&parsed); err != nil || parsed.Body != "häj" {
+		t.Errorf("Wanted the XML converted from Latin-1, got %q and %v", parsed.Body, err)
+	}
+}
+
+func TestMalformedBase64(t *testing.T) {
+	body := parse(t, "Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n"+
+		"--b\r\nContent-Type: text/plain\r\n\r\nstill readable\r\n"+
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"broken.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\ncGRm!!!!\r\n"+
+		"--b--\r\n")
+	if body.Text != "still readable\n" {
+		t.Errorf("Wanted the text of a message with a malformed part, got %q", body.Text)
+	}
+	if len(body.Attachments) != 1 || body.Attachments[0].FileName() != "broken.pdf" || string(body.Attachments[0].Content()) != "pdf" {
+		t.Errorf("Wanted what could be decoded of the malformed attachment kept, got %v", body.Attachments)
+	}
+	if len(body.Errors) == 0 || !strings.Contains(body.Errors[0].Error(), "Malformed Base64") {
+		t.Errorf("Wanted the malformed base64 recorded, got %v", body.Errors)
+	}
+}
@@ -0,0 +1,290 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/profile"
+)
+
+// FailAfter is how long the active notifier of a Failover may be without a connection before the Failover fails over,
+// and RecoverInterval how often it tries the notifiers before the active one again.
+var (
+	FailAfter       = 5 * time.Minute
+	RecoverInterval = 5 * time.Minute
+)
+
+// Backend is a notifier of a Failover, with the name it is reported by.
+type Backend struct {
+	Name     string
+	Notifier Notifier
+}
+
+// Switch is the event of a Failover changing the active notifier, with the error that made it fail over, or nil when
+// it failed back to an earlier notifier that recovered.
+type Switch struct {
+	From string
+	To   string
+	Err  error
+}
+
+// Failover uses the first of its backends that starts, and fails over to the next one that does when the active one
+// gives up or has been without a connection for FailAfter. It tries the backends before the active one every
+// RecoverInterval, and fails back to the first of them that starts again. It notifies once after each switch, since
+// mail may have arrived while switching.
+type Failover struct {
+	FailAfter       time.Duration
+	RecoverInterval time.Duration
+	// SwitchHandler, if set, is called every time the active notifier changes.
+	SwitchHandler func(e Switch)
+	// ErrorHandler, if set, is called when a backend fails to start while switching.
+	ErrorHandler func(err error)
+	Clock        clock.Clock
+
+	backends []Backend
+	// switchLock serializes the switches, and active is the index of the started backend, guarded by switchLock.
+	switchLock sync.Mutex
+	active     int
+	loop
+}
+
+func NewFailover(backends ...Backend) *Failover {
+	return &Failover{
+		FailAfter:       FailAfter,
+		RecoverInterval: RecoverInterval,
+		Clock:           clock.Real,
+		backends:        backends,
+		active:          -1,
+	}
+}
+
+// newFailover builds a Failover from options like {"notifiers": [{"name": "xmpp"}, {"name": "poll", "options":
+// {"interval": "1m"}}], "fail_after": "5m", "recover_interval": "5m"}.
+func newFailover(env Env, options json.RawMessage) (result Notifier, err error) {
+	parsed := struct {
+		Notifiers []struct {
+			Name    string          `json:"name"`
+			Options json.RawMessage `json:"options"`
+		} `json:"notifiers"`
+		FailAfter       string `json:"fail_after"`
+		RecoverInterval string `json:"recover_interval"`
+	}{}
+	if err = decodeOptions("failover", options, &parsed); err != nil {
+		return
+	}
+	if len(parsed.Notifiers) == 0 {
+		err = fmt.Errorf("notify: failover without notifiers")
+		return
+	}
+	backends := []Backend{}
+	for _, notifier := range parsed.Notifiers {
+		backend := Backend{Name: notifier.Name}
+		if backend.Notifier, err = New(notifier.Name, env, notifier.Options); err != nil {
+			return
+		}
+		backends = append(backends, backend)
+	}
+	failover := NewFailover(backends...)
+	if parsed.FailAfter != "" {
+		if failover.FailAfter, err = time.ParseDuration(parsed.FailAfter); err != nil {
+			return
+		}
+	}
+	if parsed.RecoverInterval != "" {
+		if failover.RecoverInterval, err = time.ParseDuration(parsed.RecoverInterval); err != nil {
+			return
+		}
+	}
+	failover.SwitchHandler, failover.ErrorHandler = env.SwitchHandler, env.ErrorHandler
+	result = failover
+	return
+}
+
+// Start starts the first backend that starts, and fails if none does.
+func (self *Failover) Start(handler func()) (err error) {
+	stop, err := self.start(handler)
+	if err != nil {
+		return
+	}
+	self.switchLock.Lock()
+	defer self.switchLock.Unlock()
+	errs := []error{}
+	for i, backend := range self.backends {
+		e := backend.Notifier.Start(self.forward(stop))
+		if e == nil {
+			self.active = i
+			self.setState(stop, connstate.Running)
+			profile.Go("notify.Failover.run", func() {
+				self.run(stop)
+			})
+			return
+		}
+		errs = append(errs, fmt.Errorf("%v: %v", backend.Name, e))
+	}
+	self.fail(stop)
+	err = errors.Join(errs...)
+	if err == nil {
+		err = fmt.Errorf("notify: failover without notifiers")
+	}
+	return
+}
+
+// run checks the active backend every second, or more often if FailAfter is shorter, until stop is closed.
+func (self *Failover) run(stop chan struct{}) {
+	interval := time.Second
+	if self.FailAfter > 0 && self.FailAfter < interval {
+		interval = self.FailAfter
+	}
+	down := time.Time{}
+	retryAt := self.Clock.Now().Add(self.RecoverInterval)
+	for {
+		timer := self.Clock.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		now := self.Clock.Now()
+		self.switchLock.Lock()
+		if self.stopped(stop) {
+			self.switchLock.Unlock()
+			return
+		}
+		state := self.backends[self.active].Notifier.State()
+		if state == connstate.Running {
+			down = time.Time{}
+		} else if down.IsZero() {
+			down = now
+		}
+		switch {
+		case state == connstate.Idle || state == connstate.Stopped:
+			self.failOver(stop, fmt.Errorf("notify: %v gave up", self.backends[self.active].Name))
+			down = time.Time{}
+		case !down.IsZero() && !now.Before(down.Add(self.FailAfter)):
+			self.failOver(stop, fmt.Errorf("notify: %v without connection since %v", self.backends[self.active].Name, down))
+			down = time.Time{}
+		case self.active > 0 && !now.Before(retryAt):
+			if self.failBack(stop) {
+				down = time.Time{}
+			}
+			retryAt = now.Add(self.RecoverInterval)
+		}
+		self.switchLock.Unlock()
+	}
+}
+
+// stopped returns whether the failover started with stop has been closed.
+func (self *Failover) stopped(stop chan struct{}) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stop != stop
+}
+
+// failOver closes the active backend, and starts the first backend after it that starts, or else the first before it
+// that does. If none does the failover gives up. It must be called with switchLock held.
+func (self *Failover) failOver(stop chan struct{}, reason error) {
+	from := self.active
+	self.backends[from].Notifier.Close()
+	for i := 1; i < len(self.backends); i++ {
+		if self.switchTo(stop, (from+i)%len(self.backends), reason) {
+			return
+		}
+	}
+	if self.switchTo(stop, from, reason) {
+		return
+	}
+	self.handleError(fmt.Errorf("notify: giving up after no notifier started"))
+	self.fail(stop)
+}
+
+// failBack switches to the first backend before the active one that starts, and returns whether one did. It must be
+// called with switchLock held.
+func (self *Failover) failBack(stop chan struct{}) bool {
+	for i := 0; i < self.active; i++ {
+		from := self.active
+		if self.backends[i].Notifier.Start(self.forward(stop)) != nil {
+			continue
+		}
+		self.backends[from].Notifier.Close()
+		self.switched(stop, from, i, nil)
+		return true
+	}
+	return false
+}
+
+// switchTo starts backend i instead of the closed active one, and returns whether it started. It must be called with
+// switchLock held.
+func (self *Failover) switchTo(stop chan struct{}, i int, reason error) bool {
+	from := self.active
+	if err := self.backends[i].Notifier.Start(self.forward(stop)); err != nil {
+		self.handleError(fmt.Errorf("notify: failing over to %v: %v", self.backends[i].Name, err))
+		return false
+	}
+	self.switched(stop, from, i, reason)
+	return true
+}
+
+// switched makes backend i active, reports the switch, and notifies. It must be called with switchLock held.
+func (self *Failover) switched(stop chan struct{}, from, i int, reason error) {
+	self.active = i
+	if self.SwitchHandler != nil && from != i {
+		self.SwitchHandler(Switch{
+			From: self.backends[from].Name,
+			To:   self.backends[i].Name,
+			Err:  reason,
+		})
+	}
+	go self.notify(stop)
+}
+
+// forward returns the handler of the backends, which notifies until the failover started with stop is closed.
+func (self *Failover) forward(stop chan struct{}) func() {
+	return func() {
+		self.notify(stop)
+	}
+}
+
+func (self *Failover) handleError(err error) {
+	if self.ErrorHandler != nil {
+		self.ErrorHandler(err)
+	}
+}
+
+// Active returns the name of the active backend, or an empty string if the failover isn't started.
+func (self *Failover) Active() string {
+	self.switchLock.Lock()
+	defer self.switchLock.Unlock()
+	if self.active < 0 || self.loop.State() != connstate.Running {
+		return ""
+	}
+	return self.backends[self.active].Name
+}
+
+// State is the state of the active backend while started.
+func (self *Failover) State() connstate.State {
+	if state := self.loop.State(); state != connstate.Running {
+		return state
+	}
+	self.switchLock.Lock()
+	defer self.switchLock.Unlock()
+	return self.backends[self.active].Notifier.State()
+}
+
+// Close closes the active backend.
+func (self *Failover) Close() (err error) {
+	if !self.close() {
+		return
+	}
+	self.switchLock.Lock()
+	defer self.switchLock.Unlock()
+	if self.active >= 0 {
+		err = self.backends[self.active].Notifier.Close()
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/retry"
+)
+
+// Idle notifies when the mailbox of an imap.Client grows, using IMAP IDLE on a connection of its own. It also notifies
+// after reconnecting, since mail may have arrived while disconnected.
+type Idle struct {
+	// ReconnectPolicy decides the delays between attempts to reconnect after the connection was lost, between RetryMin
+	// and RetryMax by default.
+	ReconnectPolicy retry.Policy
+	// ErrorHandler, if set, is called when the connection is lost or reconnecting fails.
+	ErrorHandler func(err error)
+	Clock        clock.Clock
+
+	client *imap.Client
+	loop
+}
+
+func NewIdle(client *imap.Client) *Idle {
+	return &Idle{
+		ReconnectPolicy: retry.Exponential{
+			Min: RetryMin,
+			Max: RetryMax,
+		},
+		Clock:  clock.Real,
+		client: client,
+	}
+}
+
+func newIdle(env Env, options json.RawMessage) (result Notifier, err error) {
+	idle := NewIdle(env.IMAP)
+	idle.ErrorHandler = env.ErrorHandler
+	result = idle
+	return
+}
+
+// Start returns once the server accepted the first IDLE command, or connecting failed.
+func (self *Idle) Start(handler func()) (err error) {
+	stop, err := self.start(handler)
+	if err != nil {
+		return
+	}
+	ready, failed := make(chan struct{}), make(chan error, 1)
+	profile.Go("notify.Idle.run", func() {
+		failed <- self.run(stop, ready)
+	})
+	select {
+	case <-ready:
+	case err = <-failed:
+		self.fail(stop)
+	}
+	return
+}
+
+// run idles until stop is closed, reconnecting whenever the connection is lost. It returns the error if the first
+// connection fails.
+func (self *Idle) run(stop chan struct{}, ready chan struct{}) (err error) {
+	attempts := 0
+	connected := func() {
+		if ready != nil {
+			self.setState(stop, connstate.Running)
+			close(ready)
+			ready = nil
+			return
+		}
+		attempts = 0
+		if self.setState(stop, connstate.Running) {
+			self.notify(stop)
+		}
+	}
+	for {
+		err = self.client.Idle(stop, connected, func() {
+			self.notify(stop)
+		})
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if ready != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("notify: idling ended")
+		}
+		self.handleError(err)
+		attempts++
+		delay, ok := self.ReconnectPolicy.Next(attempts)
+		if !ok {
+			self.handleError(fmt.Errorf("notify: giving up idling after %v failed attempts", attempts))
+			self.fail(stop)
+			return nil
+		}
+		if !self.setState(stop, connstate.Backoff) {
+			return nil
+		}
+		timer := self.Clock.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+		if !self.setState(stop, connstate.Connecting) {
+			return nil
+		}
+	}
+}
+
+func (self *Idle) handleError(err error) {
+	if self.ErrorHandler != nil {
+		self.ErrorHandler(err)
+	}
+}
+
+func (self *Idle) Close() error {
+	self.close()
+	return nil
+}
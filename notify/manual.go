@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"github.com/zond/gmail/connstate"
+)
+
+// Manual notifies when Notify is called, for applications that learn of new mail on their own, and for tests.
+type Manual struct {
+	loop
+}
+
+func NewManual() *Manual {
+	return &Manual{}
+}
+
+func (self *Manual) Start(handler func()) (err error) {
+	stop, err := self.start(handler)
+	if err != nil {
+		return
+	}
+	self.setState(stop, connstate.Running)
+	return
+}
+
+// Notify calls the handler, unless the notifier is stopped.
+func (self *Manual) Notify() {
+	self.lock.Lock()
+	stop := self.stop
+	self.lock.Unlock()
+	if stop != nil {
+		self.notify(stop)
+	}
+}
+
+func (self *Manual) Close() error {
+	self.close()
+	return nil
+}
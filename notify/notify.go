@@ -0,0 +1,240 @@
+// Package notify contains the ways a client can learn that new mail may have arrived, and a registry letting other
+// packages add their own and have them selected by name, like in a configuration file.
+//
+//	notifier, err := notify.New("idle", client.NotifierEnv(), nil)
+//	if err != nil {
+//		return err
+//	}
+//	client.Notifier(notifier)
+//
+// The xmpp notifier is the default, and uses the Gmail XMPP notifications. The idle notifier uses IMAP IDLE, push
+// uses Gmail API watches published to Cloud Pub/Sub, and poll checks the inbox at an interval. The failover notifier
+// switches between a list of the others.
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/xmpp"
+)
+
+var ErrAlreadyStarted = errors.New("notify: notifier already started")
+
+// RetryMin and RetryMax limit the delay between attempts to reconnect Idle notifiers, and to renew the watch of Push
+// notifiers, without policies of their own. The delay doubles for each failure, like for the XMPP connection.
+var (
+	RetryMin = time.Second
+	RetryMax = 5 * time.Minute
+)
+
+// Notifier tells when new mail may have arrived in the inbox.
+type Notifier interface {
+	// Start connects, and calls handler whenever new mail may have arrived until Close is called. It returns
+	// ErrAlreadyStarted if the notifier is already started, and may be called again after Close or a failed Start.
+	Start(handler func()) error
+	// Close stops the notifier. Closing a stopped notifier does nothing.
+	Close() error
+	// State is the state of the connection of the notifier.
+	State() connstate.State
+}
+
+// Env is what the notifiers of an account can be built with.
+type Env struct {
+	XMPP *xmpp.Client
+	// IMAP is the client of the watched mailbox.
+	IMAP         *imap.Client
+	Credentials  auth.Provider
+	ErrorHandler func(err error)
+	// SwitchHandler is given to the failover notifiers.
+	SwitchHandler func(e Switch)
+}
+
+// Factory builds a Notifier for the account of env. The options, which may be empty, are the JSON object configuring
+// the notifier.
+type Factory func(env Env, options json.RawMessage) (Notifier, error)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{}
+)
+
+func init() {
+	Register("xmpp", func(env Env, options json.RawMessage) (Notifier, error) {
+		return XMPP(env.XMPP), nil
+	})
+	Register("idle", newIdle)
+	Register("push", newPush)
+	Register("poll", newPoll)
+	Register("failover", newFailover)
+	Register("manual", func(env Env, options json.RawMessage) (Notifier, error) {
+		return NewManual(), nil
+	})
+}
+
+// Register makes New build the notifiers called name with factory. It panics if name is already registered.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, found := factories[name]; found {
+		panic(fmt.Errorf("notify: %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the registered notifier names, sorted.
+func Names() (result []string) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	for name := range factories {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return
+}
+
+// New builds the notifier registered as name.
+func New(name string, env Env, options json.RawMessage) (result Notifier, err error) {
+	factoriesLock.RLock()
+	factory, found := factories[name]
+	factoriesLock.RUnlock()
+	if !found {
+		err = fmt.Errorf("notify: unknown notifier %q", name)
+		return
+	}
+	return factory(env, options)
+}
+
+// decodeOptions decodes the options of a notifier into result, unless there are none.
+func decodeOptions(name string, options json.RawMessage, result interface{}) (err error) {
+	if len(options) == 0 || string(options) == "null" {
+		return
+	}
+	if err = json.Unmarshal(options, result); err != nil {
+		err = fmt.Errorf("notify: %v options: %v", name, err)
+	}
+	return
+}
+
+// xmppStates are the notifier states of the states of an xmpp.Client.
+var xmppStates = map[xmpp.State]connstate.State{
+	xmpp.Idle:       connstate.Idle,
+	xmpp.Connecting: connstate.Connecting,
+	xmpp.Running:    connstate.Running,
+	xmpp.Backoff:    connstate.Backoff,
+	xmpp.Stopped:    connstate.Stopped,
+}
+
+type xmppNotifier struct {
+	// lock makes checking the state of the client, giving it the handler, and starting it, happen at once, so that
+	// concurrent Starts don't replace the handler of a started client.
+	lock   *sync.Mutex
+	client *xmpp.Client
+}
+
+// XMPP returns a Notifier using the new mail notifications client gets from Gmail.
+func XMPP(client *xmpp.Client) Notifier {
+	return xmppNotifier{lock: &sync.Mutex{}, client: client}
+}
+
+func (self xmppNotifier) Start(handler func()) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if state := self.client.State(); state != xmpp.Idle && state != xmpp.Stopped {
+		return ErrAlreadyStarted
+	}
+	self.client.MailHandler(handler)
+	if err = self.client.Start(); err == xmpp.ErrAlreadyStarted {
+		err = ErrAlreadyStarted
+	}
+	return
+}
+
+func (self xmppNotifier) Close() error {
+	return self.client.Close()
+}
+
+func (self xmppNotifier) State() connstate.State {
+	return xmppStates[self.client.State()]
+}
+
+// loop is the state of a notifier running in a goroutine of its own.
+type loop struct {
+	lock    sync.Mutex
+	state   connstate.State
+	stop    chan struct{}
+	handler func()
+}
+
+// start moves the notifier to Connecting, and returns the channel closed when it is closed.
+func (self *loop) start(handler func()) (stop chan struct{}, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop != nil {
+		err = ErrAlreadyStarted
+		return
+	}
+	self.state, self.stop, self.handler = connstate.Connecting, make(chan struct{}), handler
+	stop = self.stop
+	return
+}
+
+// setState changes the state, unless the notifier started with stop has been closed.
+func (self *loop) setState(stop chan struct{}, state connstate.State) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop != stop {
+		return false
+	}
+	self.state = state
+	return true
+}
+
+// fail moves the notifier started with stop to Idle after failing, letting it be started again.
+func (self *loop) fail(stop chan struct{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop == stop {
+		close(self.stop)
+		self.state, self.stop = connstate.Idle, nil
+	}
+}
+
+// notify calls the handler, unless the notifier started with stop has been closed.
+func (self *loop) notify(stop chan struct{}) {
+	self.lock.Lock()
+	handler := self.handler
+	if self.stop != stop {
+		handler = nil
+	}
+	self.lock.Unlock()
+	if handler != nil {
+		handler()
+	}
+}
+
+// close stops the notifier, and returns whether it was started.
+func (self *loop) close() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.state = connstate.Stopped
+	if self.stop == nil {
+		return false
+	}
+	close(self.stop)
+	self.stop = nil
+	return true
+}
+
+func (self *loop) State() connstate.State {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.state
+}
@@ -0,0 +1,339 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/rest"
+	"github.com/zond/gmail/retry"
+)
+
+type fakeNotifier struct {
+	options json.RawMessage
+	loop
+}
+
+func (self *fakeNotifier) Start(handler func()) (err error) {
+	_, err = self.start(handler)
+	return
+}
+
+func (self *fakeNotifier) Close() error {
+	self.close()
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("fake", func(env Env, options json.RawMessage) (Notifier, error) {
+		return &fakeNotifier{options: options}, nil
+	})
+	defer func() {
+		factoriesLock.Lock()
+		delete(factories, "fake")
+		factoriesLock.Unlock()
+	}()
+	if names := fmt.Sprint(Names()); names != "[failover fake idle manual poll push xmpp]" {
+		t.Errorf("Wanted the built in notifiers and the fake one, got %v", names)
+	}
+	notifier, err := New("fake", Env{}, json.RawMessage(`{"a": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake, ok := notifier.(*fakeNotifier); !ok || string(fake.options) != `{"a": 1}` {
+		t.Errorf("Wanted the fake notifier with its options, got %#v", notifier)
+	}
+	if _, err := New("ews", Env{}, nil); err == nil {
+		t.Errorf("Wanted an unknown notifier to fail")
+	}
+	if _, err := New("poll", Env{}, json.RawMessage(`{"interval": "often"}`)); err == nil {
+		t.Errorf("Wanted an invalid interval to fail")
+	}
+	if _, err := New("push", Env{}, nil); err == nil {
+		t.Errorf("Wanted push without topic to fail")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Wanted registering a name twice to panic")
+		}
+	}()
+	Register("poll", newPoll)
+}
+
+func TestPoll(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	notified := make(chan struct{}, 1)
+	poll := NewPoll(time.Minute)
+	poll.Clock = fake
+	if err := poll.Start(func() {
+		notified <- struct{}{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if poll.State() != connstate.Running {
+		t.Errorf("Wanted a started poll to be running, got %v", poll.State())
+	}
+	if err := poll.Start(func() {}); err != ErrAlreadyStarted {
+		t.Errorf("Wanted ErrAlreadyStarted, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(time.Minute)
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatalf("Not notified after the interval")
+		}
+	}
+	poll.Close()
+	if poll.State() != connstate.Stopped {
+		t.Errorf("Wanted a closed poll to be stopped, got %v", poll.State())
+	}
+	fake.Advance(time.Minute)
+	select {
+	case <-notified:
+		t.Errorf("Wanted no notifications after Close")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestIdleWithoutIMAP(t *testing.T) {
+	client := imap.New("user@example.com", "").MailStore(func(ctx context.Context) (imap.MailStore, error) {
+		return nil, fmt.Errorf("no store")
+	})
+	idle := NewIdle(client)
+	if err := idle.Start(func() {}); err != imap.ErrNoRawClient {
+		t.Errorf("Wanted ErrNoRawClient, got %v", err)
+	}
+	if idle.State() != connstate.Idle {
+		t.Errorf("Wanted a failed idle to be idle, got %v", idle.State())
+	}
+}
+
+func TestPush(t *testing.T) {
+	var lock sync.Mutex
+	watches, stops, failing := 0, 0, false
+	watched := make(chan struct{}, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/watch":
+			watches++
+			watched <- struct{}{}
+			if failing {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"historyId": "1", "expiration": "1431990098200"}`)
+		case "/stop":
+			stops++
+		}
+	}))
+	defer server.Close()
+	defer func(base string) {
+		rest.BaseURL = base
+	}(rest.BaseURL)
+	rest.BaseURL = server.URL
+	push := NewPush(rest.New(auth.Static{User: "user@example.com", Token: "token"}), "projects/p/topics/gmail")
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	push.Clock = fake
+	push.RenewPolicy = retry.Exponential{Min: time.Minute, Max: time.Hour}
+	notified := make(chan struct{}, 1)
+	data := base64.StdEncoding.EncodeToString([]byte(`{"emailAddress": "user@example.com", "historyId": 2}`))
+	deliver := func() int {
+		rsp := httptest.NewRecorder()
+		push.ServeHTTP(rsp, httptest.NewRequest("POST", "/", strings.NewReader(`{"message": {"data": "`+data+`"}}`)))
+		return rsp.Code
+	}
+	if code := deliver(); code != http.StatusServiceUnavailable {
+		t.Errorf("Wanted pushes before Start to be refused, got %v", code)
+	}
+	if err := push.Start(func() {
+		notified <- struct{}{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if code := deliver(); code != http.StatusNoContent {
+		t.Errorf("Wanted the push to be accepted, got %v", code)
+	}
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatalf("Not notified of the push")
+	}
+	// The watch is renewed every PushRenew, and after RenewPolicy when renewing fails.
+	waitWatch := func() {
+		select {
+		case <-watched:
+		case <-time.After(time.Second):
+			t.Fatalf("Watch not renewed")
+		}
+	}
+	waitWatch()
+	lock.Lock()
+	failing = true
+	lock.Unlock()
+	fake.BlockUntil(1)
+	fake.Advance(PushRenew)
+	waitWatch()
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	fake.BlockUntil(1)
+	if state := push.State(); state != connstate.Backoff {
+		t.Errorf("Wanted a failed renewal to back off, got %v", state)
+	}
+	fake.Advance(time.Minute)
+	waitWatch()
+	fake.BlockUntil(1)
+	if state := push.State(); state != connstate.Running {
+		t.Errorf("Wanted a renewed watch to be running, got %v", state)
+	}
+	if err := push.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if watches != 3 || stops != 1 {
+		t.Errorf("Wanted three watches and one stop, got %v and %v", watches, stops)
+	}
+}
+
+// flakyNotifier fails to start while down, and has whatever state it is given.
+type flakyNotifier struct {
+	lock    sync.Mutex
+	down    bool
+	state   connstate.State
+	handler func()
+}
+
+func (self *flakyNotifier) Start(handler func()) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.down {
+		return fmt.Errorf("down")
+	}
+	self.state, self.handler = connstate.Running, handler
+	return nil
+}
+
+func (self *flakyNotifier) Close() error {
+	self.set(false, connstate.Stopped)
+	return nil
+}
+
+func (self *flakyNotifier) State() connstate.State {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.state
+}
+
+func (self *flakyNotifier) set(down bool, state connstate.State) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.down, self.state = down, state
+}
+
+func TestFailover(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	primary, secondary := &flakyNotifier{}, &flakyNotifier{}
+	failover := NewFailover(Backend{Name: "primary", Notifier: primary}, Backend{Name: "secondary", Notifier: secondary})
+	failover.Clock, failover.FailAfter, failover.RecoverInterval = fake, 10*time.Second, time.Minute
+	switches, notified := make(chan Switch, 1), make(chan struct{}, 1)
+	failover.SwitchHandler = func(e Switch) {
+		switches <- e
+	}
+	if err := failover.Start(func() {
+		notified <- struct{}{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if failover.Active() != "primary" || secondary.State() != connstate.Idle {
+		t.Fatalf("Wanted only the primary started, got %v", failover.Active())
+	}
+	tick := func(d time.Duration) {
+		for passed := time.Duration(0); passed < d; passed += time.Second {
+			fake.BlockUntil(1)
+			fake.Advance(time.Second)
+		}
+	}
+	awaitSwitch := func(from, to string, failed bool) {
+		select {
+		case e := <-switches:
+			if e.From != from || e.To != to || (e.Err != nil) != failed {
+				t.Errorf("Wanted a switch from %v to %v, got %+v", from, to, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No switch from %v to %v", from, to)
+		}
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatalf("Not notified after switching to %v", to)
+		}
+	}
+	primary.set(true, connstate.Backoff)
+	tick(5 * time.Second)
+	select {
+	case e := <-switches:
+		t.Fatalf("Wanted no switch before FailAfter, got %+v", e)
+	default:
+	}
+	// The primary is noticed down at the first check, a second in.
+	tick(6 * time.Second)
+	awaitSwitch("primary", "secondary", true)
+	if failover.Active() != "secondary" || primary.State() != connstate.Stopped {
+		t.Errorf("Wanted the secondary active and the primary closed, got %v and %v", failover.Active(), primary.State())
+	}
+	primary.set(false, connstate.Stopped)
+	tick(time.Minute)
+	awaitSwitch("secondary", "primary", false)
+	if failover.Active() != "primary" || secondary.State() != connstate.Stopped {
+		t.Errorf("Wanted the primary active and the secondary closed, got %v and %v", failover.Active(), secondary.State())
+	}
+	primary.lock.Lock()
+	handler := primary.handler
+	primary.lock.Unlock()
+	handler()
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatalf("Not notified by the primary after failing back")
+	}
+	// Giving up fails over at once.
+	primary.set(true, connstate.Idle)
+	tick(time.Second)
+	awaitSwitch("primary", "secondary", true)
+	if err := failover.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if failover.State() != connstate.Stopped || secondary.State() != connstate.Stopped {
+		t.Errorf("Wanted the failover and the secondary stopped, got %v and %v", failover.State(), secondary.State())
+	}
+}
+
+func TestFailoverOptions(t *testing.T) {
+	notifier, err := New("failover", Env{}, json.RawMessage(`{"notifiers": [{"name": "poll"}, {"name": "poll", "options": {"interval": "1s"}}], "fail_after": "1m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failover := notifier.(*Failover)
+	if len(failover.backends) != 2 || failover.FailAfter != time.Minute || failover.backends[1].Notifier.(*Poll).Interval != time.Second {
+		t.Errorf("Wanted two polls failing over after a minute, got %+v", failover)
+	}
+	if _, err := New("failover", Env{}, json.RawMessage(`{"notifiers": [{"name": "ews"}]}`)); err == nil {
+		t.Errorf("Wanted an unknown backend to fail")
+	}
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/profile"
+)
+
+// PollInterval is how often poll notifiers configured without an interval notify.
+var PollInterval = time.Minute
+
+// Poll notifies every Interval, for accounts where no notifications can be had. Every notification makes the client
+// check the inbox, so the interval should stay well within the Gmail IMAP bandwidth limits.
+type Poll struct {
+	Interval time.Duration
+	Clock    clock.Clock
+
+	loop
+}
+
+func NewPoll(interval time.Duration) *Poll {
+	return &Poll{
+		Interval: interval,
+		Clock:    clock.Real,
+	}
+}
+
+// newPoll builds a Poll from options like {"interval": "30s"}.
+func newPoll(env Env, options json.RawMessage) (result Notifier, err error) {
+	parsed := struct {
+		Interval string `json:"interval"`
+	}{}
+	if err = decodeOptions("poll", options, &parsed); err != nil {
+		return
+	}
+	interval := PollInterval
+	if parsed.Interval != "" {
+		if interval, err = time.ParseDuration(parsed.Interval); err != nil {
+			return
+		}
+	}
+	result = NewPoll(interval)
+	return
+}
+
+func (self *Poll) Start(handler func()) (err error) {
+	stop, err := self.start(handler)
+	if err != nil {
+		return
+	}
+	self.setState(stop, connstate.Running)
+	profile.Go("notify.Poll.run", func() {
+		for {
+			timer := self.Clock.NewTimer(self.Interval)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+			self.notify(stop)
+		}
+	})
+	return
+}
+
+func (self *Poll) Close() error {
+	self.close()
+	return nil
+}
@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/connstate"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/rest"
+	"github.com/zond/gmail/retry"
+)
+
+// PushRenew is how often Push renews its watch. Gmail expires watches after a week, and recommends renewing them daily.
+var PushRenew = 24 * time.Hour
+
+// Push notifies when Gmail publishes a change of the inbox to a Cloud Pub/Sub topic, and Pub/Sub pushes it to the
+// ServeHTTP of the Push. The account must be able to use the Gmail API, see the rest package, and Gmail must be allowed
+// to publish to the topic.
+type Push struct {
+	// Addr, if set, is where Start listens for the pushes. Otherwise the Push must be served by another server.
+	Addr string
+	// RenewPolicy decides the delays before trying again after renewing the watch failed, between RetryMin and RetryMax
+	// by default.
+	RenewPolicy retry.Policy
+	// ErrorHandler, if set, is called when renewing the watch fails.
+	ErrorHandler func(err error)
+	Clock        clock.Clock
+
+	api    *rest.API
+	topic  string
+	server *http.Server
+	loop
+}
+
+func NewPush(api *rest.API, topic string) *Push {
+	return &Push{
+		RenewPolicy: retry.Exponential{
+			Min: RetryMin,
+			Max: RetryMax,
+		},
+		Clock: clock.Real,
+		api:   api,
+		topic: topic,
+	}
+}
+
+// newPush builds a Push from options like {"topic": "projects/myproject/topics/gmail", "addr": ":8025"}.
+func newPush(env Env, options json.RawMessage) (result Notifier, err error) {
+	parsed := struct {
+		Topic string `json:"topic"`
+		Addr  string `json:"addr"`
+	}{}
+	if err = decodeOptions("push", options, &parsed); err != nil {
+		return
+	}
+	if parsed.Topic == "" {
+		err = fmt.Errorf("notify: push without topic")
+		return
+	}
+	push := NewPush(rest.New(env.Credentials), parsed.Topic)
+	push.Addr, push.ErrorHandler = parsed.Addr, env.ErrorHandler
+	result = push
+	return
+}
+
+// Start watches the inbox, and listens for pushes if Addr is set.
+func (self *Push) Start(handler func()) (err error) {
+	stop, err := self.start(handler)
+	if err != nil {
+		return
+	}
+	if _, err = self.api.Watch(context.Background(), self.topic, "INBOX"); err != nil {
+		self.fail(stop)
+		return
+	}
+	if self.Addr != "" {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", self.Addr); err != nil {
+			self.api.StopWatch(context.Background())
+			self.fail(stop)
+			return
+		}
+		server := &http.Server{Handler: self}
+		self.lock.Lock()
+		self.server = server
+		self.lock.Unlock()
+		go server.Serve(listener)
+	}
+	self.setState(stop, connstate.Running)
+	profile.Go("notify.Push.renew", func() {
+		self.renew(stop)
+	})
+	return
+}
+
+// renew renews the watch every PushRenew until stop is closed.
+func (self *Push) renew(stop chan struct{}) {
+	delay, attempts := PushRenew, 0
+	for {
+		timer := self.Clock.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		_, err := self.api.Watch(context.Background(), self.topic, "INBOX")
+		if err == nil {
+			delay, attempts = PushRenew, 0
+			self.setState(stop, connstate.Running)
+			continue
+		}
+		if self.ErrorHandler != nil {
+			self.ErrorHandler(fmt.Errorf("notify: renewing the watch: %v", err))
+		}
+		attempts++
+		var ok bool
+		if delay, ok = self.RenewPolicy.Next(attempts); !ok {
+			self.fail(stop)
+			return
+		}
+		self.setState(stop, connstate.Backoff)
+	}
+}
+
+// ServeHTTP accepts the pushes from a Pub/Sub push subscription.
+func (self *Push) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	if _, err = rest.ParsePush(body); err != nil {
+		// Pub/Sub retries failed pushes, which wouldn't help.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	self.lock.Lock()
+	stop := self.stop
+	self.lock.Unlock()
+	if stop == nil {
+		// Pub/Sub retries the pushes arriving while stopped, until the next Start.
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	// The push is acknowledged at once, since checking the inbox may take longer than Pub/Sub waits.
+	go self.notify(stop)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Close stops the watch, and the server listening for pushes.
+func (self *Push) Close() (err error) {
+	started := self.close()
+	self.lock.Lock()
+	server := self.server
+	self.server = nil
+	self.lock.Unlock()
+	if started {
+		err = self.api.StopWatch(context.Background())
+	}
+	if server != nil {
+		if e := server.Close(); err == nil {
+			err = e
+		}
+	}
+	return
+}
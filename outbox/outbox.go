@@ -0,0 +1,372 @@
+// Package outbox queues outgoing mail in a persistent Store, and delivers it in the background, retrying failed
+// deliveries, so that mail isn't lost when the SMTP server is unavailable for a while.
+//
+//	store, err := boltstore.Open("gmail.db")
+//	box := client.Outbox(store)
+//	box.EventHandler = func(e outbox.Event) {
+//		log.Printf("%v: %v %v", e.Message.ID, e.Status, e.Err)
+//	}
+//	box.Start()
+//	defer box.Close()
+//	id, err := box.Send("me@gmail.com", []string{"you@example.com"}, body)
+//
+// Messages can also be scheduled for later with SendAt, and cancelled until they are sent.
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/quota"
+	"github.com/zond/gmail/retry"
+)
+
+// Message is a queued message.
+type Message struct {
+	ID   string   `json:"id"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// Body is the whole message, with headers.
+	Body   []byte    `json:"body"`
+	Queued time.Time `json:"queued"`
+	// Scheduled is when SendAt was asked to deliver the message, if later than when it was queued.
+	Scheduled   time.Time `json:"scheduled,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Store persists the queued messages, encoded by the Outbox. boltstore.Store implements it.
+type Store interface {
+	// PutOutgoing adds the message with id, or replaces it if it exists.
+	PutOutgoing(id string, msg []byte) error
+	// Outgoing returns all messages, ordered by id.
+	Outgoing() ([][]byte, error)
+	RemoveOutgoing(id string) error
+}
+
+// Sender delivers a message, like gmail.Client#SendRaw.
+type Sender func(msg Message) error
+
+type Status int
+
+const (
+	// Queued messages were stored by Send.
+	Queued Status = iota
+	Sent
+	// Retrying messages failed, and will be tried again at their NextAttempt.
+	Retrying
+	// Failed messages failed permanently, or too many times, and are removed from the queue.
+	Failed
+	// Cancelled messages were removed from the queue by Cancel.
+	Cancelled
+)
+
+var ErrNotQueued = errors.New("outbox: message not queued")
+
+func (self Status) String() string {
+	switch self {
+	case Queued:
+		return "queued"
+	case Sent:
+		return "sent"
+	case Retrying:
+		return "retrying"
+	case Failed:
+		return "failed"
+	case Cancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("status(%d)", int(self))
+}
+
+// Event tells what happened to a message.
+type Event struct {
+	Message Message
+	Status  Status
+	// Err is why Retrying and Failed messages failed.
+	Err error
+}
+
+// Outbox delivers the messages in its Store in the background, once started. It is safe for concurrent use.
+type Outbox struct {
+	// Policy decides the delays before retrying failed messages, and when to give up. Errors with SMTP 5xx codes, and
+	// Permanent errors, are never retried. Messages failing with quota.ErrQuotaExceeded are retried when the quota allows,
+	// without counting as an attempt.
+	Policy retry.Policy
+	// EventHandler, if set, is called when a message is queued, sent, fails or is cancelled, from the goroutine doing it.
+	EventHandler func(e Event)
+	Clock        clock.Clock
+
+	store Store
+	send  Sender
+	// sendLock makes Cancel wait for the message being sent, and cancelled holds the ids cancelled since the current
+	// delivery loaded the queue.
+	sendLock  sync.Mutex
+	cancelled map[string]bool
+	lock      sync.Mutex
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func New(store Store, send Sender) *Outbox {
+	return &Outbox{
+		Policy: retry.Exponential{
+			Min:      time.Minute,
+			Max:      time.Hour,
+			Attempts: 24,
+		},
+		Clock: clock.Real,
+		store: store,
+		send:  send,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (self *Outbox) emit(e Event) {
+	if self.EventHandler != nil {
+		self.EventHandler(e)
+	}
+}
+
+// Send queues a message with the given envelope and body, and returns its id. The message is delivered in the
+// background once the Outbox is started, even if the process is restarted in between.
+func (self *Outbox) Send(from string, to []string, body []byte) (id string, err error) {
+	return self.SendAt(time.Time{}, from, to, body)
+}
+
+// SendAt is Send, but holds the message until at, if that is in the future. Until then, it can be cancelled.
+func (self *Outbox) SendAt(at time.Time, from string, to []string, body []byte) (id string, err error) {
+	suffix := make([]byte, 4)
+	if _, err = rand.Read(suffix); err != nil {
+		return
+	}
+	now := self.Clock.Now()
+	// Ids sort in the order the messages were queued.
+	id = fmt.Sprintf("%016x%x", now.UnixNano(), suffix)
+	msg := Message{
+		ID:          id,
+		From:        from,
+		To:          to,
+		Body:        body,
+		Queued:      now,
+		NextAttempt: now,
+	}
+	if at.After(now) {
+		msg.Scheduled, msg.NextAttempt = at, at
+	}
+	if err = self.put(msg); err != nil {
+		return
+	}
+	self.emit(Event{Message: msg, Status: Queued})
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+func (self *Outbox) put(msg Message) (err error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	return self.store.PutOutgoing(msg.ID, b)
+}
+
+// Pending returns the messages not yet sent, oldest first.
+func (self *Outbox) Pending() (result []Message, err error) {
+	encoded, err := self.store.Outgoing()
+	if err != nil {
+		return
+	}
+	for _, b := range encoded {
+		msg := Message{}
+		if err = json.Unmarshal(b, &msg); err != nil {
+			return
+		}
+		result = append(result, msg)
+	}
+	return
+}
+
+// Start delivers the queued messages in the background, until Close is called.
+func (self *Outbox) Start() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop != nil {
+		return
+	}
+	// The first delivery covers the messages queued so far.
+	select {
+	case <-self.wake:
+	default:
+	}
+	self.stop, self.stopped = make(chan struct{}), make(chan struct{})
+	stop, stopped := self.stop, self.stopped
+	profile.Go("outbox.run", func() {
+		self.run(stop, stopped)
+	})
+}
+
+// Close stops delivering, after the message being delivered, if any. The queued messages stay in the Store.
+func (self *Outbox) Close() error {
+	self.lock.Lock()
+	stop, stopped := self.stop, self.stopped
+	self.stop, self.stopped = nil, nil
+	self.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+	return nil
+}
+
+func (self *Outbox) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		next, err := self.deliver(stop)
+		if err != nil {
+			// The store failed, so try again later.
+			next = self.Clock.Now().Add(time.Minute)
+		}
+		var timer clock.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = self.Clock.NewTimer(next.Sub(self.Clock.Now()))
+			timeout = timer.C()
+		}
+		stopping := false
+		select {
+		case <-stop:
+			stopping = true
+		case <-self.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// Permanent is implemented by the errors of a Sender that will fail the same way if retried, like
+// quota.ErrTooManyRecipients.
+type Permanent interface {
+	error
+	Permanent()
+}
+
+// permanent returns whether err is an SMTP error or a Permanent error, that will fail the same way if retried.
+func permanent(err error) bool {
+	if smtpErr, ok := err.(*textproto.Error); ok {
+		return smtpErr.Code >= 500
+	}
+	_, ok := err.(Permanent)
+	return ok
+}
+
+// deliver sends the due messages, and returns when the next one is due, or the zero time if none is queued.
+func (self *Outbox) deliver(stop chan struct{}) (next time.Time, err error) {
+	self.sendLock.Lock()
+	self.cancelled = map[string]bool{}
+	msgs, err := self.Pending()
+	self.sendLock.Unlock()
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !msg.NextAttempt.After(self.Clock.Now()) {
+			if msg, err = self.deliverOne(msg); err != nil {
+				return
+			}
+		}
+		if !msg.NextAttempt.IsZero() && (next.IsZero() || msg.NextAttempt.Before(next)) {
+			next = msg.NextAttempt
+		}
+	}
+	return
+}
+
+// deliverOne tries to send msg, unless it was cancelled, and returns it with the zero NextAttempt unless it is still
+// queued.
+func (self *Outbox) deliverOne(msg Message) (result Message, err error) {
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
+	result = msg
+	result.NextAttempt = time.Time{}
+	if self.cancelled[msg.ID] {
+		return
+	}
+	msg.Attempts++
+	sendErr := self.send(msg)
+	if sendErr == nil {
+		if err = self.store.RemoveOutgoing(msg.ID); err != nil {
+			return
+		}
+		self.emit(Event{Message: msg, Status: Sent})
+		return
+	}
+	msg.LastError = sendErr.Error()
+	retryAt := time.Time{}
+	if quotaErr, ok := sendErr.(quota.ErrQuotaExceeded); ok {
+		// Waiting for the quota doesn't count as an attempt.
+		msg.Attempts--
+		retryAt = quotaErr.RetryAt
+	} else if delay, ok := self.Policy.Next(msg.Attempts); ok && !permanent(sendErr) {
+		retryAt = self.Clock.Now().Add(delay)
+	}
+	if retryAt.IsZero() {
+		if err = self.store.RemoveOutgoing(msg.ID); err != nil {
+			return
+		}
+		self.emit(Event{Message: msg, Status: Failed, Err: sendErr})
+		return
+	}
+	msg.NextAttempt = retryAt
+	if err = self.put(msg); err != nil {
+		return
+	}
+	self.emit(Event{Message: msg, Status: Retrying, Err: sendErr})
+	result = msg
+	return
+}
+
+// Cancel removes a message from the queue, waiting for it to be sent first if that is in progress. It returns
+// ErrNotQueued if the message isn't queued, because it was sent, failed or never existed.
+func (self *Outbox) Cancel(id string) (err error) {
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
+	msgs, err := self.Pending()
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		if msg.ID == id {
+			if err = self.store.RemoveOutgoing(id); err != nil {
+				return
+			}
+			if self.cancelled != nil {
+				self.cancelled[id] = true
+			}
+			self.emit(Event{Message: msg, Status: Cancelled})
+			return
+		}
+	}
+	return ErrNotQueued
+}
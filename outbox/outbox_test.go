@@ -0,0 +1,239 @@
+package outbox
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/quota"
+	"github.com/zond/gmail/retry"
+)
+
+type memoryStore struct {
+	lock sync.Mutex
+	msgs map[string][]byte
+}
+
+func (self *memoryStore) PutOutgoing(id string, msg []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.msgs[id] = msg
+	return nil
+}
+
+func (self *memoryStore) Outgoing() (result [][]byte, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ids := []string{}
+	for id := range self.msgs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		result = append(result, self.msgs[id])
+	}
+	return
+}
+
+func (self *memoryStore) RemoveOutgoing(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.msgs, id)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	store := &memoryStore{msgs: map[string][]byte{}}
+	failures := map[string][]error{
+		"transient": {fmt.Errorf("connection refused"), &textproto.Error{Code: 421, Msg: "try again later"}},
+		"permanent": {&textproto.Error{Code: 550, Msg: "no such user"}},
+		"crowded":   {quota.ErrTooManyRecipients{Recipients: 200, Limit: 100}},
+	}
+	var lock sync.Mutex
+	box := New(store, func(msg Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if errs := failures[string(msg.Body)]; len(errs) > 0 {
+			failures[string(msg.Body)] = errs[1:]
+			return errs[0]
+		}
+		return nil
+	})
+	box.Clock = fake
+	box.Policy = retry.Exponential{Min: time.Minute, Max: time.Hour, Attempts: 5}
+	events := make(chan Event, 16)
+	box.EventHandler = func(e Event) {
+		events <- e
+	}
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("No event")
+		}
+		return Event{}
+	}
+	// Messages queued before starting are delivered when started.
+	if _, err := box.Send("me@example.com", []string{"you@example.com"}, []byte("transient")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if e := next(); e.Status != Queued {
+		t.Errorf("Wanted queued, got %+v", e)
+	}
+	box.Start()
+	defer box.Close()
+	if e := next(); e.Status != Retrying || e.Message.Attempts != 1 || e.Message.LastError != "connection refused" {
+		t.Errorf("Wanted a retry after the first attempt, got %+v", e)
+	}
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	if e := next(); e.Status != Retrying || e.Message.Attempts != 2 || !e.Message.NextAttempt.Equal(fake.Now().Add(2*time.Minute)) {
+		t.Errorf("Wanted a retry with backoff after the transient SMTP error, got %+v", e)
+	}
+	if _, err := box.Send("me@example.com", []string{"you@example.com"}, []byte("permanent")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if e := next(); e.Status != Queued {
+		t.Errorf("Wanted queued, got %+v", e)
+	}
+	if e := next(); e.Status != Failed || string(e.Message.Body) != "permanent" {
+		t.Errorf("Wanted the permanent failure to not be retried, got %+v", e)
+	}
+	if _, err := box.Send("me@example.com", []string{"you@example.com"}, []byte("crowded")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if e := next(); e.Status != Queued {
+		t.Errorf("Wanted queued, got %+v", e)
+	}
+	if e := next(); e.Status != Failed || string(e.Message.Body) != "crowded" {
+		t.Errorf("Wanted too many recipients to not be retried, got %+v", e)
+	}
+	if pending, err := box.Pending(); err != nil || len(pending) != 1 || string(pending[0].Body) != "transient" {
+		t.Errorf("Wanted only the transient failure pending, got %+v, %v", pending, err)
+	}
+	fake.BlockUntil(1)
+	fake.Advance(2 * time.Minute)
+	if e := next(); e.Status != Sent || e.Message.Attempts != 3 || string(e.Message.Body) != "transient" {
+		t.Errorf("Wanted the message sent on the third attempt, got %+v", e)
+	}
+	if pending, err := box.Pending(); err != nil || len(pending) != 0 {
+		t.Errorf("Wanted nothing pending, got %+v, %v", pending, err)
+	}
+}
+
+func TestOutboxQuota(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	limiter := quota.New(quota.Limits{PerMinute: 1})
+	limiter.Clock = fake
+	sent := make(chan string, 2)
+	box := New(&memoryStore{msgs: map[string][]byte{}}, func(msg Message) (err error) {
+		if err = limiter.Reserve(len(msg.To)); err == nil {
+			sent <- string(msg.Body)
+		}
+		return
+	})
+	box.Clock = fake
+	box.Policy = retry.Never
+	events := make(chan Event, 16)
+	box.EventHandler = func(e Event) {
+		if e.Status != Queued {
+			events <- e
+		}
+	}
+	box.Start()
+	defer box.Close()
+	for _, body := range []string{"first", "second"} {
+		if _, err := box.Send("me@example.com", []string{"you@example.com"}, []byte(body)); err != nil {
+			t.Fatalf("%v", err)
+		}
+		select {
+		case e := <-events:
+			if body == "second" && (e.Status != Retrying || e.Message.Attempts != 0 || !e.Message.NextAttempt.Equal(fake.Now().Add(time.Minute))) {
+				t.Errorf("Wanted the second message to wait for the quota, got %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No event")
+		}
+	}
+	fake.BlockUntil(1)
+	fake.Advance(time.Minute)
+	for _, want := range []string{"first", "second"} {
+		select {
+		case body := <-sent:
+			if body != want {
+				t.Errorf("Wanted %v sent, got %v", want, body)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Wanted %v sent", want)
+		}
+	}
+}
+
+func TestScheduled(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	store := &memoryStore{msgs: map[string][]byte{}}
+	sent := make(chan string, 2)
+	newOutbox := func() *Outbox {
+		box := New(store, func(msg Message) error {
+			sent <- string(msg.Body)
+			return nil
+		})
+		box.Clock = fake
+		return box
+	}
+	box := newOutbox()
+	events := []Status{}
+	box.EventHandler = func(e Event) {
+		events = append(events, e.Status)
+	}
+	box.Start()
+	later, err := box.SendAt(start.Add(time.Hour), "me@example.com", []string{"you@example.com"}, []byte("later"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cancelled, err := box.SendAt(start.Add(time.Hour), "me@example.com", []string{"you@example.com"}, []byte("cancelled"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := box.Cancel(cancelled); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := box.Cancel(cancelled); err != ErrNotQueued {
+		t.Errorf("Wanted ErrNotQueued cancelling twice, got %v", err)
+	}
+	fake.BlockUntil(1)
+	box.Close()
+	if fmt.Sprint(events) != "[queued queued cancelled]" {
+		t.Errorf("Wanted two messages queued and one cancelled, got %v", events)
+	}
+	// The scheduled message survives a restart.
+	box = newOutbox()
+	box.Start()
+	defer box.Close()
+	if pending, err := box.Pending(); err != nil || len(pending) != 1 || pending[0].ID != later || !pending[0].Scheduled.Equal(start.Add(time.Hour)) {
+		t.Errorf("Wanted the scheduled message pending, got %+v, %v", pending, err)
+	}
+	fake.BlockUntil(1)
+	fake.Advance(59 * time.Minute)
+	select {
+	case body := <-sent:
+		t.Errorf("Wanted nothing sent before the scheduled time, got %v", body)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Advance(time.Minute)
+	select {
+	case body := <-sent:
+		if body != "later" {
+			t.Errorf("Wanted the scheduled message sent, got %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Nothing sent at the scheduled time")
+	}
+}
@@ -0,0 +1,28 @@
+// Package profile labels the long-running goroutines of the other packages for pprof, like the XMPP connection of
+// each client, so that CPU and goroutine profiles show which of them the time was spent in.
+//
+//	profile.Labels = true
+//	go http.ListenAndServe("localhost:6060", nil) // with net/http/pprof imported
+//
+// The goroutines get the label "goroutine", naming the function they run, like "xmpp.run", and those serving an
+// account also "account".
+package profile
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// Labels makes Go label the goroutines it starts. It must be set before any clients are started.
+var Labels = false
+
+// Go runs f in a new goroutine, labelled with the name, and the additional key and value pairs, if Labels is set.
+func Go(name string, f func(), labels ...string) {
+	if !Labels {
+		go f()
+		return
+	}
+	go pprof.Do(context.Background(), pprof.Labels(append([]string{"goroutine", name}, labels...)...), func(context.Context) {
+		f()
+	})
+}
@@ -0,0 +1,32 @@
+package profile
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+func TestGo(t *testing.T) {
+	defer func(labels bool) {
+		Labels = labels
+	}(Labels)
+	for _, enabled := range []bool{false, true} {
+		Labels = enabled
+		running, done := make(chan struct{}), make(chan struct{})
+		Go("profile.test", func() {
+			close(running)
+			<-done
+		}, "account", "user@example.com")
+		<-running
+		buf := &bytes.Buffer{}
+		if err := pprof.Lookup("goroutine").WriteTo(buf, 1); err != nil {
+			t.Fatal(err)
+		}
+		close(done)
+		labelled := strings.Contains(buf.String(), `"account":"user@example.com"`) && strings.Contains(buf.String(), `"goroutine":"profile.test"`)
+		if labelled != enabled {
+			t.Errorf("Wanted the goroutine labelled to be %v, got %v", enabled, labelled)
+		}
+	}
+}
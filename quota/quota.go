@@ -0,0 +1,248 @@
+// Package quota limits how much mail is sent, to stay within the sending limits of Gmail instead of getting the account
+// locked for a day.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+// Limits are the maximum numbers of messages and recipients per period. Zero means no limit.
+type Limits struct {
+	PerMinute            int `json:"per_minute,omitempty"`
+	PerDay               int `json:"per_day,omitempty"`
+	RecipientsPerDay     int `json:"recipients_per_day,omitempty"`
+	RecipientsPerMessage int `json:"recipients_per_message,omitempty"`
+}
+
+var (
+	// Gmail are the published limits of personal Gmail accounts sending using SMTP.
+	Gmail = Limits{
+		PerDay:               500,
+		RecipientsPerDay:     500,
+		RecipientsPerMessage: 100,
+	}
+	// Workspace are the published limits of Google Workspace accounts sending using SMTP.
+	Workspace = Limits{
+		PerDay:               2000,
+		RecipientsPerDay:     10000,
+		RecipientsPerMessage: 100,
+	}
+)
+
+// ErrQuotaExceeded is returned when sending now would exceed Limit, and sending may be tried again at RetryAt.
+type ErrQuotaExceeded struct {
+	Limit   string
+	RetryAt time.Time
+}
+
+func (self ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota: %v exceeded until %v", self.Limit, self.RetryAt.Format(time.RFC3339))
+}
+
+// ErrTooManyRecipients is returned for messages with more recipients than RecipientsPerMessage or RecipientsPerDay
+// allow, which will never be sent. It is Permanent, for outbox.Outbox not to retry them.
+type ErrTooManyRecipients struct {
+	Recipients int
+	Limit      int
+}
+
+func (self ErrTooManyRecipients) Error() string {
+	return fmt.Sprintf("quota: %v recipients exceed the limit of %v", self.Recipients, self.Limit)
+}
+
+func (self ErrTooManyRecipients) Permanent() {}
+
+// Store persists what a Limiter counted, encoded by the Limiter, so that restarting doesn't reset the limits.
+// boltstore.Store implements it.
+type Store interface {
+	// PutQuota replaces the sends stored for name.
+	PutQuota(name string, sent []byte) error
+	// Quota returns the sends stored for name, or nil if there are none.
+	Quota(name string) ([]byte, error)
+}
+
+type send struct {
+	At         time.Time `json:"at"`
+	Recipients int       `json:"recipients"`
+}
+
+// Limiter counts the messages sent during the last day, in memory, or in a Store if Persist was called. It is safe for
+// concurrent use.
+type Limiter struct {
+	Clock  clock.Clock
+	limits Limits
+	lock   sync.Mutex
+	sent   []send
+	// store and name are where the sends are persisted, and loaded tells whether they were read from there yet.
+	store  Store
+	name   string
+	loaded bool
+}
+
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		Clock:  clock.Real,
+		limits: limits,
+	}
+}
+
+// Persist makes the Limiter count the sends stored in store for name, like the account, before its own, and store the
+// sends it counts there.
+func (self *Limiter) Persist(store Store, name string) *Limiter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.store, self.name, self.loaded = store, name, false
+	return self
+}
+
+// load reads the sends from the store, unless it already did or there is none. It must be called with lock held.
+func (self *Limiter) load() (err error) {
+	if self.store == nil || self.loaded {
+		return
+	}
+	b, err := self.store.Quota(self.name)
+	if err != nil || b == nil {
+		self.loaded = err == nil
+		return
+	}
+	stored := []send{}
+	if err = json.Unmarshal(b, &stored); err != nil {
+		return
+	}
+	self.sent = append(stored, self.sent...)
+	self.loaded = true
+	return
+}
+
+// save writes the sends to the store, if any. It must be called with lock held.
+func (self *Limiter) save() (err error) {
+	if self.store == nil {
+		return
+	}
+	b, err := json.Marshal(self.sent)
+	if err != nil {
+		return
+	}
+	return self.store.PutQuota(self.name, b)
+}
+
+// Reserve counts a message to recipients as sent, or returns ErrQuotaExceeded if that would exceed the limits. Messages
+// with more recipients than RecipientsPerMessage or RecipientsPerDay always fail, with ErrTooManyRecipients. If the
+// Limiter is persisted, and the Store fails, the message isn't counted and the error is returned.
+func (self *Limiter) Reserve(recipients int) (err error) {
+	for _, limit := range []int{self.limits.RecipientsPerMessage, self.limits.RecipientsPerDay} {
+		if limit > 0 && recipients > limit {
+			err = ErrTooManyRecipients{Recipients: recipients, Limit: limit}
+			return
+		}
+	}
+	now := self.Clock.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.load(); err != nil {
+		return
+	}
+	for len(self.sent) > 0 && !self.sent[0].At.After(now.Add(-24*time.Hour)) {
+		self.sent = self.sent[1:]
+	}
+	// retryAt returns when enough of the sends in the period before now have expired for the limit to allow one more.
+	retryAt := func(period time.Duration, limit int, count func(s send) int) (result time.Time, exceeded bool) {
+		if limit == 0 {
+			return
+		}
+		needed := count(send{Recipients: recipients})
+		total := 0
+		for _, s := range self.sent {
+			if s.At.After(now.Add(-period)) {
+				total += count(s)
+			}
+		}
+		if total+needed <= limit {
+			return
+		}
+		for _, s := range self.sent {
+			if !s.At.After(now.Add(-period)) {
+				continue
+			}
+			total -= count(s)
+			if total+needed <= limit {
+				return s.At.Add(period), true
+			}
+		}
+		return now.Add(period), true
+	}
+	messages := func(send) int { return 1 }
+	for _, limit := range []struct {
+		name   string
+		period time.Duration
+		limit  int
+		count  func(s send) int
+	}{
+		{"messages per minute", time.Minute, self.limits.PerMinute, messages},
+		{"messages per day", 24 * time.Hour, self.limits.PerDay, messages},
+		{"recipients per day", 24 * time.Hour, self.limits.RecipientsPerDay, func(s send) int { return s.Recipients }},
+	} {
+		if at, exceeded := retryAt(limit.period, limit.limit, limit.count); exceeded {
+			quotaErr := ErrQuotaExceeded{Limit: limit.name, RetryAt: at}
+			if existing, ok := err.(ErrQuotaExceeded); !ok || at.After(existing.RetryAt) {
+				err = quotaErr
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	self.sent = append(self.sent, send{At: now, Recipients: recipients})
+	if err = self.save(); err != nil {
+		self.sent = self.sent[:len(self.sent)-1]
+	}
+	return
+}
+
+// Release uncounts a message to recipients counted by Reserve, for messages that failed to be sent after all. If the
+// Limiter is persisted, and the Store fails, the message stays counted and the error is returned.
+func (self *Limiter) Release(recipients int) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.load(); err != nil {
+		return
+	}
+	for i := len(self.sent) - 1; i >= 0; i-- {
+		if self.sent[i].Recipients != recipients {
+			continue
+		}
+		released := self.sent[i]
+		self.sent = append(self.sent[:i:i], self.sent[i+1:]...)
+		if err = self.save(); err != nil {
+			self.sent = append(self.sent[:i:i], append([]send{released}, self.sent[i:]...)...)
+		}
+		return
+	}
+	return
+}
+
+// Remaining returns how many more messages PerDay allows to be sent now, or -1 if PerDay is zero. If the Limiter is
+// persisted, and the Store fails to load, none are.
+func (self *Limiter) Remaining() (result int) {
+	if self.limits.PerDay == 0 {
+		return -1
+	}
+	now := self.Clock.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.load(); err != nil {
+		return 0
+	}
+	result = self.limits.PerDay
+	for _, s := range self.sent {
+		if s.At.After(now.Add(-24 * time.Hour)) {
+			result--
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+)
+
+func TestLimiter(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	limiter := New(Limits{PerMinute: 2, PerDay: 3, RecipientsPerDay: 4, RecipientsPerMessage: 3})
+	limiter.Clock = fake
+	for i := 0; i < 2; i++ {
+		if err := limiter.Reserve(1); err != nil {
+			t.Fatalf("%v", err)
+		}
+		fake.Advance(10 * time.Second)
+	}
+	err := limiter.Reserve(1)
+	if quotaErr, ok := err.(ErrQuotaExceeded); !ok || quotaErr.Limit != "messages per minute" || !quotaErr.RetryAt.Equal(start.Add(time.Minute)) {
+		t.Errorf("Wanted the per minute limit exceeded until a minute after the first message, got %v", err)
+	}
+	if err := limiter.Reserve(4); err == nil {
+		t.Errorf("Wanted too many recipients for one message to fail")
+	} else if _, ok := err.(ErrTooManyRecipients); !ok {
+		t.Errorf("Wanted too many recipients for one message to not be a quota that can be waited for, got %v", err)
+	}
+	fake.Advance(time.Minute)
+	err = limiter.Reserve(3)
+	if quotaErr, ok := err.(ErrQuotaExceeded); !ok || quotaErr.Limit != "recipients per day" || !quotaErr.RetryAt.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("Wanted the recipients per day limit exceeded until a day after the first message, got %v", err)
+	}
+	if err := limiter.Reserve(1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if remaining := limiter.Remaining(); remaining != 0 {
+		t.Errorf("Wanted no messages remaining, got %v", remaining)
+	}
+	fake.Advance(time.Minute)
+	err = limiter.Reserve(1)
+	if quotaErr, ok := err.(ErrQuotaExceeded); !ok || quotaErr.Limit != "messages per day" || !quotaErr.RetryAt.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("Wanted the per day limit exceeded, got %v", err)
+	}
+	fake.Advance(24 * time.Hour)
+	if err := limiter.Reserve(1); err != nil {
+		t.Errorf("Wanted the limits to allow sending a day later, got %v", err)
+	}
+}
+
+type memoryStore map[string][]byte
+
+func (self memoryStore) PutQuota(name string, sent []byte) error {
+	self[name] = sent
+	return nil
+}
+
+func (self memoryStore) Quota(name string) ([]byte, error) {
+	return self[name], nil
+}
+
+func TestPersist(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	store := memoryStore{}
+	limiter := New(Limits{PerDay: 2}).Persist(store, "me@example.com")
+	limiter.Clock = fake
+	if err := limiter.Reserve(1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	fake.Advance(time.Hour)
+	// A new Limiter, like after restarting, counts what the first one sent.
+	restarted := New(Limits{PerDay: 2}).Persist(store, "me@example.com")
+	restarted.Clock = fake
+	if remaining := restarted.Remaining(); remaining != 1 {
+		t.Errorf("Wanted 1 message remaining, got %v", remaining)
+	}
+	if err := restarted.Reserve(1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	err := restarted.Reserve(1)
+	if quotaErr, ok := err.(ErrQuotaExceeded); !ok || !quotaErr.RetryAt.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("Wanted the per day limit exceeded until a day after the first message, got %v", err)
+	}
+	if other := New(Limits{PerDay: 2}).Persist(store, "other@example.com"); other.Remaining() != 2 {
+		t.Errorf("Wanted other names counted apart")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	store := memoryStore{}
+	limiter := New(Limits{PerDay: 2, RecipientsPerDay: 3}).Persist(store, "me@example.com")
+	limiter.Clock = clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	if err := limiter.Reserve(1); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := limiter.Reserve(2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := limiter.Release(2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if remaining := limiter.Remaining(); remaining != 1 {
+		t.Errorf("Wanted the released message not counted, got %v remaining", remaining)
+	}
+	if err := limiter.Reserve(2); err != nil {
+		t.Errorf("Wanted the released recipients not counted, got %v", err)
+	}
+	// The store has what is left after the release, like after restarting.
+	restarted := New(Limits{PerDay: 2}).Persist(store, "me@example.com")
+	restarted.Clock = limiter.Clock
+	if remaining := restarted.Remaining(); remaining != 0 {
+		t.Errorf("Wanted the release stored, got %v remaining", remaining)
+	}
+}
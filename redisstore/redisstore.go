@@ -0,0 +1,224 @@
+// Package redisstore keeps imap.Checkpoint and imap.Dedup state in Redis, to share it between replicas of a service.
+//
+//	store, err := redisstore.New("redis://:password@localhost:6379/0")
+//	client := imap.New(user, password).Checkpoint(store).Dedup(store)
+package redisstore
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var NetworkTimeout = 30 * time.Second
+
+// ErrorReply is an error returned by the Redis server.
+type ErrorReply string
+
+func (self ErrorReply) Error() string {
+	return "redis: " + string(self)
+}
+
+// Store implements imap.Checkpoint and imap.Dedup on top of a single Redis connection, which is opened when needed
+// and reopened after errors.
+type Store struct {
+	// Prefix is prepended to all keys.
+	Prefix string
+	// SeenTTL is how long dedup keys are kept. Zero means forever.
+	SeenTTL time.Duration
+
+	lock sync.Mutex
+	url  *url.URL
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// New takes a redis://[[user]:password@]host[:port][/db] URL, or rediss:// for TLS.
+func New(rawurl string) (result *Store, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		err = fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+		return
+	}
+	result = &Store{
+		Prefix:  "gmail:",
+		SeenTTL: 30 * 24 * time.Hour,
+		url:     u,
+	}
+	return
+}
+
+func (self *Store) connect() (err error) {
+	addr := self.url.Host
+	if self.url.Port() == "" {
+		addr = net.JoinHostPort(self.url.Hostname(), "6379")
+	}
+	if self.conn, err = net.DialTimeout("tcp", addr, NetworkTimeout); err != nil {
+		return
+	}
+	if self.url.Scheme == "rediss" {
+		self.conn = tls.Client(self.conn, &tls.Config{
+			ServerName: self.url.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+	}
+	self.r = bufio.NewReader(self.conn)
+	if self.url.User != nil {
+		password, _ := self.url.User.Password()
+		args := []string{"AUTH", password}
+		if user := self.url.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err = self.do(args...); err != nil {
+			return
+		}
+	}
+	if db := strings.Trim(self.url.Path, "/"); db != "" && db != "0" {
+		if _, err = self.do("SELECT", db); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Do sends a command and returns the reply: a string, an int64, nil or a []interface{} of those.
+func (self *Store) Do(args ...string) (result interface{}, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer func() {
+		if _, isReply := err.(ErrorReply); err != nil && !isReply {
+			self.close()
+		}
+	}()
+	if self.conn == nil {
+		if err = self.connect(); err != nil {
+			self.close()
+			return
+		}
+	}
+	return self.do(args...)
+}
+
+func (self *Store) do(args ...string) (result interface{}, err error) {
+	self.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	w := bufio.NewWriter(self.conn)
+	fmt.Fprintf(w, "*%v\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%v\r\n%v\r\n", len(arg), arg)
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	return self.read()
+}
+
+func (self *Store) read() (result interface{}, err error) {
+	line, err := self.r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		err = errors.New("redis: empty reply")
+		return
+	}
+	switch line[0] {
+	case '+':
+		result = line[1:]
+	case '-':
+		err = ErrorReply(line[1:])
+	case ':':
+		result, err = strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		var n int
+		if n, err = strconv.Atoi(line[1:]); err != nil || n < 0 {
+			return
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(self.r, b); err != nil {
+			return
+		}
+		result = string(b[:n])
+	case '*':
+		var n int
+		if n, err = strconv.Atoi(line[1:]); err != nil || n < 0 {
+			return
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			if elements[i], err = self.read(); err != nil {
+				return
+			}
+		}
+		result = elements
+	default:
+		err = fmt.Errorf("redis: unexpected reply %q", line)
+	}
+	return
+}
+
+func (self *Store) close() {
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+func (self *Store) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.close()
+	return nil
+}
+
+func (self *Store) checkpointKey(mailbox string, uidValidity uint32) string {
+	return fmt.Sprintf("%vcheckpoint:%v:%v", self.Prefix, uidValidity, mailbox)
+}
+
+func (self *Store) LastUID(mailbox string, uidValidity uint32) (result uint32, err error) {
+	reply, err := self.Do("GET", self.checkpointKey(mailbox, uidValidity))
+	if err != nil || reply == nil {
+		return
+	}
+	s, _ := reply.(string)
+	uid, err := strconv.ParseUint(s, 10, 32)
+	result = uint32(uid)
+	return
+}
+
+// SetLastUID saves the checkpoint. Replicas sharing a Store should agree on which of them handles each mailbox, since
+// the last write wins.
+func (self *Store) SetLastUID(mailbox string, uidValidity uint32, uid uint32) (err error) {
+	_, err = self.Do("SET", self.checkpointKey(mailbox, uidValidity), strconv.FormatUint(uint64(uid), 10))
+	return
+}
+
+func (self *Store) Seen(key string) (result bool, err error) {
+	reply, err := self.Do("EXISTS", self.Prefix+"seen:"+key)
+	if err != nil {
+		return
+	}
+	n, _ := reply.(int64)
+	result = n > 0
+	return
+}
+
+func (self *Store) MarkSeen(key string) (err error) {
+	args := []string{"SET", self.Prefix + "seen:" + key, strconv.FormatInt(time.Now().Unix(), 10)}
+	if self.SeenTTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(self.SeenTTL/time.Millisecond), 10))
+	}
+	_, err = self.Do(args...)
+	return
+}
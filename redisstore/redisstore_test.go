@@ -0,0 +1,137 @@
+package redisstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+// fakeRedis understands just enough of RESP and the commands used by Store.
+type fakeRedis struct {
+	lock     sync.Mutex
+	listener net.Listener
+	values   map[string]string
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	result := &fakeRedis{
+		listener: listener,
+		values:   map[string]string{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go result.serve(conn)
+		}
+	}()
+	return result
+}
+
+func (self *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := []string{}
+		for i := 0; i < n; i++ {
+			if line, err = r.ReadString('\n'); err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err = io.ReadFull(r, b); err != nil {
+				return
+			}
+			args = append(args, string(b[:size]))
+		}
+		self.lock.Lock()
+		self.commands = append(self.commands, strings.Join(args, " "))
+		reply := "+OK\r\n"
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] != "secret" {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "GET":
+			if v, found := self.values[args[1]]; found {
+				reply = fmt.Sprintf("$%v\r\n%v\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "SET":
+			self.values[args[1]] = args[2]
+		case "EXISTS":
+			_, found := self.values[args[1]]
+			if found {
+				reply = ":1\r\n"
+			} else {
+				reply = ":0\r\n"
+			}
+		}
+		self.lock.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.listener.Close()
+	store, err := New(fmt.Sprintf("redis://:secret@%v/2", server.listener.Addr()))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	mailbox := imaptest.New()
+	mailbox.Deliver("From: a@example.com\r\nSubject: first\r\n\r\nbody")
+	mailbox.Deliver("From: a@example.com\r\nSubject: second\r\n\r\nbody")
+	c := imap.New("user@example.com", "secret").MailStore(mailbox.Open).Checkpoint(store).Dedup(store)
+	if err := c.HandleNew(func(*imap.Mail) error { return nil }); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if last, err := store.LastUID("INBOX", mailbox.UIDValidity()); err != nil || last != 2 {
+		t.Errorf("Wanted checkpoint 2 but got %v, %v", last, err)
+	}
+	if seen, err := store.Seen(fmt.Sprintf("gmail:%x", imaptest.GmailIDBase+1)); err != nil || !seen {
+		t.Errorf("Wanted the first message to be seen, got %v, %v", seen, err)
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.commands) < 2 || server.commands[0] != "AUTH secret" || server.commands[1] != "SELECT 2" {
+		t.Errorf("Wanted AUTH and SELECT first, got %q", server.commands)
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.listener.Close()
+	store, err := New(fmt.Sprintf("redis://:wrong@%v", server.listener.Addr()))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer store.Close()
+	if _, err := store.Seen("key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Wanted WRONGPASS but got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/retry"
+)
+
+// BatchURL is the batch endpoint of the Gmail API, and BatchSize the most messages fetched in each batch request.
+var (
+	BatchURL  = "https://gmail.googleapis.com/batch/gmail/v1"
+	BatchSize = 50
+)
+
+// QuotaPerSecond is how many quota units the batches may use each second. The Gmail API allows 250 per user, and
+// fetching a message costs 5.
+var QuotaPerSecond = 250
+
+// BatchRetry decides the delays before the messages of a batch that were rate limited are fetched again.
+var BatchRetry retry.Policy = retry.Exponential{Min: time.Second, Max: 32 * time.Second, Attempts: 5}
+
+const getCost = 5
+
+// throttle spaces out the requests to stay within QuotaPerSecond.
+type throttle struct {
+	lock sync.Mutex
+	next time.Time
+}
+
+// wait waits on clk until units more quota units can be used.
+func (self *throttle) wait(ctx context.Context, clk clock.Clock, units int) error {
+	self.lock.Lock()
+	now := clk.Now()
+	if self.next.Before(now) {
+		self.next = now
+	}
+	delay := self.next.Sub(now)
+	self.next = self.next.Add(time.Duration(units) * time.Second / time.Duration(QuotaPerSecond))
+	self.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clk.After(delay):
+		return nil
+	}
+}
+
+// getAll gets the messages in the given format using batch requests. Messages that no longer exist are left out, and
+// messages that were rate limited are fetched again according to BatchRetry.
+func (self *API) getAll(ctx context.Context, ids []string, format string) (result []message, err error) {
+	for len(ids) > 0 {
+		n := BatchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		pending := ids[:n]
+		for attempt := 1; len(pending) > 0; attempt++ {
+			var got []message
+			if got, pending, err = self.batchGet(ctx, pending, format); err != nil {
+				return
+			}
+			result = append(result, got...)
+			if len(pending) == 0 {
+				break
+			}
+			delay, ok := BatchRetry.Next(attempt)
+			if !ok {
+				return nil, Error{Status: http.StatusTooManyRequests, Message: fmt.Sprintf("still rate limited after %v attempts", attempt)}
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-self.clock.After(delay):
+			}
+		}
+		ids = ids[n:]
+	}
+	return
+}
+
+// rateLimited returns whether the status of a response means that the request should be retried later.
+func rateLimited(err Error) bool {
+	return err.Status == http.StatusTooManyRequests || err.Status == http.StatusServiceUnavailable ||
+		(err.Status == http.StatusForbidden && strings.Contains(strings.ToLower(err.Message), "rate limit"))
+}
+
+// batchGet gets the messages in one batch request, and returns the ids of those that were rate limited.
+func (self *API) batchGet(ctx context.Context, ids []string, format string) (result []message, limited []string, err error) {
+	creds, err := self.provider.Credentials()
+	if err != nil {
+		return
+	}
+	if creds.Token == "" {
+		err = fmt.Errorf("rest: the Gmail API needs OAuth2 credentials")
+		return
+	}
+	base, err := url.Parse(BaseURL)
+	if err != nil {
+		return
+	}
+	if err = self.throttle.wait(ctx, self.clock, getCost*len(ids)); err != nil {
+		return
+	}
+	body := &bytes.Buffer{}
+	parts := multipart.NewWriter(body)
+	for i, id := range ids {
+		var part io.Writer
+		if part, err = parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<item%v>", i)},
+		}); err != nil {
+			return
+		}
+		fmt.Fprintf(part, "GET %v/messages/%v?format=%v\r\n\r\n", base.Path, url.PathEscape(id), format)
+	}
+	if err = parts.Close(); err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", BatchURL, body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+creds.Token)
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+	rsp, err := self.client().Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(rsp.Body)
+		e := errorFrom(rsp.StatusCode, b)
+		if rateLimited(e) {
+			return nil, ids, nil
+		}
+		err = e
+		return
+	}
+	_, params, err := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	answered := map[int]bool{}
+	reader := multipart.NewReader(rsp.Body, params["boundary"])
+	for {
+		part, e := reader.NextPart()
+		if e != nil {
+			if e != io.EOF {
+				err = e
+			}
+			break
+		}
+		i, e := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(part.Header.Get("Content-Id"), "<response-item"), ">"))
+		if e != nil || i < 0 || i >= len(ids) {
+			err = fmt.Errorf("rest: unexpected batch part %q", part.Header.Get("Content-Id"))
+			return
+		}
+		answered[i] = true
+		var itemRsp *http.Response
+		if itemRsp, err = http.ReadResponse(bufio.NewReader(part), nil); err != nil {
+			return
+		}
+		var b []byte
+		b, err = ioutil.ReadAll(itemRsp.Body)
+		itemRsp.Body.Close()
+		if err != nil {
+			return
+		}
+		switch {
+		case itemRsp.StatusCode >= 200 && itemRsp.StatusCode <= 299:
+			var msg message
+			if err = json.Unmarshal(b, &msg); err != nil {
+				return
+			}
+			result = append(result, msg)
+		case itemRsp.StatusCode == http.StatusNotFound:
+		default:
+			itemErr := errorFrom(itemRsp.StatusCode, b)
+			if !rateLimited(itemErr) {
+				err = fmt.Errorf("rest: fetching %v: %v", ids[i], itemErr)
+				return
+			}
+			limited = append(limited, ids[i])
+		}
+	}
+	if err != nil {
+		return
+	}
+	for i, id := range ids {
+		if !answered[i] {
+			limited = append(limited, id)
+		}
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package rest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Watch is an active request for Gmail to publish changes of the mailbox to Cloud Pub/Sub.
+type Watch struct {
+	// HistoryID is the mailbox history id when the watch started.
+	HistoryID  uint64
+	Expiration time.Time
+}
+
+// Watch asks Gmail to publish a Push to the Cloud Pub/Sub topic, like "projects/myproject/topics/gmail", whenever the
+// mailboxes with the given label ids, or any of them if there are none, change. Gmail must be allowed to publish to the
+// topic. Watches expire after a week, so Watch should be called again at least daily.
+func (self *API) Watch(ctx context.Context, topic string, labelIDs ...string) (result Watch, err error) {
+	request := struct {
+		TopicName string   `json:"topicName"`
+		LabelIDs  []string `json:"labelIds,omitempty"`
+	}{topic, labelIDs}
+	response := struct {
+		HistoryID  uint64 `json:"historyId,string"`
+		Expiration int64  `json:"expiration,string"`
+	}{}
+	if err = self.do(ctx, "POST", "/watch", nil, request, &response); err != nil {
+		return
+	}
+	result = Watch{
+		HistoryID:  response.HistoryID,
+		Expiration: time.Unix(0, response.Expiration*int64(time.Millisecond)),
+	}
+	return
+}
+
+// StopWatch stops Gmail from publishing changes of the mailbox.
+func (self *API) StopWatch(ctx context.Context) error {
+	return self.do(ctx, "POST", "/stop", nil, nil, nil)
+}
+
+// Push is the notification Gmail publishes for a Watch when the mailbox changed.
+type Push struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// ParsePush returns the Push in the body of a request from a Cloud Pub/Sub push subscription.
+func ParsePush(body []byte) (result Push, err error) {
+	envelope := struct {
+		Message struct {
+			Data string `json:"data"`
+		} `json:"message"`
+	}{}
+	if err = json.Unmarshal(body, &envelope); err != nil {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(envelope.Message.Data)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return
+	}
+	if result.EmailAddress == "" {
+		err = fmt.Errorf("rest: push without email address")
+	}
+	return
+}
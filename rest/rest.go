@@ -0,0 +1,686 @@
+// Package rest implements imap.MailStore on top of the Gmail REST API, for accounts that have IMAP disabled but can
+// log in with OAuth2.
+//
+//	api := rest.New(provider)
+//	client := imap.New(user, "").UpdateCredentials(provider).Fallback(api.Open)
+//
+// The API has no UIDs, so the messages are numbered in the order they are first found, and the numbering starts over
+// with a new UIDVALIDITY every time the process starts. IMAP search criteria are translated to Gmail search queries,
+// and only the criteria this package uses are supported.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+// BaseURL is the Gmail API endpoint of the authenticated user.
+var BaseURL = "https://gmail.googleapis.com/gmail/v1/users/me"
+
+var HTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// Error is an error response from the API.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (self Error) Error() string {
+	return fmt.Sprintf("rest: %v %v", self.Status, self.Message)
+}
+
+// systemLabels are the label ids of the Gmail system mailboxes, and systemNames the X-GM-LABELS names of the system
+// labels.
+var (
+	systemLabels = map[string]string{
+		"INBOX":             "INBOX",
+		"[Gmail]/All Mail":  "",
+		"[Gmail]/Drafts":    "DRAFT",
+		"[Gmail]/Important": "IMPORTANT",
+		"[Gmail]/Sent Mail": "SENT",
+		"[Gmail]/Spam":      "SPAM",
+		"[Gmail]/Starred":   "STARRED",
+		"[Gmail]/Trash":     "TRASH",
+	}
+	systemNames = map[string]string{
+		"INBOX":     `\Inbox`,
+		"DRAFT":     `\Draft`,
+		"IMPORTANT": `\Important`,
+		"SENT":      `\Sent`,
+		"STARRED":   `\Starred`,
+	}
+)
+
+// uids numbers the messages of a mailbox.
+type uids struct {
+	byID  map[string]uint32
+	byUID map[uint32]string
+	last  uint32
+}
+
+// API opens MailStores using the Gmail API. It is safe for concurrent use.
+type API struct {
+	provider    auth.Provider
+	uidValidity uint32
+	lock        sync.Mutex
+	mailboxes   map[string]*uids
+	// labels maps the names of the user labels to their ids, and is loaded when needed.
+	labels     map[string]string
+	throttle   throttle
+	httpClient *http.Client
+	clock      clock.Clock
+}
+
+// New returns an API authenticating with the access tokens of provider.
+func New(provider auth.Provider) *API {
+	return &API{
+		provider:    provider,
+		uidValidity: uint32(time.Now().Unix()),
+		mailboxes:   map[string]*uids{},
+		clock:       clock.Real,
+	}
+}
+
+// WithHTTPClient makes the API send its requests using client instead of HTTPClient.
+func (self *API) WithHTTPClient(client *http.Client) *API {
+	self.httpClient = client
+	return self
+}
+
+// WithClock makes the API time the throttling and the retries of batches with c instead of the real clock.
+func (self *API) WithClock(c clock.Clock) *API {
+	self.clock = c
+	return self
+}
+
+// client returns the HTTP client to send requests with.
+func (self *API) client() *http.Client {
+	if self.httpClient != nil {
+		return self.httpClient
+	}
+	return HTTPClient
+}
+
+// Open returns a MailStore for mailbox, which is a Gmail system mailbox like imap.SpamMailbox, or the name of a user
+// label. It has the signature imap.Client.Fallback wants.
+func (self *API) Open(ctx context.Context, mailbox string) (result imap.MailStore, err error) {
+	labelID, found := systemLabels[mailbox]
+	if !found {
+		if labelID, err = self.labelID(ctx, mailbox, false); err != nil {
+			return
+		}
+		if labelID == "" {
+			err = fmt.Errorf("rest: no label %q", mailbox)
+			return
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	numbers := self.mailboxes[mailbox]
+	if numbers == nil {
+		numbers = &uids{
+			byID:  map[string]uint32{},
+			byUID: map[uint32]string{},
+		}
+		self.mailboxes[mailbox] = numbers
+	}
+	result = &store{
+		api:     self,
+		labelID: labelID,
+		uids:    numbers,
+	}
+	return
+}
+
+// do sends a request to the API, with body encoded as JSON if not nil, and decodes the JSON response into result if
+// not nil.
+func (self *API) do(ctx context.Context, method, path string, query url.Values, body, result interface{}) (err error) {
+	creds, err := self.provider.Credentials()
+	if err != nil {
+		return
+	}
+	if creds.Token == "" {
+		return fmt.Errorf("rest: the Gmail API needs OAuth2 credentials")
+	}
+	var reader io.Reader
+	if body != nil {
+		var b []byte
+		if b, err = json.Marshal(body); err != nil {
+			return
+		}
+		reader = bytes.NewReader(b)
+	}
+	u := BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+creds.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := self.client().Do(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return errorFrom(rsp.StatusCode, b)
+	}
+	if result != nil && len(b) > 0 {
+		err = json.Unmarshal(b, result)
+	}
+	return
+}
+
+// errorFrom returns the Error of a response.
+func errorFrom(status int, body []byte) Error {
+	parsed := struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error.Message != "" {
+		message = parsed.Error.Message
+	}
+	return Error{Status: status, Message: message}
+}
+
+// loadLabels loads the names and ids of the user labels, unless they already are.
+func (self *API) loadLabels(ctx context.Context) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.labels != nil {
+		return
+	}
+	listed := struct {
+		Labels []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"labels"`
+	}{}
+	if err = self.do(ctx, "GET", "/labels", nil, nil, &listed); err != nil {
+		return
+	}
+	self.labels = map[string]string{}
+	for _, label := range listed.Labels {
+		self.labels[label.Name] = label.ID
+	}
+	return
+}
+
+// labelID returns the id of the user label name, creating the label if create is set, or an empty id if it doesn't
+// exist.
+func (self *API) labelID(ctx context.Context, name string, create bool) (result string, err error) {
+	if err = self.loadLabels(ctx); err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result = self.labels[name]
+	if result == "" && create {
+		created := struct {
+			ID string `json:"id"`
+		}{}
+		if err = self.do(ctx, "POST", "/labels", nil, map[string]string{"name": name}, &created); err != nil {
+			return
+		}
+		result = created.ID
+		self.labels[name] = result
+	}
+	return
+}
+
+// labelName returns the X-GM-LABELS name of the label id, or an empty name for labels IMAP doesn't show.
+func (self *API) labelName(id string) string {
+	if name, found := systemNames[id]; found {
+		return name
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for name, labelID := range self.labels {
+		if labelID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+type store struct {
+	api     *API
+	labelID string
+	uids    *uids
+}
+
+// uid returns the UID of the message id, numbering it if it's new.
+func (self *store) uid(id string) uint32 {
+	self.api.lock.Lock()
+	defer self.api.lock.Unlock()
+	uid, found := self.uids.byID[id]
+	if !found {
+		self.uids.last++
+		uid = self.uids.last
+		self.uids.byID[id] = uid
+		self.uids.byUID[uid] = id
+	}
+	return uid
+}
+
+// ids returns the message ids of the known UIDs.
+func (self *store) ids(uids []uint32) (result []string) {
+	self.api.lock.Lock()
+	defer self.api.lock.Unlock()
+	for _, uid := range uids {
+		if id, found := self.uids.byUID[uid]; found {
+			result = append(result, id)
+		}
+	}
+	return
+}
+
+func (self *store) UIDValidity() uint32 {
+	return self.api.uidValidity
+}
+
+func (self *store) Close() error {
+	return nil
+}
+
+// query translates IMAP search criteria into a Gmail search query, and the UID sets they contain.
+func query(criteria []string) (result string, uidSets []string, err error) {
+	terms := []string{}
+	for _, criterion := range criteria {
+		tokens := tokenize(criterion)
+		arg := func() (string, error) {
+			if len(tokens) < 2 {
+				return "", fmt.Errorf("rest: missing argument to %v", tokens[0])
+			}
+			tokens = tokens[1:]
+			return tokens[0], nil
+		}
+		for ; len(tokens) > 0; tokens = tokens[1:] {
+			key := strings.ToUpper(tokens[0])
+			var value string
+			if key != "ALL" && key != "SEEN" && key != "UNSEEN" && key != "FLAGGED" && key != "UNFLAGGED" {
+				if value, err = arg(); err != nil {
+					return
+				}
+			}
+			switch key {
+			case "ALL":
+			case "SEEN":
+				terms = append(terms, "-is:unread")
+			case "UNSEEN":
+				terms = append(terms, "is:unread")
+			case "FLAGGED":
+				terms = append(terms, "is:starred")
+			case "UNFLAGGED":
+				terms = append(terms, "-is:starred")
+			case "KEYWORD":
+				terms = append(terms, "label:"+quote(value))
+			case "UNKEYWORD":
+				terms = append(terms, "-label:"+quote(value))
+			case "SINCE", "BEFORE", "ON":
+				var date time.Time
+				if date, err = time.Parse("2-Jan-2006", value); err != nil {
+					return
+				}
+				if key != "BEFORE" {
+					terms = append(terms, "after:"+date.Format("2006/01/02"))
+				}
+				if key == "BEFORE" {
+					terms = append(terms, "before:"+date.Format("2006/01/02"))
+				} else if key == "ON" {
+					terms = append(terms, "before:"+date.AddDate(0, 0, 1).Format("2006/01/02"))
+				}
+			case "FROM", "TO", "CC", "SUBJECT":
+				terms = append(terms, strings.ToLower(key)+":"+quote(value))
+			case "HEADER":
+				if !strings.EqualFold(value, "Message-ID") {
+					err = fmt.Errorf("rest: unsupported header %v", value)
+					return
+				}
+				if value, err = arg(); err != nil {
+					return
+				}
+				terms = append(terms, "rfc822msgid:"+quote(strings.Trim(value, "<>")))
+			case "X-GM-RAW":
+				terms = append(terms, "("+value+")")
+			case "UID":
+				uidSets = append(uidSets, value)
+			default:
+				err = fmt.Errorf("rest: unsupported search key %v", tokens[0])
+				return
+			}
+		}
+	}
+	result = strings.Join(terms, " ")
+	return
+}
+
+func quote(s string) string {
+	return `"` + strings.Replace(s, `"`, "", -1) + `"`
+}
+
+// tokenize splits an IMAP search criterion into keys and arguments, removing the quotes.
+func tokenize(s string) (result []string) {
+	current := &bytes.Buffer{}
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			current.WriteByte(s[i])
+		case c == ' ' && !quoted:
+			if current.Len() > 0 {
+				result = append(result, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 {
+		result = append(result, current.String())
+	}
+	return
+}
+
+// inSet returns whether uid is in the IMAP UID set, where * is the highest UID found.
+func inSet(uid, highest uint32, set string) (result bool, err error) {
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		limits := make([]uint64, len(bounds))
+		for i, bound := range bounds {
+			if bound == "*" {
+				limits[i] = uint64(highest)
+			} else if limits[i], err = strconv.ParseUint(bound, 10, 32); err != nil {
+				return
+			}
+		}
+		low, high := limits[0], limits[len(limits)-1]
+		if low > high {
+			low, high = high, low
+		}
+		if uint64(uid) >= low && uint64(uid) <= high {
+			return true, nil
+		}
+	}
+	return
+}
+
+func (self *store) Search(ctx context.Context, criteria ...string) (result []uint32, err error) {
+	q, uidSets, err := query(criteria)
+	if err != nil {
+		return
+	}
+	params := url.Values{"maxResults": {"500"}}
+	if q != "" {
+		params.Set("q", q)
+	}
+	if self.labelID != "" {
+		params.Set("labelIds", self.labelID)
+	}
+	if self.labelID == "" || self.labelID == "SPAM" || self.labelID == "TRASH" {
+		params.Set("includeSpamTrash", "true")
+	}
+	ids := []string{}
+	for {
+		listed := struct {
+			Messages []struct {
+				ID string `json:"id"`
+			} `json:"messages"`
+			NextPageToken string `json:"nextPageToken"`
+		}{}
+		if err = self.api.do(ctx, "GET", "/messages", params, nil, &listed); err != nil {
+			return
+		}
+		for _, msg := range listed.Messages {
+			ids = append(ids, msg.ID)
+		}
+		if listed.NextPageToken == "" {
+			break
+		}
+		params.Set("pageToken", listed.NextPageToken)
+	}
+	// The messages are listed newest first, and numbered oldest first.
+	var highest uint32
+	for i := len(ids) - 1; i >= 0; i-- {
+		uid := self.uid(ids[i])
+		if uid > highest {
+			highest = uid
+		}
+		result = append(result, uid)
+	}
+	for _, set := range uidSets {
+		filtered := []uint32{}
+		for _, uid := range result {
+			var in bool
+			if in, err = inSet(uid, highest, set); err != nil {
+				return
+			}
+			if in {
+				filtered = append(filtered, uid)
+			}
+		}
+		result = filtered
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return
+}
+
+// message is a message as returned by messages.get.
+type message struct {
+	ID           string   `json:"id"`
+	ThreadID     string   `json:"threadId"`
+	LabelIDs     []string `json:"labelIds"`
+	InternalDate string   `json:"internalDate"`
+	Raw          string   `json:"raw"`
+}
+
+// convert returns msg as an imap.Message.
+func (self *store) convert(msg message) (result imap.Message, err error) {
+	result.UID = self.uid(msg.ID)
+	if result.Body, err = base64.URLEncoding.DecodeString(msg.Raw); err != nil {
+		// The API usually leaves out the padding.
+		if result.Body, err = base64.RawURLEncoding.DecodeString(msg.Raw); err != nil {
+			return
+		}
+	}
+	result.GmailID, _ = strconv.ParseUint(msg.ID, 16, 64)
+	result.ThreadID, _ = strconv.ParseUint(msg.ThreadID, 16, 64)
+	if millis, e := strconv.ParseInt(msg.InternalDate, 10, 64); e == nil {
+		result.InternalDate = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	unread := false
+	for _, id := range msg.LabelIDs {
+		switch id {
+		case "UNREAD":
+			unread = true
+		case "STARRED":
+			result.Flags = append(result.Flags, `\Flagged`)
+		case "DRAFT":
+			result.Flags = append(result.Flags, `\Draft`)
+		}
+		if name := self.api.labelName(id); name != "" {
+			result.Labels = append(result.Labels, name)
+		}
+	}
+	if !unread {
+		result.Flags = append(result.Flags, `\Seen`)
+	}
+	return
+}
+
+func (self *store) Fetch(ctx context.Context, uids ...uint32) (result []imap.Message, err error) {
+	// The label names are needed to convert the label ids.
+	if err = self.api.loadLabels(ctx); err != nil {
+		return
+	}
+	msgs, err := self.api.getAll(ctx, self.ids(uids), "raw")
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		var converted imap.Message
+		if converted, err = self.convert(msg); err != nil {
+			return
+		}
+		result = append(result, converted)
+	}
+	return
+}
+
+func (self *store) Labels(ctx context.Context, uids ...uint32) (result map[uint32][]string, err error) {
+	if err = self.api.loadLabels(ctx); err != nil {
+		return
+	}
+	msgs, err := self.api.getAll(ctx, self.ids(uids), "minimal")
+	if err != nil {
+		return
+	}
+	result = map[uint32][]string{}
+	for _, msg := range msgs {
+		labels := []string{}
+		for _, labelID := range msg.LabelIDs {
+			if name := self.api.labelName(labelID); name != "" {
+				labels = append(labels, name)
+			}
+		}
+		result[self.uid(msg.ID)] = labels
+	}
+	return
+}
+
+// labelIDs returns the ids of the IMAP labels or keywords, creating the missing user labels if create is set, and
+// leaving them out otherwise.
+func (self *store) labelIDs(ctx context.Context, names []string, create bool) (result []string, err error) {
+	for _, name := range names {
+		found := false
+		for id, systemName := range systemNames {
+			if strings.EqualFold(name, systemName) {
+				result, found = append(result, id), true
+			}
+		}
+		if found {
+			continue
+		}
+		var id string
+		if id, err = self.api.labelID(ctx, name, create); err != nil {
+			return
+		}
+		if id != "" {
+			result = append(result, id)
+		}
+	}
+	return
+}
+
+// modify adds and removes label ids on the messages.
+func (self *store) modify(ctx context.Context, uids []uint32, add, remove []string) (err error) {
+	ids := self.ids(uids)
+	if len(ids) == 0 || len(add)+len(remove) == 0 {
+		return
+	}
+	return self.api.do(ctx, "POST", "/messages/batchModify", nil, map[string][]string{
+		"ids":            ids,
+		"addLabelIds":    add,
+		"removeLabelIds": remove,
+	}, nil)
+}
+
+// AddFlags marks the messages as read for `\Seen`, stars them for `\Flagged`, and adds keywords as labels, like Gmail
+// does over IMAP.
+func (self *store) AddFlags(ctx context.Context, flags []string, uids ...uint32) (err error) {
+	var add, remove, keywords []string
+	for _, flag := range flags {
+		switch flag {
+		case `\Seen`:
+			remove = append(remove, "UNREAD")
+		case `\Flagged`:
+			add = append(add, "STARRED")
+		default:
+			if strings.HasPrefix(flag, `\`) {
+				return fmt.Errorf("rest: unsupported flag %v", flag)
+			}
+			keywords = append(keywords, flag)
+		}
+	}
+	ids, err := self.labelIDs(ctx, keywords, true)
+	if err != nil {
+		return
+	}
+	return self.modify(ctx, uids, append(add, ids...), remove)
+}
+
+func (self *store) AddLabels(ctx context.Context, labels []string, uids ...uint32) (err error) {
+	ids, err := self.labelIDs(ctx, labels, true)
+	if err != nil {
+		return
+	}
+	return self.modify(ctx, uids, ids, nil)
+}
+
+func (self *store) RemoveLabels(ctx context.Context, labels []string, uids ...uint32) (err error) {
+	ids, err := self.labelIDs(ctx, labels, false)
+	if err != nil {
+		return
+	}
+	return self.modify(ctx, uids, nil, ids)
+}
+
+// Append inserts the message into the mailbox. The API can't set the internal date, so it's taken from the Date
+// header instead of date.
+func (self *store) Append(ctx context.Context, flags []string, date time.Time, body []byte) (err error) {
+	labelIDs := []string{}
+	if self.labelID != "" {
+		labelIDs = append(labelIDs, self.labelID)
+	}
+	seen := false
+	for _, flag := range flags {
+		switch flag {
+		case `\Seen`:
+			seen = true
+		case `\Flagged`:
+			labelIDs = append(labelIDs, "STARRED")
+		}
+	}
+	if !seen {
+		labelIDs = append(labelIDs, "UNREAD")
+	}
+	return self.api.do(ctx, "POST", "/messages", url.Values{"internalDateSource": {"dateHeader"}}, map[string]interface{}{
+		"raw":      base64.URLEncoding.EncodeToString(body),
+		"labelIds": labelIDs,
+	}, nil)
+}
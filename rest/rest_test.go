@@ -0,0 +1,277 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/retry"
+)
+
+// fakeAPI serves the parts of the Gmail API the package uses, for messages with ids 0a, 0b and 0c.
+type fakeAPI struct {
+	labels   map[string][]string
+	queries  []string
+	modified []string
+	// limited are the ids whose next get in a batch is rate limited.
+	limited map[string]bool
+	batches [][]string
+}
+
+// batch answers a batch request by serving each of its parts.
+func (self *fakeAPI) batch(w http.ResponseWriter, r *http.Request) {
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	// The whole request is read first, since the server stops reading the body of requests once the response is written.
+	body, _ := ioutil.ReadAll(r.Body)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	parts := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+	ids := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		// The parts are request lines without a protocol version, followed by an empty line.
+		line, _ := bufio.NewReader(part).ReadString('\n')
+		fields := strings.Fields(line)
+		req := httptest.NewRequest(fields[0], fields[1], nil)
+		req.Header = r.Header
+		id := strings.TrimPrefix(req.URL.Path, "/messages/")
+		ids = append(ids, id)
+		rsp := httptest.NewRecorder()
+		if self.limited[id] {
+			delete(self.limited, id)
+			rsp.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			self.ServeHTTP(rsp, req)
+		}
+		out, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<response-" + strings.Trim(part.Header.Get("Content-Id"), "<>") + ">"},
+		})
+		rsp.Result().Write(out)
+	}
+	self.batches = append(self.batches, ids)
+	parts.Close()
+}
+
+func (self *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"message": "bad token"}}`)
+		return
+	}
+	switch {
+	case r.URL.Path == "/batch":
+		self.batch(w, r)
+	case r.URL.Path == "/labels" && r.Method == "GET":
+		fmt.Fprint(w, `{"labels": [{"id": "INBOX", "name": "INBOX"}, {"id": "Label_1", "name": "Work"}]}`)
+	case r.URL.Path == "/labels" && r.Method == "POST":
+		fmt.Fprint(w, `{"id": "Label_2"}`)
+	case r.URL.Path == "/messages":
+		self.queries = append(self.queries, r.URL.Query().Get("q"))
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprint(w, `{"messages": [{"id": "0c"}, {"id": "0b"}], "nextPageToken": "next"}`)
+		} else {
+			fmt.Fprint(w, `{"messages": [{"id": "0a"}]}`)
+		}
+	case r.URL.Path == "/messages/batchModify":
+		body := map[string][]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		self.modified = append(self.modified, fmt.Sprint(body["ids"], body["addLabelIds"], body["removeLabelIds"]))
+	case strings.HasPrefix(r.URL.Path, "/messages/"):
+		id := strings.TrimPrefix(r.URL.Path, "/messages/")
+		if self.labels[id] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":           id,
+			"threadId":     "0f",
+			"labelIds":     self.labels[id],
+			"internalDate": "1580472000000",
+			"raw":          base64.RawURLEncoding.EncodeToString([]byte("Subject: " + id + "\r\n\r\nbody")),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestStore(t *testing.T) {
+	fake := &fakeAPI{
+		labels: map[string][]string{
+			"0a": {"INBOX", "UNREAD"},
+			"0b": {"INBOX", "Label_1", "STARRED"},
+		},
+		limited: map[string]bool{"0b": true},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	defer func(base, batch string, size int, policy retry.Policy) {
+		BaseURL, BatchURL, BatchSize, BatchRetry = base, batch, size, policy
+	}(BaseURL, BatchURL, BatchSize, BatchRetry)
+	BaseURL, BatchURL, BatchSize, BatchRetry = server.URL, server.URL+"/batch", 2, retry.Exponential{Min: time.Millisecond, Attempts: 1}
+
+	api := New(auth.Static{User: "user@example.com", Token: "token"})
+	store, err := api.Open(context.Background(), "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uids, err := store.Search(context.Background(), "UNKEYWORD "+imap.OldKeyword, "SINCE 31-Jan-2020", "UID 2:*")
+	if err != nil || !reflect.DeepEqual(uids, []uint32{2, 3}) {
+		t.Fatalf("Wanted the two newest messages, got %v and %v", uids, err)
+	}
+	if want := `-label:"` + imap.OldKeyword + `" after:2020/01/31`; fake.queries[0] != want {
+		t.Errorf("Wanted the query %q but got %q", want, fake.queries[0])
+	}
+	msgs, err := store.Fetch(context.Background(), 1, 2, 3)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("Wanted two messages, got %+v and %v", msgs, err)
+	}
+	// 0c doesn't exist, and 0b is fetched again after being rate limited.
+	if want := [][]string{{"0a", "0b"}, {"0b"}, {"0c"}}; !reflect.DeepEqual(fake.batches, want) {
+		t.Errorf("Wanted the batches %v but got %v", want, fake.batches)
+	}
+	if msg := msgs[1]; string(msg.Body) != "Subject: 0b\r\n\r\nbody" || msg.GmailID != 0x0b || msg.ThreadID != 0x0f || msg.InternalDate.Unix() != 1580472000 ||
+		!reflect.DeepEqual(msg.Flags, []string{`\Flagged`, `\Seen`}) || !reflect.DeepEqual(msg.Labels, []string{`\Inbox`, "Work", `\Starred`}) {
+		t.Errorf("Wanted 0b converted, got %+v", msg)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string(nil)) {
+		t.Errorf("Wanted 0a unread, got %v", msgs[0].Flags)
+	}
+	if err := store.AddFlags(context.Background(), []string{`\Seen`, imap.OldKeyword}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveLabels(context.Background(), []string{`\Inbox`, "Missing"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[0a] [Label_2] [UNREAD]", "[0b] [] [INBOX]"}; !reflect.DeepEqual(fake.modified, want) {
+		t.Errorf("Wanted %v but got %v", want, fake.modified)
+	}
+	if _, err := New(auth.Static{User: "user@example.com", Token: "wrong"}).Open(context.Background(), "Work"); err == nil || err.(Error).Status != http.StatusUnauthorized {
+		t.Errorf("Wanted the API error, got %v", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	fake := &fakeAPI{labels: map[string][]string{}}
+	ids := []string{}
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("%x", 0x100+i)
+		fake.labels[id] = []string{"INBOX"}
+		ids = append(ids, id)
+	}
+	batches := make(chan bool, len(ids))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/batch" {
+			batches <- true
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer func(base, batch string, size, quota int) {
+		BaseURL, BatchURL, BatchSize, QuotaPerSecond = base, batch, size, quota
+	}(BaseURL, BatchURL, BatchSize, QuotaPerSecond)
+	// Each batch of two messages uses a second of quota.
+	BaseURL, BatchURL, BatchSize, QuotaPerSecond = server.URL, server.URL+"/batch", 2, 2*getCost
+	clk := clock.NewFake(time.Now())
+	api := New(auth.Static{User: "user@example.com", Token: "token"}).WithClock(clk)
+	done := make(chan error, 1)
+	go func() {
+		msgs, err := api.getAll(context.Background(), ids, "raw")
+		if err == nil && len(msgs) != len(ids) {
+			err = fmt.Errorf("got %v messages", len(msgs))
+		}
+		done <- err
+	}()
+	<-batches
+	for i := 1; i < 3; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second - time.Millisecond)
+		select {
+		case <-batches:
+			t.Fatalf("Wanted batch %v to wait for the quota", i+1)
+		case <-time.After(10 * time.Millisecond):
+		}
+		clk.Advance(time.Millisecond)
+		<-batches
+	}
+	if err := <-done; err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestPush(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/watch" || body["topicName"] != "projects/p/topics/gmail" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"historyId": "1234", "expiration": "1431990098200"}`)
+	}))
+	defer server.Close()
+	defer func(base string) {
+		BaseURL = base
+	}(BaseURL)
+	BaseURL = server.URL
+	api := New(auth.Static{User: "user@example.com", Token: "token"})
+	watch, err := api.Watch(context.Background(), "projects/p/topics/gmail", "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watch.HistoryID != 1234 || watch.Expiration.UnixMilli() != 1431990098200 {
+		t.Errorf("Wanted history 1234 expiring at 1431990098200, got %+v", watch)
+	}
+	data := base64.StdEncoding.EncodeToString([]byte(`{"emailAddress": "user@example.com", "historyId": 9876543210}`))
+	push, err := ParsePush([]byte(`{"message": {"data": "` + data + `", "messageId": "1"}, "subscription": "s"}`))
+	if err != nil || push.EmailAddress != "user@example.com" || push.HistoryID != 9876543210 {
+		t.Errorf("Wanted the push for user@example.com, got %+v and %v", push, err)
+	}
+	if _, err := ParsePush([]byte(`{"message": {}}`)); err == nil {
+		t.Errorf("Wanted a push without data to fail")
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	fake := &fakeAPI{labels: map[string][]string{}}
+	ids := []string{}
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("%x", 0x100+i)
+		fake.labels[id] = []string{"INBOX"}
+		ids = append(ids, id)
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	defer func(base, batch string, quota int) {
+		BaseURL, BatchURL, QuotaPerSecond = base, batch, quota
+	}(BaseURL, BatchURL, QuotaPerSecond)
+	BaseURL, BatchURL, QuotaPerSecond = server.URL, server.URL+"/batch", 1<<30
+	api := New(auth.Static{User: "user@example.com", Token: "token"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fake.batches = nil
+		msgs, err := api.getAll(context.Background(), ids, "raw")
+		if err != nil || len(msgs) != len(ids) {
+			b.Fatalf("Wanted %v messages, got %v and %v", len(ids), len(msgs), err)
+		}
+	}
+}
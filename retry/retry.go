@@ -0,0 +1,46 @@
+// Package retry contains the policies deciding how long to wait before retrying failed operations.
+package retry
+
+import (
+	"time"
+)
+
+// Policy decides the delay before each retry of a failed operation.
+type Policy interface {
+	// Next returns the delay before retry number attempt, counting from 1, or false to give up.
+	Next(attempt int) (delay time.Duration, ok bool)
+}
+
+// Func lets an ordinary function be used as a Policy.
+type Func func(attempt int) (time.Duration, bool)
+
+func (self Func) Next(attempt int) (time.Duration, bool) {
+	return self(attempt)
+}
+
+// Never gives up at once.
+var Never Policy = Func(func(int) (time.Duration, bool) {
+	return 0, false
+})
+
+// Exponential waits Min before the first retry, and doubles the delay for each retry after that, up to Max.
+// A zero Max keeps the delay at Min, and a zero Attempts means no limit on the number of retries.
+type Exponential struct {
+	Min      time.Duration
+	Max      time.Duration
+	Attempts int
+}
+
+func (self Exponential) Next(attempt int) (delay time.Duration, ok bool) {
+	if attempt < 1 || (self.Attempts > 0 && attempt > self.Attempts) {
+		return
+	}
+	delay = self.Min
+	for i := 1; i < attempt && delay < self.Max; i++ {
+		delay *= 2
+	}
+	if self.Max > 0 && delay > self.Max {
+		delay = self.Max
+	}
+	return delay, true
+}
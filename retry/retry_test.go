@@ -0,0 +1,23 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponential(t *testing.T) {
+	policy := Exponential{Min: time.Second, Max: 5 * time.Second, Attempts: 5}
+	for attempt, want := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay, ok := policy.Next(attempt); attempt == 0 && ok {
+			t.Errorf("Wanted no delay before attempt 0")
+		} else if attempt > 0 && (!ok || delay != want) {
+			t.Errorf("Wanted %v before attempt %v, got %v, %v", want, attempt, delay, ok)
+		}
+	}
+	if _, ok := policy.Next(6); ok {
+		t.Errorf("Wanted the policy to give up after 5 attempts")
+	}
+	if delay, ok := (Exponential{Min: time.Second}).Next(100); !ok || delay != time.Second {
+		t.Errorf("Wanted a constant delay without Max, got %v, %v", delay, ok)
+	}
+}
@@ -0,0 +1,162 @@
+// Package rules applies automatic actions, like labeling or archiving, to mail matching user defined conditions.
+//
+//	client.MailHandler(rules.Handler(handler, rules.Rule{
+//		Conditions: []rules.Condition{rules.FromDomain("example.com")},
+//		Actions:    []rules.Action{rules.AddLabel("example"), rules.Archive},
+//	}))
+package rules
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/zond/gmail/addr"
+	"github.com/zond/gmail/imap"
+)
+
+// Condition decides if a rule applies to a message.
+type Condition func(msg *imap.Mail) bool
+
+// Action changes a message. The changes are made by the IMAP client after all handlers succeeded.
+type Action func(msg *imap.Mail)
+
+// Rule performs its Actions on messages matching all its Conditions.
+type Rule struct {
+	Conditions []Condition
+	Actions    []Action
+}
+
+func (self Rule) Matches(msg *imap.Mail) bool {
+	for _, condition := range self.Conditions {
+		if !condition(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler returns a handler performing the actions of all matching rules, and then calling next if it isn't nil.
+func Handler(next imap.MailHandler, rules ...Rule) imap.MailHandler {
+	return func(msg *imap.Mail) error {
+		for _, rule := range rules {
+			if rule.Matches(msg) {
+				for _, action := range rule.Actions {
+					action(msg)
+				}
+			}
+		}
+		if next != nil {
+			return next(msg)
+		}
+		return nil
+	}
+}
+
+// FromDomain matches messages with a From address in domain or any of its subdomains.
+func FromDomain(domain string) Condition {
+	domain = strings.ToLower(domain)
+	return func(msg *imap.Mail) bool {
+		from := addr.From(msg)
+		if from == nil {
+			return false
+		}
+		host := addr.Domain(from.Address)
+		return host != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+	}
+}
+
+func SubjectMatches(re *regexp.Regexp) Condition {
+	return func(msg *imap.Mail) bool {
+		return msg.MIMEBody != nil && re.MatchString(msg.GetHeader("Subject"))
+	}
+}
+
+// PriorityAtLeast matches messages classified as priority or higher, see imap.Classify.
+func PriorityAtLeast(priority imap.Priority) Condition {
+	return func(msg *imap.Mail) bool {
+		return msg.Priority >= priority
+	}
+}
+
+func HasAttachment(msg *imap.Mail) bool {
+	return msg.MIMEBody != nil && len(msg.Attachments) > 0
+}
+
+func AddLabel(label string) Action {
+	return func(msg *imap.Mail) {
+		msg.AddLabels(label)
+	}
+}
+
+func MarkRead(msg *imap.Mail) {
+	msg.MarkRead()
+}
+
+func Archive(msg *imap.Mail) {
+	msg.Archive()
+}
+
+func Star(msg *imap.Mail) {
+	msg.Star()
+}
+
+// SenderPolicy decides whose mail is handled at all, by From address. The zero value allows everyone.
+type SenderPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// NewSenderPolicy returns a policy denying mail from senders matching any deny pattern, and, if there are allow patterns,
+// mail from senders matching none of them. Patterns containing @ match whole addresses, like "*@example.com" or
+// "alerts-*@example.com", and the others domains, like "example.com" or "*.example.com", using path.Match wildcards.
+// Matching ignores case, and addresses match both as written and normalized by addr.Normalize.
+func NewSenderPolicy(allow, deny []string) (result SenderPolicy, err error) {
+	normalize := func(patterns []string) (normalized []string, err error) {
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if _, err = path.Match(pattern, ""); err != nil {
+				err = fmt.Errorf("rules: invalid sender pattern %q: %v", pattern, err)
+				return
+			}
+			if strings.Contains(pattern, "@") && !strings.ContainsAny(pattern, `*?[\`) {
+				pattern = addr.Normalize(pattern)
+			}
+			normalized = append(normalized, pattern)
+		}
+		return
+	}
+	if result.allow, err = normalize(allow); err != nil {
+		return
+	}
+	result.deny, err = normalize(deny)
+	return
+}
+
+// Allowed returns whether the policy allows the sender of msg. Mail without a valid From address is only allowed when
+// there are no allow patterns.
+func (self SenderPolicy) Allowed(msg *imap.Mail) bool {
+	from := addr.From(msg)
+	if from != nil && matchesSender(self.deny, from.Address) {
+		return false
+	}
+	return len(self.allow) == 0 || (from != nil && matchesSender(self.allow, from.Address))
+}
+
+func matchesSender(patterns []string, address string) bool {
+	addresses := []string{strings.ToLower(address), addr.Normalize(address)}
+	domain := addr.Domain(address)
+	for _, pattern := range patterns {
+		subjects := []string{domain}
+		if strings.Contains(pattern, "@") {
+			subjects = addresses
+		}
+		for _, subject := range subjects {
+			if matched, _ := path.Match(pattern, subject); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
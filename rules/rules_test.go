@@ -0,0 +1,94 @@
+package rules
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestHandler(t *testing.T) {
+	mailbox := imaptest.New()
+	matching := mailbox.Deliver("From: Someone <someone@mail.example.com>\r\nSubject: Invoice 123\r\n\r\nbody")
+	other := mailbox.Deliver("From: someone@example.org\r\nSubject: Invoice 456\r\n\r\nbody")
+	mailbox.SetLabels(matching, `\Inbox`)
+	mailbox.SetLabels(other, `\Inbox`)
+	handled := 0
+	handler := Handler(func(msg *imap.Mail) error {
+		handled++
+		return nil
+	}, Rule{
+		Conditions: []Condition{FromDomain("example.com"), SubjectMatches(regexp.MustCompile("^Invoice"))},
+		Actions:    []Action{AddLabel("invoices"), Archive, MarkRead},
+	})
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(handler); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if handled != 2 {
+		t.Errorf("Wanted 2 handled messages, got %v", handled)
+	}
+	labels, err := mailbox.Labels(context.Background(), matching, other)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := []string{"invoices"}; !reflect.DeepEqual(labels[matching], want) {
+		t.Errorf("Wanted %v but got %v", want, labels[matching])
+	}
+	if want := []string{`\Inbox`}; !reflect.DeepEqual(labels[other], want) {
+		t.Errorf("Wanted %v but got %v", want, labels[other])
+	}
+	if want := []string{imap.OldKeyword, `\Seen`}; !reflect.DeepEqual(mailbox.Flags(matching), want) {
+		t.Errorf("Wanted %v but got %v", want, mailbox.Flags(matching))
+	}
+	if want := []string{imap.OldKeyword}; !reflect.DeepEqual(mailbox.Flags(other), want) {
+		t.Errorf("Wanted %v but got %v", want, mailbox.Flags(other))
+	}
+}
+
+func TestSenderPolicy(t *testing.T) {
+	policy, err := NewSenderPolicy([]string{"*.example.com", "Boss@example.org"}, []string{"spam.example.com", "noreply-*@example.org"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for from, want := range map[string]bool{
+		"someone@mail.example.com":    true,
+		"someone@spam.example.com":    false,
+		"someone@example.com":         false,
+		"The Boss <boss@EXAMPLE.org>": true,
+		"other@example.org":           false,
+		"not an address":              false,
+	} {
+		msg, err := imap.Parse(imap.Message{Body: []byte("From: " + from + "\r\nSubject: hi\r\n\r\nbody")})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if allowed := policy.Allowed(msg); allowed != want {
+			t.Errorf("%v: wanted %v, got %v", from, want, allowed)
+		}
+	}
+	deny, err := NewSenderPolicy(nil, []string{"noreply-*@example.org", "j.doe@gmail.com"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for from, want := range map[string]bool{
+		"noreply-alerts@example.org": false,
+		"someone@example.org":        true,
+		"not an address":             true,
+		"jdoe+lists@googlemail.com":  false,
+		"jane.doe@gmail.com":         true,
+	} {
+		msg, err := imap.Parse(imap.Message{Body: []byte("From: " + from + "\r\nSubject: hi\r\n\r\nbody")})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if allowed := deny.Allowed(msg); allowed != want {
+			t.Errorf("%v: wanted %v, got %v", from, want, allowed)
+		}
+	}
+	if _, err := NewSenderPolicy([]string{"[example.com"}, nil); err == nil {
+		t.Errorf("Wanted an invalid pattern to fail")
+	}
+}
@@ -0,0 +1,25 @@
+// Package simulate makes gmail clients that keep their inbox in memory instead of connecting to Gmail, to let
+// applications test their mail handlers without network access.
+//
+//	client := simulate.New("user@gmail.com").MailHandler(handler)
+//	if _, err := client.Start(); err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	err := client.InjectMail(imap.Message{Body: []byte("From: friend@example.com\r\nSubject: hi\r\n\r\nbody")})
+package simulate
+
+import (
+	"github.com/zond/gmail"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+// Inbox returns a new empty inbox to simulate clients with, see gmail.Client#Simulate.
+func Inbox() gmail.Simulator {
+	return imaptest.New()
+}
+
+// New returns a client for account with a new simulated inbox.
+func New(account string) *gmail.Client {
+	return gmail.New(account, "").Simulate(Inbox())
+}
@@ -0,0 +1,25 @@
+package simulate
+
+import (
+	"testing"
+
+	"github.com/zond/gmail/imap"
+)
+
+func TestNew(t *testing.T) {
+	subjects := []string{}
+	c, err := New("user@example.com").MailHandler(func(msg *imap.Mail) error {
+		subjects = append(subjects, msg.GetHeader("Subject"))
+		return nil
+	}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.InjectMail(imap.Message{Body: []byte("From: friend@example.com\r\nSubject: hello\r\n\r\nbody")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(subjects) != 1 || subjects[0] != "hello" {
+		t.Errorf("Wanted the injected mail handled, got %v", subjects)
+	}
+}
@@ -0,0 +1,34 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/zond/gmail/imap"
+)
+
+// Desktop shows new mail as a desktop notification from app, with the sender as title and the subject and snippet as
+// text. It uses notify-send (D-Bus) on Linux and other unixes, osascript on macOS, and a PowerShell toast on Windows.
+func Desktop(app string) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		title := msg.GetHeader("From")
+		body := strings.TrimSpace(msg.GetHeader("Subject") + "\n" + snippet(msg))
+		name, args, env := desktopCommand(app, title, body)
+		ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = append(os.Environ(), env...)
+		output := &bytes.Buffer{}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		if err = cmd.Run(); err != nil {
+			err = fmt.Errorf("%v: %v: %s", name, err, bytes.TrimSpace(output.Bytes()))
+			return
+		}
+		return
+	}
+}
@@ -0,0 +1,10 @@
+package sinks
+
+// The texts are passed as arguments to avoid quoting them in AppleScript.
+const desktopScript = `on run argv
+display notification (item 3 of argv) with title (item 1 of argv) subtitle (item 2 of argv)
+end run`
+
+func desktopCommand(app, title, body string) (name string, args []string, env []string) {
+	return "osascript", []string{"-e", desktopScript, app, title, body}, nil
+}
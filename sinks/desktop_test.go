@@ -0,0 +1,33 @@
+//go:build !darwin && !windows
+
+package sinks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestDesktop(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > " + out + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "notify-send"), []byte(script), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	if err := Desktop("gmail")(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if want := "--app-name=gmail\n--\na@example.com\nhi\nbody\n"; string(b) != want {
+		t.Errorf("Wanted %#v but got %#v", want, string(b))
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !darwin && !windows
+
+package sinks
+
+func desktopCommand(app, title, body string) (name string, args []string, env []string) {
+	return "notify-send", []string{"--app-name=" + app, "--", title, body}, nil
+}
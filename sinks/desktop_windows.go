@@ -0,0 +1,23 @@
+package sinks
+
+// DesktopAppID is the AppUserModelID the Windows toasts are shown as. It has to belong to an installed app, so it
+// defaults to PowerShell.
+var DesktopAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// The texts are passed in the environment to avoid quoting them in PowerShell.
+const desktopScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText04)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:GMAIL_TOAST_APP)) | Out-Null
+$text.Item(1).AppendChild($template.CreateTextNode($env:GMAIL_TOAST_TITLE)) | Out-Null
+$text.Item(2).AppendChild($template.CreateTextNode($env:GMAIL_TOAST_BODY)) | Out-Null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:GMAIL_TOAST_ID).Show([Windows.UI.Notifications.ToastNotification]::new($template))`
+
+func desktopCommand(app, title, body string) (name string, args []string, env []string) {
+	return "powershell.exe", []string{"-NoProfile", "-NonInteractive", "-Command", desktopScript}, []string{
+		"GMAIL_TOAST_ID=" + DesktopAppID,
+		"GMAIL_TOAST_APP=" + app,
+		"GMAIL_TOAST_TITLE=" + title,
+		"GMAIL_TOAST_BODY=" + body,
+	}
+}
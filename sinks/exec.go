@@ -0,0 +1,44 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+var CommandTimeout = time.Minute
+
+// Exec runs the command for each new mail, with the Notification as JSON on stdin and
+// GMAIL_FROM, GMAIL_SUBJECT and GMAIL_UID in the environment. A non zero exit status fails the handler.
+func Exec(name string, args ...string) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		notification := NewNotification(msg)
+		input, err := json.Marshal(notification)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdin = bytes.NewReader(append(input, '\n'))
+		cmd.Env = append(os.Environ(),
+			"GMAIL_FROM="+notification.From,
+			"GMAIL_SUBJECT="+notification.Subject,
+			fmt.Sprintf("GMAIL_UID=%v", notification.UID),
+		)
+		output := &bytes.Buffer{}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		if err = cmd.Run(); err != nil {
+			err = fmt.Errorf("%v: %v: %s", name, err, bytes.TrimSpace(output.Bytes()))
+			return
+		}
+		return
+	}
+}
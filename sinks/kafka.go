@@ -0,0 +1,322 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+)
+
+var errKafkaShort = errors.New("kafka: short response")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaError is a Kafka error code returned by a broker, see the protocol guide for their meaning.
+type KafkaError struct {
+	Topic     string
+	Partition int32
+	Code      int16
+}
+
+func (self KafkaError) Error() string {
+	return fmt.Sprintf("kafka: error code %v for partition %v of %v", self.Code, self.Partition, self.Topic)
+}
+
+// Kafka is a minimal Publisher for Kafka brokers from version 1.0, without TLS or SASL. It produces each message
+// without a key to the partitions of the topic in turn, and waits for all in-sync replicas to acknowledge it. It looks
+// up the partition leaders when needed, and connects to them again after errors.
+type Kafka struct {
+	lock        sync.Mutex
+	url         *url.URL
+	conns       map[string]*kafkaConn
+	leaders     map[string][]string // the address of the leader of each partition, by topic
+	next        int
+	correlation int32
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewKafka takes a kafka://host[:port] URL of a bootstrap broker.
+func NewKafka(rawurl string) (result *Kafka, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "kafka" {
+		err = fmt.Errorf("unsupported Kafka URL scheme %q", u.Scheme)
+		return
+	}
+	result = &Kafka{
+		url:     u,
+		conns:   map[string]*kafkaConn{},
+		leaders: map[string][]string{},
+	}
+	return
+}
+
+func kafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// kafkaReader decodes a response, remembering the first error so that it only has to be checked at the end.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (self *kafkaReader) take(n int) (result []byte) {
+	if self.err == nil && (n < 0 || len(self.b) < n) {
+		self.err = errKafkaShort
+	}
+	if self.err != nil {
+		return make([]byte, 8)
+	}
+	result, self.b = self.b[:n], self.b[n:]
+	return
+}
+
+func (self *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(self.take(2)))
+}
+
+func (self *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(self.take(4)))
+}
+
+func (self *kafkaReader) int64() int64 {
+	return int64(binary.BigEndian.Uint64(self.take(8)))
+}
+
+// string reads a string, or a nullable string, which is empty when null.
+func (self *kafkaReader) string() string {
+	l := self.int16()
+	if l == -1 {
+		return ""
+	}
+	return string(self.take(int(l)))
+}
+
+// array reads the length of an array, and calls f for each element until an error occurs.
+func (self *kafkaReader) array(f func()) {
+	for n := self.int32(); n > 0 && self.err == nil; n-- {
+		f()
+	}
+}
+
+// roundTrip sends a request to the broker at addr, connecting to it if needed, and returns the body of the response.
+func (self *Kafka) roundTrip(addr string, apiKey, version int16, body []byte) (result *kafkaReader, err error) {
+	c, found := self.conns[addr]
+	if !found {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", addr, NetworkTimeout); err != nil {
+			return
+		}
+		c = &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+		self.conns[addr] = c
+	}
+	c.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	self.correlation++
+	header := binary.BigEndian.AppendUint16(nil, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(version))
+	header = binary.BigEndian.AppendUint32(header, uint32(self.correlation))
+	header = kafkaString(header, "github.com/zond/gmail")
+	request := binary.BigEndian.AppendUint32(nil, uint32(len(header)+len(body)))
+	if _, err = c.conn.Write(append(append(request, header...), body...)); err != nil {
+		return
+	}
+	size := make([]byte, 4)
+	if _, err = io.ReadFull(c.r, size); err != nil {
+		return
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err = io.ReadFull(c.r, response); err != nil {
+		return
+	}
+	result = &kafkaReader{b: response}
+	if correlation := result.int32(); result.err == nil && correlation != self.correlation {
+		err = fmt.Errorf("kafka: got the response to request %v instead of %v", correlation, self.correlation)
+	}
+	return
+}
+
+// lookup asks the bootstrap broker for the leaders of the partitions of topic, using Metadata version 4.
+func (self *Kafka) lookup(topic string) (leaders []string, err error) {
+	addr := self.url.Host
+	if self.url.Port() == "" {
+		addr = net.JoinHostPort(self.url.Hostname(), "9092")
+	}
+	body := binary.BigEndian.AppendUint32(nil, 1)
+	body = kafkaString(body, topic)
+	// Let the broker create the topic, if it is configured to.
+	body = append(body, 1)
+	r, err := self.roundTrip(addr, kafkaMetadata, 4, body)
+	if err != nil {
+		return
+	}
+	r.int32() // throttle time
+	brokers := map[int32]string{}
+	r.array(func() {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	})
+	r.string() // cluster id
+	r.int32()  // controller id
+	partitions := map[int32]int32{}
+	r.array(func() {
+		code, name := r.int16(), r.string()
+		r.take(1) // is internal
+		r.array(func() {
+			partitionCode, partition, leader := r.int16(), r.int32(), r.int32()
+			r.array(func() { r.int32() }) // replicas
+			r.array(func() { r.int32() }) // in-sync replicas
+			if name != topic {
+				return
+			}
+			if code == 0 {
+				code = partitionCode
+			}
+			if err == nil && code != 0 {
+				err = KafkaError{Topic: topic, Partition: partition, Code: code}
+			}
+			partitions[partition] = leader
+		})
+		if err == nil && name == topic && code != 0 {
+			err = KafkaError{Topic: topic, Partition: -1, Code: code}
+		}
+	})
+	if r.err != nil {
+		err = r.err
+	}
+	if err != nil {
+		return
+	}
+	for partition := int32(0); partition < int32(len(partitions)); partition++ {
+		leader, found := partitions[partition]
+		if !found || brokers[leader] == "" {
+			err = fmt.Errorf("kafka: no leader for partition %v of %v", partition, topic)
+			return
+		}
+		leaders = append(leaders, brokers[leader])
+	}
+	if len(leaders) == 0 {
+		err = fmt.Errorf("kafka: no partitions for %v", topic)
+	}
+	return
+}
+
+// recordBatch encodes payload as the value of a single record without key, in a record batch of magic version 2.
+func recordBatch(payload []byte, at time.Time) (result []byte) {
+	record := []byte{0}                      // attributes
+	record = binary.AppendVarint(record, 0)  // timestamp delta
+	record = binary.AppendVarint(record, 0)  // offset delta
+	record = binary.AppendVarint(record, -1) // null key
+	record = binary.AppendVarint(record, int64(len(payload)))
+	record = append(record, payload...)
+	record = binary.AppendVarint(record, 0) // headers
+	// checked is the part of the batch covered by its CRC.
+	checked := binary.BigEndian.AppendUint16(nil, 0) // attributes
+	checked = binary.BigEndian.AppendUint32(checked, 0)
+	checked = binary.BigEndian.AppendUint64(checked, uint64(at.UnixMilli()))
+	checked = binary.BigEndian.AppendUint64(checked, uint64(at.UnixMilli()))
+	// No producer id, epoch or sequence, since the producer isn't idempotent.
+	checked = binary.BigEndian.AppendUint64(checked, ^uint64(0))
+	checked = binary.BigEndian.AppendUint16(checked, ^uint16(0))
+	checked = binary.BigEndian.AppendUint32(checked, ^uint32(0))
+	checked = binary.BigEndian.AppendUint32(checked, 1)
+	checked = binary.AppendVarint(checked, int64(len(record)))
+	checked = append(checked, record...)
+	result = binary.BigEndian.AppendUint64(nil, 0) // base offset
+	result = binary.BigEndian.AppendUint32(result, uint32(4+1+4+len(checked)))
+	result = binary.BigEndian.AppendUint32(result, ^uint32(0)) // partition leader epoch
+	result = append(result, 2)                                 // magic
+	result = binary.BigEndian.AppendUint32(result, crc32.Checksum(checked, castagnoli))
+	return append(result, checked...)
+}
+
+// Publish produces payload to the next partition of topic in turn, using Produce version 3.
+func (self *Kafka) Publish(topic string, payload []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer func() {
+		if err != nil {
+			self.close()
+		}
+	}()
+	leaders, found := self.leaders[topic]
+	if !found {
+		if leaders, err = self.lookup(topic); err != nil {
+			return
+		}
+		self.leaders[topic] = leaders
+	}
+	partition := int32(self.next % len(leaders))
+	self.next++
+	batch := recordBatch(payload, time.Now())
+	body := binary.BigEndian.AppendUint16(nil, ^uint16(0)) // no transactional id
+	body = binary.BigEndian.AppendUint16(body, ^uint16(0)) // acks from all in-sync replicas
+	body = binary.BigEndian.AppendUint32(body, uint32(NetworkTimeout/time.Millisecond))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = kafkaString(body, topic)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, uint32(partition))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+	r, err := self.roundTrip(leaders[partition], kafkaProduce, 3, append(body, batch...))
+	if err != nil {
+		return
+	}
+	acknowledged := false
+	r.array(func() {
+		r.string() // topic
+		r.array(func() {
+			index, code := r.int32(), r.int16()
+			r.int64() // base offset
+			r.int64() // log append time
+			if index != partition {
+				return
+			}
+			if code != 0 && err == nil {
+				err = KafkaError{Topic: topic, Partition: partition, Code: code}
+			}
+			acknowledged = true
+		})
+	})
+	if r.err != nil {
+		err = r.err
+	} else if err == nil && !acknowledged {
+		err = fmt.Errorf("kafka: no acknowledgement for partition %v of %v", partition, topic)
+	}
+	return
+}
+
+// close closes all connections and forgets the leaders, to look them up again.
+func (self *Kafka) close() {
+	for addr, c := range self.conns {
+		c.conn.Close()
+		delete(self.conns, addr)
+	}
+	self.leaders = map[string][]string{}
+}
+
+func (self *Kafka) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.close()
+	return nil
+}
@@ -0,0 +1,222 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+type produced struct {
+	topic     string
+	partition int32
+	value     string
+}
+
+// kafkaBroker is a single broker leading both partitions of every topic. It answers the first produce requests with
+// the error codes in failures.
+type kafkaBroker struct {
+	t        *testing.T
+	listener net.Listener
+	lock     sync.Mutex
+	lookups  int
+	failures []int16
+	produced chan produced
+}
+
+func newKafkaBroker(t *testing.T) (result *kafkaBroker) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	result = &kafkaBroker{
+		t:        t,
+		listener: l,
+		produced: make(chan produced, 10),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go result.serve(conn)
+		}
+	}()
+	return
+}
+
+func (self *kafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(r, request); err != nil {
+			return
+		}
+		req := &kafkaReader{b: request}
+		apiKey, version, correlation := req.int16(), req.int16(), req.int32()
+		req.string() // client id
+		rsp := binary.BigEndian.AppendUint32(nil, uint32(correlation))
+		switch {
+		case apiKey == kafkaMetadata && version == 4:
+			rsp = self.metadata(req, rsp)
+		case apiKey == kafkaProduce && version == 3:
+			rsp = self.produce(req, rsp)
+		default:
+			self.t.Errorf("Unexpected request %v version %v", apiKey, version)
+			return
+		}
+		if req.err != nil {
+			self.t.Errorf("%v", req.err)
+			return
+		}
+		conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(rsp))), rsp...))
+	}
+}
+
+func (self *kafkaBroker) metadata(req *kafkaReader, rsp []byte) []byte {
+	self.lock.Lock()
+	self.lookups++
+	self.lock.Unlock()
+	topics := []string{}
+	req.array(func() {
+		topics = append(topics, req.string())
+	})
+	host, port, _ := net.SplitHostPort(self.listener.Addr().String())
+	numeric, _ := strconv.Atoi(port)
+	rsp = binary.BigEndian.AppendUint32(rsp, 0) // throttle time
+	rsp = binary.BigEndian.AppendUint32(rsp, 1)
+	rsp = binary.BigEndian.AppendUint32(rsp, 7)
+	rsp = kafkaString(rsp, host)
+	rsp = binary.BigEndian.AppendUint32(rsp, uint32(numeric))
+	rsp = binary.BigEndian.AppendUint16(rsp, ^uint16(0)) // no rack
+	rsp = kafkaString(rsp, "cluster")
+	rsp = binary.BigEndian.AppendUint32(rsp, 7)
+	rsp = binary.BigEndian.AppendUint32(rsp, uint32(len(topics)))
+	for _, topic := range topics {
+		rsp = binary.BigEndian.AppendUint16(rsp, 0)
+		rsp = kafkaString(rsp, topic)
+		rsp = append(rsp, 0)
+		rsp = binary.BigEndian.AppendUint32(rsp, 2)
+		// The partitions are listed out of order, like brokers may.
+		for _, partition := range []uint32{1, 0} {
+			rsp = binary.BigEndian.AppendUint16(rsp, 0)
+			rsp = binary.BigEndian.AppendUint32(rsp, partition)
+			rsp = binary.BigEndian.AppendUint32(rsp, 7)
+			rsp = binary.BigEndian.AppendUint32(rsp, 1)
+			rsp = binary.BigEndian.AppendUint32(rsp, 7)
+			rsp = binary.BigEndian.AppendUint32(rsp, 1)
+			rsp = binary.BigEndian.AppendUint32(rsp, 7)
+		}
+	}
+	return rsp
+}
+
+func (self *kafkaBroker) produce(req *kafkaReader, rsp []byte) []byte {
+	if transactional := req.int16(); transactional != -1 {
+		self.t.Errorf("Wanted no transactional id, got %v", transactional)
+	}
+	if acks := req.int16(); acks != -1 {
+		self.t.Errorf("Wanted acks from all replicas, got %v", acks)
+	}
+	req.int32() // timeout
+	var got produced
+	req.array(func() {
+		got.topic = req.string()
+		req.array(func() {
+			got.partition = req.int32()
+			batch := &kafkaReader{b: req.take(int(req.int32()))}
+			batch.int64() // base offset
+			if length := batch.int32(); int(length) != len(batch.b) {
+				self.t.Errorf("Wanted the batch length %v, got %v", len(batch.b), length)
+			}
+			batch.int32() // partition leader epoch
+			if magic := batch.take(1)[0]; magic != 2 {
+				self.t.Errorf("Wanted magic 2, got %v", magic)
+			}
+			if crc := uint32(batch.int32()); crc != crc32.Checksum(batch.b, crc32.MakeTable(crc32.Castagnoli)) {
+				self.t.Errorf("Wrong CRC %x", crc)
+			}
+			batch.take(2 + 4 + 8 + 8 + 8 + 2 + 4) // attributes to base sequence
+			if records := batch.int32(); records != 1 {
+				self.t.Errorf("Wanted 1 record, got %v", records)
+			}
+			record := batch.b
+			varint := func() int64 {
+				v, n := binary.Varint(record)
+				record = record[n:]
+				return v
+			}
+			if length := varint(); int(length) != len(record) {
+				self.t.Errorf("Wanted the record length %v, got %v", len(record), length)
+			}
+			record = record[1:] // attributes
+			varint()            // timestamp delta
+			varint()            // offset delta
+			if key := varint(); key != -1 {
+				self.t.Errorf("Wanted no key, got %v", key)
+			}
+			value := int(varint())
+			got.value = string(record[:value])
+		})
+	})
+	self.lock.Lock()
+	code := int16(0)
+	if len(self.failures) > 0 {
+		code, self.failures = self.failures[0], self.failures[1:]
+	}
+	self.lock.Unlock()
+	if code == 0 {
+		self.produced <- got
+	}
+	rsp = binary.BigEndian.AppendUint32(rsp, 1)
+	rsp = kafkaString(rsp, got.topic)
+	rsp = binary.BigEndian.AppendUint32(rsp, 1)
+	rsp = binary.BigEndian.AppendUint32(rsp, uint32(got.partition))
+	rsp = binary.BigEndian.AppendUint16(rsp, uint16(code))
+	rsp = binary.BigEndian.AppendUint64(rsp, 0)
+	rsp = binary.BigEndian.AppendUint64(rsp, ^uint64(0))
+	return binary.BigEndian.AppendUint32(rsp, 0) // throttle time
+}
+
+func TestKafka(t *testing.T) {
+	broker := newKafkaBroker(t)
+	// NOT_LEADER_OR_FOLLOWER, like after the leader moved.
+	broker.failures = []int16{6}
+	publisher, err := NewKafka("kafka://" + broker.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer publisher.Close()
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	if err, ok := Publish(publisher, "mail.new")(msg).(KafkaError); !ok || err.Code != 6 {
+		t.Fatalf("Wanted the error code of the broker, got %v", err)
+	}
+	for _, partition := range []int32{1, 0} {
+		if err := Publish(publisher, "mail.new")(msg); err != nil {
+			t.Fatalf("%v", err)
+		}
+		got := <-broker.produced
+		if got.topic != "mail.new" || got.partition != partition || !strings.Contains(got.value, `"subject":"hi"`) {
+			t.Errorf("Unexpected record %+v in partition %v", got, partition)
+		}
+	}
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.lookups != 2 {
+		t.Errorf("Wanted the leaders looked up again after the error, got %v lookups", broker.lookups)
+	}
+}
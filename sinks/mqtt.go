@@ -0,0 +1,224 @@
+package sinks
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttPubrec     = 0x50
+	mqttPubrel     = 0x62
+	mqttPubcomp    = 0x70
+	mqttDisconnect = 0xe0
+)
+
+// MQTT is a minimal MQTT 3.1.1 Publisher. It connects when needed, and reconnects after errors.
+type MQTT struct {
+	// QoS is the quality of service level, 0, 1 or 2, used for publishing.
+	QoS byte
+	// Retain makes the broker keep the last message for new subscribers.
+	Retain   bool
+	ClientID string
+
+	lock     sync.Mutex
+	url      *url.URL
+	conn     net.Conn
+	r        *bufio.Reader
+	packetId uint16
+}
+
+// NewMQTT takes a mqtt://[user:password@]host[:port] or mqtts:// URL.
+func NewMQTT(rawurl string) (result *MQTT, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		err = fmt.Errorf("unsupported MQTT URL scheme %q", u.Scheme)
+		return
+	}
+	result = &MQTT{
+		url:      u,
+		ClientID: fmt.Sprintf("gmail-%d", time.Now().UnixNano()),
+	}
+	return
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func (self *MQTT) write(header byte, body []byte) (err error) {
+	packet := []byte{header}
+	for l := len(body); ; {
+		digit := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if l == 0 {
+			break
+		}
+	}
+	_, err = self.conn.Write(append(packet, body...))
+	return
+}
+
+func (self *MQTT) read() (header byte, body []byte, err error) {
+	if header, err = self.r.ReadByte(); err != nil {
+		return
+	}
+	l, multiplier := 0, 1
+	for {
+		var digit byte
+		if digit, err = self.r.ReadByte(); err != nil {
+			return
+		}
+		l += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, l)
+	_, err = io.ReadFull(self.r, body)
+	return
+}
+
+// expect reads packets until one with the given header (and packet id, if any) arrives.
+func (self *MQTT) expect(header byte, packetId uint16) (body []byte, err error) {
+	for {
+		var got byte
+		if got, body, err = self.read(); err != nil {
+			return
+		}
+		if got == header && (packetId == 0 || (len(body) >= 2 && binary.BigEndian.Uint16(body) == packetId)) {
+			return
+		}
+	}
+}
+
+func (self *MQTT) connect() (err error) {
+	addr := self.url.Host
+	if self.url.Port() == "" {
+		if self.url.Scheme == "mqtts" {
+			addr = net.JoinHostPort(self.url.Hostname(), "8883")
+		} else {
+			addr = net.JoinHostPort(self.url.Hostname(), "1883")
+		}
+	}
+	if self.conn, err = net.DialTimeout("tcp", addr, NetworkTimeout); err != nil {
+		return
+	}
+	if self.url.Scheme == "mqtts" {
+		self.conn = tls.Client(self.conn, &tls.Config{
+			ServerName: self.url.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+	}
+	self.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	self.r = bufio.NewReader(self.conn)
+	// Clean session, and keep alive disabled since we only connect to publish.
+	flags := byte(0x02)
+	payload := mqttString(self.ClientID)
+	if self.url.User != nil {
+		flags |= 0x80
+		payload = append(payload, mqttString(self.url.User.Username())...)
+		if password, found := self.url.User.Password(); found {
+			flags |= 0x40
+			payload = append(payload, mqttString(password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	if err = self.write(mqttConnect, append(body, payload...)); err != nil {
+		return
+	}
+	ack, err := self.expect(mqttConnack, 0)
+	if err != nil {
+		return
+	}
+	if len(ack) != 2 || ack[1] != 0 {
+		err = fmt.Errorf("mqtt: connection refused: %v", ack)
+		return
+	}
+	return
+}
+
+func (self *MQTT) Publish(topic string, payload []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer func() {
+		if err != nil {
+			self.close()
+		}
+	}()
+	if self.QoS > 2 {
+		err = fmt.Errorf("mqtt: invalid QoS %v", self.QoS)
+		return
+	}
+	if self.conn == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+	}
+	self.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	header := byte(mqttPublish) | self.QoS<<1
+	if self.Retain {
+		header |= 0x01
+	}
+	body := mqttString(topic)
+	var packetId uint16
+	if self.QoS > 0 {
+		self.packetId++
+		if self.packetId == 0 {
+			self.packetId = 1
+		}
+		packetId = self.packetId
+		body = binary.BigEndian.AppendUint16(body, packetId)
+	}
+	if err = self.write(header, append(body, payload...)); err != nil {
+		return
+	}
+	switch self.QoS {
+	case 1:
+		_, err = self.expect(mqttPuback, packetId)
+	case 2:
+		if _, err = self.expect(mqttPubrec, packetId); err != nil {
+			return
+		}
+		if err = self.write(mqttPubrel, binary.BigEndian.AppendUint16(nil, packetId)); err != nil {
+			return
+		}
+		_, err = self.expect(mqttPubcomp, packetId)
+	}
+	return
+}
+
+func (self *MQTT) close() {
+	if self.conn != nil {
+		self.write(mqttDisconnect, nil)
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+func (self *MQTT) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.close()
+	return nil
+}
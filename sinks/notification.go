@@ -0,0 +1,86 @@
+package sinks
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+// Notification is the summary of a new mail that sinks send on.
+// It is encoded as JSON with the fields uid, gmail_id, thread_id, from, to, subject, date (RFC 3339), snippet, link
+// and priority.
+type Notification struct {
+	UID      uint32    `json:"uid"`
+	GmailID  uint64    `json:"gmail_id,omitempty"`
+	ThreadID uint64    `json:"thread_id,omitempty"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Subject  string    `json:"subject"`
+	Date     time.Time `json:"date"`
+	Snippet  string    `json:"snippet"`
+	Link     string    `json:"link,omitempty"`
+	// Priority is the imap.Priority, like "urgent", so that consumers can route urgent mail differently.
+	Priority imap.Priority `json:"priority"`
+}
+
+func NewNotification(msg *imap.Mail) Notification {
+	return Notification{
+		UID:      msg.UID,
+		GmailID:  msg.GmailID,
+		ThreadID: msg.ThreadID,
+		From:     msg.GetHeader("From"),
+		To:       msg.GetHeader("To"),
+		Subject:  msg.GetHeader("Subject"),
+		Date:     msg.InternalDate,
+		Snippet:  snippet(msg),
+		Link:     msg.Link(),
+		Priority: msg.Priority,
+	}
+}
+
+// Mail rebuilds a message with the headers, snippet and ids of the notification, to send it through the sinks again.
+// The text of the message is the snippet, and it has no attachments.
+func (self Notification) Mail() (result *imap.Mail, err error) {
+	header := func(value string) string {
+		return mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+	}
+	body := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nDate: %v\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v",
+		header(self.From), header(self.To), header(self.Subject), self.Date.Format(time.RFC1123Z), self.Snippet)
+	if result, err = imap.Parse(imap.Message{
+		UID:          self.UID,
+		GmailID:      self.GmailID,
+		ThreadID:     self.ThreadID,
+		InternalDate: self.Date,
+		Body:         []byte(body),
+	}); err != nil {
+		return
+	}
+	result.Snippet = self.Snippet
+	result.Priority = self.Priority
+	return
+}
+
+// ErrorEvent is an error reported by a client, encoded as JSON with the fields time (RFC 3339) and error.
+type ErrorEvent struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+func NewErrorEvent(err error) ErrorEvent {
+	return ErrorEvent{
+		Time:  time.Now(),
+		Error: err.Error(),
+	}
+}
+
+// snippet shortens msg.Snippet further if SnippetLength is shorter than imap.SnippetLength.
+func snippet(msg *imap.Mail) string {
+	text := strings.TrimSuffix(msg.Snippet, "…")
+	if runes := []rune(text); len(runes) > SnippetLength {
+		return string(runes[:SnippetLength]) + "…"
+	}
+	return msg.Snippet
+}
@@ -0,0 +1,137 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+// Publisher is the small part of a message broker client needed to publish notifications, like a NATS connection
+// or a Kafka producer.
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+type PublisherFunc func(topic string, payload []byte) error
+
+func (self PublisherFunc) Publish(topic string, payload []byte) error {
+	return self(topic, payload)
+}
+
+// Publish publishes the Notification of each new mail as JSON to the topic.
+func Publish(publisher Publisher, topic string) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		payload, err := json.Marshal(NewNotification(msg))
+		if err != nil {
+			return
+		}
+		return publisher.Publish(topic, payload)
+	}
+}
+
+var NetworkTimeout = 30 * time.Second
+
+// NATS is a minimal Publisher for NATS servers, waiting for the server to acknowledge each message with a PONG.
+// It connects when needed, and reconnects after errors.
+type NATS struct {
+	lock sync.Mutex
+	url  *url.URL
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATS takes a nats://[user:password@]host[:port] URL.
+func NewNATS(rawurl string) (result *NATS, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	result = &NATS{
+		url: u,
+	}
+	return
+}
+
+func (self *NATS) connect() (err error) {
+	addr := self.url.Host
+	if self.url.Port() == "" {
+		addr = net.JoinHostPort(self.url.Hostname(), "4222")
+	}
+	if self.conn, err = net.DialTimeout("tcp", addr, NetworkTimeout); err != nil {
+		return
+	}
+	self.r = bufio.NewReader(self.conn)
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "github.com/zond/gmail",
+	}
+	if self.url.User != nil {
+		options["user"] = self.url.User.Username()
+		options["pass"], _ = self.url.User.Password()
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(self.conn, "CONNECT %s\r\n", b)
+	return
+}
+
+func (self *NATS) Publish(topic string, payload []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer func() {
+		if err != nil {
+			self.close()
+		}
+	}()
+	if self.conn == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+	}
+	self.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	if _, err = fmt.Fprintf(self.conn, "PUB %v %v\r\n%s\r\nPING\r\n", topic, len(payload), payload); err != nil {
+		return
+	}
+	for {
+		var line string
+		if line, err = self.r.ReadString('\n'); err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return
+		case line == "PING":
+			if _, err = fmt.Fprintf(self.conn, "PONG\r\n"); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			err = fmt.Errorf("nats: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+			return
+		}
+	}
+}
+
+func (self *NATS) close() {
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+func (self *NATS) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.close()
+	return nil
+}
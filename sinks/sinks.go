@@ -0,0 +1,85 @@
+// Package sinks contains imap.MailHandlers that forward new mail to other services.
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+// SnippetLength limits the snippets sent by the sinks further, when shorter than imap.SnippetLength.
+var SnippetLength = 200
+
+var HTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// All returns a handler that calls all handlers, and fails if any of them fails.
+func All(handlers ...imap.MailHandler) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		for _, handler := range handlers {
+			if e := handler(msg); e != nil && err == nil {
+				err = e
+			}
+		}
+		return
+	}
+}
+
+func postJSON(url string, payload interface{}) (err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	rsp, err := HTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		err = fmt.Errorf("%v returned %v: %s", url, rsp.Status, msg)
+		return
+	}
+	return
+}
+
+// Slack posts new mail to a Slack incoming webhook.
+func Slack(webhook string) imap.MailHandler {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	return func(msg *imap.Mail) error {
+		subject := escape.Replace(msg.GetHeader("Subject"))
+		if link := msg.Link(); link != "" {
+			subject = fmt.Sprintf("<%v|%v>", link, subject)
+		}
+		return postJSON(webhook, map[string]interface{}{
+			"text": fmt.Sprintf("*From:* %v\n*Subject:* %v\n%v", escape.Replace(msg.GetHeader("From")), subject, escape.Replace(snippet(msg))),
+		})
+	}
+}
+
+// Discord posts new mail to a Discord webhook.
+func Discord(webhook string) imap.MailHandler {
+	return func(msg *imap.Mail) error {
+		embed := map[string]interface{}{
+			"title":       msg.GetHeader("Subject"),
+			"description": snippet(msg),
+			"author": map[string]string{
+				"name": msg.GetHeader("From"),
+			},
+		}
+		if link := msg.Link(); link != "" {
+			embed["url"] = link
+		}
+		return postJSON(webhook, map[string]interface{}{
+			"embeds": []interface{}{embed},
+		})
+	}
+}
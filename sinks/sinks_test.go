@@ -0,0 +1,189 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func capture(t *testing.T, status int) (server *httptest.Server, payloads chan map[string]interface{}) {
+	payloads = make(chan map[string]interface{}, 1)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("%v", err)
+		}
+		payloads <- payload
+		w.WriteHeader(status)
+	}))
+	return
+}
+
+func TestSlack(t *testing.T) {
+	server, payloads := capture(t, http.StatusOK)
+	defer server.Close()
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: <hi>\r\n\r\nbody")
+	if err := Slack(server.URL)(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	text := (<-payloads)["text"].(string)
+	if !strings.Contains(text, "a@example.com") || !strings.Contains(text, "&lt;hi&gt;") || !strings.Contains(text, msg.Link()) {
+		t.Errorf("Unexpected text %#v", text)
+	}
+}
+
+func TestDiscordFailure(t *testing.T) {
+	server, payloads := capture(t, http.StatusTooManyRequests)
+	defer server.Close()
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	if err := Discord(server.URL)(msg); err == nil {
+		t.Errorf("Wanted an error")
+	}
+	embed := (<-payloads)["embeds"].([]interface{})[0].(map[string]interface{})
+	if embed["title"] != "hi" || embed["url"] != msg.Link() {
+		t.Errorf("Unexpected embed %+v", embed)
+	}
+}
+
+func TestExec(t *testing.T) {
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	out := filepath.Join(t.TempDir(), "out")
+	if err := Exec("sh", "-c", `cat > "$0" && echo "$GMAIL_FROM|$GMAIL_SUBJECT|$GMAIL_UID" >> "$0"`, out)(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	notification := Notification{}
+	if err := json.Unmarshal([]byte(lines[0]), &notification); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if notification.Subject != "hi" || notification.UID != msg.UID {
+		t.Errorf("Unexpected notification %+v", notification)
+	}
+	if want := "a@example.com|hi|1"; lines[1] != want {
+		t.Errorf("Wanted %#v but got %#v", want, lines[1])
+	}
+	if err := Exec("sh", "-c", "echo broken >&2; exit 1")(msg); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Wanted an error containing the output, got %v", err)
+	}
+}
+
+func TestNATS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	published := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "CONNECT ") && !strings.Contains(line, `"pass":"secret"`):
+				fmt.Fprintf(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				published <- strings.Fields(line)[1] + " " + strings.TrimSpace(payload)
+			case line == "PING\r\n":
+				fmt.Fprintf(conn, "PONG\r\n")
+			}
+		}
+	}()
+	publisher, err := NewNATS("nats://user:secret@" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer publisher.Close()
+	msg := imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")
+	if err := Publish(publisher, "mail.new")(msg); err != nil {
+		t.Fatalf("%v", err)
+	}
+	got := <-published
+	if !strings.HasPrefix(got, "mail.new {") || !strings.Contains(got, `"subject":"hi"`) {
+		t.Errorf("Unexpected publication %#v", got)
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	publisher, err := NewMQTT("mqtt://user:secret@" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer publisher.Close()
+	publisher.QoS = 2
+	publisher.Retain = true
+	published := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		broker := &MQTT{conn: conn, r: bufio.NewReader(conn)}
+		if header, body, err := broker.read(); err != nil || header != mqttConnect || !strings.HasSuffix(string(body), "\x00\x04user\x00\x06secret") {
+			t.Errorf("Unexpected CONNECT %x %q %v", header, body, err)
+			return
+		}
+		broker.write(mqttConnack, []byte{0, 0})
+		header, body, err := broker.read()
+		if err != nil {
+			return
+		}
+		topicLen := int(body[0])<<8 | int(body[1])
+		topic := string(body[2 : 2+topicLen])
+		packetId := body[2+topicLen : 4+topicLen]
+		published <- fmt.Sprintf("%x %v %s", header, topic, body[4+topicLen:])
+		broker.write(mqttPubrec, packetId)
+		if header, body, err = broker.read(); err != nil || header != mqttPubrel || string(body) != string(packetId) {
+			t.Errorf("Unexpected PUBREL %x %q %v", header, body, err)
+			return
+		}
+		broker.write(mqttPubcomp, packetId)
+		broker.read()
+	}()
+	if err := publisher.Publish("home/mail", []byte("new")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, want := <-published, "35 home/mail new"; got != want {
+		t.Errorf("Wanted %#v but got %#v", want, got)
+	}
+}
+
+func TestNotificationMail(t *testing.T) {
+	notification := NewNotification(imaptest.Fetch(t, "From: a@example.com\r\nTo: b@example.com\r\nSubject: hello\r\n\r\nbody"))
+	msg, err := notification.Mail()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if again := NewNotification(msg); !reflect.DeepEqual(again, notification) {
+		t.Errorf("Wanted %+v, got %+v", notification, again)
+	}
+}
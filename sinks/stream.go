@@ -0,0 +1,237 @@
+package sinks
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Stream is an http.Handler streaming the Notifications of new mail to its clients, as Server-Sent Events or as
+// WebSocket text frames depending on what the client asks for.
+type Stream struct {
+	// Token, if set, has to be provided as a bearer token in the Authorization header, or as the token query parameter.
+	Token string
+	// Buffer is the number of notifications queued for each client before new ones are dropped for that client.
+	Buffer int
+	// Heartbeat is the interval between keep alive messages.
+	Heartbeat time.Duration
+	Clock     clock.Clock
+
+	lock        sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+func NewStream(token string) *Stream {
+	return &Stream{
+		Token:       token,
+		Buffer:      16,
+		Heartbeat:   30 * time.Second,
+		Clock:       clock.Real,
+		subscribers: map[chan []byte]bool{},
+	}
+}
+
+// Handler returns a handler sending new mail to all connected clients. It never fails.
+func (self *Stream) Handler() imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		payload, err := json.Marshal(NewNotification(msg))
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		for subscriber := range self.subscribers {
+			select {
+			case subscriber <- payload:
+			default:
+			}
+		}
+		return
+	}
+}
+
+func (self *Stream) subscribe() (result chan []byte) {
+	result = make(chan []byte, self.Buffer)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subscribers[result] = true
+	return
+}
+
+func (self *Stream) unsubscribe(c chan []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.subscribers, c)
+}
+
+func (self *Stream) authorized(r *http.Request) bool {
+	if self.Token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(self.Token)) == 1
+}
+
+func headerContains(r *http.Request, key, value string) bool {
+	for _, v := range strings.Split(r.Header.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !self.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if headerContains(r, "Connection", "upgrade") && headerContains(r, "Upgrade", "websocket") {
+		self.serveWebSocket(w, r)
+	} else {
+		self.serveEvents(w, r)
+	}
+}
+
+func (self *Stream) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c := self.subscribe()
+	defer self.unsubscribe(c)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		heartbeat := self.Clock.NewTimer(self.Heartbeat)
+		select {
+		case payload := <-c:
+			fmt.Fprintf(w, "event: mail\ndata: %s\n\n", payload)
+		case <-heartbeat.C():
+			fmt.Fprintf(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			heartbeat.Stop()
+			return
+		}
+		heartbeat.Stop()
+		flusher.Flush()
+	}
+}
+
+func (self *Stream) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err = rw.Flush(); err != nil {
+		return
+	}
+	c := self.subscribe()
+	defer self.unsubscribe(c)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		discardFrames(rw.Reader)
+	}()
+	for {
+		heartbeat := self.Clock.NewTimer(self.Heartbeat)
+		select {
+		case payload := <-c:
+			err = writeFrame(rw.Writer, 0x1, payload)
+		case <-heartbeat.C():
+			err = writeFrame(rw.Writer, 0x9, nil)
+		case <-closed:
+			writeFrame(rw.Writer, 0x8, nil)
+			heartbeat.Stop()
+			return
+		}
+		heartbeat.Stop()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeFrame(w *bufio.Writer, opcode byte, payload []byte) (err error) {
+	header := []byte{0x80 | opcode}
+	switch l := len(payload); {
+	case l < 126:
+		header = append(header, byte(l))
+	case l <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(l))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(l))
+	}
+	if _, err = w.Write(append(header, payload...)); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// discardFrames reads client frames until the connection fails or the client sends a close frame.
+func discardFrames(r *bufio.Reader) {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		if header[0]&0x0f == 0x8 {
+			return
+		}
+		l := uint64(header[1] & 0x7f)
+		switch l {
+		case 126:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			l = uint64(binary.BigEndian.Uint16(b))
+		case 127:
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			l = binary.BigEndian.Uint64(b)
+		}
+		if header[1]&0x80 != 0 {
+			l += 4
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(l)); err != nil {
+			return
+		}
+	}
+}
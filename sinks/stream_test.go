@@ -0,0 +1,98 @@
+package sinks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func waitForSubscribers(t *testing.T, stream *Stream, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		stream.lock.Lock()
+		count := len(stream.subscribers)
+		stream.lock.Unlock()
+		if count >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Wanted %v subscribers, got %v", n, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	stream := NewStream("secret")
+	server := httptest.NewServer(stream)
+	defer server.Close()
+	if rsp, err := http.Get(server.URL); err != nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Wanted 401, got %v %v", rsp, err)
+	}
+	rsp, err := http.Get(server.URL + "?token=secret")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rsp.Body.Close()
+	waitForSubscribers(t, stream, 1)
+	if err := stream.Handler()(imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	r := bufio.NewReader(rsp.Body)
+	event, _ := r.ReadString('\n')
+	data, _ := r.ReadString('\n')
+	if event != "event: mail\n" || !strings.HasPrefix(data, "data: {") || !strings.Contains(data, `"subject":"hi"`) {
+		t.Errorf("Unexpected event %#v %#v", event, data)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	stream := NewStream("secret")
+	server := httptest.NewServer(stream)
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nAuthorization: Bearer secret\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols || rsp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake response %+v", rsp)
+	}
+	waitForSubscribers(t, stream, 1)
+	if err := stream.Handler()(imaptest.Fetch(t, "From: a@example.com\r\nSubject: hi\r\n\r\nbody")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if header[0] != 0x81 {
+		t.Fatalf("Wanted a text frame, got %x", header)
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if header[1]&0x7f == 126 {
+		b := make([]byte, 2)
+		io.ReadFull(r, b)
+		payload = make([]byte, int(b[0])<<8|int(b[1]))
+	}
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(string(payload), `"subject":"hi"`) {
+		t.Errorf("Unexpected payload %s", payload)
+	}
+}
@@ -0,0 +1,199 @@
+// Package sqlstore keeps imap.Checkpoint and imap.Dedup state, and a log of deliveries to each sink, in a SQL database.
+//
+//	store := sqlstore.New(db, sqlstore.Postgres)
+//	err := store.CreateTables()
+//	client := imap.New(user, password).Checkpoint(store).Dedup(store)
+//	client.MailHandler(sinks.All(store.Log("slack", sinks.Slack(webhook)), store.Log("exec", sinks.Exec(command))))
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zond/gmail/imap"
+)
+
+// Dialect adapts the queries to a database.
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	MySQL
+	SQLite
+)
+
+// rebind replaces the ? placeholders with $1, $2... for Postgres.
+func (self Dialect) rebind(query string) string {
+	if self != Postgres {
+		return query
+	}
+	b := &strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(b, "$%v", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// upsert returns an insert into table, updating the given assignments if the keys already exist.
+// In the assignments, new.column is the inserted value and old.column the existing one.
+func (self Dialect) upsert(table string, keys []string, columns []string, assignments string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", table, strings.Join(columns, ", "), placeholders)
+	if self == MySQL {
+		assignments = replaceColumns(assignments, columns, "new.", "VALUES(%v)")
+		assignments = replaceColumns(assignments, columns, "old.", "%v")
+		return self.rebind(insert + " ON DUPLICATE KEY UPDATE " + assignments)
+	}
+	assignments = replaceColumns(assignments, columns, "new.", "excluded.%v")
+	assignments = replaceColumns(assignments, columns, "old.", table+".%v")
+	return self.rebind(fmt.Sprintf("%v ON CONFLICT (%v) DO UPDATE SET %v", insert, strings.Join(keys, ", "), assignments))
+}
+
+func replaceColumns(s string, columns []string, prefix, format string) string {
+	for _, column := range columns {
+		s = strings.Replace(s, prefix+column, fmt.Sprintf(format, column), -1)
+	}
+	return s
+}
+
+// insertIgnore returns an insert into table doing nothing if the row already exists.
+func (self Dialect) insertIgnore(table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if self == MySQL {
+		return fmt.Sprintf("INSERT IGNORE INTO %v (%v) VALUES (%v)", table, strings.Join(columns, ", "), placeholders)
+	}
+	return self.rebind(fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v) ON CONFLICT DO NOTHING", table, strings.Join(columns, ", "), placeholders))
+}
+
+// Delivery statuses.
+const (
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// Delivery is the latest attempt to deliver a message to a sink.
+type Delivery struct {
+	Key      string
+	Sink     string
+	Status   string
+	Error    string
+	Attempts int
+	Updated  time.Time
+}
+
+// Store implements imap.Checkpoint and imap.Dedup. Create the tables with CreateTables before using it.
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func New(db *sql.DB, dialect Dialect) *Store {
+	return &Store{
+		db:      db,
+		dialect: dialect,
+	}
+}
+
+// CreateTables creates gmail_checkpoints, gmail_seen and gmail_deliveries unless they already exist.
+func (self *Store) CreateTables() (err error) {
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS gmail_checkpoints (mailbox VARCHAR(255) NOT NULL PRIMARY KEY, uid_validity BIGINT NOT NULL, last_uid BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS gmail_seen (dedup_key VARCHAR(255) NOT NULL PRIMARY KEY, seen_at BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS gmail_deliveries (dedup_key VARCHAR(255) NOT NULL, sink VARCHAR(255) NOT NULL, status VARCHAR(32) NOT NULL, error TEXT NOT NULL, attempts BIGINT NOT NULL, updated_at BIGINT NOT NULL, PRIMARY KEY (dedup_key, sink))",
+	} {
+		if _, err = self.db.Exec(statement); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *Store) LastUID(mailbox string, uidValidity uint32) (result uint32, err error) {
+	var storedValidity, lastUID int64
+	if err = self.db.QueryRow(self.dialect.rebind("SELECT uid_validity, last_uid FROM gmail_checkpoints WHERE mailbox = ?"), mailbox).Scan(&storedValidity, &lastUID); err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	if uint32(storedValidity) == uidValidity {
+		result = uint32(lastUID)
+	}
+	return
+}
+
+func (self *Store) SetLastUID(mailbox string, uidValidity uint32, uid uint32) (err error) {
+	_, err = self.db.Exec(self.dialect.upsert("gmail_checkpoints", []string{"mailbox"}, []string{"mailbox", "uid_validity", "last_uid"}, "uid_validity = new.uid_validity, last_uid = new.last_uid"), mailbox, int64(uidValidity), int64(uid))
+	return
+}
+
+func (self *Store) Seen(key string) (result bool, err error) {
+	var one int
+	if err = self.db.QueryRow(self.dialect.rebind("SELECT 1 FROM gmail_seen WHERE dedup_key = ?"), key).Scan(&one); err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	result = err == nil
+	return
+}
+
+func (self *Store) MarkSeen(key string) (err error) {
+	_, err = self.db.Exec(self.dialect.insertIgnore("gmail_seen", []string{"dedup_key", "seen_at"}), key, time.Now().Unix())
+	return
+}
+
+// Log wraps a sink, recording each delivery attempt under name. Messages already delivered by the sink are skipped, so
+// that when one of several sinks fails and the message is retried, the others don't deliver it again.
+// Messages without an imap.Mail#Key are always delivered.
+func (self *Store) Log(name string, handler imap.MailHandler) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		key := msg.Key()
+		if key == "" {
+			return handler(msg)
+		}
+		var status string
+		if err = self.db.QueryRow(self.dialect.rebind("SELECT status FROM gmail_deliveries WHERE dedup_key = ? AND sink = ?"), key, name).Scan(&status); err != nil && err != sql.ErrNoRows {
+			return
+		}
+		if status == Delivered {
+			err = nil
+			return
+		}
+		status, message := Delivered, ""
+		if err = handler(msg); err != nil {
+			status, message = Failed, err.Error()
+		}
+		if _, e := self.db.Exec(self.dialect.upsert("gmail_deliveries", []string{"dedup_key", "sink"}, []string{"dedup_key", "sink", "status", "error", "attempts", "updated_at"}, "status = new.status, error = new.error, attempts = old.attempts + 1, updated_at = new.updated_at"), key, name, status, message, 1, time.Now().Unix()); e != nil && err == nil {
+			err = e
+		}
+		return
+	}
+}
+
+// Deliveries returns the delivery log of the message with the given imap.Mail#Key.
+func (self *Store) Deliveries(key string) (result []Delivery, err error) {
+	rows, err := self.db.Query(self.dialect.rebind("SELECT dedup_key, sink, status, error, attempts, updated_at FROM gmail_deliveries WHERE dedup_key = ? ORDER BY sink"), key)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		delivery := Delivery{}
+		var updated int64
+		if err = rows.Scan(&delivery.Key, &delivery.Sink, &delivery.Status, &delivery.Error, &delivery.Attempts, &updated); err != nil {
+			return
+		}
+		delivery.Updated = time.Unix(updated, 0)
+		result = append(result, delivery)
+	}
+	err = rows.Err()
+	return
+}
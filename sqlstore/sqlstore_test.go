@@ -0,0 +1,26 @@
+package sqlstore
+
+import (
+	"testing"
+)
+
+func TestUpsert(t *testing.T) {
+	keys := []string{"dedup_key", "sink"}
+	columns := []string{"dedup_key", "sink", "attempts"}
+	assignments := "attempts = old.attempts + 1"
+	for dialect, want := range map[Dialect]string{
+		Postgres: "INSERT INTO d (dedup_key, sink, attempts) VALUES ($1, $2, $3) ON CONFLICT (dedup_key, sink) DO UPDATE SET attempts = d.attempts + 1",
+		SQLite:   "INSERT INTO d (dedup_key, sink, attempts) VALUES (?, ?, ?) ON CONFLICT (dedup_key, sink) DO UPDATE SET attempts = d.attempts + 1",
+		MySQL:    "INSERT INTO d (dedup_key, sink, attempts) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE attempts = attempts + 1",
+	} {
+		if got := dialect.upsert("d", keys, columns, assignments); got != want {
+			t.Errorf("%v: wanted %q but got %q", dialect, want, got)
+		}
+	}
+	if got, want := MySQL.upsert("c", []string{"mailbox"}, []string{"mailbox", "last_uid"}, "last_uid = new.last_uid"), "INSERT INTO c (mailbox, last_uid) VALUES (?, ?) ON DUPLICATE KEY UPDATE last_uid = VALUES(last_uid)"; got != want {
+		t.Errorf("Wanted %q but got %q", want, got)
+	}
+	if got, want := Postgres.insertIgnore("s", []string{"a", "b"}), "INSERT INTO s (a, b) VALUES ($1, $2) ON CONFLICT DO NOTHING"; got != want {
+		t.Errorf("Wanted %q but got %q", want, got)
+	}
+}
@@ -0,0 +1,114 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyBounds are the upper bounds of the buckets of the latency histograms.
+var LatencyBounds = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// Latency is the timing of one message found after a new mail notification.
+type Latency struct {
+	UID uint32
+	// Notified is when the XMPP notification arrived.
+	Notified time.Time
+	// Fetched is when the IMAP fetch of the message completed.
+	Fetched time.Time
+	// Handled is when the mail handler returned.
+	Handled time.Time
+}
+
+// Fetch is the time from the notification until the message was fetched.
+func (self Latency) Fetch() time.Duration {
+	return self.Fetched.Sub(self.Notified)
+}
+
+// Handle is the time from the message being fetched until the mail handler returned.
+func (self Latency) Handle() time.Duration {
+	return self.Handled.Sub(self.Fetched)
+}
+
+// Total is the time from the notification until the mail handler returned.
+func (self Latency) Total() time.Duration {
+	return self.Handled.Sub(self.Notified)
+}
+
+// HistogramBucket is the number of durations no longer than Le.
+type HistogramBucket struct {
+	Le    time.Duration
+	Count int
+}
+
+// Histogram is a thread safe distribution of durations.
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []time.Duration
+	counts []int
+	count  int
+	sum    time.Duration
+}
+
+// NewHistogram returns an empty Histogram with buckets for the given upper bounds.
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	bounds = append([]time.Duration{}, bounds...)
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i] < bounds[j]
+	})
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int, len(bounds)),
+	}
+}
+
+func (self *Histogram) Observe(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.count++
+	self.sum += d
+	if i := sort.Search(len(self.bounds), func(i int) bool {
+		return d <= self.bounds[i]
+	}); i < len(self.bounds) {
+		self.counts[i]++
+	}
+}
+
+// Buckets returns the cumulative bucket counts, smallest bound first. Durations longer than all bounds are only
+// included in Count.
+func (self *Histogram) Buckets() (result []HistogramBucket) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	cumulative := 0
+	for i, bound := range self.bounds {
+		cumulative += self.counts[i]
+		result = append(result, HistogramBucket{
+			Le:    bound,
+			Count: cumulative,
+		})
+	}
+	return
+}
+
+func (self *Histogram) Count() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.count
+}
+
+func (self *Histogram) Sum() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.sum
+}
@@ -0,0 +1,176 @@
+// Package stats aggregates mail counts per sender, label, hour and day, for simple mailbox analytics.
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zond/gmail/addr"
+	"github.com/zond/gmail/imap"
+)
+
+// Count is the number of messages for a sender or label.
+type Count struct {
+	Key   string
+	Count int
+}
+
+// Bucket is the number of messages received during the hour or day starting at Start.
+type Bucket struct {
+	Start time.Time
+	Count int
+}
+
+// Stats is a thread safe aggregate of messages.
+type Stats struct {
+	lock     sync.Mutex
+	location *time.Location
+	total    int
+	senders  map[string]int
+	labels   map[string]int
+	hours    map[time.Time]int
+	days     map[time.Time]int
+	fetch    *Histogram
+	handle   *Histogram
+	latency  *Histogram
+}
+
+// New returns an empty Stats, placing messages in days of the given location, or UTC if nil.
+func New(location *time.Location) *Stats {
+	if location == nil {
+		location = time.UTC
+	}
+	return &Stats{
+		location: location,
+		senders:  map[string]int{},
+		labels:   map[string]int{},
+		hours:    map[time.Time]int{},
+		days:     map[time.Time]int{},
+		fetch:    NewHistogram(LatencyBounds...),
+		handle:   NewHistogram(LatencyBounds...),
+		latency:  NewHistogram(LatencyBounds...),
+	}
+}
+
+// Handler returns a handler adding each message to the stats after next, if not nil, handled it without error.
+func (self *Stats) Handler(next imap.MailHandler) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		if next != nil {
+			if err = next(msg); err != nil {
+				return
+			}
+		}
+		self.Add(msg)
+		return
+	}
+}
+
+// Add counts msg by its From address normalized by addr.Normalize, labels and internal date.
+func (self *Stats) Add(msg *imap.Mail) {
+	sender := addr.NormalizedFrom(msg)
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	date = date.In(self.location)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.total++
+	if sender != "" {
+		self.senders[sender]++
+	}
+	for _, label := range msg.Labels {
+		self.labels[label]++
+	}
+	self.hours[date.Truncate(time.Hour)]++
+	self.days[time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, self.location)]++
+}
+
+// AddLatency adds the timing of a message to the latency histograms.
+func (self *Stats) AddLatency(latency Latency) {
+	self.fetch.Observe(latency.Fetch())
+	self.handle.Observe(latency.Handle())
+	self.latency.Observe(latency.Total())
+}
+
+// FetchLatency is the distribution of the times from new mail notifications until the messages were fetched.
+func (self *Stats) FetchLatency() *Histogram {
+	return self.fetch
+}
+
+// HandleLatency is the distribution of the times from messages being fetched until the mail handler returned.
+func (self *Stats) HandleLatency() *Histogram {
+	return self.handle
+}
+
+// Latency is the distribution of the times from new mail notifications until the mail handler returned.
+func (self *Stats) Latency() *Histogram {
+	return self.latency
+}
+
+func (self *Stats) Total() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.total
+}
+
+// TopSenders returns the n senders with the most messages, most first.
+func (self *Stats) TopSenders(n int) []Count {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return top(self.senders, n)
+}
+
+// TopLabels returns the n labels with the most messages, most first.
+func (self *Stats) TopLabels(n int) []Count {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return top(self.labels, n)
+}
+
+// Hourly returns the number of messages per hour, oldest first. Hours without messages are left out.
+func (self *Stats) Hourly() []Bucket {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return buckets(self.hours)
+}
+
+// Daily returns the number of messages per day, oldest first. Days without messages are left out.
+func (self *Stats) Daily() []Bucket {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return buckets(self.days)
+}
+
+func top(counts map[string]int, n int) (result []Count) {
+	for key, count := range counts {
+		result = append(result, Count{
+			Key:   key,
+			Count: count,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return
+}
+
+func buckets(counts map[time.Time]int) (result []Bucket) {
+	for start, count := range counts {
+		result = append(result, Bucket{
+			Start: start,
+			Count: count,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return
+}
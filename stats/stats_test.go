@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/imap"
+	"github.com/zond/gmail/imap/imaptest"
+)
+
+func TestStats(t *testing.T) {
+	mailbox := imaptest.New()
+	morning := time.Date(2020, 1, 2, 9, 15, 0, 0, time.UTC)
+	for _, msg := range []struct {
+		from string
+		date time.Time
+	}{
+		{"A <a@example.com>", morning},
+		{"b@example.com", morning.Add(10 * time.Minute)},
+		{"A@Example.com", morning.Add(25 * time.Hour)},
+	} {
+		mailbox.Append(context.Background(), nil, msg.date, []byte("From: "+msg.from+"\r\nSubject: hi\r\n\r\nbody"))
+	}
+	mailbox.SetLabels(1, "work")
+	mailbox.SetLabels(3, "work", "urgent")
+	s := New(nil)
+	if err := imap.New("user@example.com", "secret").MailStore(mailbox.Open).HandleNew(s.Handler(nil)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Total() != 3 {
+		t.Errorf("Wanted 3 messages, got %v", s.Total())
+	}
+	if want := []Count{{"a@example.com", 2}}; !reflect.DeepEqual(s.TopSenders(1), want) {
+		t.Errorf("Wanted %v but got %v", want, s.TopSenders(1))
+	}
+	if want := []Count{{"work", 2}, {"urgent", 1}}; !reflect.DeepEqual(s.TopLabels(5), want) {
+		t.Errorf("Wanted %v but got %v", want, s.TopLabels(5))
+	}
+	if want := []Bucket{{time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC), 2}, {time.Date(2020, 1, 3, 10, 0, 0, 0, time.UTC), 1}}; !reflect.DeepEqual(s.Hourly(), want) {
+		t.Errorf("Wanted %v but got %v", want, s.Hourly())
+	}
+	if want := []Bucket{{time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), 2}, {time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), 1}}; !reflect.DeepEqual(s.Daily(), want) {
+		t.Errorf("Wanted %v but got %v", want, s.Daily())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := New(nil)
+	notified := time.Date(2020, 1, 2, 9, 15, 0, 0, time.UTC)
+	for _, fetch := range []time.Duration{200 * time.Millisecond, 3 * time.Second, time.Hour} {
+		s.AddLatency(Latency{
+			Notified: notified,
+			Fetched:  notified.Add(fetch),
+			Handled:  notified.Add(fetch + 50*time.Millisecond),
+		})
+	}
+	fetch := s.FetchLatency()
+	if fetch.Count() != 3 || fetch.Sum() != time.Hour+3200*time.Millisecond {
+		t.Errorf("Wanted 3 fetches, got %v summing to %v", fetch.Count(), fetch.Sum())
+	}
+	for _, bucket := range fetch.Buckets() {
+		want := 0
+		switch {
+		case bucket.Le >= 5*time.Second:
+			want = 2
+		case bucket.Le >= 250*time.Millisecond:
+			want = 1
+		}
+		if bucket.Count != want {
+			t.Errorf("Wanted %v fetches within %v, got %v", want, bucket.Le, bucket.Count)
+		}
+	}
+	if buckets := s.HandleLatency().Buckets(); buckets[0].Count != 3 {
+		t.Errorf("Wanted all handling within %v, got %+v", buckets[0].Le, buckets)
+	}
+	if total := s.Latency().Sum(); total != fetch.Sum()+150*time.Millisecond {
+		t.Errorf("Wanted the total latency to include handling, got %v", total)
+	}
+}
@@ -0,0 +1,170 @@
+// Package watch follows the conversations of sent messages, and tells when replies to them arrive.
+//
+//	watcher := watch.New(func(e watch.ThreadUpdated) {
+//		log.Printf("%v got reply %v", e.MessageID, e.Reply.GetHeader("Subject"))
+//	})
+//	client.MailHandler(watcher.Handler(handler))
+//	watcher.Watch(sent.MessageID, time.Now().Add(7*24*time.Hour))
+//
+// The watched conversations are only remembered as long as the process.
+package watch
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+// ThreadUpdated tells that Reply arrived in the conversation of the watched message MessageID.
+type ThreadUpdated struct {
+	MessageID string
+	Reply     *imap.Mail
+	// Replies is the number of replies in the conversation so far, including this one.
+	Replies int
+}
+
+type watched struct {
+	until   time.Time
+	replies int
+}
+
+// Watcher follows the conversations of the watched messages. It is safe for concurrent use.
+type Watcher struct {
+	Clock   clock.Clock
+	handler func(e ThreadUpdated)
+	lock    sync.Mutex
+	watched map[string]*watched
+	// conversations maps the ids of the messages, and the Gmail ids of the threads, in the watched conversations to
+	// the watched message ids.
+	conversations map[string]string
+	threads       map[uint64]string
+}
+
+func New(handler func(e ThreadUpdated)) *Watcher {
+	return &Watcher{
+		Clock:         clock.Real,
+		handler:       handler,
+		watched:       map[string]*watched{},
+		conversations: map[string]string{},
+		threads:       map[uint64]string{},
+	}
+}
+
+func trimID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// messageIDs returns the ids in an In-Reply-To or References header, without angle brackets.
+func messageIDs(header string) []string {
+	return strings.FieldsFunc(header, func(r rune) bool {
+		return r == '<' || r == '>' || r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// Watch makes replies in the conversation of the message with messageID, like compose.Message#MessageID, be reported
+// until the given time.
+func (self *Watcher) Watch(messageID string, until time.Time) {
+	messageID = trimID(messageID)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.watched[messageID] = &watched{until: until}
+	self.conversations[messageID] = messageID
+}
+
+// Unwatch stops reporting replies in the conversation of the message with messageID.
+func (self *Watcher) Unwatch(messageID string) {
+	messageID = trimID(messageID)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.forget(messageID)
+}
+
+// forget removes the watched message with messageID and its conversation. It must be called with lock held.
+func (self *Watcher) forget(messageID string) {
+	delete(self.watched, messageID)
+	for id, watchedID := range self.conversations {
+		if watchedID == messageID {
+			delete(self.conversations, id)
+		}
+	}
+	for thread, watchedID := range self.threads {
+		if watchedID == messageID {
+			delete(self.threads, thread)
+		}
+	}
+}
+
+// Watched returns the ids of the messages watched.
+func (self *Watcher) Watched() (result []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for id := range self.watched {
+		result = append(result, id)
+	}
+	return
+}
+
+// match returns the event for msg if it is a reply in a watched conversation, and adds it to the conversation.
+func (self *Watcher) match(msg *imap.Mail) (result *ThreadUpdated) {
+	if msg.MIMEBody == nil {
+		return
+	}
+	now := self.Clock.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for id, w := range self.watched {
+		if now.After(w.until) {
+			self.forget(id)
+		}
+	}
+	own := trimID(msg.GetHeader("Message-Id"))
+	if _, found := self.watched[own]; found {
+		// The watched message itself, sent to the account.
+		return
+	}
+	watchedID := ""
+	if msg.ThreadID != 0 {
+		watchedID = self.threads[msg.ThreadID]
+	}
+	for _, header := range []string{"In-Reply-To", "References"} {
+		for _, ref := range messageIDs(msg.GetHeader(header)) {
+			if id, found := self.conversations[ref]; found && watchedID == "" {
+				watchedID = id
+			}
+		}
+	}
+	w, found := self.watched[watchedID]
+	if !found {
+		return
+	}
+	if own != "" {
+		self.conversations[own] = watchedID
+	}
+	if msg.ThreadID != 0 {
+		self.threads[msg.ThreadID] = watchedID
+	}
+	w.replies++
+	return &ThreadUpdated{
+		MessageID: watchedID,
+		Reply:     msg,
+		Replies:   w.replies,
+	}
+}
+
+// Handler returns a handler calling next, and then, if next succeeded and the message is a reply in a watched
+// conversation, the handler of the Watcher.
+func (self *Watcher) Handler(next imap.MailHandler) imap.MailHandler {
+	return func(msg *imap.Mail) (err error) {
+		if err = next(msg); err != nil {
+			return
+		}
+		if e := self.match(msg); e != nil {
+			self.handler(*e)
+		}
+		return
+	}
+}
@@ -0,0 +1,58 @@
+package watch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/imap"
+)
+
+func TestWatcher(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	events := []string{}
+	watcher := New(func(e ThreadUpdated) {
+		events = append(events, fmt.Sprintf("%v:%v:%v", e.MessageID, e.Reply.GetHeader("Subject"), e.Replies))
+	})
+	watcher.Clock = fake
+	failing := false
+	handler := watcher.Handler(func(msg *imap.Mail) error {
+		if failing {
+			return fmt.Errorf("failing")
+		}
+		return nil
+	})
+	deliver := func(threadID uint64, headers string) {
+		msg, err := imap.Parse(imap.Message{ThreadID: threadID, Body: []byte(headers + "\r\n\r\nbody")})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		handler(msg)
+	}
+	watcher.Watch("<sent@example.com>", fake.Now().Add(time.Hour))
+	watcher.Watch("other@example.com", fake.Now().Add(2*time.Hour))
+	deliver(1, "Message-Id: <sent@example.com>\r\nSubject: sent")
+	deliver(1, "Message-Id: <r1@example.com>\r\nIn-Reply-To: <sent@example.com>\r\nSubject: r1")
+	failing = true
+	deliver(1, "Message-Id: <r2@example.com>\r\nReferences: <sent@example.com> <r1@example.com>\r\nSubject: failed")
+	failing = false
+	deliver(1, "Message-Id: <r2@example.com>\r\nReferences: <sent@example.com><r1@example.com>\r\nSubject: r2")
+	deliver(1, "Message-Id: <r3@example.com>\r\nSubject: r3")
+	deliver(2, "Message-Id: <unrelated@example.com>\r\nReferences: <elsewhere@example.com>\r\nSubject: unrelated")
+	if want := "[sent@example.com:r1:1 sent@example.com:r2:2 sent@example.com:r3:3]"; fmt.Sprint(events) != want {
+		t.Errorf("Wanted %v, got %v", want, events)
+	}
+	events = nil
+	fake.Advance(90 * time.Minute)
+	deliver(1, "Message-Id: <r4@example.com>\r\nIn-Reply-To: <r3@example.com>\r\nSubject: late")
+	deliver(3, "Message-Id: <o1@example.com>\r\nIn-Reply-To: <other@example.com>\r\nSubject: o1")
+	watcher.Unwatch("other@example.com")
+	deliver(3, "Message-Id: <o2@example.com>\r\nIn-Reply-To: <o1@example.com>\r\nSubject: o2")
+	if want := "[other@example.com:o1:1]"; fmt.Sprint(events) != want {
+		t.Errorf("Wanted replies after expiry or unwatching ignored, got %v", events)
+	}
+	if watched := watcher.Watched(); len(watched) != 0 {
+		t.Errorf("Wanted nothing watched, got %v", watched)
+	}
+}
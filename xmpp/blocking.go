@@ -0,0 +1,152 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const (
+	nsBlocking       = "urn:xmpp:blocking"
+	nsBlockingErrors = "urn:xmpp:blocking:errors"
+)
+
+// BlockedError is returned when sending to a JID that is blocked, and given to the ErrorHandler when the server refuses
+// a message because of blocking.
+type BlockedError struct {
+	JID string
+}
+
+func (self BlockedError) Error() string {
+	return fmt.Sprintf("xmpp: %v is blocked", self.JID)
+}
+
+type blockItems struct {
+	Items []struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"item"`
+}
+
+func (self *blockItems) jids() (result []string) {
+	for _, item := range self.Items {
+		result = append(result, item.JID)
+	}
+	return
+}
+
+func blockItemsXML(jids []string) string {
+	b := &strings.Builder{}
+	for _, jid := range jids {
+		fmt.Fprintf(b, "<item jid='%s'/>", escaped(jid))
+	}
+	return b.String()
+}
+
+// Block blocks all communication with the jids, which may be bare or full JIDs, or domains, with XEP-0191. It fails
+// with ErrNotStarted until Start has connected.
+func (self *Client) Block(jids ...string) (err error) {
+	if len(jids) == 0 {
+		return
+	}
+	if _, err = self.request("set", "", "<block xmlns='"+nsBlocking+"'>"+blockItemsXML(jids)+"</block>"); err != nil {
+		return
+	}
+	self.updateBlocked(jids, true)
+	return
+}
+
+// Unblock unblocks the jids, or every blocked JID if none is given. It fails with ErrNotStarted until Start has
+// connected.
+func (self *Client) Unblock(jids ...string) (err error) {
+	if _, err = self.request("set", "", "<unblock xmlns='"+nsBlocking+"'>"+blockItemsXML(jids)+"</unblock>"); err != nil {
+		return
+	}
+	self.updateBlocked(jids, false)
+	return
+}
+
+// BlockList fetches the blocked JIDs from the server. It fails with ErrNotStarted until Start has connected.
+func (self *Client) BlockList() (result []string, err error) {
+	iq, err := self.request("get", "", "<blocklist xmlns='"+nsBlocking+"'/>")
+	if err != nil {
+		return
+	}
+	parsed := struct {
+		Blocklist blockItems `xml:"urn:xmpp:blocking blocklist"`
+	}{}
+	if err = unmarshalInner(iq.Inner, &parsed); err != nil {
+		return
+	}
+	result = parsed.Blocklist.jids()
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+	self.blocked = map[string]bool{}
+	for _, jid := range result {
+		self.blocked[jid] = true
+	}
+	return
+}
+
+// updateBlocked marks the jids as blocked or not. Unblocking no jids unblocks every JID.
+func (self *Client) updateBlocked(jids []string, blocked bool) {
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+	if !blocked && len(jids) == 0 {
+		self.blocked = nil
+		return
+	}
+	if self.blocked == nil {
+		self.blocked = map[string]bool{}
+	}
+	for _, jid := range jids {
+		if blocked {
+			self.blocked[jid] = true
+		} else {
+			delete(self.blocked, jid)
+		}
+	}
+}
+
+// checkBlocked returns a BlockedError if to is known to be blocked, by its full JID, bare JID or domain.
+func (self *Client) checkBlocked(to string) error {
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+	bare := to
+	if i := strings.Index(bare, "/"); i != -1 {
+		bare = bare[:i]
+	}
+	domain := bare[strings.Index(bare, "@")+1:]
+	for _, jid := range []string{to, bare, domain} {
+		if self.blocked[jid] {
+			return BlockedError{JID: to}
+		}
+	}
+	return nil
+}
+
+// handleBlockPush applies the changes the server pushes when the blocklist was changed by another resource, and
+// returns whether the stanza was one.
+func (self *Client) handleBlockPush(stanza *Stanza) (handled bool, err error) {
+	if stanza.Type != "set" || !strings.Contains(string(stanza.Inner), nsBlocking) {
+		return
+	}
+	parsed := struct {
+		Block   *blockItems `xml:"urn:xmpp:blocking block"`
+		Unblock *blockItems `xml:"urn:xmpp:blocking unblock"`
+	}{}
+	if unmarshalInner(stanza.Inner, &parsed) != nil || (parsed.Block == nil && parsed.Unblock == nil) {
+		return
+	}
+	if parsed.Block != nil {
+		self.updateBlocked(parsed.Block.jids(), true)
+	}
+	if parsed.Unblock != nil {
+		self.updateBlocked(parsed.Unblock.jids(), false)
+	}
+	return true, self.send("<iq type='result' id='%s'/>\n", escaped(stanza.Id))
+}
+
+// blocked returns whether the error refuses a stanza because of blocking.
+func blocked(e *StanzaError) bool {
+	return e != nil && e.Specific == xml.Name{Space: nsBlockingErrors, Local: "blocked"}
+}
@@ -0,0 +1,95 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const nsChatStates = "http://jabber.org/protocol/chatstates"
+
+// ChatState is the XEP-0085 state of a participant in a chat, like composing while typing.
+type ChatState string
+
+const (
+	ChatActive    ChatState = "active"
+	ChatComposing ChatState = "composing"
+	ChatPaused    ChatState = "paused"
+	ChatInactive  ChatState = "inactive"
+	ChatGone      ChatState = "gone"
+)
+
+var chatStates = map[string]ChatState{
+	"active":    ChatActive,
+	"composing": ChatComposing,
+	"paused":    ChatPaused,
+	"inactive":  ChatInactive,
+	"gone":      ChatGone,
+}
+
+// chatState returns the chat state among the names of the elements of a message, if any.
+func chatState(names []xml.Name) ChatState {
+	for _, name := range names {
+		if name.Space == nsChatStates {
+			if state, found := chatStates[name.Local]; found {
+				return state
+			}
+		}
+	}
+	return ""
+}
+
+// Message is a message received from a contact. Standalone chat state notifications are messages without Body.
+type Message struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Body      string    `json:"body"`
+	Thread    string    `json:"thread,omitempty"`
+	ChatState ChatState `json:"chat_state,omitempty"`
+}
+
+// ChatHandler will be called with the messages received from contacts, including their chat states.
+func (self *Client) ChatHandler(f func(msg Message)) *Client {
+	self.chatHandler = f
+	return self
+}
+
+func (self *Client) handleChat(stanza *Stanza) {
+	if stanza.Type == "error" {
+		if blocked(stanza.Error) {
+			self.errorHandler(BlockedError{JID: stanza.From})
+		}
+		return
+	}
+	if self.chatHandler == nil || (stanza.Body == "" && stanza.ChatState == "") {
+		return
+	}
+	self.chatHandler(Message{
+		From:      stanza.From,
+		To:        stanza.To,
+		Id:        stanza.Id,
+		Type:      stanza.Type,
+		Body:      stanza.Body,
+		Thread:    stanza.Thread,
+		ChatState: stanza.ChatState,
+	})
+}
+
+// SendMessage sends a chat message with body to the JID to, with the active chat state. It fails with ErrNotStarted
+// until Start has connected, and returns a BlockedError if to is blocked.
+func (self *Client) SendMessage(to, body string) error {
+	if err := self.checkBlocked(to); err != nil {
+		return err
+	}
+	return self.send("<message to='%s' type='chat'><body>%s</body><%s xmlns='%s'/></message>\n", escaped(to), escaped(body), ChatActive, nsChatStates)
+}
+
+// SendChatState sends a standalone chat state notification to the JID to, like ChatComposing while the user types a
+// message and ChatPaused when they stop. It fails with ErrNotStarted until Start has connected, and returns a
+// BlockedError if to is blocked.
+func (self *Client) SendChatState(to string, state ChatState) error {
+	if err := self.checkBlocked(to); err != nil {
+		return err
+	}
+	return self.send("<message to='%s' type='chat'><%s xmlns='%s'/></message>\n", escaped(to), escaped(state), nsChatStates)
+}
@@ -0,0 +1,100 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/zond/gmail/auth"
+)
+
+// Mechanisms limits the SASL mechanisms the client authenticates with to mechanisms, like DIGEST-MD5 or PLAIN, tried in
+// that order. Without it the client uses EXTERNAL if it has ClientCertificates, and otherwise the first usable
+// mechanism offered by the server.
+func (self *Client) Mechanisms(mechanisms ...string) *Client {
+	self.mechanisms = mechanisms
+	return self
+}
+
+// RequireTLS makes the client refuse to authenticate over connections without TLS. Connections to Endpoints always
+// use TLS, so it only matters for connections made by Dial.
+func (self *Client) RequireTLS(require bool) *Client {
+	self.requireTLS = require
+	return self
+}
+
+// RequireStrongAuth makes the client refuse PLAIN, which sends the password itself, even over TLS.
+func (self *Client) RequireStrongAuth(require bool) *Client {
+	self.requireStrongAuth = require
+	return self
+}
+
+// AllowCleartext lets PLAIN and X-OAUTH2 send the password or token over connections that are neither TLS nor local,
+// which the client refuses by default.
+func (self *Client) AllowCleartext(allow bool) *Client {
+	self.allowCleartext = allow
+	return self
+}
+
+// mechanism picks the mechanism to authenticate with among those offered by the server, following the preferences
+// and the policy of the client.
+func (self *Client) mechanism(offered []string, creds auth.Credentials) (result string, err error) {
+	encrypted, local := channel(self.conn)
+	if self.requireTLS && !encrypted {
+		err = errors.New("xmpp: refusing to authenticate without TLS")
+		return
+	}
+	candidates := self.mechanisms
+	if len(candidates) == 0 {
+		candidates = append([]string{"EXTERNAL"}, offered...)
+	}
+	refused := []string{}
+	for _, m := range candidates {
+		found := false
+		for _, o := range offered {
+			found = found || o == m
+		}
+		switch {
+		case !found:
+		case m == "EXTERNAL" && len(self.tlsConfig.Certificates) == 0:
+		case m == "X-OAUTH2" && creds.Token == "":
+		case (m == "PLAIN" || m == "DIGEST-MD5") && creds.Token != "":
+		case m != "EXTERNAL" && m != "X-OAUTH2" && m != "PLAIN" && m != "DIGEST-MD5":
+		case m == "PLAIN" && self.requireStrongAuth,
+			(m == "PLAIN" || m == "X-OAUTH2") && !encrypted && !local && !self.allowCleartext:
+			refused = append(refused, m)
+		default:
+			return m, nil
+		}
+	}
+	if len(refused) > 0 {
+		err = fmt.Errorf("xmpp: refusing %v over this connection, offered %v", refused, offered)
+	} else if creds.Token != "" {
+		err = fmt.Errorf("X-OAUTH2 authentication is not an option: %v", offered)
+	} else {
+		err = fmt.Errorf("PLAIN authentication is not an option: %v", offered)
+	}
+	return
+}
+
+// channel returns whether conn uses TLS, and otherwise whether it stays on the local machine, like loopback and
+// in-memory connections do.
+func channel(conn net.Conn) (encrypted, local bool) {
+	if r, ok := conn.(recordingConn); ok {
+		conn = r.Conn
+	}
+	if _, encrypted = conn.(*tls.Conn); encrypted {
+		return
+	}
+	switch addr := conn.RemoteAddr().(type) {
+	case nil:
+	case *net.TCPAddr:
+		local = addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		local = true
+	default:
+		local = addr.Network() == "pipe"
+	}
+	return
+}
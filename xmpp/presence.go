@@ -0,0 +1,46 @@
+package xmpp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Presence is a presence received from a contact, like the availability of a friend, or a subscription request.
+type Presence struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Id   string `json:"id"`
+	// Type is empty for available contacts, and otherwise like unavailable, subscribe or error.
+	Type string `json:"type"`
+	// Show is like away, chat, dnd or xa, or empty for plain availability.
+	Show     string `json:"show,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Priority int    `json:"priority"`
+}
+
+// PresenceHandler will be called with the presences received from contacts, including those the server delivers while
+// the stream is set up.
+func (self *Client) PresenceHandler(f func(presence Presence)) *Client {
+	self.presenceHandler = f
+	return self
+}
+
+func (self *Client) handlePresence(stanza *Stanza) {
+	if self.presenceHandler == nil {
+		return
+	}
+	// Priorities outside the range of RFC 6121, or that aren't numbers, count as the default 0.
+	priority, err := strconv.Atoi(strings.TrimSpace(stanza.Priority))
+	if err != nil || priority < -128 || priority > 127 {
+		priority = 0
+	}
+	self.presenceHandler(Presence{
+		From:     stanza.From,
+		To:       stanza.To,
+		Id:       stanza.Id,
+		Type:     stanza.Type,
+		Show:     stanza.Show,
+		Status:   stanza.Status,
+		Priority: priority,
+	})
+}
@@ -0,0 +1,125 @@
+package xmpp
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	Inbound  = "in"
+	Outbound = "out"
+)
+
+// Record is one chunk of wire traffic in a recording.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      string    `json:"data"`
+}
+
+var secrets = []*regexp.Regexp{
+	regexp.MustCompile(`(<auth[^>]*>)[^<]*(</auth>)`),
+	regexp.MustCompile(`(<response[^>]*>)[^<]*(</response>)`),
+}
+
+// Sanitize removes SASL payloads, which contain credentials, from outbound traffic.
+func Sanitize(data string) string {
+	for _, secret := range secrets {
+		data = secret.ReplaceAllString(data, "${1}REDACTED${2}")
+	}
+	return data
+}
+
+type recorder struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func (self *recorder) record(direction string, data []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.enc.Encode(Record{
+		Time:      time.Now(),
+		Direction: direction,
+		Data:      Sanitize(string(data)),
+	})
+}
+
+type recordingConn struct {
+	net.Conn
+	recorder *recorder
+}
+
+func (self recordingConn) Read(b []byte) (n int, err error) {
+	n, err = self.Conn.Read(b)
+	if n > 0 {
+		self.recorder.record(Inbound, b[:n])
+	}
+	return
+}
+
+func (self recordingConn) Write(b []byte) (n int, err error) {
+	n, err = self.Conn.Write(b)
+	if n > 0 {
+		self.recorder.record(Outbound, b[:n])
+	}
+	return
+}
+
+// Record makes the client write all traffic as JSON encoded Records to w, with SASL payloads redacted.
+func (self *Client) Record(w io.Writer) *Client {
+	self.recorder = &recorder{
+		enc: json.NewEncoder(w),
+	}
+	return self
+}
+
+// Replay feeds the inbound traffic of a recording made by Client#Record through the stanza parser,
+// calling f with every parsed stanza. Stream openings are skipped. Replay returns the first parse error.
+func Replay(r io.Reader, f func(name xml.Name, stanza interface{})) (err error) {
+	pr, pw := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<24)
+		for scanner.Scan() {
+			record := Record{}
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if record.Direction == Inbound {
+				if _, err := io.WriteString(pw, record.Data); err != nil {
+					return
+				}
+			}
+		}
+		pw.CloseWithError(scanner.Err())
+	}()
+	defer pr.Close()
+	p := xml.NewDecoder(pr)
+	for {
+		se, err := nextStart(p)
+		if err == io.EOF {
+			return nil
+		} else if syntaxErr, ok := err.(*xml.SyntaxError); ok && syntaxErr.Msg == "unexpected EOF" {
+			// Recordings end in the middle of the stream.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if se.Name.Space == nsStream && se.Name.Local == "stream" {
+			continue
+		}
+		name, stanza, err := decode(p, se)
+		if err != nil {
+			return err
+		}
+		f(name, stanza)
+	}
+}
@@ -0,0 +1,53 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+)
+
+const nsVCard = "vcard-temp"
+
+// VCard is the contact information of a JID, from its vcard-temp vCard.
+type VCard struct {
+	FullName string
+	Nickname string
+	// Photo is the avatar image, of type PhotoType, like image/png.
+	Photo     []byte
+	PhotoType string
+}
+
+type vCard struct {
+	XMLName  xml.Name `xml:"vcard-temp vCard"`
+	FullName string   `xml:"FN"`
+	Nickname string   `xml:"NICKNAME"`
+	Photo    struct {
+		Type   string `xml:"TYPE"`
+		BinVal string `xml:"BINVAL"`
+	} `xml:"PHOTO"`
+}
+
+// VCard fetches the vCard of jid, or of the user if jid is empty. It fails with ErrNotStarted until Start has connected.
+// Contacts without a vCard make it return a StanzaError with the item-not-found or service-unavailable condition.
+func (self *Client) VCard(jid string) (result VCard, err error) {
+	iq, err := self.request("get", jid, "<vCard xmlns='"+nsVCard+"'/>")
+	if err != nil {
+		return
+	}
+	parsed := vCard{}
+	if len(strings.TrimSpace(string(iq.Inner))) == 0 {
+		// Servers may answer with an empty result for users without a vCard.
+		return
+	}
+	if err = xml.Unmarshal(iq.Inner, &parsed); err != nil {
+		return
+	}
+	result.FullName, result.Nickname, result.PhotoType = parsed.FullName, parsed.Nickname, parsed.Photo.Type
+	if parsed.Photo.BinVal != "" {
+		// The base64 is usually wrapped in lines.
+		if result.Photo, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(parsed.Photo.BinVal), "")); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -1,7 +1,7 @@
 package xmpp
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/tls"
@@ -10,50 +10,238 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zond/gmail/auth"
+	"github.com/zond/gmail/clock"
+	"github.com/zond/gmail/dialer"
+	"github.com/zond/gmail/profile"
+	"github.com/zond/gmail/retry"
 )
 
 const (
-	gtalkHost = "talk.google.com"
-	gtalkAddr = "talk.google.com:443"
-	nsStream  = "http://etherx.jabber.org/streams"
-	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
-	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
-	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
-	nsClient  = "jabber:client"
-	nsNotify  = "google:mail:notify"
+	gtalkHost    = "talk.google.com"
+	nsStream     = "http://etherx.jabber.org/streams"
+	nsTLS        = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL       = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind       = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSession    = "urn:ietf:params:xml:ns:xmpp-session"
+	nsClient     = "jabber:client"
+	nsNotify     = "google:mail:notify"
+	nsGoogleAuth = "http://www.google.com/talk/protocol/auth"
+	nsStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
 )
 
 var DefaultConfig = tls.Config{
 	ServerName: gtalkHost,
+	MinVersion: tls.VersionTLS12,
+}
+
+// Endpoint is an address of the server. Connections to it use TLS from the start, or are upgraded with STARTTLS if
+// StartTLS is set. Either way the server certificate is verified against talk.google.com.
+type Endpoint struct {
+	Addr     string
+	StartTLS bool
+}
+
+// DefaultEndpoints are tried in order by clients without Endpoints, for networks that block some of the ports.
+var DefaultEndpoints = []Endpoint{
+	{Addr: "talk.google.com:443"},
+	{Addr: "talk.google.com:5222", StartTLS: true},
+	{Addr: "xmpp.l.google.com:5222", StartTLS: true},
 }
 
 type Client struct {
-	conn         *tls.Conn // connection to server
-	jid          string    // Jabber ID for our connection
-	domain       string
-	p            *xml.Decoder
-	user         string
-	password     string
-	errorHandler func(e error)
-	mailHandler  func()
-	debug        bool
+	conn            net.Conn      // connection to server
+	w               *bufio.Writer // buffers writes to conn
+	r               *bufio.Reader // buffers reads from conn, for all the decoders of its streams
+	jid             string        // Jabber ID for our connection
+	domain          string
+	p               *xml.Decoder
+	user            string
+	credentials     *auth.Swappable
+	errorHandler    func(e error)
+	mailHandler     func()
+	tlsConfig       *tls.Config
+	tlsHandler      func(state tls.ConnectionState) error
+	dial            func() (net.Conn, error)
+	endpoints       []Endpoint
+	recorder        *recorder
+	debug           bool
+	writeLock       sync.Mutex
+	claimLock       sync.Mutex
+	claims          map[string]func(iq IQ)
+	renewTimer      clock.Timer
+	clock           clock.Clock
+	authHandler     func(e auth.Event)
+	retryPolicy     retry.Policy
+	middleware      []func(next StanzaHandler) StanzaHandler
+	chatHandler     func(msg Message)
+	presenceHandler func(presence Presence)
+	pending         []*Stanza // received while setting up the stream, only used by the goroutine reading it
+	requests        uint64
+	charsets        func(charset string, input io.Reader) (io.Reader, error)
+	entities        map[string]string
+	// endpoint is the index of the endpoint that last worked, guarded by stateLock.
+	endpoint int
+	// resource is the resource to bind, if any, renamed to resource-N after N-1 conflicts, up to conflictLimit. They
+	// are only used while setting up and reading the stream.
+	resource      string
+	conflicts     int
+	conflictLimit int
+	// mechanisms, requireTLS, requireStrongAuth and allowCleartext are the authentication policy.
+	mechanisms        []string
+	requireTLS        bool
+	requireStrongAuth bool
+	allowCleartext    bool
+	// blockLock guards blocked, the JIDs known to be blocked.
+	blockLock sync.Mutex
+	blocked   map[string]bool
+	// stateLock guards state, stop, done, conn and renewTimer. conn and w are only replaced with writeLock held as well,
+	// and w is only used with writeLock held.
+	stateLock sync.Mutex
+	state     State
+	stop      chan struct{}
+	// done is closed when the run goroutine of the last Start returns.
+	done chan struct{}
+}
+
+// State is the connection state of a Client.
+type State int
+
+const (
+	// Idle clients haven't been started, or failed to start.
+	Idle State = iota
+	Connecting
+	Running
+	// Backoff clients lost the connection and failed to reconnect, and are waiting before trying again.
+	Backoff
+	// Stopped clients have been closed.
+	Stopped
+)
+
+var stateNames = map[State]string{
+	Idle:       "Idle",
+	Connecting: "Connecting",
+	Running:    "Running",
+	Backoff:    "Backoff",
+	Stopped:    "Stopped",
+}
+
+func (self State) String() string {
+	return stateNames[self]
+}
+
+// ReconnectMin and ReconnectMax limit the delay between failed attempts to reconnect after the connection was lost,
+// for clients without a ReconnectPolicy. The first attempt is made at once, and the delay doubles for each failure
+// after that.
+var (
+	ReconnectMin = time.Second
+	ReconnectMax = 5 * time.Minute
+)
+
+// RequestTimeout is how long the requests of the client, like VCard, wait for the answer of the server.
+var RequestTimeout = 30 * time.Second
+
+// DefaultResourceConflicts is how many times new clients rename their resource after conflicts, see ResourceConflicts.
+var DefaultResourceConflicts = 5
+
+var (
+	ErrStopped        = errors.New("xmpp: client closed")
+	ErrAlreadyStarted = errors.New("xmpp: client already started")
+	// ErrNotStarted is returned when writing to the stream before the client has connected.
+	ErrNotStarted = errors.New("xmpp: client not started")
+)
+
+// IQ is an iq stanza received from the server.
+type IQ struct {
+	From string
+	To   string
+	Id   string
+	Type string
+	// Inner is the raw XML content of the stanza.
+	Inner []byte
+}
+
+// StanzaError is an error answer to a stanza, with its type, like cancel or modify, its defined condition, like
+// item-not-found, and its optional text.
+type StanzaError struct {
+	Type      string
+	Condition string
+	Text      string
+	// Specific is the application specific condition, if any, like {urn:xmpp:blocking:errors blocked}.
+	Specific xml.Name
+}
+
+func (self StanzaError) Error() string {
+	if self.Text != "" {
+		return fmt.Sprintf("xmpp: %v (%v): %v", self.Condition, self.Type, self.Text)
+	}
+	return fmt.Sprintf("xmpp: %v (%v)", self.Condition, self.Type)
+}
+
+// parseStanzaError returns the error in the raw XML content of an error stanza.
+func parseStanzaError(inner []byte) StanzaError {
+	parsed := struct {
+		Error clientError
+	}{}
+	unmarshalInner(inner, &parsed)
+	return parsed.Error.stanzaError()
+}
+
+// unmarshalInner unmarshals the raw XML content of a stanza into the fields of v.
+func unmarshalInner(inner []byte, v interface{}) error {
+	return xml.Unmarshal(append(append([]byte("<stanza>"), inner...), "</stanza>"...), v)
+}
+
+// Stanza is a stanza received from the server, after the connection was set up.
+type Stanza struct {
+	// Name is like {jabber:client iq}, {jabber:client message} or {jabber:client presence}.
+	Name xml.Name
+	From string
+	To   string
+	Id   string
+	Type string
+	// Inner is the raw XML content of iq stanzas.
+	Inner []byte
+	// NewMail is set for new mail notifications.
+	NewMail bool
+	// Body, Thread and ChatState are set for messages.
+	Body      string
+	Thread    string
+	ChatState ChatState
+	// Show, Status and Priority are set for presences.
+	Show     string
+	Status   string
+	Priority string
+	// Error is set for error messages.
+	Error *StanzaError
 }
 
+// StanzaHandler handles a received stanza. Returning an error closes the connection, and makes the client reconnect.
+type StanzaHandler func(stanza *Stanza) error
+
 func New(user, password string) *Client {
 	return &Client{
-		user:     user,
-		password: password,
+		credentials: auth.NewSwappable(auth.Static{
+			User:     user,
+			Password: password,
+		}),
+		tlsConfig: DefaultConfig.Clone(),
 		errorHandler: func(e error) {
 			fmt.Println(e)
 		},
 		mailHandler: func() {
 			fmt.Println("NEW MAIL")
 		},
+		conflictLimit: DefaultResourceConflicts,
+		clock:         clock.Real,
 	}
 }
 
@@ -62,6 +250,12 @@ func (self *Client) Debug() *Client {
 	return self
 }
 
+// Clock replaces the clock timing credential renewal, reconnection backoff and requests, to let tests drive them.
+func (self *Client) Clock(c clock.Clock) *Client {
+	self.clock = c
+	return self
+}
+
 func (self *Client) MailHandler(f func()) *Client {
 	self.mailHandler = f
 	return self
@@ -72,262 +266,930 @@ func (self *Client) ErrorHandler(f func(e error)) *Client {
 	return self
 }
 
-func (self *Client) Start() (err error) {
-	if err = self.connect(); err != nil {
+// Resource makes the client bind resource, like notify, instead of letting the server pick one. If another session has
+// bound it, the client binds resource-2, resource-3 and so on, see ResourceConflicts.
+func (self *Client) Resource(resource string) *Client {
+	self.resource = resource
+	return self
+}
+
+// ResourceConflicts limits how many times the client renames its resource, when binding fails or the stream is closed
+// because another session uses it. After that the conflicts are returned as errors, and the client keeps the last
+// name it tried.
+func (self *Client) ResourceConflicts(limit int) *Client {
+	self.conflictLimit = limit
+	return self
+}
+
+// boundResource returns the resource to bind after the conflicts so far.
+func (self *Client) boundResource() string {
+	if self.conflicts == 0 {
+		return self.resource
+	}
+	return fmt.Sprintf("%v-%v", self.resource, self.conflicts+1)
+}
+
+// renameResource picks the next resource after a conflict, and returns whether there was one within the limit.
+func (self *Client) renameResource() bool {
+	if self.resource == "" || self.conflicts >= self.conflictLimit {
+		return false
+	}
+	self.conflicts++
+	return true
+}
+
+// TLSVersions limits the TLS versions negotiated with the server. A zero max means no upper limit.
+func (self *Client) TLSVersions(min, max uint16) *Client {
+	self.tlsConfig.MinVersion = min
+	self.tlsConfig.MaxVersion = max
+	return self
+}
+
+// CipherSuites limits the TLS 1.0-1.2 cipher suites offered to the server.
+func (self *Client) CipherSuites(suites ...uint16) *Client {
+	self.tlsConfig.CipherSuites = suites
+	return self
+}
+
+// ClientCertificates are presented to servers asking for them during the TLS handshake. If the server offers SASL
+// EXTERNAL, the client then authenticates with it, as the user the certificate is for, instead of using a password.
+func (self *Client) ClientCertificates(certs ...tls.Certificate) *Client {
+	self.tlsConfig.Certificates = certs
+	return self
+}
+
+// TLSSessionCache lets reconnects resume earlier TLS sessions stored in cache, which isn't done by default.
+func (self *Client) TLSSessionCache(cache tls.ClientSessionCache) *Client {
+	self.tlsConfig.ClientSessionCache = cache
+	return self
+}
+
+// TLSHandler will be called with the negotiated connection state after each handshake.
+// If it returns an error the connection is closed and the error returned from Start.
+func (self *Client) TLSHandler(f func(state tls.ConnectionState) error) *Client {
+	self.tlsHandler = f
+	return self
+}
+
+// AuthHandler will be called after each SASL authentication attempt, successful or not.
+func (self *Client) AuthHandler(f func(e auth.Event)) *Client {
+	self.authHandler = f
+	return self
+}
+
+// ReconnectPolicy decides the delay between failed attempts to reconnect after the connection was lost. The first
+// attempt is always made at once. If the policy gives up, the client becomes Idle and may be started again.
+func (self *Client) ReconnectPolicy(policy retry.Policy) *Client {
+	self.retryPolicy = policy
+	return self
+}
+
+func (self *Client) reconnectPolicy() retry.Policy {
+	if self.retryPolicy != nil {
+		return self.retryPolicy
+	}
+	return retry.Exponential{
+		Min: ReconnectMin,
+		Max: ReconnectMax,
+	}
+}
+
+// UpdateCredentials replaces the credentials provider. The new credentials will be used the next time the client logs in.
+func (self *Client) UpdateCredentials(provider auth.Provider) *Client {
+	self.credentials.Swap(provider)
+	return self
+}
+
+// Dial replaces the endpoints with f. The connections returned by f are used as is, so f is responsible for any
+// encryption.
+func (self *Client) Dial(f func() (net.Conn, error)) *Client {
+	self.dial = f
+	return self
+}
+
+// Endpoints replaces DefaultEndpoints. Each connection attempt starts with the endpoint that worked last, and tries the
+// following ones in turn, wrapping around, until one of them works.
+func (self *Client) Endpoints(endpoints ...Endpoint) *Client {
+	self.endpoints = endpoints
+	return self
+}
+
+// Endpoint returns the endpoint that last worked, or the first one before any connection was made.
+func (self *Client) Endpoint() Endpoint {
+	endpoints := self.endpoints
+	if len(endpoints) == 0 {
+		endpoints = DefaultEndpoints
+	}
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return endpoints[self.endpoint%len(endpoints)]
+}
+
+// SendStanza marshals v with encoding/xml and writes it to the stream. It is safe to call concurrently with the client
+// acknowledging notifications, but fails with ErrNotStarted until Start has connected.
+func (self *Client) SendStanza(v interface{}) (err error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return
+	}
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.w == nil {
+		return ErrNotStarted
+	}
+	if _, err = self.w.Write(b); err != nil {
 		return
 	}
+	return self.w.Flush()
+}
 
-	go self.handleMail()
+// ClaimIQ makes f be called with the next result or error iq with the given id, instead of it being ignored.
+// Claim the id before sending the request with SendStanza.
+func (self *Client) ClaimIQ(id string, f func(iq IQ)) *Client {
+	self.claimLock.Lock()
+	defer self.claimLock.Unlock()
+	if self.claims == nil {
+		self.claims = map[string]func(iq IQ){}
+	}
+	self.claims[id] = f
+	return self
+}
 
+// unclaim removes the claim of id, if it is still there.
+func (self *Client) unclaim(id string) {
+	self.claimLock.Lock()
+	defer self.claimLock.Unlock()
+	delete(self.claims, id)
+}
+
+// request sends an iq of typ with the raw XML inner to the JID to, or the server if to is empty, and waits for the
+// answer. Error answers are returned as StanzaErrors.
+func (self *Client) request(typ, to, inner string) (result IQ, err error) {
+	id := fmt.Sprintf("req-%v", atomic.AddUint64(&self.requests, 1))
+	answers := make(chan IQ, 1)
+	self.ClaimIQ(id, func(iq IQ) {
+		answers <- iq
+	})
+	attrs := ""
+	if to != "" {
+		attrs = fmt.Sprintf(" to='%s'", escaped(to))
+	}
+	if err = self.send("<iq type='%s' id='%s'%s>%s</iq>\n", typ, id, attrs, inner); err != nil {
+		self.unclaim(id)
+		return
+	}
+	timer := self.clock.NewTimer(RequestTimeout)
+	defer timer.Stop()
+	select {
+	case result = <-answers:
+	case <-timer.C():
+		self.unclaim(id)
+		err = fmt.Errorf("xmpp: no answer to %v within %v", id, RequestTimeout)
+		return
+	}
+	if result.Type == "error" {
+		err = parseStanzaError(result.Inner)
+	}
+	return
+}
+
+func (self *Client) claimed(stanza *Stanza) (result func(iq IQ)) {
+	if stanza.Type != "result" && stanza.Type != "error" {
+		return
+	}
+	self.claimLock.Lock()
+	defer self.claimLock.Unlock()
+	if result = self.claims[stanza.Id]; result != nil {
+		delete(self.claims, stanza.Id)
+	}
 	return
 }
 
-func (self *Client) handleMail() {
+// Use adds middleware to the handling of received stanzas, for logging, metrics, filtering or rewriting them. The
+// middleware added first sees the stanzas first, and the client itself handles what the last one passes on, by
+// answering claimed iqs and acknowledging new mail notifications. Add all middleware before Start.
+func (self *Client) Use(middleware ...func(next StanzaHandler) StanzaHandler) *Client {
+	self.middleware = append(self.middleware, middleware...)
+	return self
+}
+
+// CharsetReader makes the client read streams declaring encodings other than UTF-8, by converting them to UTF-8 with f,
+// like mimeutil.CharsetReader. Without it such streams fail to parse.
+func (self *Client) CharsetReader(f func(charset string, input io.Reader) (io.Reader, error)) *Client {
+	self.charsets = f
+	return self
+}
+
+// Entities makes the client accept the named entities in entities, like xml.HTMLEntity, in addition to the five
+// predefined by XML. Without it other entities fail to parse.
+func (self *Client) Entities(entities map[string]string) *Client {
+	self.entities = entities
+	return self
+}
+
+// newDecoder returns a decoder of the stream read from r.
+func (self *Client) newDecoder(r io.Reader) *xml.Decoder {
+	p := xml.NewDecoder(r)
+	p.CharsetReader = self.charsets
+	p.Entity = self.entities
+	return p
+}
+
+func (self *Client) State() State {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.state
+}
+
+// setState changes the state, unless the client has been stopped.
+func (self *Client) setState(state State) bool {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	if self.state == Stopped {
+		return false
+	}
+	self.state = state
+	return true
+}
+
+// Start connects, and keeps the client connected until Close is called. It returns ErrAlreadyStarted if the client is
+// already started, and may be called again after Close or a failed Start.
+func (self *Client) Start() (err error) {
+	self.stateLock.Lock()
+	if self.state != Idle && self.state != Stopped {
+		self.stateLock.Unlock()
+		return ErrAlreadyStarted
+	}
+	self.state = Connecting
+	self.stop = make(chan struct{})
+	stop, previous := self.stop, self.done
+	self.done = make(chan struct{})
+	done := self.done
+	self.stateLock.Unlock()
+	if previous != nil {
+		// The stream of the previous connection must not be read while the new one is set up.
+		<-previous
+	}
+	if err = self.connect(); err != nil {
+		self.setState(Idle)
+		close(done)
+		return
+	}
+	if self.setState(Running) {
+		profile.Go("xmpp.run", func() {
+			self.run(stop, done)
+		}, "account", self.user)
+	} else {
+		close(done)
+	}
+	return
+}
+
+// run handles the stream until the client is closed, reconnecting whenever the connection is lost.
+func (self *Client) run(stop, done chan struct{}) {
+	defer close(done)
 	for {
-		name, i, err := next(self.p)
-		if err != nil {
-			if strings.Contains(err.Error(), "closed") || strings.Contains(err.Error(), "reset") {
-				self.Close()
-				if e := self.Start(); e != nil {
-					self.errorHandler(fmt.Errorf("While trying to restart after %v: %v", err, e))
+		err := self.handleMail()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "reset") {
+			self.errorHandler(err)
+		}
+		delay, attempts := time.Duration(0), 0
+		for {
+			if attempts > 0 {
+				if !self.setState(Backoff) {
+					return
 				}
-			} else {
-				if self.errorHandler != nil {
-					self.errorHandler(err)
+				select {
+				case <-stop:
+					return
+				case <-self.clock.After(delay):
 				}
 			}
+			if !self.setState(Connecting) {
+				return
+			}
+			e := self.connect()
+			if e == nil {
+				break
+			}
+			if e == ErrStopped {
+				return
+			}
+			self.errorHandler(fmt.Errorf("While trying to restart after %v: %v", err, e))
+			attempts++
+			var ok bool
+			if delay, ok = self.reconnectPolicy().Next(attempts); !ok {
+				self.errorHandler(fmt.Errorf("Giving up restarting after %v failed attempts", attempts))
+				self.setState(Idle)
+				return
+			}
+		}
+		if !self.setState(Running) {
 			return
 		}
-		if name.Space == nsClient && name.Local == "iq" {
-			if ciq, ok := i.(*clientIQ); ok && ciq.To == self.jid && ciq.Type == "set" && ciq.NewMail != nil {
-				fmt.Fprintf(self.conn, "<iq type='result' from='%v' to='%v' id='%v' />\n", self.user, self.jid, ciq.Id)
-				if self.mailHandler != nil {
-					self.mailHandler()
-				}
+	}
+}
+
+// handleMail reads stanzas, and passes them through the middleware to handleStanza, until the connection fails.
+func (self *Client) handleMail() (err error) {
+	handler := StanzaHandler(self.handleStanza)
+	for i := len(self.middleware) - 1; i >= 0; i-- {
+		handler = self.middleware[i](handler)
+	}
+	// The stanzas received while the stream was set up are handled first.
+	pending := self.pending
+	self.pending = nil
+	for _, stanza := range pending {
+		if err = handler(stanza); err != nil {
+			return
+		}
+	}
+	for {
+		var name xml.Name
+		var i interface{}
+		if name, i, err = next(self.p); err != nil {
+			return
+		}
+		if e, ok := i.(*streamError); ok && e.Any.Local == "conflict" {
+			// Another session took over the resource, so the next connection binds a new one.
+			self.renameResource()
+		}
+		stanza := toStanza(name, i)
+		err = handler(stanza)
+		release(i)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// toStanza copies a stanza returned by decode into a Stanza.
+func toStanza(name xml.Name, i interface{}) (result *Stanza) {
+	result = &Stanza{
+		Name: name,
+	}
+	switch v := i.(type) {
+	case *clientIQ:
+		result.From, result.To, result.Id, result.Type, result.Inner = v.From, v.To, v.Id, v.Type, v.Inner
+		result.NewMail = v.NewMail != nil
+	case *clientMessage:
+		result.From, result.To, result.Id, result.Type = v.From, v.To, v.Id, v.Type
+		result.Body, result.Thread, result.ChatState = v.Body, v.Thread, chatState(v.Other)
+		if v.Error != nil {
+			e := v.Error.stanzaError()
+			result.Error = &e
+		}
+	case *clientPresence:
+		result.From, result.To, result.Id, result.Type = v.From, v.To, v.Id, v.Type
+		result.Show, result.Status, result.Priority = v.Show, v.Status, v.Priority
+	}
+	return
+}
+
+// iq returns the iq stanza as an IQ.
+func (self *Stanza) iq() IQ {
+	return IQ{
+		From:  self.From,
+		To:    self.To,
+		Id:    self.Id,
+		Type:  self.Type,
+		Inner: self.Inner,
+	}
+}
+
+// awaitIQ reads stanzas until the answer to the iq with id, while the stream is set up. Answers to other claimed iqs
+// are dispatched through their claims, and the messages, presences and other iqs received before it, like offline
+// messages and roster pushes, are kept to be handled once the stream is running. Error answers are returned as
+// StanzaErrors.
+func (self *Client) awaitIQ(id string) (result IQ, err error) {
+	answered := false
+	self.ClaimIQ(id, func(iq IQ) {
+		result, answered = iq, true
+	})
+	defer self.unclaim(id)
+	for !answered {
+		var name xml.Name
+		var i interface{}
+		if name, i, err = next(self.p); err != nil {
+			return
+		}
+		if name.Space != nsClient {
+			if e, ok := i.(*streamError); ok {
+				return result, fmt.Errorf("xmpp: stream error while waiting for %v: %+v", id, *e)
 			}
+			return result, errors.New("xmpp: expected <iq> " + id + ", got <" + name.Local + "> in " + name.Space)
 		}
+		stanza := toStanza(name, i)
+		release(i)
+		if f := self.claimed(stanza); f != nil {
+			f(stanza.iq())
+		} else {
+			self.pending = append(self.pending, stanza)
+		}
+	}
+	if result.Type == "error" {
+		err = parseStanzaError(result.Inner)
 	}
+	return
+}
+
+// omittedOr returns whether the address of an answer is empty, which servers may leave it for answers about the
+// user's own account, or one of wanted.
+func omittedOr(address string, wanted ...string) bool {
+	if address == "" {
+		return true
+	}
+	for _, w := range wanted {
+		if address == w {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStanza answers claimed iqs, acknowledges new mail notifications and blocklist pushes, and passes messages and
+// presences to the chat and presence handlers.
+func (self *Client) handleStanza(stanza *Stanza) (err error) {
+	if stanza.Name.Space == nsClient && stanza.Name.Local == "message" {
+		self.handleChat(stanza)
+		return
+	}
+	if stanza.Name.Space == nsClient && stanza.Name.Local == "presence" {
+		self.handlePresence(stanza)
+		return
+	}
+	if stanza.Name.Space != nsClient || stanza.Name.Local != "iq" {
+		return
+	}
+	if f := self.claimed(stanza); f != nil {
+		f(stanza.iq())
+	} else if stanza.To == self.jid && stanza.Type == "set" && stanza.NewMail {
+		if err = self.send("<iq type='result' from='%v' to='%v' id='%v' />\n", self.user, self.jid, stanza.Id); err != nil {
+			return
+		}
+		if self.mailHandler != nil {
+			self.mailHandler()
+		}
+	} else if stanza.Type == "set" {
+		_, err = self.handleBlockPush(stanza)
+	}
+	return
 }
 
 func (self *Client) connect() (err error) {
-	c, err := net.Dial("tcp", gtalkAddr)
+	creds, err := self.credentials.Credentials()
+	if err != nil {
+		return
+	}
+	self.user = creds.User
+	var conn net.Conn
+	if self.dial != nil {
+		conn, err = self.dial()
+	} else {
+		conn, err = self.dialEndpoints()
+	}
 	if err != nil {
 		return
 	}
-	self.conn = tls.Client(c, &DefaultConfig)
-	if err = self.conn.Handshake(); err != nil {
+	if self.recorder != nil {
+		conn = recordingConn{conn, self.recorder}
+	}
+	if err = self.setConn(conn); err != nil {
 		return
 	}
-	if err = self.init(); err != nil {
-		self.Close()
+	if err = self.init(creds); err != nil {
+		conn.Close()
 		return
 	}
-
+	if !creds.Expiry.IsZero() {
+		// Closing the connection makes run reconnect, with credentials refreshed by the provider.
+		self.stateLock.Lock()
+		self.renewTimer = self.clock.AfterFunc(creds.Expiry.Add(-auth.RefreshMargin).Sub(self.clock.Now()), func() {
+			conn.Close()
+		})
+		self.stateLock.Unlock()
+	}
 	return
 }
 
-func (self *Client) init() error {
-	var r io.Reader
-	r = self.conn
+// setConn replaces the connection, unless the client has been stopped, in which case conn is closed.
+func (self *Client) setConn(conn net.Conn) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	if self.state == Stopped {
+		conn.Close()
+		return ErrStopped
+	}
+	// The renewal of the previous connection would otherwise stay pending, and pile up with every reconnect.
+	if self.renewTimer != nil {
+		self.renewTimer.Stop()
+		self.renewTimer = nil
+	}
+	self.conn = conn
+	self.w = bufio.NewWriter(conn)
+	var r io.Reader = conn
 	if self.debug {
-		r = tee{self.conn, os.Stdout}
+		r = tee{conn, os.Stdout}
 	}
+	self.r = bufio.NewReader(r)
+	return nil
+}
 
-	self.p = xml.NewDecoder(r)
+// dialEndpoints connects to the endpoint that last worked, or to the following ones in turn if that fails.
+func (self *Client) dialEndpoints() (result net.Conn, err error) {
+	endpoints := self.endpoints
+	if len(endpoints) == 0 {
+		endpoints = DefaultEndpoints
+	}
+	self.stateLock.Lock()
+	first := self.endpoint
+	self.stateLock.Unlock()
+	failures := []string{}
+	for i := range endpoints {
+		n := (first + i) % len(endpoints)
+		if result, err = self.dialEndpoint(endpoints[n]); err == nil {
+			self.stateLock.Lock()
+			self.endpoint = n
+			self.stateLock.Unlock()
+			return
+		}
+		failures = append(failures, fmt.Sprintf("%v: %v", endpoints[n].Addr, err))
+	}
+	err = fmt.Errorf("xmpp: no endpoint could be reached: %v", strings.Join(failures, "; "))
+	return
+}
 
-	a := strings.SplitN(self.user, "@", 2)
-	if len(a) != 2 {
-		return errors.New("xmpp: invalid username (want user@domain): " + self.user)
+// dialEndpoint connects to endpoint, and returns the connection once TLS is negotiated.
+func (self *Client) dialEndpoint(endpoint Endpoint) (result net.Conn, err error) {
+	c, err := dialer.Dial(endpoint.Addr)
+	if err != nil {
+		return
 	}
-	user := a[0]
-	domain := a[1]
+	// Endpoints that accept connections but never answer have to fail too, for the next one to be tried.
+	c.SetDeadline(time.Now().Add(dialer.Timeout))
+	if endpoint.StartTLS {
+		if err = self.startTLS(c); err != nil {
+			c.Close()
+			return
+		}
+	}
+	conn := tls.Client(c, self.tlsConfig)
+	if err = conn.Handshake(); err != nil {
+		c.Close()
+		return
+	}
+	if self.tlsHandler != nil {
+		if err = self.tlsHandler(conn.ConnectionState()); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	c.SetDeadline(time.Time{})
+	result = conn
+	return
+}
 
-	// Declare intent to be a jabber client.
-	fmt.Fprintf(self.conn, "<?xml version='1.0'?>\n"+
+// startTLS opens a stream on the plain connection c, and asks the server to upgrade it to TLS. The stream is opened
+// again by init once TLS is negotiated.
+func (self *Client) startTLS(c net.Conn) (err error) {
+	domain := self.user[strings.LastIndex(self.user, "@")+1:]
+	if _, err = fmt.Fprintf(c, "<?xml version='1.0'?>\n"+
 		"<stream:stream to='%s' xmlns='%s'\n"+
 		" xmlns:stream='%s' version='1.0'>\n",
-		xmlEscape(domain), nsClient, nsStream)
-
-	// Server should respond with a stream opening.
-	se, err := nextStart(self.p)
+		escaped(domain), nsClient, nsStream); err != nil {
+		return
+	}
+	p := self.newDecoder(c)
+	se, err := nextStart(p)
 	if err != nil {
-		return err
+		return
 	}
 	if se.Name.Space != nsStream || se.Name.Local != "stream" {
 		return errors.New("xmpp: expected <stream> but got <" + se.Name.Local + "> in " + se.Name.Space)
 	}
-
-	// Now we're in the stream and can use Unmarshal.
-	// Next message should be <features> to tell us authentication options.
-	// See section 4.6 in RFC 3920.
 	var f streamFeatures
-	if err = self.p.DecodeElement(&f, nil); err != nil {
+	if err = p.DecodeElement(&f, nil); err != nil {
 		return errors.New("unmarshal <features>: " + err.Error())
 	}
-	mechanism := ""
-	for _, m := range f.Mechanisms.Mechanism {
-		if m == "PLAIN" {
-			mechanism = m
-			// Plain authentication: send base64-encoded \x00 user \x00 password.
-			raw := "\x00" + user + "\x00" + self.password
-			enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-			base64.StdEncoding.Encode(enc, []byte(raw))
-			fmt.Fprintf(self.conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>\n",
-				nsSASL, enc)
-			break
+	if f.StartTLS.XMLName.Local == "" {
+		return errors.New("xmpp: the server doesn't offer STARTTLS")
+	}
+	if _, err = fmt.Fprintf(c, "<starttls xmlns='%s'/>\n", nsTLS); err != nil {
+		return
+	}
+	name, _, err := next(p)
+	if err != nil {
+		return
+	}
+	if name.Space != nsTLS || name.Local != "proceed" {
+		return errors.New("xmpp: STARTTLS refused with <" + name.Local + ">")
+	}
+	return
+}
+
+// send writes one stanza, or another piece of the stream, and flushes it to the connection in a single write.
+func (self *Client) send(format string, args ...interface{}) (err error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.w == nil {
+		return ErrNotStarted
+	}
+	if _, err = fmt.Fprintf(self.w, format, args...); err != nil {
+		return
+	}
+	return self.w.Flush()
+}
+
+// sendAuth writes an auth element with the base64 encoded raw payload, and zeroes raw and all copies of it.
+func (self *Client) sendAuth(attrs string, raw []byte) (err error) {
+	head, tail := "<auth xmlns='"+nsSASL+"' "+attrs+">", "</auth>\n"
+	buf := make([]byte, len(head)+base64.StdEncoding.EncodedLen(len(raw))+len(tail))
+	copy(buf, head)
+	base64.StdEncoding.Encode(buf[len(head):], raw)
+	copy(buf[len(buf)-len(tail):], tail)
+	// The credentials bypass the buffer of w, which can't be zeroed.
+	self.writeLock.Lock()
+	if self.w == nil {
+		err = ErrNotStarted
+	} else if err = self.w.Flush(); err == nil {
+		_, err = self.conn.Write(buf)
+	}
+	self.writeLock.Unlock()
+	auth.Zero(raw)
+	auth.Zero(buf)
+	return
+}
+
+// restartStream opens a new stream to domain, with a new decoder reading it, and returns the features of the server.
+// It opens the first stream of a connection, which follows any STARTTLS upgrade, and the stream after SASL, and
+// nothing of the old stream can confuse the new decoder. The XML declaration is only sent before the first stream.
+func (self *Client) restartStream(domain string, first bool) (result streamFeatures, err error) {
+	// The decoders share the buffered reader of the connection, so nothing already read from it is lost.
+	self.p = self.newDecoder(self.r)
+	declaration := ""
+	if first {
+		declaration = "<?xml version='1.0'?>\n"
+	}
+	// Declare intent to be a jabber client.
+	if err = self.send("%s<stream:stream to='%s' xmlns='%s'\n"+
+		" xmlns:stream='%s' version='1.0'>\n",
+		declaration, escaped(domain), nsClient, nsStream); err != nil {
+		return
+	}
+	// Server should respond with a stream opening, and then its features.
+	se, err := nextStart(self.p)
+	if err != nil {
+		return
+	}
+	if se.Name.Space != nsStream || se.Name.Local != "stream" {
+		err = errors.New("xmpp: expected <stream> but got <" + se.Name.Local + "> in " + se.Name.Space)
+		return
+	}
+	if err = self.p.DecodeElement(&result, nil); err != nil {
+		err = errors.New("unmarshal <features>: " + err.Error())
+	}
+	return
+}
+
+// init negotiates the stream and authenticates using creds, without keeping them.
+func (self *Client) init(creds auth.Credentials) error {
+	a := strings.SplitN(self.user, "@", 2)
+	if len(a) != 2 {
+		return errors.New("xmpp: invalid username (want user@domain): " + self.user)
+	}
+	user := a[0]
+	domain := a[1]
+
+	// The features of the first stream tell us the authentication options, see section 4.6 in RFC 3920.
+	f, err := self.restartStream(domain, true)
+	if err != nil {
+		return err
+	}
+	mechanism, err := self.mechanism(f.Mechanisms.Mechanism, creds)
+	if err != nil {
+		return err
+	}
+	var name xml.Name
+	var val interface{}
+	switch mechanism {
+	case "EXTERNAL":
+		// The identity comes from the client certificate, so the authorization identity is left empty.
+		if err = self.send("<auth xmlns='%s' mechanism='EXTERNAL'>=</auth>\n", nsSASL); err != nil {
+			return err
 		}
-		if m == "DIGEST-MD5" {
-			mechanism = m
-			// Digest-MD5 authentication
-			fmt.Fprintf(self.conn, "<auth xmlns='%s' mechanism='DIGEST-MD5'/>\n",
-				nsSASL)
-			var ch saslChallenge
-			if err = self.p.DecodeElement(&ch, nil); err != nil {
-				return errors.New("unmarshal <challenge>: " + err.Error())
-			}
-			b, err := base64.StdEncoding.DecodeString(string(ch))
-			if err != nil {
-				return err
-			}
-			tokens := map[string]string{}
-			for _, token := range strings.Split(string(b), ",") {
-				kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
-				if len(kv) == 2 {
-					if kv[1][0] == '"' && kv[1][len(kv[1])-1] == '"' {
-						kv[1] = kv[1][1 : len(kv[1])-1]
-					}
-					tokens[kv[0]] = kv[1]
+	case "X-OAUTH2":
+		// Google OAuth2 authentication: like PLAIN, but with the full address and an access token.
+		raw := append([]byte("\x00"+self.user+"\x00"), creds.Token...)
+		if err = self.sendAuth("mechanism='X-OAUTH2' auth:service='oauth2' xmlns:auth='"+nsGoogleAuth+"'", raw); err != nil {
+			return err
+		}
+	case "PLAIN":
+		// Plain authentication: send base64-encoded \x00 user \x00 password.
+		raw := append([]byte("\x00"+user+"\x00"), creds.Password...)
+		if err = self.sendAuth("mechanism='PLAIN'", raw); err != nil {
+			return err
+		}
+	case "DIGEST-MD5":
+		// Digest-MD5 authentication
+		if err = self.send("<auth xmlns='%s' mechanism='DIGEST-MD5'/>\n", nsSASL); err != nil {
+			return err
+		}
+		var ch saslChallenge
+		if err = self.p.DecodeElement(&ch, nil); err != nil {
+			return errors.New("unmarshal <challenge>: " + err.Error())
+		}
+		b, err := base64.StdEncoding.DecodeString(string(ch))
+		if err != nil {
+			return err
+		}
+		tokens := digestTokens(b)
+		realm, _ := tokens["realm"]
+		nonce, _ := tokens["nonce"]
+		qop, _ := tokens["qop"]
+		charset, _ := tokens["charset"]
+		cnonceStr := cnonce()
+		digestUri := "xmpp/" + domain
+		nonceCount := fmt.Sprintf("%08x", 1)
+		digest := saslDigestResponse(user, realm, creds.Password, nonce, cnonceStr, "AUTHENTICATE", digestUri, nonceCount)
+		message := "username=" + user + ", realm=" + realm + ", nonce=" + nonce + ", cnonce=" + cnonceStr + ", nc=" + nonceCount + ", qop=" + qop + ", digest-uri=" + digestUri + ", response=" + digest + ", charset=" + charset
+		if err = self.send("<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(message))); err != nil {
+			return err
+		}
+
+		// The server proves it knows the password with the rspauth, sent in a challenge to be acknowledged with an
+		// empty response, or as the additional data of its success, see section 6.3.10 in RFC 6120. Failures are left
+		// to the checks below.
+		if name, val, err = next(self.p); err != nil {
+			return err
+		}
+		rspauth := saslDigestResponse(user, realm, creds.Password, nonce, cnonceStr, "", digestUri, nonceCount)
+		switch v := val.(type) {
+		case *saslChallenge:
+			if err = checkRspAuth(string(*v), rspauth); err == nil {
+				if err = self.send("<response xmlns='%s'/>\n", nsSASL); err != nil {
+					return err
 				}
+				val = nil
 			}
-			realm, _ := tokens["realm"]
-			nonce, _ := tokens["nonce"]
-			qop, _ := tokens["qop"]
-			charset, _ := tokens["charset"]
-			cnonceStr := cnonce()
-			digestUri := "xmpp/" + domain
-			nonceCount := fmt.Sprintf("%08x", 1)
-			digest := saslDigestResponse(user, realm, self.password, nonce, cnonceStr, "AUTHENTICATE", digestUri, nonceCount)
-			message := "username=" + user + ", realm=" + realm + ", nonce=" + nonce + ", cnonce=" + cnonceStr + ", nc=" + nonceCount + ", qop=" + qop + ", digest-uri=" + digestUri + ", response=" + digest + ", charset=" + charset
-			fmt.Fprintf(self.conn, "<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(message)))
-
-			var rspauth saslRspAuth
-			if err = self.p.DecodeElement(&rspauth, nil); err != nil {
-				return errors.New("unmarshal <challenge>: " + err.Error())
+		case *saslSuccess:
+			err = checkRspAuth(v.Data, rspauth)
+		}
+		if err != nil {
+			if self.authHandler != nil {
+				self.authHandler(auth.NewEvent("xmpp", domain, creds.User, mechanism, err))
 			}
-			b, err = base64.StdEncoding.DecodeString(string(rspauth))
-			if err != nil {
-				return err
+			return err
+		}
+	}
+
+	// Next message should be either success or failure, unless it was read already.
+	if val == nil {
+		name, val, err = next(self.p)
+	}
+	if err == nil {
+		switch v := val.(type) {
+		case *saslSuccess:
+		case *saslFailure:
+			// v.Any is type of sub-element in failure,
+			// which gives a description of what failed.
+			reason := v.Any.Local
+			if v.Text != "" {
+				reason += ": " + v.Text
 			}
-			fmt.Fprintf(self.conn, "<response xmlns='%s'/>\n", nsSASL)
-			break
+			err = errors.New("auth failure: " + reason)
+		default:
+			err = errors.New("expected <success> or <failure>, got <" + name.Local + "> in " + name.Space)
 		}
 	}
-	if mechanism == "" {
-		return errors.New(fmt.Sprintf("PLAIN authentication is not an option: %v", f.Mechanisms.Mechanism))
+	if self.authHandler != nil {
+		self.authHandler(auth.NewEvent("xmpp", domain, creds.User, mechanism, err))
 	}
-
-	// Next message should be either success or failure.
-	name, val, err := next(self.p)
 	if err != nil {
 		return err
 	}
-	switch v := val.(type) {
-	case *saslSuccess:
-	case *saslFailure:
-		// v.Any is type of sub-element in failure,
-		// which gives a description of what failed.
-		return errors.New("auth failure: " + v.Any.Local)
-	default:
-		return errors.New("expected <success> or <failure>, got <" + name.Local + "> in " + name.Space)
-	}
 
 	// Now that we're authenticated, we're supposed to start the stream over again.
-	// Declare intent to be a jabber client.
-	fmt.Fprintf(self.conn, "<stream:stream to='%s' xmlns='%s'\n"+
-		" xmlns:stream='%s' version='1.0'>\n",
-		xmlEscape(domain), nsClient, nsStream)
-
-	// Here comes another <stream> and <features>.
-	se, err = nextStart(self.p)
-	if err != nil {
+	if f, err = self.restartStream(domain, false); err != nil {
 		return err
 	}
-	if se.Name.Space != nsStream || se.Name.Local != "stream" {
-		return errors.New("expected <stream>, got <" + se.Name.Local + "> in " + se.Name.Space)
-	}
-	if err = self.p.DecodeElement(&f, nil); err != nil {
-		return errors.New("unmarshal <features>: " + err.Error())
-	}
 
-	fmt.Fprintf(self.conn, "<iq type='set' id='x'><bind xmlns='%s'></bind></iq>\n", nsBind)
-	var iq clientIQ
-	if err = self.p.DecodeElement(&iq, nil); err != nil {
-		return errors.New("unmarshal <iq>: " + err.Error())
+	// Offline messages and presences may arrive at any time from here on, and are kept until the stream is running.
+	self.pending = nil
+	var iq IQ
+	for {
+		resource := ""
+		if self.resource != "" {
+			resource = fmt.Sprintf("<resource>%s</resource>", escaped(self.boundResource()))
+		}
+		if err = self.send("<iq type='set' id='x'><bind xmlns='%s'>%s</bind></iq>\n", nsBind, resource); err != nil {
+			return err
+		}
+		if iq, err = self.awaitIQ("x"); err == nil {
+			break
+		}
+		if e, ok := err.(StanzaError); !ok || e.Condition != "conflict" || !self.renameResource() {
+			return errors.New("bind: " + err.Error())
+		}
 	}
-	if &iq.Bind == nil {
+	bound := struct {
+		Bind bindBind
+	}{}
+	if unmarshalInner(iq.Inner, &bound) != nil || bound.Bind.Jid == "" {
 		return errors.New("<iq> result missing <bind>")
 	}
-	self.jid = iq.Bind.Jid // our local id
+	self.jid = bound.Bind.Jid // our local id
 
-	// Make sure we have enabled the notifications
-	fmt.Fprintf(self.conn, "<iq type='set' id='setting-1'><usersetting xmlns='google:setting'><mailnotifications value='true'/></usersetting></iq>")
+	// Servers still following RFC 3921 require the session to be established before the stream is used.
+	if f.Session != nil && f.Session.Optional == nil {
+		if err = self.send("<iq type='set' id='session-1'><session xmlns='%s'/></iq>\n", nsSession); err != nil {
+			return err
+		}
+		if _, err = self.awaitIQ("session-1"); err != nil {
+			return errors.New("session: " + err.Error())
+		}
+	}
 
-	// Check the incoming iq
-	name, i, err := next(self.p)
-	if err != nil {
+	// Make sure we have enabled the notifications
+	if err = self.send("<iq type='set' id='setting-1'><usersetting xmlns='google:setting'><mailnotifications value='true'/></usersetting></iq>"); err != nil {
 		return err
 	}
-	if name.Space != nsClient || name.Local != "iq" {
-		return errors.New("expected <iq>, got <" + name.Local + "> in " + name.Space)
+
+	// Check the incoming iq
+	if iq, err = self.awaitIQ("setting-1"); err != nil {
+		return errors.New("enable mail notifications: " + err.Error())
 	}
-	if iq, ok := i.(*clientIQ); !ok {
-		return errors.New(fmt.Sprintf("expected <iq> got %v", i))
-	} else if iq.To != self.jid || iq.Type != "result" {
-		return errors.New(fmt.Sprintf("expected <iq> to %v with type 'result', got %v", self.jid, iq))
+	if !omittedOr(iq.To, self.jid) {
+		return errors.New(fmt.Sprintf("expected <iq> to %v, got %+v", self.jid, iq))
 	}
 
-	fmt.Fprintf(self.conn, "<iq type='get' to='%s'><query xmlns='http://jabber.org/protocol/disco#info'/></iq>", domain)
+	if err = self.send("<iq type='get' id='disco-1' to='%s'><query xmlns='http://jabber.org/protocol/disco#info'/></iq>", domain); err != nil {
+		return err
+	}
 
-	name, i, err = next(self.p)
-	if name.Space != nsClient || name.Local != "iq" {
-		return errors.New("expected <iq>, got <" + name.Local + "> in " + name.Space)
+	if iq, err = self.awaitIQ("disco-1"); err != nil {
+		return errors.New("disco: " + err.Error())
+	} else if !omittedOr(iq.From, domain) || !omittedOr(iq.To, self.jid) {
+		return errors.New(fmt.Sprintf("expected <iq> from %#v, to %#v but got %#v, %#v", domain, self.jid, iq.From, iq.To))
 	}
-	ciq, ok := i.(*clientIQ)
-	if !ok {
-		return errors.New(fmt.Sprintf("expected <iq> got %v", i))
-	} else if ciq.From != domain || ciq.To != self.jid || ciq.Type != "result" {
-		return errors.New(fmt.Sprintf("expected <iq> from %#v, to %#v of type 'result' but got %#v, %#v, %#v", domain, self.jid, ciq.From, ciq.To, ciq.Type))
+	disco := struct {
+		Query query `xml:"http://jabber.org/protocol/disco#info query"`
+	}{}
+	if err = unmarshalInner(iq.Inner, &disco); err != nil {
+		return errors.New("unmarshal disco: " + err.Error())
 	}
 
 	found := false
-	for _, feature := range ciq.Query.Features {
+	for _, feature := range disco.Query.Features {
 		if feature.Var == nsNotify {
 			found = true
 			break
 		}
 	}
 	if !found {
-		return errors.New(fmt.Sprintf("expected to find %v, but got %+v", nsNotify, ciq.Query.Features))
+		return errors.New(fmt.Sprintf("expected to find %v, but got %+v", nsNotify, disco.Query.Features))
 	}
 
-	fmt.Fprintf(self.conn, fmt.Sprintf("<iq type='get' from='%v'	to='%v' id='mail-request-1'><query xmlns='google:mail:notify'/></iq>", self.jid, self.user))
-
-	name, i, err = next(self.p)
-	if name.Space != nsClient || name.Local != "iq" {
-		return errors.New(fmt.Sprintf("expected <iq> got %v", i))
+	if err = self.send("<iq type='get' from='%v'	to='%v' id='mail-request-1'><query xmlns='google:mail:notify'/></iq>", self.jid, self.user); err != nil {
+		return err
 	}
-	ciq, ok = i.(*clientIQ)
-	if !ok {
-		return errors.New(fmt.Sprintf("expected <iq> got %v", i))
-	} else if ciq.From != self.user || ciq.Id != "mail-request-1" || ciq.To != self.jid || ciq.Type != "result" {
-		return errors.New(fmt.Sprintf("expected <iq> from %#v to %#v of type 'result', with id 'mail-request-1', but got %v", self.user, self.jid, ciq))
+
+	if iq, err = self.awaitIQ("mail-request-1"); err != nil {
+		return errors.New("mail request: " + err.Error())
+	} else if !omittedOr(iq.From, self.user) || !omittedOr(iq.To, self.jid) {
+		return errors.New(fmt.Sprintf("expected <iq> from %#v to %#v, with id 'mail-request-1', but got %+v", self.user, self.jid, iq))
 	}
 
 	return nil
 }
 
+// Close stops the client, and closes the connection. Closing a stopped client does nothing.
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.stateLock.Lock()
+	if c.state == Stopped {
+		c.stateLock.Unlock()
+		return nil
+	}
+	c.state = Stopped
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+	}
+	conn := c.conn
+	c.stateLock.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
 
 func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
@@ -353,6 +1215,34 @@ func saslDigestResponse(username, realm, passwd, nonce, cnonceStr,
 	return response
 }
 
+// digestTokens parses the comma separated key=value pairs of a DIGEST-MD5 challenge, unquoting the values.
+func digestTokens(b []byte) map[string]string {
+	tokens := map[string]string{}
+	for _, token := range strings.Split(string(b), ",") {
+		kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
+		if len(kv) == 2 {
+			if len(kv[1]) > 1 && kv[1][0] == '"' && kv[1][len(kv[1])-1] == '"' {
+				kv[1] = kv[1][1 : len(kv[1])-1]
+			}
+			tokens[kv[0]] = kv[1]
+		}
+	}
+	return tokens
+}
+
+// checkRspAuth checks that the base64 encoded data from the server carries the rspauth a server knowing the password
+// would send.
+func checkRspAuth(data, rspauth string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return errors.New("auth failure: DIGEST-MD5 rspauth from the server is malformed: " + err.Error())
+	}
+	if digestTokens(b)["rspauth"] != rspauth {
+		return errors.New("auth failure: DIGEST-MD5 rspauth from the server doesn't match")
+	}
+	return nil
+}
+
 func cnonce() string {
 	randSize := big.NewInt(0)
 	randSize.Lsh(big.NewInt(1), 64)
@@ -369,20 +1259,27 @@ type streamFeatures struct {
 	StartTLS   tlsStartTLS
 	Mechanisms saslMechanisms
 	Bind       bindBind
-	Session    bool
+	Session    *streamSession
+}
+
+// RFC 3921  3  Session establishment, optional since RFC 6121
+
+type streamSession struct {
+	XMLName  xml.Name  `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Optional *struct{} `xml:"optional"`
 }
 
 type streamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
-	Any     xml.Name
-	Text    string
+	Any     xml.Name `xml:",any"`
+	Text    string   `xml:"text"`
 }
 
 // RFC 3920  C.3  TLS name space
 
 type tlsStartTLS struct {
-	XMLName  xml.Name `xml:":ietf:params:xml:ns:xmpp-tls starttls"`
-	Required bool
+	XMLName  xml.Name  `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Required *struct{} `xml:"required"`
 }
 
 type tlsProceed struct {
@@ -407,8 +1304,6 @@ type saslAuth struct {
 
 type saslChallenge string
 
-type saslRspAuth string
-
 type saslResponse string
 
 type saslAbort struct {
@@ -417,11 +1312,13 @@ type saslAbort struct {
 
 type saslSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+	Data    string   `xml:",chardata"`
 }
 
 type saslFailure struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
-	Any     xml.Name
+	Any     xml.Name `xml:",any"`
+	Text    string   `xml:"text"`
 }
 
 // RFC 3920  C.5  Resource binding name space
@@ -447,8 +1344,9 @@ type clientMessage struct {
 	Body    string `xml:"body"`
 	Thread  string `xml:"thread"`
 
-	// Any hasn't matched element
-	Other []string `xml:",any"`
+	Error *clientError
+	// Other are the names of the elements not matched above, like chat states.
+	Other []xml.Name `xml:",any"`
 }
 
 type clientText struct {
@@ -464,9 +1362,9 @@ type clientPresence struct {
 	Type    string   `xml:"type,attr"` // error, probe, subscribe, subscribed, unavailable, unsubscribe, unsubscribed
 	Lang    string   `xml:"lang,attr"`
 
-	Show     string `xml:"show"`        // away, chat, dnd, xa
-	Status   string `xml:"status,attr"` // sb []clientText
-	Priority string `xml:"priority,attr"`
+	Show     string `xml:"show"`   // away, chat, dnd, xa
+	Status   string `xml:"status"` // sb []clientText
+	Priority string `xml:"priority"`
 	Error    *clientError
 }
 
@@ -480,6 +1378,7 @@ type clientIQ struct { // info/query
 	Bind    bindBind
 	Query   query
 	NewMail *newMail
+	Inner   []byte `xml:",innerxml"`
 }
 
 type newMail struct {
@@ -503,28 +1402,71 @@ type feature struct {
 	Var string `xml:"var,attr"`
 }
 
+// clientError is matched in any namespace, since servers using jabber:server put the errors of stanzas in it.
 type clientError struct {
-	XMLName xml.Name `xml:"jabber:client error"`
-	Code    string   `xml:",attr"`
-	Type    string   `xml:",attr"`
-	Any     xml.Name
-	Text    string
+	XMLName    xml.Name `xml:"error"`
+	Code       string   `xml:"code,attr"`
+	Type       string   `xml:"type,attr"`
+	Conditions []struct {
+		XMLName xml.Name
+		Text    string `xml:",chardata"`
+	} `xml:",any"`
 }
 
-// Scan XML token stream to find next StartElement.
+func (self clientError) stanzaError() (result StanzaError) {
+	result.Type, result.Condition = self.Type, "undefined-condition"
+	for _, condition := range self.Conditions {
+		switch {
+		case condition.XMLName.Space != nsStanzas:
+			result.Specific = condition.XMLName
+		case condition.XMLName.Local == "text":
+			result.Text = strings.TrimSpace(condition.Text)
+		default:
+			result.Condition = condition.XMLName.Local
+		}
+	}
+	return
+}
+
+// Scan XML token stream to find next StartElement, with its name normalized.
 func nextStart(p *xml.Decoder) (xml.StartElement, error) {
 	for {
 		t, err := p.Token()
-		if err != nil && err != io.EOF {
+		if err != nil {
 			return xml.StartElement{}, err
 		}
 		switch t := t.(type) {
 		case xml.StartElement:
+			t.Name = normalize(t.Name)
 			return t, nil
 		}
 	}
-	log.Printf("github.com/zond/gmail/xmpp unable to find next start element!")
-	panic("unreachable")
+}
+
+// namespaceAliases maps namespaces some servers use to the equivalent ones the stanzas are matched by. encoding/xml
+// leaves undeclared prefixes as the namespace, so the conventional prefixes are included.
+var namespaceAliases = map[string]string{
+	"jabber:server": nsClient,
+	"stream":        nsStream,
+	"sasl":          nsSASL,
+	"tls":           nsTLS,
+}
+
+// normalize replaces aliased namespaces in name. Stanzas without a namespace are put in jabber:client, and features in
+// the stream namespace, as if inherited from a stream that failed to declare its default namespace.
+func normalize(name xml.Name) xml.Name {
+	if alias, found := namespaceAliases[name.Space]; found {
+		name.Space = alias
+	}
+	if name.Space == "" {
+		switch name.Local {
+		case "message", "presence", "iq":
+			name.Space = nsClient
+		case "features":
+			name.Space = nsStream
+		}
+	}
+	return name
 }
 
 // Scan XML token stream for next element and save into val.
@@ -536,41 +1478,46 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	if err != nil {
 		return xml.Name{}, nil, err
 	}
+	return decode(p, se)
+}
 
+// Decode the element started by se into a stanza of the matching type. Messages, presences and iqs come from their
+// pools, and callers done with them should give them back with release.
+func decode(p *xml.Decoder, se xml.StartElement) (xml.Name, interface{}, error) {
 	// Put it in an interface and allocate one.
 	var nv interface{}
-	switch se.Name.Space + " " + se.Name.Local {
-	case nsStream + " features":
+	switch se.Name {
+	case xml.Name{Space: nsStream, Local: "features"}:
 		nv = &streamFeatures{}
-	case nsStream + " error":
+	case xml.Name{Space: nsStream, Local: "error"}:
 		nv = &streamError{}
-	case nsTLS + " starttls":
+	case xml.Name{Space: nsTLS, Local: "starttls"}:
 		nv = &tlsStartTLS{}
-	case nsTLS + " proceed":
+	case xml.Name{Space: nsTLS, Local: "proceed"}:
 		nv = &tlsProceed{}
-	case nsTLS + " failure":
+	case xml.Name{Space: nsTLS, Local: "failure"}:
 		nv = &tlsFailure{}
-	case nsSASL + " mechanisms":
+	case xml.Name{Space: nsSASL, Local: "mechanisms"}:
 		nv = &saslMechanisms{}
-	case nsSASL + " challenge":
-		nv = ""
-	case nsSASL + " response":
-		nv = ""
-	case nsSASL + " abort":
+	case xml.Name{Space: nsSASL, Local: "challenge"}:
+		nv = new(saslChallenge)
+	case xml.Name{Space: nsSASL, Local: "response"}:
+		nv = new(saslResponse)
+	case xml.Name{Space: nsSASL, Local: "abort"}:
 		nv = &saslAbort{}
-	case nsSASL + " success":
+	case xml.Name{Space: nsSASL, Local: "success"}:
 		nv = &saslSuccess{}
-	case nsSASL + " failure":
+	case xml.Name{Space: nsSASL, Local: "failure"}:
 		nv = &saslFailure{}
-	case nsBind + " bind":
+	case xml.Name{Space: nsBind, Local: "bind"}:
 		nv = &bindBind{}
-	case nsClient + " message":
-		nv = &clientMessage{}
-	case nsClient + " presence":
-		nv = &clientPresence{}
-	case nsClient + " iq":
-		nv = &clientIQ{}
-	case nsClient + " error":
+	case xml.Name{Space: nsClient, Local: "message"}:
+		nv = messagePool.Get()
+	case xml.Name{Space: nsClient, Local: "presence"}:
+		nv = presencePool.Get()
+	case xml.Name{Space: nsClient, Local: "iq"}:
+		nv = iqPool.Get()
+	case xml.Name{Space: nsClient, Local: "error"}:
 		nv = &clientError{}
 	default:
 		return xml.Name{}, nil, errors.New("unexpected XMPP message " +
@@ -578,13 +1525,43 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	}
 
 	// Unmarshal into that storage.
-	if err = p.DecodeElement(nv, &se); err != nil {
+	if err := p.DecodeElement(nv, &se); err != nil {
 		return xml.Name{}, nil, err
 	}
-	return se.Name, nv, err
+	return se.Name, nv, nil
 }
 
-var xmlSpecial = map[byte]string{
+// The most common stanzas are pooled, since chatty accounts receive a lot of them. handleMail and awaitIQ release the
+// stanzas they read once copied into a Stanza, the others are left to the garbage collector.
+var (
+	iqPool = sync.Pool{New: func() interface{} {
+		return &clientIQ{}
+	}}
+	messagePool = sync.Pool{New: func() interface{} {
+		return &clientMessage{}
+	}}
+	presencePool = sync.Pool{New: func() interface{} {
+		return &clientPresence{}
+	}}
+)
+
+// release resets a stanza returned by decode and puts it back in its pool, if it has one. The stanza must not be used
+// afterwards.
+func release(stanza interface{}) {
+	switch v := stanza.(type) {
+	case *clientIQ:
+		*v = clientIQ{}
+		iqPool.Put(v)
+	case *clientMessage:
+		*v = clientMessage{}
+		messagePool.Put(v)
+	case *clientPresence:
+		*v = clientPresence{}
+		presencePool.Put(v)
+	}
+}
+
+var xmlSpecial = [256]string{
 	'<':  "&lt;",
 	'>':  "&gt;",
 	'"':  "&quot;",
@@ -592,17 +1569,24 @@ var xmlSpecial = map[byte]string{
 	'&':  "&amp;",
 }
 
-func xmlEscape(s string) string {
-	var b bytes.Buffer
+// escaped formats as the XML escaped string, written straight to the output without building the escaped copy.
+type escaped string
+
+func (self escaped) Format(f fmt.State, verb rune) {
+	writeEscaped(f, string(self))
+}
+
+// writeEscaped writes s to w with the XML special characters escaped, in runs between the special characters.
+func writeEscaped(w io.Writer, s string) {
+	start := 0
 	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if s, ok := xmlSpecial[c]; ok {
-			b.WriteString(s)
-		} else {
-			b.WriteByte(c)
+		if replacement := xmlSpecial[s[i]]; replacement != "" {
+			io.WriteString(w, s[start:i])
+			io.WriteString(w, replacement)
+			start = i + 1
 		}
 	}
-	return b.String()
+	io.WriteString(w, s[start:])
 }
 
 type tee struct {
@@ -0,0 +1,529 @@
+// Package xmpptest provides an in-process fake of the Google Talk mail notification service,
+// to let code using github.com/zond/gmail/xmpp be tested without network access or Google credentials.
+//
+//	server := xmpptest.New("user@example.com", "password")
+//	client := xmpp.New("user@example.com", "password").Dial(server.Dial)
+//	client.MailHandler(...).Start()
+//	server.NotifyNewMail()
+package xmpptest
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	nsStream  = "http://etherx.jabber.org/streams"
+	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsClient  = "jabber:client"
+	nsNotify  = "google:mail:notify"
+	nsDisco   = "http://jabber.org/protocol/disco#info"
+	nsVCard   = "vcard-temp"
+	nsBlock   = "urn:xmpp:blocking"
+	nsStanza  = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
+	nsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+)
+
+var ErrClosed = errors.New("xmpptest: server closed")
+
+// Element is a stanza received from a client.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (self Element) Attr(name string) string {
+	for _, attr := range self.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+type Server struct {
+	// User is the full address (user@domain) the server accepts.
+	User     string
+	Password string
+	// Resource is appended to User to create the bound JID, when the client doesn't ask for a resource.
+	Resource string
+	// Token is the OAuth2 access token accepted with X-OAUTH2.
+	Token string
+	// Mechanisms are the SASL mechanisms advertised. Only PLAIN, X-OAUTH2, DIGEST-MD5 and EXTERNAL are actually
+	// supported. EXTERNAL accepts clients presenting a certificate for User, as common name or email address, which
+	// requires StartTLS to ask for client certificates.
+	Mechanisms []string
+	// Features are advertised in disco#info responses.
+	Features []string
+	// VCards are the raw XML contents of the vCards of the JIDs, answered to vcard-temp requests. Requests for other
+	// JIDs get item-not-found errors.
+	VCards map[string]string
+	// Offline are raw stanzas, like messages and presences, sent to each client right after it binds its resource, the
+	// way servers deliver what arrived while the user was offline.
+	Offline []string
+	// OmitAddresses makes the server leave out the from and to of its answers to bind, disco#info, mail and other plain
+	// requests, as servers may for answers about the user's own account.
+	OmitAddresses bool
+	// SpoofedRspAuth, if set, makes the server accept any DIGEST-MD5 response and answer with this rspauth, like a
+	// server that doesn't know the password.
+	SpoofedRspAuth string
+	// RspAuthInSuccess makes the server send the DIGEST-MD5 rspauth as the additional data of its success, as RFC 6120
+	// allows, instead of in a challenge acknowledged by the client.
+	RspAuthInSuccess bool
+	// ReplaceResources makes binding a resource bound by another session close that session with a conflict stream
+	// error, like most servers, instead of refusing the bind with a conflict error.
+	ReplaceResources bool
+	// OptionalSession makes the server mark the session establishment as optional, like RFC 6121 servers, instead of
+	// requiring it.
+	OptionalSession bool
+	// StanzaHandler, if set, is called with every stanza received from a client.
+	StanzaHandler func(e Element)
+	// StartTLS, if set, makes the server require clients to upgrade the connection with STARTTLS, using this config,
+	// before authenticating.
+	StartTLS *tls.Config
+
+	lock     sync.Mutex
+	sessions map[*session]bool
+	closed   bool
+	nextId   int
+	blocked  map[string]bool
+	bound    map[string]*session
+}
+
+func New(user, password string) *Server {
+	return &Server{
+		User:       user,
+		Password:   password,
+		Resource:   "xmpptest",
+		Mechanisms: []string{"PLAIN"},
+		Features:   []string{nsNotify},
+		sessions:   map[*session]bool{},
+	}
+}
+
+// Dial returns the client end of a new in-memory connection to the server.
+// It has the signature expected by xmpp.Client#Dial.
+func (self *Server) Dial() (net.Conn, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil, ErrClosed
+	}
+	client, server := net.Pipe()
+	s := &session{
+		server: self,
+		conn:   server,
+		dec:    xml.NewDecoder(server),
+	}
+	go s.serve()
+	return client, nil
+}
+
+// Sessions returns the number of clients that have completed the handshake and subscribed to notifications.
+func (self *Server) Sessions() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.sessions)
+}
+
+// NotifyNewMail sends a new-mail notification to all subscribed clients.
+func (self *Server) NotifyNewMail() (err error) {
+	self.lock.Lock()
+	sessions := []*session{}
+	for s := range self.sessions {
+		sessions = append(sessions, s)
+	}
+	self.nextId++
+	id := self.nextId
+	self.lock.Unlock()
+	for _, s := range sessions {
+		if e := s.send("<iq type='set' from='%v' to='%v' id='mail-%v'><new-mail xmlns='%v'/></iq>", xmlEscape(self.User), xmlEscape(s.jid), id, nsNotify); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Send writes raw XML to all subscribed clients.
+func (self *Server) Send(raw string) (err error) {
+	self.lock.Lock()
+	sessions := []*session{}
+	for s := range self.sessions {
+		sessions = append(sessions, s)
+	}
+	self.lock.Unlock()
+	for _, s := range sessions {
+		if e := s.send("%s", raw); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Block blocks the jids, like another resource of the user would, and pushes the change to all subscribed clients.
+// Messages from the clients to blocked JIDs get blocked errors.
+func (self *Server) Block(jids ...string) (err error) {
+	self.block(jids, true)
+	self.lock.Lock()
+	self.nextId++
+	id := self.nextId
+	self.lock.Unlock()
+	return self.Send(fmt.Sprintf("<iq type='set' id='push-%v'><block xmlns='%v'>%v</block></iq>", id, nsBlock, blockItems(jids)))
+}
+
+func (self *Server) block(jids []string, blocked bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.blocked == nil || (!blocked && len(jids) == 0) {
+		self.blocked = map[string]bool{}
+	}
+	for _, jid := range jids {
+		if blocked {
+			self.blocked[jid] = true
+		} else {
+			delete(self.blocked, jid)
+		}
+	}
+}
+
+func (self *Server) isBlocked(jid string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if i := strings.Index(jid, "/"); i != -1 {
+		jid = jid[:i]
+	}
+	return self.blocked[jid]
+}
+
+func blockItems(jids []string) (result string) {
+	for _, jid := range jids {
+		result += "<item jid='" + xmlEscape(jid) + "'/>"
+	}
+	return
+}
+
+// Drop closes all client connections, but lets clients connect again.
+func (self *Server) Drop() {
+	self.lock.Lock()
+	sessions := self.sessions
+	self.sessions = map[*session]bool{}
+	self.lock.Unlock()
+	for s := range sessions {
+		s.conn.Close()
+	}
+}
+
+// Close closes all client connections and makes further Dial calls fail.
+func (self *Server) Close() error {
+	self.lock.Lock()
+	self.closed = true
+	self.lock.Unlock()
+	self.Drop()
+	return nil
+}
+
+type session struct {
+	server    *Server
+	conn      net.Conn
+	dec       *xml.Decoder
+	writeLock sync.Mutex
+	jid       string
+	authed    bool
+	digested  bool
+	secure    bool
+}
+
+func (self *session) send(format string, args ...interface{}) (err error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	_, err = fmt.Fprintf(self.conn, format, args...)
+	return
+}
+
+func (self *session) serve() {
+	defer func() {
+		self.server.lock.Lock()
+		delete(self.server.sessions, self)
+		if self.server.bound[self.jid] == self {
+			delete(self.server.bound, self.jid)
+		}
+		self.server.lock.Unlock()
+		self.conn.Close()
+	}()
+	for {
+		tok, err := self.dec.Token()
+		if err != nil {
+			return
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Space == nsStream && se.Name.Local == "stream" {
+			if err = self.openStream(); err != nil {
+				return
+			}
+			continue
+		}
+		e := Element{}
+		if err = self.dec.DecodeElement(&e, &se); err != nil {
+			return
+		}
+		if self.server.StanzaHandler != nil {
+			self.server.StanzaHandler(e)
+		}
+		if err = self.handle(e); err != nil {
+			return
+		}
+	}
+}
+
+func (self *session) openStream() (err error) {
+	domain := self.domain()
+	if err = self.send("<?xml version='1.0'?><stream:stream xmlns='%v' xmlns:stream='%v' from='%v' id='xmpptest' version='1.0'>", nsClient, nsStream, xmlEscape(domain)); err != nil {
+		return
+	}
+	if self.server.StartTLS != nil && !self.secure {
+		return self.send("<stream:features><starttls xmlns='%v'><required/></starttls></stream:features>", nsTLS)
+	}
+	if !self.authed {
+		mechanisms := ""
+		for _, m := range self.server.Mechanisms {
+			mechanisms += "<mechanism>" + xmlEscape(m) + "</mechanism>"
+		}
+		return self.send("<stream:features><mechanisms xmlns='%v'>%v</mechanisms></stream:features>", nsSASL, mechanisms)
+	}
+	optional := ""
+	if self.server.OptionalSession {
+		optional = "<optional/>"
+	}
+	return self.send("<stream:features><bind xmlns='%v'/><session xmlns='%v'>%v</session></stream:features>", nsBind, nsSession, optional)
+}
+
+func (self *session) domain() string {
+	if i := strings.Index(self.server.User, "@"); i != -1 {
+		return self.server.User[i+1:]
+	}
+	return self.server.User
+}
+
+func (self *session) handle(e Element) (err error) {
+	switch {
+	case e.XMLName.Space == nsTLS && e.XMLName.Local == "starttls":
+		return self.startTLS()
+	case self.server.StartTLS != nil && !self.secure:
+		return io.EOF
+	case e.XMLName.Space == nsSASL && e.XMLName.Local == "auth" && e.Attr("mechanism") == "DIGEST-MD5":
+		return self.digestChallenge()
+	case e.XMLName.Space == nsSASL && e.XMLName.Local == "auth":
+		return self.auth(e)
+	case e.XMLName.Space == nsSASL && e.XMLName.Local == "response":
+		return self.digestResponse(e)
+	case e.XMLName.Local == "iq":
+		return self.iq(e)
+	case e.XMLName.Local == "message" && self.server.isBlocked(e.Attr("to")):
+		return self.send("<message type='error' from='%v' to='%v'><error type='cancel'><not-acceptable xmlns='%v'/><blocked xmlns='urn:xmpp:blocking:errors'/></error></message>", xmlEscape(e.Attr("to")), xmlEscape(self.jid), nsStanza)
+	}
+	return
+}
+
+// startTLS upgrades the connection, after which the client opens a new stream.
+func (self *session) startTLS() (err error) {
+	if self.server.StartTLS == nil || self.secure {
+		self.send("<failure xmlns='%v'/>", nsTLS)
+		return io.EOF
+	}
+	if err = self.send("<proceed xmlns='%v'/>", nsTLS); err != nil {
+		return
+	}
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	conn := tls.Server(self.conn, self.server.StartTLS)
+	if err = conn.Handshake(); err != nil {
+		return
+	}
+	self.conn, self.dec, self.secure = conn, xml.NewDecoder(conn), true
+	return
+}
+
+func (self *session) auth(e Element) (err error) {
+	if e.Attr("mechanism") == "EXTERNAL" && self.certifiedUser() {
+		self.authed = true
+		return self.send("<success xmlns='%v'/>", nsSASL)
+	}
+	if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(e.Inner)); err == nil {
+		parts := strings.Split(string(b), "\x00")
+		switch {
+		case len(parts) != 3:
+		case e.Attr("mechanism") == "PLAIN" && parts[1]+"@"+self.domain() == self.server.User && parts[2] == self.server.Password,
+			e.Attr("mechanism") == "X-OAUTH2" && parts[1] == self.server.User && self.server.Token != "" && parts[2] == self.server.Token:
+			self.authed = true
+			return self.send("<success xmlns='%v'/>", nsSASL)
+		}
+	}
+	if err = self.send("<failure xmlns='%v'><not-authorized/></failure>", nsSASL); err != nil {
+		return
+	}
+	return io.EOF
+}
+
+func (self *session) iq(e Element) (err error) {
+	id := xmlEscape(e.Attr("id"))
+	switch {
+	case e.Attr("type") == "result":
+		return
+	case !self.authed:
+		return io.EOF
+	case strings.Contains(e.Inner, nsBind):
+		return self.bind(e)
+	case strings.Contains(e.Inner, nsDisco):
+		features := ""
+		for _, f := range self.server.Features {
+			features += "<feature var='" + xmlEscape(f) + "'/>"
+		}
+		return self.send("<iq type='result' id='%v'%v><query xmlns='%v'><identity category='server' type='im' name='xmpptest'/>%v</query></iq>", id, self.addresses(self.domain(), self.jid), nsDisco, features)
+	case strings.Contains(e.Inner, nsNotify):
+		self.server.lock.Lock()
+		self.server.sessions[self] = true
+		self.server.lock.Unlock()
+		return self.send("<iq type='result' id='%v'%v><mailbox xmlns='%v' result-time='0' total-matched='0'/></iq>", id, self.addresses(self.server.User, self.jid), nsNotify)
+	case strings.Contains(e.Inner, nsVCard):
+		return self.vCard(e)
+	case strings.Contains(e.Inner, nsBlock):
+		return self.blocking(e)
+	}
+	return self.send("<iq type='result' id='%v'%v/>", id, self.addresses("", self.jid))
+}
+
+// addresses returns the from and to attributes of an answer, or nothing if OmitAddresses is set.
+func (self *session) addresses(from, to string) (result string) {
+	if self.server.OmitAddresses {
+		return
+	}
+	if from != "" {
+		result += " from='" + xmlEscape(from) + "'"
+	}
+	return result + " to='" + xmlEscape(to) + "'"
+}
+
+// certifiedUser returns whether the client presented a certificate for User during the TLS handshake.
+func (self *session) certifiedUser() bool {
+	conn, ok := self.conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		if cert.Subject.CommonName == self.server.User {
+			return true
+		}
+		for _, email := range cert.EmailAddresses {
+			if email == self.server.User {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bind binds the resource the client asks for, or Resource, unless another session has bound it.
+func (self *session) bind(e Element) (err error) {
+	id := xmlEscape(e.Attr("id"))
+	parsed := struct {
+		Resource string `xml:"bind>resource"`
+	}{}
+	xml.Unmarshal([]byte("<iq>"+e.Inner+"</iq>"), &parsed)
+	if parsed.Resource == "" {
+		parsed.Resource = self.server.Resource
+	}
+	jid := self.server.User + "/" + parsed.Resource
+	self.server.lock.Lock()
+	if self.server.bound == nil {
+		self.server.bound = map[string]*session{}
+	}
+	other := self.server.bound[jid]
+	if other == nil || self.server.ReplaceResources {
+		self.server.bound[jid] = self
+	}
+	self.server.lock.Unlock()
+	if other != nil && other != self {
+		if !self.server.ReplaceResources {
+			return self.send("<iq type='error' id='%v'><bind xmlns='%v'/><error type='cancel'><conflict xmlns='%v'/></error></iq>", id, nsBind, nsStanza)
+		}
+		other.send("<stream:error><conflict xmlns='%v'/></stream:error></stream:stream>", nsStreams)
+		other.conn.Close()
+	}
+	self.jid = jid
+	if err = self.send("<iq type='result' id='%v'%v><bind xmlns='%v'><jid>%v</jid></bind></iq>", id, self.addresses("", self.jid), nsBind, xmlEscape(self.jid)); err != nil {
+		return
+	}
+	if len(self.server.Offline) > 0 {
+		// The flood is sent while the client goes on setting up the stream, since the connection has no buffer.
+		go self.send("%s", strings.Join(self.server.Offline, ""))
+	}
+	return
+}
+
+// vCard answers a vcard-temp request with the vCard in VCards.
+func (self *session) vCard(e Element) (err error) {
+	id, to := xmlEscape(e.Attr("id")), e.Attr("to")
+	if to == "" {
+		to = self.server.User
+	}
+	if vCard, found := self.server.VCards[to]; found {
+		return self.send("<iq type='result' id='%v' from='%v' to='%v'><vCard xmlns='%v'>%v</vCard></iq>", id, xmlEscape(to), xmlEscape(self.jid), nsVCard, vCard)
+	}
+	return self.send("<iq type='error' id='%v' from='%v' to='%v'><vCard xmlns='%v'/><error type='cancel'><item-not-found xmlns='%v'/></error></iq>", id, xmlEscape(to), xmlEscape(self.jid), nsVCard, nsStanza)
+}
+
+// blocking answers blocklist requests, and changes the blocklist.
+func (self *session) blocking(e Element) (err error) {
+	id := xmlEscape(e.Attr("id"))
+	parsed := struct {
+		Children []struct {
+			XMLName xml.Name
+			Items   []struct {
+				JID string `xml:"jid,attr"`
+			} `xml:"item"`
+		} `xml:",any"`
+	}{}
+	if err = xml.Unmarshal([]byte("<iq>"+e.Inner+"</iq>"), &parsed); err != nil || len(parsed.Children) == 0 {
+		return
+	}
+	jids := []string{}
+	for _, item := range parsed.Children[0].Items {
+		jids = append(jids, item.JID)
+	}
+	switch parsed.Children[0].XMLName.Local {
+	case "blocklist":
+		self.server.lock.Lock()
+		for jid := range self.server.blocked {
+			jids = append(jids, jid)
+		}
+		self.server.lock.Unlock()
+		sort.Strings(jids)
+		return self.send("<iq type='result' id='%v' to='%v'><blocklist xmlns='%v'>%v</blocklist></iq>", id, xmlEscape(self.jid), nsBlock, blockItems(jids))
+	case "block":
+		self.server.block(jids, true)
+	case "unblock":
+		self.server.block(jids, false)
+	}
+	return self.send("<iq type='result' id='%v' to='%v'/>", id, xmlEscape(self.jid))
+}
+
+func xmlEscape(s string) string {
+	b := &strings.Builder{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}